@@ -0,0 +1,232 @@
+package yggdrasil
+
+// This keeps an address book of the nodes that we've had sessions with, saved
+// to a file, so that a user can find a node they talked to before, by its key
+// and address, even after both ends have changed coords or restarted.
+// A node is added or updated whenever it pings a session with us, and each
+// entry can be given a name with the admin API. Entries for configured aliases
+// take the alias as their name if they don't have one. The book is saved
+// periodically while it has changes, and when the node stops. Once it's full,
+// the nodes that were seen least recently are forgotten.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The most nodes kept in the address book, and how often it's saved while it has changes.
+const addressBook_maxEntries = 1024
+const addressBook_saveInterval = time.Minute
+
+// A node in the address book, as saved in the file.
+type addressBook_entry struct {
+	Key       string    `json:"key"`
+	Address   string    `json:"address"`
+	Coords    string    `json:"coords"` // Hex-encoded coords that the node last had
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Name      string    `json:"name,omitempty"`
+}
+
+type addressBook struct {
+	core    *Core
+	mutex   sync.Mutex // Protects the below
+	file    string     // Where the address book is saved, or empty if disabled
+	entries map[boxPubKey]*addressBook_entry
+	changed bool      // Whether there are changes that haven't been saved
+	saved   time.Time // When the address book was last saved
+}
+
+// Initializes the addressBook struct.
+func (b *addressBook) init(core *Core) {
+	b.core = core
+	b.entries = make(map[boxPubKey]*addressBook_entry)
+}
+
+// Sets the file that the address book is saved to, and loads the entries that are already in it.
+// An empty path disables the address book.
+func (b *addressBook) setFile(path string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.file = path
+	b.entries = make(map[boxPubKey]*addressBook_entry)
+	if path == "" {
+		return
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			b.core.log.Println("Failed to read address book:", err)
+		}
+		return
+	}
+	var entries []*addressBook_entry
+	if err := json.Unmarshal(bs, &entries); err != nil {
+		b.core.log.Println("Failed to parse address book:", err)
+		return
+	}
+	for _, entry := range entries {
+		keyBytes, err := hex.DecodeString(entry.Key)
+		if err != nil || len(keyBytes) != boxPubKeyLen {
+			continue
+		}
+		var key boxPubKey
+		copy(key[:], keyBytes)
+		// The address is worked out from the key, in case the file was edited
+		addr := address_addrForNodeID(getNodeID(&key))
+		entry.Address = net.IP(addr[:]).String()
+		b.entries[key] = entry
+	}
+	b.prune()
+}
+
+// Records that a node sent us a session ping or pong, so a session with it is up.
+func (b *addressBook) see(key *boxPubKey, coords []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.file == "" {
+		return
+	}
+	now := time.Now()
+	entry, isIn := b.entries[*key]
+	if !isIn {
+		addr := address_addrForNodeID(getNodeID(key))
+		entry = &addressBook_entry{
+			Key:       hex.EncodeToString(key[:]),
+			Address:   net.IP(addr[:]).String(),
+			FirstSeen: now,
+			LastSeen:  now,
+		}
+		b.entries[*key] = entry
+		b.prune()
+	}
+	if entry.Name == "" {
+		entry.Name = b.core.aliases.getName(net.ParseIP(entry.Address))
+	}
+	entry.Coords = hex.EncodeToString(coords)
+	entry.LastSeen = now
+	b.changed = true
+}
+
+// Parses an encryption public key given to the admin API.
+func addressBook_parseKey(keyString string) (*boxPubKey, error) {
+	keyBytes, err := hex.DecodeString(keyString)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyBytes) != boxPubKeyLen {
+		return nil, errors.New("Invalid key length")
+	}
+	var key boxPubKey
+	copy(key[:], keyBytes)
+	return &key, nil
+}
+
+// Names a node in the address book, or removes its name if the name is empty.
+func (b *addressBook) setName(key *boxPubKey, name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	entry, isIn := b.entries[*key]
+	if !isIn {
+		return errors.New("node not found in the address book")
+	}
+	entry.Name = name
+	b.changed = true
+	return nil
+}
+
+// Removes a node from the address book.
+func (b *addressBook) remove(key *boxPubKey) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, isIn := b.entries[*key]; !isIn {
+		return errors.New("node not found in the address book")
+	}
+	delete(b.entries, *key)
+	b.changed = true
+	return nil
+}
+
+// Gets the entries in the address book, most recently seen first.
+func (b *addressBook) getEntries() []addressBook_entry {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	entries := make([]addressBook_entry, 0, len(b.entries))
+	for _, entry := range b.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastSeen.After(entries[j].LastSeen)
+	})
+	return entries
+}
+
+// Forgets the nodes that were seen least recently while there are too many. Must be called with the mutex held.
+func (b *addressBook) prune() {
+	for len(b.entries) > addressBook_maxEntries {
+		var oldest *boxPubKey
+		for key, entry := range b.entries {
+			if oldest == nil || entry.LastSeen.Before(b.entries[*oldest].LastSeen) {
+				k := key
+				oldest = &k
+			}
+		}
+		delete(b.entries, *oldest)
+	}
+}
+
+// Saves the address book if it has changed and wasn't saved recently.
+// This is called by the router's periodic maintenance.
+func (b *addressBook) doMaintenance() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.changed && time.Since(b.saved) > addressBook_saveInterval {
+		b.save()
+	}
+}
+
+// Saves the address book if it has changes, when the node stops.
+func (b *addressBook) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.changed {
+		b.save()
+	}
+}
+
+// Writes the address book to its file, replacing it atomically. Must be called with the mutex held.
+func (b *addressBook) save() {
+	b.saved = time.Now()
+	if b.file == "" {
+		return
+	}
+	entries := make([]*addressBook_entry, 0, len(b.entries))
+	for _, entry := range b.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastSeen.After(entries[j].LastSeen)
+	})
+	bs, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		b.core.log.Println("Failed to encode address book:", err)
+		return
+	}
+	tmp := b.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		b.core.log.Println("Failed to write address book:", err)
+		return
+	}
+	if err := os.Rename(tmp, b.file); err != nil {
+		b.core.log.Println("Failed to write address book:", err)
+		return
+	}
+	b.changed = false
+}
@@ -0,0 +1,178 @@
+package yggdrasil
+
+// This watches for changes to the host's addresses, i.e. when moving from WiFi
+// to mobile data, or when DHCP hands out a new address. Outgoing links that
+// were using an address that has gone away are closed and dialled again
+// straight away, instead of waiting for them to time out, which can take a
+// long time for TCP connections whose packets are silently going nowhere.
+// Once the new links have had a chance to come up, sessions are pinged so that
+// remote nodes learn our new coords without waiting for us to send traffic.
+// Listeners bound to a specific address are also listened on again whenever
+// the host's addresses change, as the address they're bound to may be gone.
+// Link-local links are also dialled again when their interface goes away or
+// comes back with a different index, as their zone then refers to the wrong
+// interface, even if the interface still has the same link-local address.
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often the host's addresses are checked.
+const addrWatch_interval = 2 * time.Second
+
+// How long to wait after closing links before pinging sessions, to give the new links time to come up.
+const addrWatch_sessionDelay = 2 * default_tcp_timeout
+
+type addrWatch struct {
+	core    *Core
+	addrs   map[string]struct{} // Only used by watch
+	ifaces  map[string]int      // Interface indexes by name, only used by watch
+	unbound bool                // Set if a listener couldn't be bound, so that it's tried again, and only used by watch
+	stop    chan struct{}
+}
+
+// Initializes the addrWatch struct.
+func (w *addrWatch) init(core *Core) {
+	w.core = core
+}
+
+// Starts watching the host's addresses.
+func (w *addrWatch) start() {
+	w.addrs, _ = addrWatch_getAddrs()
+	w.ifaces, _ = addrWatch_getInterfaces()
+	w.stop = make(chan struct{})
+	go w.watch(w.stop)
+}
+
+// Stops watching the host's addresses.
+func (w *addrWatch) close() {
+	if w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+	}
+}
+
+// Checks the host's addresses every addrWatch_interval until stopped, and migrates links if any have gone away.
+func (w *addrWatch) watch(stop chan struct{}) {
+	ticker := time.NewTicker(addrWatch_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		addrs, err := addrWatch_getAddrs()
+		if err != nil {
+			continue
+		}
+		var removed bool
+		for addr := range w.addrs {
+			if _, isIn := addrs[addr]; !isIn {
+				removed = true
+				break
+			}
+		}
+		changed := removed || len(addrs) != len(w.addrs)
+		w.addrs = addrs
+		if changed || w.unbound {
+			w.unbound = w.core.tcp.rebindListeners(addrs)
+		}
+		// Zones may be formatted as either the name or the index of the interface
+		stale := make(map[string]struct{})
+		if ifaces, err := addrWatch_getInterfaces(); err == nil {
+			for name, index := range w.ifaces {
+				if newIndex, isIn := ifaces[name]; !isIn || newIndex != index {
+					stale[name] = struct{}{}
+					stale[strconv.Itoa(index)] = struct{}{}
+				}
+			}
+			w.ifaces = ifaces
+		}
+		if !removed && len(stale) == 0 {
+			continue
+		}
+		gone := func(conn net.Conn) bool {
+			for _, addr := range []net.Addr{conn.LocalAddr(), conn.RemoteAddr()} {
+				if _, isIn := stale[addrWatch_getZone(addr)]; isIn {
+					return true
+				}
+			}
+			// Links that don't use IP, like in-memory links, are left alone
+			ip := addrWatch_getIP(conn.LocalAddr())
+			if ip == nil {
+				return false
+			}
+			_, isIn := addrs[ip.String()]
+			return !isIn
+		}
+		if n := w.core.tcp.reconnect(gone); n > 0 {
+			w.core.log.Println("Local addresses changed, reconnecting", n, "peer(s)")
+			time.AfterFunc(addrWatch_sessionDelay, w.pingSessions)
+		}
+	}
+}
+
+// Pings every session, so the remote nodes learn our current coords.
+func (w *addrWatch) pingSessions() {
+	w.core.router.doAdmin(func() {
+		for _, sinfo := range w.core.sessions.sinfos {
+			w.core.sessions.ping(sinfo)
+		}
+	})
+}
+
+// Gets the IP addresses currently assigned to the host's interfaces.
+func addrWatch_getAddrs() (map[string]struct{}, error) {
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[string]struct{})
+	for _, ifaddr := range ifaddrs {
+		if ip, _, err := net.ParseCIDR(ifaddr.String()); err == nil {
+			addrs[ip.String()] = struct{}{}
+		}
+	}
+	return addrs, nil
+}
+
+// Gets the index of each of the host's interfaces, by name.
+func addrWatch_getInterfaces() (map[string]int, error) {
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	ifaces := make(map[string]int)
+	for _, intf := range intfs {
+		ifaces[intf.Name] = intf.Index
+	}
+	return ifaces, nil
+}
+
+// Gets the zone of a socket address, i.e. "eth0" for [fe80::1%eth0]:1234, or an empty string if it has none.
+func addrWatch_getZone(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	if idx := strings.Index(host, "%"); idx >= 0 {
+		return host[idx+1:]
+	}
+	return ""
+}
+
+// Gets the IP address of a local socket address, without any port or zone, or nil if it isn't an IP address.
+func addrWatch_getIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	if idx := strings.Index(host, "%"); idx >= 0 {
+		host = host[:idx]
+	}
+	return net.ParseIP(host)
+}
@@ -1,19 +1,23 @@
 package yggdrasil
 
 import (
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/url"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"yggdrasil/config"
 	"yggdrasil/defaults"
 )
 
@@ -62,16 +66,31 @@ func (a *admin) init(c *Core, listenaddr string) {
 	a.addHandler("dot", []string{}, func(in admin_info) (admin_info, error) {
 		return admin_info{"dot": string(a.getResponse_dot())}, nil
 	})
+	a.addHandler("getTopology", []string{"[format]"}, func(in admin_info) (admin_info, error) {
+		nodes, edges := a.getData_getTopology()
+		format, _ := in["format"].(string)
+		switch format {
+		case "", "json":
+			return admin_info{"topology": admin_info{"nodes": nodes, "edges": edges}}, nil
+		case "dot":
+			return admin_info{"dot": a.getResponse_topologyDot(nodes, edges)}, nil
+		default:
+			return admin_info{"formats": []string{"json", "dot"}}, errors.New("unknown format")
+		}
+	})
 	a.addHandler("getSelf", []string{}, func(in admin_info) (admin_info, error) {
 		self := a.getData_getSelf().asMap()
 		ip := fmt.Sprint(self["ip"])
 		delete(self, "ip")
 		return admin_info{"self": admin_info{ip: self}}, nil
 	})
+	a.addHandler("getHealth", []string{}, func(in admin_info) (admin_info, error) {
+		return admin_info{"health": a.getData_getHealth().asMap()}, nil
+	})
 	a.addHandler("getPeers", []string{}, func(in admin_info) (admin_info, error) {
 		sort := "ip"
 		peers := make(admin_info)
-		for _, peerdata := range a.getData_getPeers() {
+		for _, peerdata := range a.withAliases(a.getData_getPeers()) {
 			p := peerdata.asMap()
 			so := fmt.Sprint(p[sort])
 			peers[so] = p
@@ -82,7 +101,7 @@ func (a *admin) init(c *Core, listenaddr string) {
 	a.addHandler("getSwitchPeers", []string{}, func(in admin_info) (admin_info, error) {
 		sort := "port"
 		switchpeers := make(admin_info)
-		for _, s := range a.getData_getSwitchPeers() {
+		for _, s := range a.withAliases(a.getData_getSwitchPeers()) {
 			p := s.asMap()
 			so := fmt.Sprint(p[sort])
 			switchpeers[so] = p
@@ -94,10 +113,13 @@ func (a *admin) init(c *Core, listenaddr string) {
 		queues := a.getData_getSwitchQueues()
 		return admin_info{"switchqueues": queues.asMap()}, nil
 	})
+	a.addHandler("getSwitchFlows", []string{}, func(in admin_info) (admin_info, error) {
+		return admin_info{"switchflows": a.getData_getSwitchFlows()}, nil
+	})
 	a.addHandler("getDHT", []string{}, func(in admin_info) (admin_info, error) {
 		sort := "ip"
 		dht := make(admin_info)
-		for _, d := range a.getData_getDHT() {
+		for _, d := range a.withAliases(a.getData_getDHT()) {
 			p := d.asMap()
 			so := fmt.Sprint(p[sort])
 			dht[so] = p
@@ -105,10 +127,38 @@ func (a *admin) init(c *Core, listenaddr string) {
 		}
 		return admin_info{"dht": dht}, nil
 	})
-	a.addHandler("getSessions", []string{}, func(in admin_info) (admin_info, error) {
+	a.addHandler("crawl", []string{"[max_nodes]"}, func(in admin_info) (admin_info, error) {
+		maxNodes := 0
+		if m, ok := in["max_nodes"]; ok {
+			if mf, ok := m.(float64); ok {
+				maxNodes = int(mf)
+			}
+		}
+		nodes, err := a.getData_crawl(maxNodes)
+		if err != nil {
+			return admin_info{}, err
+		}
+		return admin_info{"nodes": nodes}, nil
+	})
+	a.addHandler("getClosestNodes", []string{"key"}, func(in admin_info) (admin_info, error) {
+		infos, err := a.getData_getClosestNodes(fmt.Sprint(in["key"]))
+		if err != nil {
+			return admin_info{}, err
+		}
+		var closest []map[string]interface{}
+		for _, info := range infos {
+			closest = append(closest, info.asMap())
+		}
+		return admin_info{"closest": closest}, nil
+	})
+	a.addHandler("getSessions", []string{"[key]", "[address]", "[min_bytes]", "[active]"}, func(in admin_info) (admin_info, error) {
+		filter, err := admin_parseSessionFilter(in)
+		if err != nil {
+			return admin_info{}, err
+		}
 		sort := "ip"
 		sessions := make(admin_info)
-		for _, s := range a.getData_getSessions() {
+		for _, s := range a.withAliases(a.getData_getSessions(filter)) {
 			p := s.asMap()
 			so := fmt.Sprint(p[sort])
 			sessions[so] = p
@@ -116,6 +166,22 @@ func (a *admin) init(c *Core, listenaddr string) {
 		}
 		return admin_info{"sessions": sessions}, nil
 	})
+	a.addHandler("setSessionUnordered", []string{"box_pub_key", "unordered"}, func(in admin_info) (admin_info, error) {
+		unordered := fmt.Sprint(in["unordered"]) == "true"
+		if err := a.core.SetSessionUnordered(fmt.Sprint(in["box_pub_key"]), unordered); err != nil {
+			return admin_info{}, err
+		}
+		return admin_info{"box_pub_key": in["box_pub_key"], "unordered": unordered}, nil
+	})
+	a.addHandler("sweepSessions", []string{}, func(in admin_info) (admin_info, error) {
+		var closed, keys int
+		a.core.router.doAdmin(func() {
+			closed = a.core.sessions.sweep()
+			keys = len(a.core.sessions.permShared)
+			a.core.sessions.permShared = make(map[boxPubKey]*boxSharedKey)
+		})
+		return admin_info{"closed_sessions": closed, "dropped_keys": keys}, nil
+	})
 	a.addHandler("addPeer", []string{"uri", "[interface]"}, func(in admin_info) (admin_info, error) {
 		// Set sane defaults
 		intf := ""
@@ -123,6 +189,13 @@ func (a *admin) init(c *Core, listenaddr string) {
 		if itf, ok := in["interface"]; ok {
 			intf = itf.(string)
 		}
+		if stdiolink_isURI(in["uri"].(string)) {
+			return admin_info{
+				"not_added": []string{
+					in["uri"].(string),
+				},
+			}, errors.New("stdio:// and pipe:// peers can only be set in the configuration")
+		}
 		if a.addPeer(in["uri"].(string), intf) == nil {
 			return admin_info{
 				"added": []string{
@@ -152,20 +225,84 @@ func (a *admin) init(c *Core, listenaddr string) {
 			}, errors.New("Failed to remove peer")
 		}
 	})
+	a.addHandler("setLinkImpairment", []string{"port", "[latency]", "[jitter]", "[loss]"}, func(in admin_info) (admin_info, error) {
+		// Latency and jitter are in milliseconds and loss is a percentage, which may be sent as strings if they aren't whole numbers
+		args := make(map[string]float64)
+		for _, arg := range []string{"latency", "jitter", "loss"} {
+			if v, ok := in[arg]; ok {
+				f, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+				if err != nil {
+					return admin_info{}, errors.New("Invalid " + arg)
+				}
+				args[arg] = f
+			}
+		}
+		latency := time.Duration(args["latency"] * float64(time.Millisecond))
+		jitter := time.Duration(args["jitter"] * float64(time.Millisecond))
+		if err := a.setLinkImpairment(fmt.Sprint(in["port"]), latency, jitter, args["loss"]); err != nil {
+			return admin_info{}, err
+		}
+		return admin_info{
+			"impaired": admin_info{
+				"port":       in["port"],
+				"latency_ms": args["latency"],
+				"jitter_ms":  args["jitter"],
+				"loss":       args["loss"],
+			},
+		}, nil
+	})
 	a.addHandler("getTunTap", []string{}, func(in admin_info) (r admin_info, e error) {
 		defer func() {
-			recover()
-			r = admin_info{"none": admin_info{}}
-			e = nil
+			if recover() != nil {
+				r = admin_info{"none": admin_info{
+					"echo_replies": atomic.LoadUint64(&a.core.tun.counters.echoReplies),
+					"errors_sent":  atomic.LoadUint64(&a.core.tun.counters.errorsSent),
+				}}
+				e = nil
+			}
 		}()
 
+		readBatches := atomic.LoadUint64(&a.core.tun.counters.readBatches)
+		writeBatches := atomic.LoadUint64(&a.core.tun.counters.writeBatches)
+		state := a.core.tun.getState()
+		queues := len(state.queues)
+		if queues == 0 && state.iface != nil {
+			queues = 1
+		}
 		return admin_info{
-			a.core.tun.iface.Name(): admin_info{
-				"tap_mode": a.core.tun.iface.IsTAP(),
-				"mtu":      a.core.tun.mtu,
+			state.name(): admin_info{
+				"tap_mode":            state.iface.IsTAP(),
+				"mtu":                 state.mtu,
+				"queues":              queues,
+				"bytes_read":          atomic.LoadUint64(&a.core.tun.counters.bytesRead),
+				"bytes_written":       atomic.LoadUint64(&a.core.tun.counters.bytesWritten),
+				"packets_read":        atomic.LoadUint64(&a.core.tun.counters.packetsRead),
+				"packets_written":     atomic.LoadUint64(&a.core.tun.counters.packetsWritten),
+				"read_dropped":        atomic.LoadUint64(&a.core.tun.counters.readDropped),
+				"write_dropped":       atomic.LoadUint64(&a.core.tun.counters.writeDropped),
+				"read_errors":         atomic.LoadUint64(&a.core.tun.counters.readErrors),
+				"write_errors":        atomic.LoadUint64(&a.core.tun.counters.writeErrors),
+				"read_malformed":      atomic.LoadUint64(&a.core.tun.counters.readMalformed),
+				"read_malformed_by":   a.core.tun.getMalformed(),
+				"read_unsupported":    atomic.LoadUint64(&a.core.tun.counters.readUnknown),
+				"batch_size":          a.core.tun.getBatchSize(),
+				"read_batches":        readBatches,
+				"write_batches":       writeBatches,
+				"read_batch_average":  tun_batchAverage(atomic.LoadUint64(&a.core.tun.counters.packetsRead), readBatches),
+				"write_batch_average": tun_batchAverage(atomic.LoadUint64(&a.core.tun.counters.packetsWritten), writeBatches),
+				"read_filtered":       atomic.LoadUint64(&a.core.tun.counters.readFiltered),
+				"write_filtered":      atomic.LoadUint64(&a.core.tun.counters.writeFiltered),
+				"offload":             state.vnetHdr,
+				"segments_split":      atomic.LoadUint64(&a.core.tun.counters.segmentsSplit),
+				"recoveries":          atomic.LoadUint64(&a.core.tun.counters.recoveries),
+				"packet_too_big":      atomic.LoadUint64(&a.core.tun.counters.packetTooBig),
+				"mss_clamped":         atomic.LoadUint64(&a.core.tun.counters.mssClamped),
 			},
 		}, nil
 	})
+	a.addHandler("getExtraTunTaps", []string{}, func(in admin_info) (admin_info, error) {
+		return admin_info{"extra_tuntaps": a.core.extraTun.getInfo()}, nil
+	})
 	a.addHandler("setTunTap", []string{"name", "[tap_mode]", "[mtu]"}, func(in admin_info) (admin_info, error) {
 		// Set sane defaults
 		iftapmode := defaults.GetDefaults().DefaultIfTAPMode
@@ -183,10 +320,12 @@ func (a *admin) init(c *Core, listenaddr string) {
 		// Start the TUN adapter
 		if err := a.startTunWithMTU(in["name"].(string), iftapmode, ifmtu); err != nil {
 			return admin_info{}, errors.New("Failed to configure adapter")
+		} else if state := a.core.tun.getState(); state.iface == nil {
+			return admin_info{"none": admin_info{}}, nil
 		} else {
 			return admin_info{
-				a.core.tun.iface.Name(): admin_info{
-					"tap_mode": a.core.tun.iface.IsTAP(),
+				state.name(): admin_info{
+					"tap_mode": state.isTAP(),
 					"mtu":      ifmtu,
 				},
 			}, nil
@@ -199,6 +338,144 @@ func (a *admin) init(c *Core, listenaddr string) {
 		}
 		return admin_info{"multicast_interfaces": intfs}, nil
 	})
+	a.addHandler("getNodeInfo", []string{"box_pub_key", "[coords]", "[nocache]"}, func(in admin_info) (admin_info, error) {
+		var coords string
+		if c, ok := in["coords"]; ok {
+			coords = fmt.Sprint(c)
+		}
+		nocache := fmt.Sprint(in["nocache"]) == "true"
+		result, cached, err := a.admin_getNodeInfo(fmt.Sprint(in["box_pub_key"]), coords, nocache)
+		if err != nil {
+			return admin_info{}, err
+		}
+		var m map[string]interface{}
+		if err = json.Unmarshal(result, &m); err != nil {
+			return admin_info{}, err
+		}
+		return admin_info{"nodeinfo": m, "cached": cached}, nil
+	})
+	a.addHandler("getPeersNodeInfo", []string{"[hops]", "[nocache]"}, func(in admin_info) (admin_info, error) {
+		hops := 1
+		if h, ok := in["hops"].(float64); ok {
+			hops = int(h)
+		}
+		if hops < 1 || hops > 2 {
+			return admin_info{}, errors.New("hops must be 1 or 2")
+		}
+		nocache := fmt.Sprint(in["nocache"]) == "true"
+		nodes := make(admin_info)
+		for _, n := range a.withAliases(a.getData_getPeersNodeInfo(hops, nocache)) {
+			p := n.asMap()
+			so := fmt.Sprint(p["ip"])
+			nodes[so] = p
+			delete(nodes[so].(map[string]interface{}), "ip")
+		}
+		return admin_info{"nodes": nodes}, nil
+	})
+	a.addHandler("getAddressBook", []string{"[name]"}, func(in admin_info) (admin_info, error) {
+		var name string
+		if n, ok := in["name"]; ok {
+			name = strings.ToLower(fmt.Sprint(n))
+		}
+		nodes := make(admin_info)
+		for _, entry := range a.core.addrBook.getEntries() {
+			if !strings.Contains(strings.ToLower(entry.Name), name) {
+				continue
+			}
+			coords, _ := hex.DecodeString(entry.Coords)
+			nodes[entry.Address] = admin_info{
+				"box_pub_key": entry.Key,
+				"coords":      fmt.Sprint(coords),
+				"first_seen":  entry.FirstSeen.Format(time.RFC3339),
+				"last_seen":   entry.LastSeen.Format(time.RFC3339),
+				"name":        entry.Name,
+			}
+		}
+		return admin_info{"nodes": nodes}, nil
+	})
+	a.addHandler("setAddressBookName", []string{"box_pub_key", "name"}, func(in admin_info) (admin_info, error) {
+		key, err := addressBook_parseKey(fmt.Sprint(in["box_pub_key"]))
+		if err != nil {
+			return admin_info{}, err
+		}
+		if err := a.core.addrBook.setName(key, fmt.Sprint(in["name"])); err != nil {
+			return admin_info{}, err
+		}
+		return admin_info{"box_pub_key": in["box_pub_key"], "name": in["name"]}, nil
+	})
+	a.addHandler("removeAddressBookEntry", []string{"box_pub_key"}, func(in admin_info) (admin_info, error) {
+		key, err := addressBook_parseKey(fmt.Sprint(in["box_pub_key"]))
+		if err != nil {
+			return admin_info{}, err
+		}
+		if err := a.core.addrBook.remove(key); err != nil {
+			return admin_info{}, err
+		}
+		return admin_info{"removed": []string{fmt.Sprint(in["box_pub_key"])}}, nil
+	})
+	a.addHandler("getNodeServices", []string{"box_pub_key", "[coords]", "[nocache]"}, func(in admin_info) (admin_info, error) {
+		var coords string
+		if c, ok := in["coords"]; ok {
+			coords = fmt.Sprint(c)
+		}
+		nocache := fmt.Sprint(in["nocache"]) == "true"
+		result, cached, err := a.admin_getNodeInfo(fmt.Sprint(in["box_pub_key"]), coords, nocache)
+		if err != nil {
+			return admin_info{}, err
+		}
+		services, err := nodeinfo_getServices(result)
+		if err != nil {
+			return admin_info{}, err
+		}
+		return admin_info{"services": services, "cached": cached}, nil
+	})
+	a.addHandler("bench", []string{"box_pub_key", "[coords]", "[duration]", "[size]"}, func(in admin_info) (admin_info, error) {
+		var coords string
+		if c, ok := in["coords"]; ok {
+			coords = fmt.Sprint(c)
+		}
+		var duration time.Duration
+		if d, ok := in["duration"].(float64); ok {
+			duration = time.Duration(d * float64(time.Second))
+		}
+		var size int
+		if s, ok := in["size"].(float64); ok {
+			size = int(s)
+		}
+		result, err := a.getData_bench(fmt.Sprint(in["box_pub_key"]), coords, duration, size)
+		if err != nil {
+			return admin_info{}, err
+		}
+		return admin_info{"bench": result.asMap()}, nil
+	})
+	a.addHandler("getCollisions", []string{}, func(in admin_info) (admin_info, error) {
+		var collisions []map[string]interface{}
+		for _, c := range a.getData_getCollisions() {
+			collisions = append(collisions, c.asMap())
+		}
+		return admin_info{"collisions": collisions}, nil
+	})
+	a.addHandler("getCoordsHistory", []string{}, func(in admin_info) (admin_info, error) {
+		var history []map[string]interface{}
+		for _, h := range a.getData_getCoordsHistory() {
+			history = append(history, h.asMap())
+		}
+		return admin_info{"history": history}, nil
+	})
+	a.addHandler("getTapNeighbors", []string{}, func(in admin_info) (admin_info, error) {
+		var neighbors []map[string]interface{}
+		for _, n := range a.getData_getTapNeighbors() {
+			neighbors = append(neighbors, n.asMap())
+		}
+		return admin_info{"neighbors": neighbors}, nil
+	})
+	a.addHandler("getMulticastGroups", []string{}, func(in admin_info) (admin_info, error) {
+		var groups []map[string]interface{}
+		for _, g := range a.getData_getMulticastGroups() {
+			groups = append(groups, g.asMap())
+		}
+		return admin_info{"groups": groups}, nil
+	})
 	a.addHandler("getAllowedEncryptionPublicKeys", []string{}, func(in admin_info) (admin_info, error) {
 		return admin_info{"allowed_box_pubs": a.getAllowedEncryptionPublicKeys()}, nil
 	})
@@ -232,16 +509,136 @@ func (a *admin) init(c *Core, listenaddr string) {
 			}, errors.New("Failed to remove allowed key")
 		}
 	})
+	a.addHandler("getOutgoingPeers", []string{}, func(in admin_info) (admin_info, error) {
+		outgoing := a.core.tcp.getOutgoing()
+		sort.Strings(outgoing)
+		// Connections to nodes found by multicast discovery are listed again, so that they can be told apart from static peers
+		multicast := a.core.multicast.getCalls()
+		sort.Strings(multicast)
+		return admin_info{"outgoing": outgoing, "multicast": multicast}, nil
+	})
+	a.addHandler("getSessionFirewall", []string{}, func(in admin_info) (admin_info, error) {
+		return admin_info{"firewall": a.getData_getSessionFirewall()}, nil
+	})
+	a.addHandler("traceFlow", []string{"source", "destination", "[duration]", "[rate]"}, func(in admin_info) (admin_info, error) {
+		source := net.ParseIP(fmt.Sprint(in["source"]))
+		destination := net.ParseIP(fmt.Sprint(in["destination"]))
+		if source == nil || destination == nil {
+			return admin_info{}, errors.New("Invalid address")
+		}
+		var duration time.Duration
+		if d, ok := in["duration"]; ok {
+			seconds, err := strconv.ParseFloat(fmt.Sprint(d), 64)
+			if err != nil {
+				return admin_info{}, errors.New("Invalid duration")
+			}
+			// A duration of 0 stops the trace, rather than using the default
+			duration = time.Duration(seconds * float64(time.Second))
+			if duration <= 0 {
+				duration = -1
+			}
+		}
+		var rate float64
+		if r, ok := in["rate"]; ok {
+			var err error
+			if rate, err = strconv.ParseFloat(fmt.Sprint(r), 64); err != nil {
+				return admin_info{}, errors.New("Invalid rate")
+			}
+		}
+		if err := a.core.flowTrace.setTrace(source, destination, duration, rate); err != nil {
+			return admin_info{}, err
+		}
+		return admin_info{"traces": a.core.flowTrace.getTraces()}, nil
+	})
+	a.addHandler("getFlowTraces", []string{}, func(in admin_info) (admin_info, error) {
+		return admin_info{"traces": a.core.flowTrace.getTraces()}, nil
+	})
+	a.addHandler("startCapture", []string{"file", "[port]", "[duration]", "[snap_length]"}, func(in admin_info) (admin_info, error) {
+		// Without a peer port, the TUN/TAP adapter is captured
+		tun := true
+		var port switchPort
+		if p, ok := in["port"]; ok {
+			n, err := strconv.ParseUint(fmt.Sprint(p), 10, 64)
+			if err != nil {
+				return admin_info{}, errors.New("Invalid port")
+			}
+			tun, port = false, switchPort(n)
+		}
+		var duration time.Duration
+		if d, ok := in["duration"]; ok {
+			seconds, err := strconv.ParseFloat(fmt.Sprint(d), 64)
+			if err != nil {
+				return admin_info{}, errors.New("Invalid duration")
+			}
+			duration = time.Duration(seconds * float64(time.Second))
+		}
+		var snapLen int
+		if l, ok := in["snap_length"]; ok {
+			var err error
+			if snapLen, err = strconv.Atoi(fmt.Sprint(l)); err != nil {
+				return admin_info{}, errors.New("Invalid snap length")
+			}
+		}
+		if err := a.core.capture.start(fmt.Sprint(in["file"]), tun, port, duration, snapLen); err != nil {
+			return admin_info{}, err
+		}
+		return admin_info{"captures": a.core.capture.getCaptures()}, nil
+	})
+	a.addHandler("stopCapture", []string{"file"}, func(in admin_info) (admin_info, error) {
+		if err := a.core.capture.stop(fmt.Sprint(in["file"])); err != nil {
+			return admin_info{}, err
+		}
+		return admin_info{"captures": a.core.capture.getCaptures()}, nil
+	})
+	a.addHandler("getCaptures", []string{}, func(in admin_info) (admin_info, error) {
+		return admin_info{"captures": a.core.capture.getCaptures()}, nil
+	})
+	a.addHandler("getPathMTUs", []string{}, func(in admin_info) (admin_info, error) {
+		return admin_info{"path_mtus": a.core.tun.pathMTU.getEntries()}, nil
+	})
+	a.addHandler("getNDPProxy", []string{}, func(in admin_info) (admin_info, error) {
+		return admin_info{"ndp_proxy": a.core.ndpProxy.getInfo()}, nil
+	})
+	a.addHandler("getTunnelRoutes", []string{}, func(in admin_info) (admin_info, error) {
+		return admin_info{"routes": a.core.ckr.getRoutes()}, nil
+	})
+	a.addHandler("addTunnelRoute", []string{"subnet", "box_pub_key"}, func(in admin_info) (admin_info, error) {
+		if err := a.core.ckr.addRoute(fmt.Sprint(in["subnet"]), fmt.Sprint(in["box_pub_key"])); err != nil {
+			return admin_info{"not_added": []string{fmt.Sprint(in["subnet"])}}, err
+		}
+		return admin_info{"added": []string{fmt.Sprint(in["subnet"])}}, nil
+	})
+	a.addHandler("removeTunnelRoute", []string{"subnet"}, func(in admin_info) (admin_info, error) {
+		if err := a.core.ckr.removeRoute(fmt.Sprint(in["subnet"])); err != nil {
+			return admin_info{"not_removed": []string{fmt.Sprint(in["subnet"])}}, err
+		}
+		return admin_info{"removed": []string{fmt.Sprint(in["subnet"])}}, nil
+	})
+	a.addHandler("flushTunnelRoutes", []string{}, func(in admin_info) (admin_info, error) {
+		return admin_info{"removed_routes": a.core.ckr.flushRoutes()}, nil
+	})
+	a.addHandler("getAliases", []string{}, func(in admin_info) (admin_info, error) {
+		return admin_info{"aliases": a.core.aliases.getAliases()}, nil
+	})
+	a.addHandler("getProxies", []string{}, func(in admin_info) (admin_info, error) {
+		return admin_info{"proxies": a.core.proxies.getProxies()}, nil
+	})
 }
 
 // start runs the admin API socket to listen for / respond to admin API calls.
 func (a *admin) start() error {
+	if a.listenaddr == "none" {
+		return nil
+	}
 	go a.listen()
 	return nil
 }
 
 // cleans up when stopping
 func (a *admin) close() error {
+	if a.listener == nil {
+		return nil
+	}
 	return a.listener.Close()
 }
 
@@ -303,7 +700,6 @@ func (a *admin) handleRequest(conn net.Conn) {
 	for {
 		// Start with a clean slate on each request
 		recv = admin_info{}
-		send = admin_info{}
 
 		// Decode the input
 		if err := decoder.Decode(&recv); err != nil {
@@ -311,51 +707,7 @@ func (a *admin) handleRequest(conn net.Conn) {
 			return
 		}
 
-		// Send the request back with the response, and default to "error"
-		// unless the status is changed below by one of the handlers
-		send["request"] = recv
-		send["status"] = "error"
-
-	handlers:
-		for _, handler := range a.handlers {
-			// We've found the handler that matches the request
-			if strings.ToLower(recv["request"].(string)) == strings.ToLower(handler.name) {
-				// Check that we have all the required arguments
-				for _, arg := range handler.args {
-					// An argument in [square brackets] is optional and not required,
-					// so we can safely ignore those
-					if strings.HasPrefix(arg, "[") && strings.HasSuffix(arg, "]") {
-						continue
-					}
-					// Check if the field is missing
-					if _, ok := recv[arg]; !ok {
-						send = admin_info{
-							"status":    "error",
-							"error":     "Expected field missing: " + arg,
-							"expecting": arg,
-						}
-						break handlers
-					}
-				}
-
-				// By this point we should have all the fields we need, so call
-				// the handler
-				response, err := handler.handler(recv)
-				if err != nil {
-					send["error"] = err.Error()
-					if response != nil {
-						send["response"] = response
-					}
-				} else {
-					send["status"] = "success"
-					if response != nil {
-						send["response"] = response
-					}
-				}
-
-				break
-			}
-		}
+		send = a.handle(recv)
 
 		// Send the response back
 		if err := encoder.Encode(&send); err != nil {
@@ -369,6 +721,59 @@ func (a *admin) handleRequest(conn net.Conn) {
 	}
 }
 
+// handle calls the handler for a single admin request and returns the response to send back.
+func (a *admin) handle(recv admin_info) admin_info {
+	send := make(admin_info)
+	// Send the request back with the response, and default to "error"
+	// unless the status is changed below by one of the handlers
+	send["request"] = recv
+	send["status"] = "error"
+
+handlers:
+	for _, handler := range a.handlers {
+		// We've found the handler that matches the request
+		if strings.ToLower(recv["request"].(string)) == strings.ToLower(handler.name) {
+			// Check that we have all the required arguments
+			for _, arg := range handler.args {
+				// An argument in [square brackets] is optional and not required,
+				// so we can safely ignore those
+				if strings.HasPrefix(arg, "[") && strings.HasSuffix(arg, "]") {
+					continue
+				}
+				// Check if the field is missing
+				if _, ok := recv[arg]; !ok {
+					send = admin_info{
+						"status":    "error",
+						"error":     "Expected field missing: " + arg,
+						"expecting": arg,
+					}
+					break handlers
+				}
+			}
+
+			// By this point we should have all the fields we need, so call
+			// the handler, after swapping any alias names for what they
+			// refer to
+			a.resolveAliases(recv)
+			response, err := handler.handler(recv)
+			if err != nil {
+				send["error"] = err.Error()
+				if response != nil {
+					send["response"] = response
+				}
+			} else {
+				send["status"] = "success"
+				if response != nil {
+					send["response"] = response
+				}
+			}
+
+			break
+		}
+	}
+	return send
+}
+
 // asMap converts an admin_nodeInfo into a map of key/value pairs.
 func (n *admin_nodeInfo) asMap() map[string]interface{} {
 	m := make(map[string]interface{}, len(*n))
@@ -378,6 +783,38 @@ func (n *admin_nodeInfo) asMap() map[string]interface{} {
 	return m
 }
 
+// withAliases adds the name of each node's alias, or an empty string if it has none, to admin_nodeInfos that have the node's "ip".
+// Nothing is added if there are no aliases, to keep the output as it was.
+func (a *admin) withAliases(infos []admin_nodeInfo) []admin_nodeInfo {
+	if a.core.aliases.isEmpty() {
+		return infos
+	}
+	for idx, info := range infos {
+		for _, p := range info {
+			if p.key == "ip" {
+				name := a.core.aliases.getName(net.ParseIP(fmt.Sprint(p.val)))
+				infos[idx] = append(info, admin_pair{"alias", name})
+				break
+			}
+		}
+	}
+	return infos
+}
+
+// resolveAliases replaces alias names given as the key or address arguments of a request with the key or address that they refer to.
+func (a *admin) resolveAliases(in admin_info) {
+	for _, arg := range []string{"key", "box_pub_key"} {
+		if s, ok := in[arg].(string); ok {
+			in[arg] = a.core.aliases.resolveKey(s)
+		}
+	}
+	for _, arg := range []string{"address", "source", "destination"} {
+		if s, ok := in[arg].(string); ok {
+			in[arg] = a.core.aliases.resolveAddress(s)
+		}
+	}
+}
+
 // toString creates a printable string representation of an admin_nodeInfo.
 func (n *admin_nodeInfo) toString() string {
 	// TODO return something nicer looking than this
@@ -401,13 +838,43 @@ func (a *admin) printInfos(infos []admin_nodeInfo) string {
 
 // addPeer triggers a connection attempt to a node.
 func (a *admin) addPeer(addr string, sintf string) error {
-	u, err := url.Parse(addr)
+	u, err := url.Parse(config.EscapeZone(addr))
 	if err == nil {
+		args := u.Query()
+		timeouts, err := a.core.tcp.parseTimeouts(args)
+		if err != nil {
+			return err
+		}
 		switch strings.ToLower(u.Scheme) {
 		case "tcp":
-			a.core.tcp.connect(u.Host, sintf)
+			if args.Get("transport") != "" {
+				if sintf != "" {
+					return errors.New("transports can't be used with an interface: " + addr)
+				}
+				name := args.Get("transport")
+				args.Del("transport")
+				return a.core.tcp.connectTransport(name, args, u.Host, timeouts)
+			}
+			a.core.tcp.connect(u.Host, sintf, timeouts)
 		case "socks":
-			a.core.tcp.connectSOCKS(u.Host, u.Path[1:])
+			a.core.tcp.connectSOCKS(u.Host, u.Path[1:], timeouts)
+		case "unix":
+			if sintf != "" {
+				return errors.New("unix sockets can't be used with an interface: " + addr)
+			}
+			if u.Path == "" {
+				return errors.New("invalid peer: " + addr)
+			}
+			a.core.tcp.connectUnix(u.Path, timeouts)
+		case "proxy":
+			a.core.tcp.connectProxies(u.Host, timeouts)
+		case "mem":
+			return a.core.tcp.connectMem(u.Host, args, timeouts)
+		case "stdio", "pipe":
+			if sintf != "" {
+				return errors.New("stdio links can't be used with an interface: " + addr)
+			}
+			return a.core.tcp.connectStdio(u, timeouts)
 		default:
 			return errors.New("invalid peer: " + addr)
 		}
@@ -417,7 +884,7 @@ func (a *admin) addPeer(addr string, sintf string) error {
 		if strings.HasPrefix(addr, "tcp:") {
 			addr = addr[4:]
 		}
-		a.core.tcp.connect(addr, "")
+		a.core.tcp.connect(addr, "", nil)
 		return nil
 	}
 	return nil
@@ -433,33 +900,22 @@ func (a *admin) removePeer(p string) error {
 	return nil
 }
 
+// setLinkImpairment adds artificial latency, jitter and loss to traffic sent to the peer on the given port.
+func (a *admin) setLinkImpairment(p string, latency time.Duration, jitter time.Duration, loss float64) error {
+	iport, err := strconv.Atoi(p)
+	if err != nil {
+		return err
+	}
+	peer, isIn := a.core.peers.getPorts()[switchPort(iport)]
+	if !isIn || iport == 0 {
+		return errors.New("No peer on port " + p)
+	}
+	return peer.setImpairment(latency, jitter, loss)
+}
+
 // startTunWithMTU creates the tun/tap device, sets its address, and sets the MTU to the provided value.
 func (a *admin) startTunWithMTU(ifname string, iftapmode bool, ifmtu int) error {
-	// Close the TUN first if open
-	_ = a.core.tun.close()
-	// Then reconfigure and start it
-	addr := a.core.router.addr
-	straddr := fmt.Sprintf("%s/%v", net.IP(addr[:]).String(), 8*len(address_prefix)-1)
-	if ifname != "none" {
-		err := a.core.tun.setup(ifname, iftapmode, straddr, ifmtu)
-		if err != nil {
-			return err
-		}
-		// If we have open sessions then we need to notify them
-		// that our MTU has now changed
-		for _, sinfo := range a.core.sessions.sinfos {
-			if ifname == "none" {
-				sinfo.myMTU = 0
-			} else {
-				sinfo.myMTU = uint16(ifmtu)
-			}
-			a.core.sessions.sendPingPong(sinfo, false)
-		}
-		// Aaaaand... go!
-		go a.core.tun.read()
-	}
-	go a.core.tun.write()
-	return nil
+	return a.core.ReconfigureTUN(ifname, iftapmode, ifmtu)
 }
 
 // getData_getSelf returns the self node's info for admin responses.
@@ -470,10 +926,126 @@ func (a *admin) getData_getSelf() *admin_nodeInfo {
 		{"ip", a.core.GetAddress().String()},
 		{"subnet", a.core.GetSubnet().String()},
 		{"coords", fmt.Sprint(coords)},
+		{"rejected_dht_requests", a.core.router.dhtLimit.getRejected()},
+		{"rejected_nodeinfo_requests", a.core.router.nodeinfoLimit.getRejected()},
+	}
+	self = append(self, admin_nodeInfo{
+		{"uptime", int(time.Since(a.core.startTime).Seconds())},
+		{"build_name", admin_orUnknown(buildName)},
+		{"build_version", admin_orUnknown(buildVersion)},
+		{"coords_changed", a.getData_getCoordsChanged()},
+		{"listeners", a.getData_getListeners()},
+		{"multicast", a.getData_getMulticast()},
+	}...)
+	if addrs := a.core.anycast.getAddresses(); len(addrs) > 0 {
+		var anycast []string
+		for _, addr := range addrs {
+			anycast = append(anycast, net.IP(addr[:]).String())
+		}
+		self = append(self, admin_pair{"anycast", anycast})
+	}
+	if a.core.storeFwd.enabled {
+		var stored admin_info
+		a.core.router.doAdmin(func() {
+			destinations, held, dropped := a.core.storeFwd.getStats()
+			stored = admin_info{"destinations": destinations, "held": held, "dropped": dropped}
+		})
+		self = append(self, admin_pair{"store_and_forward", stored})
 	}
 	return &self
 }
 
+// getData_getHealth returns whether the node is connected to the network for an admin response.
+// The node is healthy if it has at least one peer, it has coords (or is the root, whose coords are empty), and its TUN/TAP adapter is up or disabled.
+func (a *admin) getData_getHealth() *admin_nodeInfo {
+	var problems []string
+	ports := a.core.peers.ports.Load().(map[switchPort]*peer)
+	peers := 0
+	for port := range ports {
+		if port != 0 {
+			peers++
+		}
+	}
+	if peers == 0 {
+		problems = append(problems, "no peers are connected")
+	}
+	table := a.core.switchTable.table.Load().(lookupTable)
+	coords := table.self.getCoords()
+	if len(coords) == 0 && table.self.root != a.core.sigPub {
+		problems = append(problems, "no coords have been assigned")
+	}
+	tun := "disabled"
+	if state := a.core.tun.getState(); state.iface != nil {
+		name := state.name()
+		if ifce, err := net.InterfaceByName(name); err != nil || ifce.Flags&net.FlagUp == 0 {
+			tun = "down"
+			problems = append(problems, "TUN/TAP adapter "+name+" is down")
+		} else {
+			tun = "up"
+		}
+	}
+	health := admin_nodeInfo{
+		{"alive", true},
+		{"healthy", len(problems) == 0},
+		{"peers", peers},
+		{"coords", fmt.Sprint(coords)},
+		{"tun", tun},
+	}
+	if len(problems) > 0 {
+		health = append(health, admin_pair{"problems", problems})
+	}
+	return &health
+}
+
+// admin_orUnknown returns the string, or "unknown" if it's empty, i.e. for build info that wasn't set at build time.
+func admin_orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// getData_getCoordsChanged returns how many seconds ago our coords last changed, or nil if they haven't changed since we started.
+func (a *admin) getData_getCoordsChanged() interface{} {
+	history := a.core.switchTable.getHistory()
+	for idx := len(history) - 1; idx >= 0; idx-- {
+		h := history[idx]
+		if h.oldRoot != h.newRoot || !bytes.Equal(h.oldCoords, h.newCoords) {
+			return int(time.Since(h.time).Seconds())
+		}
+	}
+	return nil
+}
+
+// getData_getListeners returns the addresses that we're accepting peer connections on, and their peering policies.
+func (a *admin) getData_getListeners() []map[string]interface{} {
+	var listeners []map[string]interface{}
+	for _, l := range a.core.tcp.getListeners() {
+		address := l.addr
+		if l.serv != nil {
+			address = l.serv.Addr().String()
+		}
+		listeners = append(listeners, map[string]interface{}{
+			"address": address,
+			"policy":  l.policy,
+			"bound":   l.serv != nil,
+		})
+	}
+	return listeners
+}
+
+// getData_getMulticast returns whether multicast peer discovery is enabled, and which interfaces it's running on.
+func (a *admin) getData_getMulticast() map[string]interface{} {
+	var intfs []string
+	for _, v := range a.core.multicast.interfaces() {
+		intfs = append(intfs, v.Name)
+	}
+	return map[string]interface{}{
+		"enabled":    len(a.core.ifceExpr) > 0,
+		"interfaces": intfs,
+	}
+}
+
 // getData_getPeers returns info from Core.peers for an admin response.
 func (a *admin) getData_getPeers() []admin_nodeInfo {
 	ports := a.core.peers.ports.Load().(map[switchPort]*peer)
@@ -486,12 +1058,46 @@ func (a *admin) getData_getPeers() []admin_nodeInfo {
 	for _, port := range ps {
 		p := ports[port]
 		addr := *address_addrForNodeID(getNodeID(&p.box))
+		var loss interface{} // Left as nil if the loss isn't known
+		if l, ok := p.getLoss(); ok {
+			loss = math.Round(l*100) / 100
+		}
+		var throughput interface{} // Left as nil if the throughput isn't known
+		if tp := p.getThroughput(); tp != 0 {
+			throughput = math.Round(tp)
+		}
+		var pathMTU interface{} // Left as nil if the path MTU isn't known
+		if p.getPathMTU != nil {
+			if mtu, ok := p.getPathMTU(); ok {
+				pathMTU = mtu
+			}
+		}
+		var rtt, rttVar interface{} // Left as nil if the round trip time isn't known
+		if r, v, ok := p.getRTT(); ok {
+			rtt = math.Round(float64(r)/float64(time.Millisecond)*100) / 100
+			rttVar = math.Round(float64(v)/float64(time.Millisecond)*100) / 100
+		}
+		score, suppressed := p.getScore()
+		var flaps uint64
+		if p.flaps != nil {
+			_, _, flaps = p.flaps.get()
+		}
 		info := admin_nodeInfo{
 			{"ip", net.IP(addr[:]).String()},
 			{"port", port},
 			{"uptime", int(time.Since(p.firstSeen).Seconds())},
 			{"bytes_sent", atomic.LoadUint64(&p.bytesSent)},
 			{"bytes_recvd", atomic.LoadUint64(&p.bytesRecvd)},
+			{"loss_percent", loss},
+			{"throughput_bps", throughput},
+			{"version", fmt.Sprintf("%d.%d", version_getBaseMetadata().ver, p.version)},
+			{"endpoint", p.endpoint},
+			{"path_mtu", pathMTU},
+			{"rtt_ms", rtt},
+			{"rtt_var_ms", rttVar},
+			{"quality", math.Round(score)},
+			{"flaps", flaps},
+			{"flap_suppressed", suppressed},
 		}
 		peerInfos = append(peerInfos, info)
 	}
@@ -529,15 +1135,25 @@ func (a *admin) getData_getSwitchQueues() admin_nodeInfo {
 	getSwitchQueues := func() {
 		queues := make([]map[string]interface{}, 0)
 		for k, v := range switchTable.queues.bufs {
-			nexthop := switchTable.bestPortForCoords([]byte(k))
+			nexthop := switchTable.bestPortForCoords(switch_getPacketCoords(v.packets[0].bytes))
 			queue := map[string]interface{}{
 				"queue_id":      k,
 				"queue_size":    v.size,
 				"queue_packets": len(v.packets),
 				"queue_port":    nexthop,
+				"queue_class":   switch_classNames[v.class],
 			}
 			queues = append(queues, queue)
 		}
+		classes := make(map[string]interface{})
+		for class, stats := range switchTable.queues.stats {
+			classes[switch_classNames[class]] = map[string]interface{}{
+				"sent_packets":    stats.sentPackets,
+				"sent_bytes":      stats.sentBytes,
+				"dropped_packets": stats.droppedPackets,
+				"dropped_bytes":   stats.droppedBytes,
+			}
+		}
 		peerInfos = admin_nodeInfo{
 			{"queues", queues},
 			{"queues_count", len(switchTable.queues.bufs)},
@@ -545,12 +1161,45 @@ func (a *admin) getData_getSwitchQueues() admin_nodeInfo {
 			{"highest_queues_count", switchTable.queues.maxbufs},
 			{"highest_queues_size", switchTable.queues.maxsize},
 			{"maximum_queues_size", switch_buffer_maxSize},
+			{"classes", classes},
 		}
 	}
 	a.core.switchTable.doAdmin(getSwitchQueues)
 	return peerInfos
 }
 
+// getData_getSwitchFlows returns how the active traffic flows are distributed over the next hops, by port, for an admin response.
+func (a *admin) getData_getSwitchFlows() map[string]interface{} {
+	ports := make(map[string]interface{})
+	getSwitchFlows := func() {
+		type portFlows struct{ flows, packets, bytes uint64 }
+		now := time.Now()
+		counts := make(map[switchPort]*portFlows)
+		for _, flow := range a.core.switchTable.flows {
+			if flow.port == 0 || now.Sub(flow.last) > switch_flowTimeout {
+				continue
+			}
+			count, isIn := counts[flow.port]
+			if !isIn {
+				count = &portFlows{}
+				counts[flow.port] = count
+			}
+			count.flows++
+			count.packets += flow.packets
+			count.bytes += flow.bytes
+		}
+		for port, count := range counts {
+			ports[fmt.Sprint(port)] = map[string]interface{}{
+				"flows":   count.flows,
+				"packets": count.packets,
+				"bytes":   count.bytes,
+			}
+		}
+	}
+	a.core.switchTable.doAdmin(getSwitchFlows)
+	return ports
+}
+
 // getData_getDHT returns info from Core.dht for an admin response.
 func (a *admin) getData_getDHT() []admin_nodeInfo {
 	var infos []admin_nodeInfo
@@ -579,19 +1228,160 @@ func (a *admin) getData_getDHT() []admin_nodeInfo {
 	return infos
 }
 
+// getData_crawl crawls the network outwards from our DHT and returns the discovered nodes for an admin response.
+// This can take a while, as crawls are rate-limited.
+func (a *admin) getData_crawl(maxNodes int) (admin_info, error) {
+	nodes, err := a.core.crawler.crawl(maxNodes)
+	if err != nil {
+		return nil, err
+	}
+	ipForKey := func(key *boxPubKey) string {
+		addr := *address_addrForNodeID(getNodeID(key))
+		return net.IP(addr[:]).String()
+	}
+	infos := make(admin_info)
+	for key, node := range nodes {
+		var links []string
+		for link := range node.links {
+			links = append(links, ipForKey(&link))
+		}
+		sort.Strings(links)
+		infos[ipForKey(&key)] = admin_info{
+			"box_pub_key": hex.EncodeToString(key[:]),
+			"coords":      fmt.Sprint(node.coords),
+			"responded":   node.responded,
+			"links":       links,
+		}
+	}
+	return infos, nil
+}
+
+// getData_getClosestNodes returns the nodes in our DHT that are closest in keyspace to the given key for an admin response, closest first.
+// The key is either a full encryption public key, or a full or partial NodeID in hex, where a partial NodeID is treated as a prefix.
+func (a *admin) getData_getClosestNodes(key string) ([]admin_nodeInfo, error) {
+	bs, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	var dest NodeID
+	switch {
+	case len(bs) == boxPubKeyLen:
+		var box boxPubKey
+		copy(box[:], bs)
+		dest = *getNodeID(&box)
+	case len(bs) > 0 && len(bs) <= NodeIDLen:
+		copy(dest[:], bs)
+	default:
+		return nil, errors.New("key must be an encryption public key or a NodeID prefix")
+	}
+	var infos []admin_nodeInfo
+	now := time.Now()
+	getClosest := func() {
+		for _, v := range a.core.dht.lookup(&dest, true) {
+			addr := *address_addrForNodeID(v.getNodeID())
+			info := admin_nodeInfo{
+				{"ip", net.IP(addr[:]).String()},
+				{"box_pub_key", hex.EncodeToString(v.key[:])},
+				{"node_id", hex.EncodeToString(v.getNodeID()[:])},
+				{"coords", fmt.Sprint(v.coords)},
+				{"last_seen", int(now.Sub(v.recv).Seconds())},
+			}
+			infos = append(infos, info)
+		}
+	}
+	a.core.router.doAdmin(getClosest)
+	return infos, nil
+}
+
+// Filters for getSessions, where zero values match every session.
+type admin_sessionFilter struct {
+	key      string        // Prefix of the remote node's encryption public key, in lower case hex
+	address  *net.IPNet    // Prefix containing the remote node's address or subnet
+	minBytes uint64        // Minimum number of bytes sent and received
+	active   time.Duration // Maximum time since we last heard from the remote node
+}
+
+// admin_parseSessionFilter parses the optional getSessions arguments into a filter.
+// The address may be an address or a prefix in CIDR notation, and active is in seconds.
+func admin_parseSessionFilter(in admin_info) (*admin_sessionFilter, error) {
+	var filter admin_sessionFilter
+	if v, ok := in["key"]; ok {
+		filter.key = strings.ToLower(fmt.Sprint(v))
+		if _, err := hex.DecodeString(filter.key + strings.Repeat("0", len(filter.key)%2)); err != nil {
+			return nil, errors.New("Invalid key")
+		}
+	}
+	if v, ok := in["address"]; ok {
+		addr := fmt.Sprint(v)
+		if !strings.Contains(addr, "/") {
+			addr += "/128"
+		}
+		_, prefix, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, errors.New("Invalid address")
+		}
+		filter.address = prefix
+	}
+	if v, ok := in["min_bytes"]; ok {
+		bytes, err := strconv.ParseUint(fmt.Sprint(v), 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid min_bytes")
+		}
+		filter.minBytes = bytes
+	}
+	if v, ok := in["active"]; ok {
+		seconds, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+		if err != nil || seconds <= 0 {
+			return nil, errors.New("Invalid active")
+		}
+		filter.active = time.Duration(seconds * float64(time.Second))
+	}
+	return &filter, nil
+}
+
+// Checks if a session matches the filter.
+func (f *admin_sessionFilter) matches(sinfo *sessionInfo) bool {
+	switch {
+	case f == nil:
+		return true
+	case !strings.HasPrefix(hex.EncodeToString(sinfo.theirPermPub[:]), f.key):
+		return false
+	case f.address != nil && !f.address.Contains(sinfo.theirAddr[:]) && !f.address.Contains(net.IP(append(sinfo.theirSubnet[:], make([]byte, 8)...))):
+		return false
+	case sinfo.bytesSent+sinfo.bytesRecvd < f.minBytes:
+		return false
+	case f.active > 0 && time.Since(sinfo.time) > f.active:
+		return false
+	}
+	return true
+}
+
 // getData_getSessions returns info from Core.sessions for an admin response.
-func (a *admin) getData_getSessions() []admin_nodeInfo {
+// If a filter is given then only the sessions that match it are returned.
+func (a *admin) getData_getSessions(filter *admin_sessionFilter) []admin_nodeInfo {
 	var infos []admin_nodeInfo
 	getSessions := func() {
 		for _, sinfo := range a.core.sessions.sinfos {
+			if !filter.matches(sinfo) {
+				continue
+			}
 			// TODO? skipped known but timed out sessions?
 			info := admin_nodeInfo{
 				{"ip", net.IP(sinfo.theirAddr[:]).String()},
 				{"coords", fmt.Sprint(sinfo.coords)},
 				{"mtu", sinfo.getMTU()},
 				{"was_mtu_fixed", sinfo.wasMTUFixed},
+				{"path_mtu_probed", sinfo.pathMTU != 0},
 				{"bytes_sent", sinfo.bytesSent},
 				{"bytes_recvd", sinfo.bytesRecvd},
+				{"ce_sent", sinfo.ceSent},
+				{"ce_recvd", sinfo.ceRecvd},
+				{"padded", sinfo.isPadded()},
+				{"unordered", sinfo.isUnordered()},
+				{"paced_drops", sinfo.heldDropped},
+			}
+			if sinfo.congestion != nil && sinfo.theirFeedback {
+				info = append(info, admin_pair{"congestion", sinfo.congestion.Info()})
 			}
 			infos = append(infos, info)
 		}
@@ -600,6 +1390,346 @@ func (a *admin) getData_getSessions() []admin_nodeInfo {
 	return infos
 }
 
+// The most NodeInfo requests that getPeersNodeInfo waits for at once.
+const admin_peersNodeInfoParallel = 16
+
+// getData_getPeersNodeInfo gets the NodeInfo of our peers in parallel, and if hops is 2, of the nodes one hop further out.
+// Those are the nodes in our DHT that are a peer's parent or child in the spanning tree, as we can't see a peer's other peerings from here.
+func (a *admin) getData_getPeersNodeInfo(hops int, nocache bool) []admin_nodeInfo {
+	type target struct {
+		key    boxPubKey
+		coords []byte
+		hops   int
+		via    boxPubKey // The peer that a node one hop further out was found through
+	}
+	var targets []target
+	a.core.router.doAdmin(func() {
+		seen := map[boxPubKey]bool{a.core.boxPub: true}
+		table := a.core.switchTable.table.Load().(lookupTable)
+		peers := a.core.peers.ports.Load().(map[switchPort]*peer)
+		for _, elem := range table.elems {
+			if p, isIn := peers[elem.port]; isIn && !seen[p.box] {
+				seen[p.box] = true
+				targets = append(targets, target{key: p.box, coords: elem.locator.getCoords(), hops: 1})
+			}
+		}
+		if hops < 2 {
+			return
+		}
+		// Coords differ by one hop if one is the other with one more port on the end
+		isNeighbour := func(x, y []byte) bool {
+			return len(x) == len(y)+1 && bytes.HasPrefix(x, y) || len(y) == len(x)+1 && bytes.HasPrefix(y, x)
+		}
+		for bidx := 0; bidx < a.core.dht.nBuckets(); bidx++ {
+			b := a.core.dht.getBucket(bidx)
+			for _, info := range append(append([]*dhtInfo(nil), b.peers...), b.other...) {
+				if seen[info.key] {
+					continue
+				}
+				for _, t := range targets {
+					if t.hops == 1 && isNeighbour(info.coords, t.coords) {
+						seen[info.key] = true
+						targets = append(targets, target{key: info.key, coords: info.coords, hops: 2, via: t.key})
+						break
+					}
+				}
+			}
+		}
+	})
+	infos := make([]admin_nodeInfo, len(targets))
+	limit := make(chan struct{}, admin_peersNodeInfoParallel)
+	var wg sync.WaitGroup
+	for idx, t := range targets {
+		addr := *address_addrForNodeID(getNodeID(&t.key))
+		info := admin_nodeInfo{
+			{"ip", net.IP(addr[:]).String()},
+			{"box_pub_key", hex.EncodeToString(t.key[:])},
+			{"coords", fmt.Sprint(t.coords)},
+			{"hops", t.hops},
+		}
+		if t.hops > 1 {
+			via := *address_addrForNodeID(getNodeID(&t.via))
+			info = append(info, admin_pair{"via", net.IP(via[:]).String()})
+		}
+		wg.Add(1)
+		go func(idx int, t target, info admin_nodeInfo) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			result, cached, err := a.admin_getNodeInfo(hex.EncodeToString(t.key[:]), fmt.Sprint(t.coords), nocache)
+			var m map[string]interface{}
+			if err == nil {
+				err = json.Unmarshal(result, &m)
+			}
+			if err != nil {
+				info = append(info, admin_pair{"error", err.Error()})
+			} else {
+				info = append(info, admin_pair{"nodeinfo", m}, admin_pair{"cached", cached})
+			}
+			infos[idx] = info
+		}(idx, t, info)
+	}
+	wg.Wait()
+	return infos
+}
+
+// admin_getNodeInfo gets the NodeInfo of the node with the given key, either from the cache or by sending a request to it.
+// If no coords are given then the coords from an existing session or our DHT are used, if there are any.
+// The returned bool is true if the result came from the cache.
+func (a *admin) admin_getNodeInfo(keyString, coordString string, nocache bool) (nodeinfoPayload, bool, error) {
+	var key boxPubKey
+	if keyBytes, err := hex.DecodeString(keyString); err != nil {
+		return nodeinfoPayload{}, false, err
+	} else if len(keyBytes) != boxPubKeyLen {
+		return nodeinfoPayload{}, false, errors.New("Invalid key length")
+	} else {
+		copy(key[:], keyBytes)
+	}
+	if !nocache {
+		if response, err := a.core.nodeinfo.getCachedNodeInfo(key); err == nil {
+			return response, true, nil
+		}
+	}
+	var coords []byte
+	for _, cstr := range strings.Split(strings.Trim(coordString, "[]"), " ") {
+		if cstr == "" {
+			continue
+		}
+		u64, err := strconv.ParseUint(cstr, 10, 8)
+		if err != nil {
+			return nodeinfoPayload{}, false, err
+		}
+		coords = append(coords, uint8(u64))
+	}
+	response := make(chan *nodeinfoPayload, 1)
+	var known bool
+	sendNodeInfoRequest := func() {
+		if coords == nil {
+			if sinfo, isIn := a.core.sessions.getByTheirPerm(&key); isIn {
+				coords = sinfo.coords
+			}
+		}
+		if coords == nil {
+			for _, info := range a.core.dht.lookup(getNodeID(&key), true) {
+				if info.key == key {
+					coords = info.coords
+					break
+				}
+			}
+		}
+		if coords == nil {
+			return
+		}
+		known = true
+		a.core.nodeinfo.addCallback(key, func(nodeinfo *nodeinfoPayload) {
+			select {
+			case response <- nodeinfo:
+			default:
+			}
+		})
+		a.core.nodeinfo.sendNodeInfo(key, coords, false)
+	}
+	a.core.router.doAdmin(sendNodeInfoRequest)
+	if !known {
+		return nodeinfoPayload{}, false, errors.New("coords for " + keyString + " are not known, please specify them")
+	}
+	select {
+	case res := <-response:
+		return *res, false, nil
+	case <-time.After(6 * time.Second):
+		return nodeinfoPayload{}, false, errors.New("getNodeInfo timeout: " + keyString)
+	}
+}
+
+// getData_bench runs a bandwidth test against the node with the given key and returns the result for an admin response.
+// If no coords are given then the coords from an existing session or our DHT are used, if there are any.
+func (a *admin) getData_bench(keyString, coordString string, duration time.Duration, size int) (admin_nodeInfo, error) {
+	var key boxPubKey
+	if keyBytes, err := hex.DecodeString(keyString); err != nil {
+		return admin_nodeInfo{}, err
+	} else if len(keyBytes) != boxPubKeyLen {
+		return admin_nodeInfo{}, errors.New("Invalid key length")
+	} else {
+		copy(key[:], keyBytes)
+	}
+	var coords []byte
+	for _, cstr := range strings.Split(strings.Trim(coordString, "[]"), " ") {
+		if cstr == "" {
+			continue
+		}
+		u64, err := strconv.ParseUint(cstr, 10, 8)
+		if err != nil {
+			return admin_nodeInfo{}, err
+		}
+		coords = append(coords, uint8(u64))
+	}
+	if coords == nil {
+		a.core.router.doAdmin(func() {
+			if sinfo, isIn := a.core.sessions.getByTheirPerm(&key); isIn {
+				coords = sinfo.coords
+				return
+			}
+			for _, info := range a.core.dht.lookup(getNodeID(&key), true) {
+				if info.key == key {
+					coords = info.coords
+					return
+				}
+			}
+		})
+	}
+	if coords == nil {
+		return admin_nodeInfo{}, errors.New("coords for " + keyString + " are not known, please specify them")
+	}
+	result, err := a.core.bench.run(key, coords, duration, size)
+	if err != nil {
+		return admin_nodeInfo{}, err
+	}
+	return admin_nodeInfo{
+		{"duration", result.duration.Seconds()},
+		{"sent_packets", result.sent},
+		{"recvd_packets", result.recvd},
+		{"recvd_bytes", result.bytes},
+		{"throughput_bps", uint64(result.getThroughput())},
+		{"loss_percent", result.getLoss()},
+	}, nil
+}
+
+// getData_getCoordsHistory returns the recent changes to our own coords from Core.switchTable for an admin response, oldest first.
+// Parents are given by their IPv6 address, and left out if there was no parent because we were the root.
+func (a *admin) getData_getCoordsHistory() []admin_nodeInfo {
+	var infos []admin_nodeInfo
+	for _, h := range a.core.switchTable.getHistory() {
+		info := admin_nodeInfo{
+			{"reason", h.reason},
+			{"time", h.time.Format(time.RFC3339)},
+			{"age", time.Since(h.time).Seconds()},
+			{"old_coords", fmt.Sprint(h.oldCoords)},
+			{"new_coords", fmt.Sprint(h.newCoords)},
+			{"root_changed", h.oldRoot != h.newRoot},
+		}
+		if h.oldParent != nil {
+			addr := *address_addrForNodeID(getNodeID(h.oldParent))
+			info = append(info, admin_pair{"old_parent", net.IP(addr[:]).String()})
+		}
+		if h.newParent != nil {
+			addr := *address_addrForNodeID(getNodeID(h.newParent))
+			info = append(info, admin_pair{"new_parent", net.IP(addr[:]).String()})
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// getData_getTapNeighbors returns the static neighbors and those seen on the TAP adapter for an admin response.
+// Times are given in seconds ago, and left as nil if they've never happened.
+func (a *admin) getData_getTapNeighbors() []admin_nodeInfo {
+	var infos []admin_nodeInfo
+	for addr, mac := range a.core.tun.icmpv6.getStaticNeighbors() {
+		infos = append(infos, admin_nodeInfo{
+			{"address", net.IP(addr[:]).String()},
+			{"mac", net.HardwareAddr(mac[:]).String()},
+			{"static", true},
+		})
+	}
+	for addr, n := range a.core.tun.icmpv6.getNeighbors() {
+		var lastSolicitation interface{}
+		if !n.lastsolicitation.IsZero() {
+			lastSolicitation = time.Since(n.lastsolicitation).Seconds()
+		}
+		infos = append(infos, admin_nodeInfo{
+			{"address", net.IP(addr[:]).String()},
+			{"mac", net.HardwareAddr(n.mac[:]).String()},
+			{"static", false},
+			{"learned", n.learned},
+			{"last_solicitation", lastSolicitation},
+			{"last_seen", time.Since(n.lastseen).Seconds()},
+		})
+	}
+	return infos
+}
+
+// getData_getMulticastGroups returns the multicast groups that we or remote nodes have joined, from Core.mcastFwd, for an admin response.
+// Remote members are given by their IPv6 address.
+func (a *admin) getData_getMulticastGroups() []admin_nodeInfo {
+	var infos []admin_nodeInfo
+	getGroups := func() {
+		joined, remote := a.core.mcastFwd.getGroups()
+		groups := make(map[address]bool)
+		for _, group := range joined {
+			groups[group] = true
+		}
+		for group := range remote {
+			if _, isIn := groups[group]; !isIn {
+				groups[group] = false
+			}
+		}
+		for group, isJoined := range groups {
+			var members []string
+			for _, key := range remote[group] {
+				addr := *address_addrForNodeID(getNodeID(&key))
+				members = append(members, net.IP(addr[:]).String())
+			}
+			infos = append(infos, admin_nodeInfo{
+				{"group", net.IP(group[:]).String()},
+				{"joined", isJoined},
+				{"members", members},
+			})
+		}
+	}
+	a.core.router.doAdmin(getGroups)
+	return infos
+}
+
+// getData_getSessionFirewall returns the session firewall rules in effect for an admin response.
+func (a *admin) getData_getSessionFirewall() admin_info {
+	var info admin_info
+	getFirewall := func() {
+		ss := &a.core.sessions
+		info = admin_info{
+			"enable":                ss.sessionFirewallEnabled,
+			"allow_from_direct":     ss.sessionFirewallAllowsDirect,
+			"allow_from_remote":     ss.sessionFirewallAllowsRemote,
+			"always_allow_outbound": ss.sessionFirewallAlwaysAllowsOutbound,
+			"deny_inbound":          ss.sessionFirewallDeniesInbound,
+			"whitelist_box_pubs":    append([]string{}, ss.sessionFirewallWhitelist...),
+			"blacklist_box_pubs":    append([]string{}, ss.sessionFirewallBlacklist...),
+			"whitelist_prefixes":    admin_prefixStrings(ss.sessionFirewallWhitelistPrefixes),
+			"blacklist_prefixes":    admin_prefixStrings(ss.sessionFirewallBlacklistPrefixes),
+		}
+	}
+	a.core.router.doAdmin(getFirewall)
+	return info
+}
+
+// Formats prefixes in CIDR notation for an admin response.
+func admin_prefixStrings(prefixes []*net.IPNet) []string {
+	strs := []string{}
+	for _, prefix := range prefixes {
+		strs = append(strs, prefix.String())
+	}
+	return strs
+}
+
+// getData_getCollisions returns info about recent key collisions with other nodes for an admin response.
+func (a *admin) getData_getCollisions() []admin_nodeInfo {
+	var infos []admin_nodeInfo
+	for _, c := range a.core.collisions.getEvents() {
+		info := admin_nodeInfo{
+			{"type", c.kind},
+			{"time", c.time.Format(time.RFC3339)},
+			{"age", time.Since(c.time).Seconds()},
+		}
+		if c.coords != nil {
+			info = append(info, admin_pair{"coords", fmt.Sprint(c.coords)})
+		}
+		if c.remote != "" {
+			info = append(info, admin_pair{"remote", c.remote})
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
 // getAllowedEncryptionPublicKeys returns the public keys permitted for incoming peer connections.
 func (a *admin) getAllowedEncryptionPublicKeys() []string {
 	pubs := a.core.peers.getAllowedEncryptionPublicKeys()
@@ -633,6 +1763,26 @@ func (a *admin) removeAllowedEncryptionPublicKey(bstr string) (err error) {
 	return
 }
 
+// setAllowedEncryptionPublicKeys replaces the whitelist for incoming peer connections.
+// The keys are all checked before any changes are made, so an invalid key leaves the whitelist untouched.
+func (a *admin) setAllowedEncryptionPublicKeys(bstrs []string) error {
+	boxes := make([]boxPubKey, 0, len(bstrs))
+	for _, bstr := range bstrs {
+		boxBytes, err := hex.DecodeString(bstr)
+		if err != nil {
+			return err
+		}
+		if len(boxBytes) != boxPubKeyLen {
+			return errors.New("invalid key length: " + bstr)
+		}
+		var box boxPubKey
+		copy(box[:], boxBytes)
+		boxes = append(boxes, box)
+	}
+	a.core.peers.setAllowedEncryptionPublicKeys(boxes)
+	return nil
+}
+
 // getResponse_dot returns a response for a graphviz dot formatted representation of the known parts of the network.
 // This is color-coded and labeled, and includes the self node, switch peers, nodes known to the DHT, and nodes with open sessions.
 // The graph is structured as a tree with directed links leading away from the root.
@@ -640,7 +1790,7 @@ func (a *admin) getResponse_dot() []byte {
 	self := a.getData_getSelf()
 	peers := a.getData_getSwitchPeers()
 	dht := a.getData_getDHT()
-	sessions := a.getData_getSessions()
+	sessions := a.getData_getSessions(nil)
 	// Start building a tree from all known nodes
 	type nodeInfo struct {
 		name    string
@@ -758,3 +1908,116 @@ func (a *admin) getResponse_dot() []byte {
 	put("}\n")
 	return out
 }
+
+// getData_getTopology returns the locally-known parts of the network as a list of nodes and a list of edges.
+// Nodes are identified by their coords, and are tagged with the reasons they are known, or "unknown" if they are only known to exist from the coords of other nodes.
+// Edges are either "tree" edges, from a parent to a child in the switch tree, or "peer" edges, from this node to each of its switch peers.
+func (a *admin) getData_getTopology() ([]admin_info, []admin_info) {
+	type topoNode struct {
+		ip   string
+		tags []string
+	}
+	nodes := make(map[string]*topoNode)
+	addNode := func(coords string, ip string, tag string) {
+		n, isIn := nodes[coords]
+		if !isIn {
+			n = &topoNode{}
+			nodes[coords] = n
+		}
+		if ip != "" {
+			n.ip = ip
+		}
+		n.tags = append(n.tags, tag)
+	}
+	addNodes := func(infos []admin_nodeInfo, tag string) {
+		for _, info := range infos {
+			n := info.asMap()
+			addNode(n["coords"].(string), n["ip"].(string), tag)
+		}
+	}
+	self := a.getData_getSelf().asMap()
+	selfCoords := self["coords"].(string)
+	peers := a.getData_getSwitchPeers()
+	addNodes(a.getData_getDHT(), "dht")
+	addNodes(a.getData_getSessions(nil), "session")
+	addNodes(peers, "peer")
+	addNode(selfCoords, self["ip"].(string), "self")
+	// Coords are printed as e.g. "[1 2 3]", so split them back up into ports
+	coordSlice := func(coords string) []string {
+		return strings.Fields(strings.Trim(coords, "[]"))
+	}
+	// Add placeholders for any ancestors we don't otherwise know about
+	for coords := range nodes {
+		ports := coordSlice(coords)
+		for idx := range ports {
+			key := fmt.Sprintf("[%v]", strings.Join(ports[:idx], " "))
+			if _, isIn := nodes[key]; !isIn {
+				nodes[key] = &topoNode{tags: []string{"unknown"}}
+			}
+		}
+	}
+	var keys []string
+	for coords := range nodes {
+		keys = append(keys, coords)
+	}
+	sort.Strings(keys)
+	var nodeInfos, edgeInfos []admin_info
+	for _, coords := range keys {
+		n := nodes[coords]
+		nodeInfos = append(nodeInfos, admin_info{
+			"coords": coords,
+			"ip":     n.ip,
+			"tags":   n.tags,
+		})
+		ports := coordSlice(coords)
+		if len(ports) == 0 {
+			continue // The root has no parent
+		}
+		port, _ := strconv.ParseUint(ports[len(ports)-1], 10, 64)
+		edgeInfos = append(edgeInfos, admin_info{
+			"from": fmt.Sprintf("[%v]", strings.Join(ports[:len(ports)-1], " ")),
+			"to":   coords,
+			"port": port,
+			"type": "tree",
+		})
+	}
+	for _, peer := range peers {
+		p := peer.asMap()
+		edgeInfos = append(edgeInfos, admin_info{
+			"from": selfCoords,
+			"to":   p["coords"].(string),
+			"port": uint64(p["port"].(switchPort)),
+			"type": "peer",
+		})
+	}
+	return nodeInfos, edgeInfos
+}
+
+// getResponse_topologyDot formats the output of getData_getTopology as a graphviz dot graph.
+// Tree edges are drawn as solid lines labeled with the child's port, and peer edges as dashed lines labeled with our port for that peer.
+func (a *admin) getResponse_topologyDot(nodes []admin_info, edges []admin_info) string {
+	var out []byte
+	put := func(s string) {
+		out = append(out, []byte(s)...)
+	}
+	put("digraph {\n")
+	for _, n := range nodes {
+		tags := n["tags"].([]string)
+		label := strings.Join(append([]string{fmt.Sprint(n["ip"])}, tags...), "\\n")
+		style := "fontname=\"sans serif\""
+		if tags[0] == "unknown" {
+			label = "?"
+			style += " style=dashed color=\"#999999\" fontcolor=\"#999999\""
+		}
+		put(fmt.Sprintf("  \"%v\" [ label = \"%v\" %s ];\n", n["coords"], label, style))
+	}
+	for _, e := range edges {
+		style := "fontname=\"sans serif\""
+		if e["type"] == "peer" {
+			style += " style=dashed color=\"#3366cc\" fontcolor=\"#3366cc\""
+		}
+		put(fmt.Sprintf("  \"%v\" -> \"%v\" [ label = \"%v\" %s ];\n", e["from"], e["to"], e["port"], style))
+	}
+	put("}\n")
+	return string(out)
+}
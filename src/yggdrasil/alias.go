@@ -0,0 +1,152 @@
+package yggdrasil
+
+// This implements a registry of human-readable names for other nodes, so that
+// operators can refer to i.e. "myserver" instead of its key or 200:: address.
+// Each alias is given either the node's encryption public key, which also
+// gives its address and subnet, or just its address or subnet, which can't be
+// used where a key is needed. Admin requests that take a key or address accept
+// an alias instead, and admin output names the nodes that have one.
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type aliases struct {
+	mutex  sync.RWMutex
+	byName map[string]*aliasInfo
+}
+
+// An alias, along with what it refers to.
+type aliasInfo struct {
+	name   string
+	key    string     // Encryption public key in hex, or empty if the alias was given an address
+	addr   net.IP     // Address of the node, or nil if the alias was given a subnet
+	subnet *net.IPNet // The node's /64 subnet, or nil if the alias was given an address
+}
+
+// Initializes the aliases struct.
+func (a *aliases) init(core *Core) {
+	a.byName = make(map[string]*aliasInfo)
+}
+
+// Replaces the aliases with the given names, each mapped to an encryption public key, an address or a /64 subnet in CIDR notation.
+func (a *aliases) setAliases(names map[string]string) error {
+	byName := make(map[string]*aliasInfo)
+	for name, target := range names {
+		if name == "" || strings.ContainsAny(name, " \t=/") {
+			return errors.New("invalid alias name: " + name)
+		}
+		info := &aliasInfo{name: name}
+		if keyBytes, err := hex.DecodeString(target); err == nil && len(keyBytes) == boxPubKeyLen {
+			var box boxPubKey
+			copy(box[:], keyBytes)
+			nodeID := getNodeID(&box)
+			addr := address_addrForNodeID(nodeID)
+			snet := address_subnetForNodeID(nodeID)
+			info.key = strings.ToLower(target)
+			info.addr = net.IP(addr[:])
+			info.subnet = &net.IPNet{
+				IP:   append(net.IP(snet[:]), make(net.IP, 8)...),
+				Mask: net.CIDRMask(64, 128),
+			}
+		} else if ip := net.ParseIP(target); ip != nil {
+			var addr address
+			copy(addr[:], ip.To16())
+			if !addr.isValid() {
+				return errors.New("invalid address for alias " + name + ": " + target)
+			}
+			info.addr = ip
+		} else if _, snet, err := net.ParseCIDR(target); err == nil {
+			var s subnet
+			copy(s[:], snet.IP.To16())
+			if ones, bits := snet.Mask.Size(); ones != 64 || bits != 128 || !s.isValid() {
+				return errors.New("invalid subnet for alias " + name + ": " + target)
+			}
+			info.subnet = snet
+		} else {
+			return errors.New("invalid key, address or subnet for alias " + name + ": " + target)
+		}
+		byName[name] = info
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.byName = byName
+	return nil
+}
+
+// Returns true if any aliases are configured.
+func (a *aliases) isEmpty() bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return len(a.byName) == 0
+}
+
+// Gets the encryption public key that the alias with the given name refers to.
+// Anything that isn't the name of an alias with a key is returned unchanged, so that keys can be given as usual.
+func (a *aliases) resolveKey(s string) string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if info, isIn := a.byName[s]; isIn && info.key != "" {
+		return info.key
+	}
+	return s
+}
+
+// Gets the address that the alias with the given name refers to, or the subnet if it only has one.
+// Anything that isn't the name of an alias is returned unchanged, so that addresses can be given as usual.
+func (a *aliases) resolveAddress(s string) string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if info, isIn := a.byName[s]; isIn {
+		if info.addr != nil {
+			return info.addr.String()
+		}
+		return info.subnet.String()
+	}
+	return s
+}
+
+// Gets the name of the alias for the node with the given address, or an empty string if there isn't one.
+// An alias that was only given a subnet matches any address within it.
+func (a *aliases) getName(ip net.IP) string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	var names []string
+	for name, info := range a.byName {
+		if (info.addr != nil && info.addr.Equal(ip)) || (info.subnet != nil && info.subnet.Contains(ip)) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	// Several names for the same node are allowed, so pick one consistently
+	sort.Strings(names)
+	return names[0]
+}
+
+// Gets every alias and what it refers to, for getAliases.
+func (a *aliases) getAliases() admin_info {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	out := make(admin_info)
+	for name, info := range a.byName {
+		alias := make(admin_info)
+		if info.key != "" {
+			alias["box_pub_key"] = info.key
+		}
+		if info.addr != nil {
+			alias["ip"] = info.addr.String()
+		}
+		if info.subnet != nil {
+			alias["subnet"] = info.subnet.String()
+		}
+		out[name] = alias
+	}
+	return out
+}
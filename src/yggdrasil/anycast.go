@@ -0,0 +1,150 @@
+package yggdrasil
+
+// This lets several nodes answer for the same "anycast" address, by each
+// being configured with the same service keypair, so that i.e. DNS resolvers
+// or caches can be run in several places and reached at one address.
+// Each service is run by a second Core inside this process, which has the
+// service's encryption keys and a random signing key, and is peered with this
+// node over an in-memory link. It joins the network as a node in its own right,
+// just below this one in the tree, and so is found by searches for the service
+// address like any other node. Packets that it receives are written to our
+// TUN/TAP adapter, and packets read from the adapter with the service address
+// as their source are sent through it, so the host must also have the service
+// address assigned to the TUN/TAP adapter or a loopback interface.
+// The DHT prefers whichever instance of a service is closest to us on the
+// tree, so searches tend to find the nearest instance, and a session that
+// loses its instance searches again and finds another one.
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long to wait before relinking a service that lost its link to us.
+const anycast_relinkInterval = time.Second
+
+type anycast struct {
+	core     *Core
+	mutex    sync.Mutex
+	services map[address]*Core // Cores answering for each service address, set before the router is started
+	conns    []net.Conn
+	closed   bool
+}
+
+// Initializes the anycast struct.
+func (a *anycast) init(core *Core) {
+	a.core = core
+	a.services = make(map[address]*Core)
+}
+
+// Creates a Core to answer for the service with the given encryption keys.
+// This must be called before the router is started.
+func (a *anycast) addService(pubHex string, privHex string) error {
+	pubBytes, err := hex.DecodeString(pubHex)
+	if err != nil {
+		return err
+	}
+	privBytes, err := hex.DecodeString(privHex)
+	if err != nil {
+		return err
+	}
+	if len(pubBytes) != boxPubKeyLen || len(privBytes) != boxPrivKeyLen {
+		return errors.New("invalid key length for anycast service " + pubHex)
+	}
+	var boxPub boxPubKey
+	var boxPriv boxPrivKey
+	copy(boxPub[:], pubBytes)
+	copy(boxPriv[:], privBytes)
+	if boxPub == a.core.boxPub {
+		return errors.New("anycast service " + pubHex + " uses this node's own key")
+	}
+	addr := *address_addrForNodeID(getNodeID(&boxPub))
+	if _, isIn := a.services[addr]; isIn {
+		return errors.New("anycast service " + pubHex + " is configured more than once")
+	}
+	sigPub, sigPriv := newSigKeys()
+	service := &Core{}
+	service.log = a.core.log
+	service.init(&boxPub, &boxPriv, sigPub, sigPriv)
+	service.collisions.setSharedKeys(true)
+	if err := service.tcp.init(service, "none", 0, 0, 0, false); err != nil {
+		return err
+	}
+	a.services[addr] = service
+	return nil
+}
+
+// Starts the service Cores, links them to us, and starts passing their traffic to and from our TUN/TAP adapter.
+// This must be called after the TUN/TAP adapter is started, so that its MTU is known.
+func (a *anycast) start() error {
+	for _, service := range a.services {
+		service.tun.mtu = a.core.tun.getState().mtu
+		service.tun.publish()
+		if err := service.switchTable.start(); err != nil {
+			return err
+		}
+		if err := service.router.start(); err != nil {
+			return err
+		}
+		go a.link(service)
+		go func(service *Core) {
+			for packet := range service.tun.recv {
+				a.core.router.toTun(packet)
+			}
+		}(service)
+	}
+	return nil
+}
+
+// Keeps an in-memory link up between us and a service Core until we're closed.
+func (a *anycast) link(service *Core) {
+	for {
+		ours, theirs := memlink_pair("anycast", 0, 0)
+		a.mutex.Lock()
+		if a.closed {
+			a.mutex.Unlock()
+			return
+		}
+		a.conns = append(a.conns, ours)
+		a.mutex.Unlock()
+		go a.core.tcp.handler(ours, &tcpListener{policy: tcp_policyOpen}, nil)
+		service.tcp.handler(theirs, &tcpListener{policy: tcp_policyOpen}, nil)
+		ours.Close()
+		a.mutex.Lock()
+		for idx, conn := range a.conns {
+			if conn == ours {
+				a.conns = append(a.conns[:idx], a.conns[idx+1:]...)
+				break
+			}
+		}
+		a.mutex.Unlock()
+		time.Sleep(anycast_relinkInterval)
+	}
+}
+
+// Gets the Core answering for a service address, or nil if the address isn't one of our services.
+func (a *anycast) getService(addr *address) *Core {
+	return a.services[*addr]
+}
+
+// Gets the addresses of the services that we answer for.
+func (a *anycast) getAddresses() []address {
+	var addrs []address
+	for addr := range a.services {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// Unlinks the service Cores.
+func (a *anycast) close() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.closed = true
+	for _, conn := range a.conns {
+		conn.Close()
+	}
+}
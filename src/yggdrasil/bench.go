@@ -0,0 +1,273 @@
+package yggdrasil
+
+// This implements a simple throughput test between two nodes, similar to iperf.
+// The node running the test sends data packets to the remote node as fast as it
+// can for a fixed time, and the remote node then reports how many packets and
+// bytes it received and over what time. From that we work out the throughput
+// that the path can actually carry and how many packets were lost on the way.
+// Nodes only take part in tests run by others if they opt in, since a test will
+// use as much bandwidth as it can get.
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The default and maximum duration of a test.
+const (
+	bench_defaultDuration = 5 * time.Second
+	bench_maxDuration     = 30 * time.Second
+)
+
+// The default and maximum size of the payload of each data packet.
+const (
+	bench_defaultSize = 1024
+	bench_maxSize     = 16384
+)
+
+// The maximum number of tests that we serve at once.
+const bench_maxTests = 4
+
+// How long to wait for the remote node to answer a start or finish packet, and how often to resend a finish packet that hasn't been answered.
+const (
+	bench_timeout       = 5 * time.Second
+	bench_retryInterval = time.Second
+)
+
+// Types of bench packets.
+const (
+	bench_start  = iota // Asks the remote node to start counting data packets for a test
+	bench_accept        // Tells the node running the test that we're counting
+	bench_data          // Data, which is counted and discarded
+	bench_finish        // Asks the remote node for the result of a test
+	bench_result        // Tells the node running the test what we received
+)
+
+// Represents a bench packet, which is sent inside protocol traffic.
+type benchPacket struct {
+	SendCoords []byte // Sender's coords
+	Type       uint64 // One of the bench_ packet types
+	ID         uint64 // Identifies the test, so late packets from an old test aren't counted in a new one
+	Seq        uint64 // The sequence number of a data packet, or the number of data packets sent in a finish packet
+	Packets    uint64 // The number of data packets received, in a result packet
+	Bytes      uint64 // The number of payload bytes received, in a result packet
+	Time       uint64 // Microseconds between the first and last data packet received, in a result packet
+	Payload    []byte // Padding in data packets
+}
+
+// The state of a test that we're serving for a remote node.
+type benchServed struct {
+	id      uint64
+	first   time.Time // When we received the first data packet
+	last    time.Time // When we received the last data packet
+	seen    time.Time // When we last heard anything about the test, for cleanup
+	packets uint64
+	bytes   uint64
+}
+
+// The result of a test that we ran against a remote node.
+type benchResult struct {
+	duration time.Duration // Time spent sending
+	sent     uint64        // Data packets sent
+	recvd    uint64        // Data packets received by the remote node
+	bytes    uint64        // Payload bytes received by the remote node
+	time     time.Duration // Time between the first and last data packet received by the remote node
+}
+
+// Gets the achievable throughput in bits per second, as measured by the remote node.
+func (r *benchResult) getThroughput() float64 {
+	if r.time <= 0 {
+		return 0
+	}
+	return float64(r.bytes) * 8 / r.time.Seconds()
+}
+
+// Gets the percentage of data packets that didn't arrive at the remote node.
+func (r *benchResult) getLoss() float64 {
+	if r.sent == 0 || r.recvd >= r.sent {
+		return 0
+	}
+	return 100 * float64(r.sent-r.recvd) / float64(r.sent)
+}
+
+// A test that we're running, waiting for replies from the remote node.
+type benchWaiting struct {
+	id      uint64
+	replies chan *benchPacket
+}
+
+// The bench struct keeps track of tests we're serving for remote nodes, and of tests we're running ourselves.
+type bench struct {
+	core    *Core
+	mutex   sync.Mutex
+	enabled bool
+	served  map[boxPubKey]*benchServed
+	waiting map[boxPubKey]*benchWaiting
+}
+
+// Initializes the bench struct.
+func (b *bench) init(core *Core) {
+	b.core = core
+	b.served = make(map[boxPubKey]*benchServed)
+	b.waiting = make(map[boxPubKey]*benchWaiting)
+}
+
+// Sets whether or not we serve tests for remote nodes.
+func (b *bench) setEnabled(enabled bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.enabled = enabled
+}
+
+// Handles a bench packet from the given key.
+// Start, data and finish packets are part of tests we're serving, while accept and result packets are passed to the test we're running against that key, if any.
+// This is called from the router goroutine, so it mustn't block.
+func (b *bench) handlePacket(p *benchPacket, fromKey *boxPubKey) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	switch p.Type {
+	case bench_start:
+		if !b.enabled {
+			return
+		}
+		for key, s := range b.served {
+			if now.Sub(s.seen) > bench_maxDuration+bench_timeout {
+				delete(b.served, key)
+			}
+		}
+		if _, isIn := b.served[*fromKey]; !isIn && len(b.served) >= bench_maxTests {
+			return
+		}
+		b.served[*fromKey] = &benchServed{id: p.ID, seen: now}
+		b.send(b.core.sessions.getSharedKey(&b.core.boxPriv, fromKey), fromKey, p.SendCoords, &benchPacket{Type: bench_accept, ID: p.ID})
+	case bench_data:
+		s, isIn := b.served[*fromKey]
+		if !isIn || s.id != p.ID {
+			return
+		}
+		if s.packets == 0 {
+			s.first = now
+		}
+		s.last = now
+		s.seen = now
+		s.packets++
+		s.bytes += uint64(len(p.Payload))
+	case bench_finish:
+		s, isIn := b.served[*fromKey]
+		if !isIn || s.id != p.ID {
+			return
+		}
+		s.seen = now
+		b.send(b.core.sessions.getSharedKey(&b.core.boxPriv, fromKey), fromKey, p.SendCoords, &benchPacket{
+			Type:    bench_result,
+			ID:      p.ID,
+			Packets: s.packets,
+			Bytes:   s.bytes,
+			Time:    uint64(s.last.Sub(s.first) / time.Microsecond),
+		})
+	case bench_accept, bench_result:
+		w, isIn := b.waiting[*fromKey]
+		if !isIn || w.id != p.ID {
+			return
+		}
+		select {
+		case w.replies <- p:
+		default:
+		}
+	}
+}
+
+// Runs a test against the given key and coords, sending data packets with the given payload size for the given duration.
+// Zero values for the duration and size use the defaults.
+// This blocks until the test is finished, so it must not be called from the router goroutine.
+func (b *bench) run(key boxPubKey, coords []byte, duration time.Duration, size int) (benchResult, error) {
+	switch {
+	case duration <= 0:
+		duration = bench_defaultDuration
+	case duration > bench_maxDuration:
+		return benchResult{}, errors.New("duration is too long")
+	}
+	switch {
+	case size <= 0:
+		size = bench_defaultSize
+	case size > bench_maxSize:
+		return benchResult{}, errors.New("size is too large")
+	}
+	w := &benchWaiting{
+		id:      rand.Uint64(),
+		replies: make(chan *benchPacket, 1),
+	}
+	b.mutex.Lock()
+	if _, isIn := b.waiting[key]; isIn {
+		b.mutex.Unlock()
+		return benchResult{}, errors.New("a test to this node is already running")
+	}
+	b.waiting[key] = w
+	b.mutex.Unlock()
+	defer func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.waiting, key)
+	}()
+	// Ask the remote node to start counting
+	shared := getSharedKey(&b.core.boxPriv, &key)
+	b.send(shared, &key, coords, &benchPacket{Type: bench_start, ID: w.id})
+	select {
+	case <-w.replies:
+	case <-time.After(bench_timeout):
+		return benchResult{}, errors.New("the remote node didn't accept the test, it may not allow them")
+	}
+	// Send data as fast as we can
+	var result benchResult
+	data := benchPacket{
+		Type:    bench_data,
+		ID:      w.id,
+		Payload: make([]byte, size),
+	}
+	start := time.Now()
+	for time.Since(start) < duration {
+		data.Seq = result.sent
+		b.send(shared, &key, coords, &data)
+		result.sent++
+	}
+	result.duration = time.Since(start)
+	// Ask for the result, asking again if the remote node doesn't answer, since the finish packet may be dropped if the path is congested
+	finish := benchPacket{Type: bench_finish, ID: w.id, Seq: result.sent}
+	timeout := time.After(bench_timeout)
+	for {
+		b.send(shared, &key, coords, &finish)
+		select {
+		case res := <-w.replies:
+			if res.Type != bench_result {
+				continue
+			}
+			result.recvd = res.Packets
+			result.bytes = res.Bytes
+			result.time = time.Duration(res.Time) * time.Microsecond
+			return result, nil
+		case <-time.After(bench_retryInterval):
+		case <-timeout:
+			return result, errors.New("the remote node didn't send a result")
+		}
+	}
+}
+
+// Sends a bench packet to the given key and coords, using the given shared permanent key.
+// This doesn't need the router goroutine, as data packets are sent from the goroutine running the test.
+func (b *bench) send(shared *boxSharedKey, key *boxPubKey, coords []byte, p *benchPacket) {
+	loc := b.core.switchTable.getLocator()
+	p.SendCoords = loc.getCoords()
+	bs := p.encode()
+	payload, nonce := boxSeal(shared, bs, nil)
+	packet := wire_protoTrafficPacket{
+		Coords:  priority_markMeasurement(coords),
+		ToKey:   *key,
+		FromKey: b.core.boxPub,
+		Nonce:   *nonce,
+		Payload: payload,
+	}
+	b.core.router.out(packet.encode())
+}
@@ -0,0 +1,276 @@
+package yggdrasil
+
+// This implements packet captures, which are started and stopped with the
+// startCapture and stopCapture admin calls, for debugging problems like MTU
+// and neighbor discovery without running tcpdump on every machine involved.
+// A capture writes the packets that cross either the TUN/TAP adapter or the
+// link to one peer to a pcap file, which can be opened with Wireshark or
+// tcpdump while the capture is still running. Adapter captures contain IPv6
+// packets, or ethernet frames in TAP mode. Peer captures contain the link
+// messages as they are sent and received, which are encrypted, so they show
+// the size and timing of the traffic rather than what's in it, and are saved
+// with a user link type. Packets are written by a goroutine of their own, and
+// dropped if it can't keep up, rather than slowing down the traffic. Captures
+// stop after a while, so that a forgotten capture doesn't fill the disk.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The default time that a capture lasts for, and the default number of bytes of each packet that are saved.
+const capture_defaultDuration = time.Minute
+const capture_defaultSnapLength = 65535
+
+// The number of packets that can wait to be written to the file, and how often the file is flushed.
+const capture_queueLength = 1024
+const capture_flushInterval = time.Second
+
+// The pcap link types for raw IP packets, ethernet frames and the link messages between peers.
+const (
+	capture_linkTypeRaw      = 101
+	capture_linkTypeEthernet = 1
+	capture_linkTypeUser0    = 147
+)
+
+type packetCapture struct {
+	core     *Core
+	active   int32 // Number of captures, accessed atomically so that packets aren't slowed down when there are none
+	mutex    sync.Mutex
+	captures map[string]*capture // By file name
+}
+
+type capture struct {
+	file     string
+	tun      bool       // Whether packets crossing the TUN/TAP adapter are captured, rather than those of a peer
+	port     switchPort // The peer whose packets are captured
+	snapLen  int
+	started  time.Time
+	expires  time.Time
+	queue    chan capture_packet
+	timer    *time.Timer
+	packets  uint64 // Only used with the mutex held
+	dropped  uint64 // Packets that didn't fit in the queue
+	linkType uint32
+}
+
+type capture_packet struct {
+	time   time.Time
+	length int // The length of the packet before it was cut down to the snap length
+	data   []byte
+}
+
+// Initializes the packetCapture struct.
+func (c *packetCapture) init(core *Core) {
+	c.core = core
+	c.captures = make(map[string]*capture)
+}
+
+// Starts capturing the packets crossing the TUN/TAP adapter, or the link to the peer on the port if tun is false, to a new pcap file.
+// A zero duration or snap length uses the default.
+func (c *packetCapture) start(file string, tun bool, port switchPort, duration time.Duration, snapLen int) error {
+	if duration <= 0 {
+		duration = capture_defaultDuration
+	}
+	if snapLen <= 0 {
+		snapLen = capture_defaultSnapLength
+	}
+	var linkType uint32 = capture_linkTypeUser0
+	if tun {
+		state := c.core.tun.getState()
+		if state.iface == nil {
+			return errors.New("there is no TUN/TAP adapter")
+		}
+		linkType = capture_linkTypeRaw
+		if state.isTAP() {
+			linkType = capture_linkTypeEthernet
+		}
+	} else if c.core.peers.getPorts()[port] == nil {
+		return errors.New("no peer on that port")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, isIn := c.captures[file]; isIn {
+		return errors.New("already capturing to " + file)
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	capt := &capture{
+		file:     file,
+		tun:      tun,
+		port:     port,
+		snapLen:  snapLen,
+		started:  now,
+		expires:  now.Add(duration),
+		queue:    make(chan capture_packet, capture_queueLength),
+		linkType: linkType,
+	}
+	capt.timer = time.AfterFunc(duration, func() { c.stop(file) })
+	c.captures[file] = capt
+	atomic.StoreInt32(&c.active, int32(len(c.captures)))
+	go c.writer(f, capt)
+	if tun {
+		c.core.log.Printf("Capturing packets on the TUN/TAP adapter to %s for %s", file, duration)
+	} else {
+		c.core.log.Printf("Capturing packets on port %d to %s for %s", port, file, duration)
+	}
+	return nil
+}
+
+// Stops the capture to the file, if there is one.
+func (c *packetCapture) stop(file string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	capt, isIn := c.captures[file]
+	if !isIn {
+		return errors.New("not capturing to " + file)
+	}
+	capt.timer.Stop()
+	delete(c.captures, file)
+	atomic.StoreInt32(&c.active, int32(len(c.captures)))
+	// The writer finishes the file once it has written what's left in the queue
+	close(capt.queue)
+	c.core.log.Printf("Stopped capturing to %s after %d packets (%d dropped)",
+		file, capt.packets, atomic.LoadUint64(&capt.dropped))
+	return nil
+}
+
+// Stops all of the captures, i.e. when the node stops.
+func (c *packetCapture) close() {
+	c.mutex.Lock()
+	var files []string
+	for file := range c.captures {
+		files = append(files, file)
+	}
+	c.mutex.Unlock()
+	for _, file := range files {
+		c.stop(file)
+	}
+}
+
+// Writes the pcap header, followed by the packets from the queue until it's closed.
+func (c *packetCapture) writer(f *os.File, capt *capture) {
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	defer w.Flush()
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4) // Magic number, with microsecond timestamps
+	binary.LittleEndian.PutUint16(header[4:6], 2)          // Major version
+	binary.LittleEndian.PutUint16(header[6:8], 4)          // Minor version
+	binary.LittleEndian.PutUint32(header[16:20], uint32(capt.snapLen))
+	binary.LittleEndian.PutUint32(header[20:24], capt.linkType)
+	if _, err := w.Write(header); err != nil {
+		c.core.log.Println("Failed to write capture:", err)
+		return
+	}
+	ticker := time.NewTicker(capture_flushInterval)
+	defer ticker.Stop()
+	record := make([]byte, 16)
+	for {
+		select {
+		case packet, ok := <-capt.queue:
+			if !ok {
+				return
+			}
+			binary.LittleEndian.PutUint32(record[0:4], uint32(packet.time.Unix()))
+			binary.LittleEndian.PutUint32(record[4:8], uint32(packet.time.Nanosecond()/1000))
+			binary.LittleEndian.PutUint32(record[8:12], uint32(len(packet.data)))
+			binary.LittleEndian.PutUint32(record[12:16], uint32(packet.length))
+			w.Write(record)
+			if _, err := w.Write(packet.data); err != nil {
+				c.core.log.Println("Failed to write capture:", err)
+				go c.stop(capt.file)
+				// Keep draining the queue until the capture is stopped, so that nothing blocks on it
+				for range capt.queue {
+				}
+				return
+			}
+		case <-ticker.C:
+			// Flush regularly, so that the file can be read while the capture is running
+			w.Flush()
+		}
+	}
+}
+
+// Queues a packet, given in parts that are joined together, i.e. an ethernet header and the packet after it, for the captures that it matches.
+func (c *packetCapture) add(tun bool, port switchPort, parts ...[]byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, capt := range c.captures {
+		if capt.tun != tun || (!tun && capt.port != port) {
+			continue
+		}
+		length := 0
+		for _, part := range parts {
+			length += len(part)
+		}
+		data := make([]byte, 0, length)
+		for _, part := range parts {
+			data = append(data, part...)
+		}
+		if len(data) > capt.snapLen {
+			data = data[:capt.snapLen]
+		}
+		select {
+		case capt.queue <- capture_packet{time: time.Now(), length: length, data: data}:
+			capt.packets++
+		default:
+			atomic.AddUint64(&capt.dropped, 1)
+		}
+	}
+}
+
+// Captures a packet or frame crossing the TUN/TAP adapter, in parts that are joined together.
+// This may be called from any goroutine.
+func (c *packetCapture) captureTUN(parts ...[]byte) {
+	if atomic.LoadInt32(&c.active) == 0 {
+		return
+	}
+	c.add(true, 0, parts...)
+}
+
+// Captures a link message sent to or received from the peer on the port.
+// This may be called from any goroutine.
+func (c *packetCapture) capturePeer(port switchPort, packet []byte) {
+	if atomic.LoadInt32(&c.active) == 0 {
+		return
+	}
+	c.add(false, port, packet)
+}
+
+// Gets the captures that are running.
+func (c *packetCapture) getCaptures() []admin_info {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var captures []admin_info
+	for _, capt := range c.captures {
+		info := admin_info{
+			"file":        capt.file,
+			"snap_length": capt.snapLen,
+			"uptime":      int(time.Since(capt.started).Seconds()),
+			"expires_in":  int(time.Until(capt.expires).Seconds()),
+			"packets":     capt.packets,
+			"dropped":     atomic.LoadUint64(&capt.dropped),
+		}
+		if capt.tun {
+			info["source"] = "tun"
+		} else {
+			info["source"] = "peer"
+			info["port"] = capt.port
+		}
+		captures = append(captures, info)
+	}
+	sort.Slice(captures, func(i, j int) bool {
+		return captures[i]["file"].(string) < captures[j]["file"].(string)
+	})
+	return captures
+}
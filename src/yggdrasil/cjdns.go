@@ -0,0 +1,133 @@
+package yggdrasil
+
+// This bridges Yggdrasil to a cjdns node running on the same host, so that
+// services on the cjdns network can be reached from Yggdrasil.
+// Each bridged cjdns address is given an alias address in our routed /64.
+// Packets that arrive over Yggdrasil for an alias have their destination
+// rewritten to the cjdns address before being written to the TUN/TAP adapter,
+// so the host routes them to cjdns. Replies read from the TUN/TAP adapter
+// have their source rewritten from the cjdns address back to the alias, so
+// they can be sent over Yggdrasil.
+// The host must route fc00::/8 through cjdns, and masquerade traffic leaving
+// through the cjdns interface, so that replies from the cjdns network come
+// back to this host.
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Transport protocols whose checksums cover the IPv6 addresses, and so need updating after a rewrite.
+const (
+	cjdns_protoTCP    = 6
+	cjdns_protoUDP    = 17
+	cjdns_protoICMPv6 = 58
+)
+
+type cjdnsBridge struct {
+	core      *Core
+	mutex     sync.RWMutex
+	toCjdns   map[address]address // Alias in our /64 to cjdns address
+	fromCjdns map[address]address // Cjdns address to alias in our /64
+}
+
+// Initializes the cjdnsBridge struct.
+func (b *cjdnsBridge) init(core *Core) {
+	b.core = core
+	b.toCjdns = make(map[address]address)
+	b.fromCjdns = make(map[address]address)
+}
+
+// Sets the mappings from aliases in our /64 to cjdns addresses.
+// Each alias and each cjdns address may only be used once.
+func (b *cjdnsBridge) setMappings(mappings map[string]string) error {
+	toCjdns := make(map[address]address)
+	fromCjdns := make(map[address]address)
+	subnet := b.core.GetSubnet()
+	_, cjdnsRange, _ := net.ParseCIDR("fc00::/8")
+	for aliasString, cjdnsString := range mappings {
+		var alias, cjdns address
+		aliasIP, cjdnsIP := net.ParseIP(aliasString), net.ParseIP(cjdnsString)
+		switch {
+		case aliasIP == nil || !subnet.Contains(aliasIP):
+			return errors.New("cjdns bridge alias " + aliasString + " is not in " + subnet.String())
+		case cjdnsIP == nil || !cjdnsRange.Contains(cjdnsIP):
+			return errors.New("cjdns bridge address " + cjdnsString + " is not a cjdns address")
+		}
+		copy(alias[:], aliasIP.To16())
+		copy(cjdns[:], cjdnsIP.To16())
+		if _, isIn := fromCjdns[cjdns]; isIn {
+			return errors.New("cjdns bridge address " + cjdnsString + " is mapped more than once")
+		}
+		toCjdns[alias] = cjdns
+		fromCjdns[cjdns] = alias
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.toCjdns = toCjdns
+	b.fromCjdns = fromCjdns
+	return nil
+}
+
+// Rewrites the destination of a packet received over Yggdrasil from an alias to the cjdns address, if there's a mapping for it.
+func (b *cjdnsBridge) translateIn(packet []byte) {
+	if len(packet) < tun_IPv6_HEADER_LENGTH || packet[0]&0xf0 != 0x60 {
+		return
+	}
+	b.mutex.RLock()
+	if len(b.toCjdns) == 0 {
+		b.mutex.RUnlock()
+		return
+	}
+	var dest address
+	copy(dest[:], packet[24:40])
+	cjdns, isIn := b.toCjdns[dest]
+	b.mutex.RUnlock()
+	if isIn {
+		cjdns_rewrite(packet, 24, &cjdns)
+	}
+}
+
+// Rewrites the source of a packet read from the TUN/TAP adapter from a cjdns address to its alias, if there's a mapping for it.
+func (b *cjdnsBridge) translateOut(packet []byte) {
+	if len(packet) < tun_IPv6_HEADER_LENGTH || packet[0]&0xf0 != 0x60 {
+		return
+	}
+	b.mutex.RLock()
+	if len(b.fromCjdns) == 0 {
+		b.mutex.RUnlock()
+		return
+	}
+	var source address
+	copy(source[:], packet[8:24])
+	alias, isIn := b.fromCjdns[source]
+	b.mutex.RUnlock()
+	if isIn {
+		cjdns_rewrite(packet, 8, &alias)
+	}
+}
+
+// Replaces the IPv6 address at the given offset in the packet, and updates the transport checksum to match.
+// Packets with extension headers are rewritten without updating any checksum, which the receiver will then drop.
+func cjdns_rewrite(packet []byte, offset int, to *address) {
+	var csumOffset int
+	switch packet[6] {
+	case cjdns_protoTCP:
+		csumOffset = tun_IPv6_HEADER_LENGTH + 16
+	case cjdns_protoUDP:
+		csumOffset = tun_IPv6_HEADER_LENGTH + 6
+	case cjdns_protoICMPv6:
+		csumOffset = tun_IPv6_HEADER_LENGTH + 2
+	}
+	if csumOffset > 0 && len(packet) >= csumOffset+2 {
+		csum := binary.BigEndian.Uint16(packet[csumOffset:])
+		csum = util_updateChecksum(csum, packet[offset:offset+len(to)], to[:])
+		if csum == 0 && packet[6] == cjdns_protoUDP {
+			csum = 0xffff // Zero means no checksum for UDP
+		}
+		binary.BigEndian.PutUint16(packet[csumOffset:], csum)
+	}
+	copy(packet[offset:], to[:])
+}
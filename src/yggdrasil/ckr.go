@@ -0,0 +1,253 @@
+package yggdrasil
+
+// This implements crypto-key routing of IPv4 over the TUN adapter, so that
+// IPv4 networks, like the LANs behind two nodes, can be joined over Yggdrasil.
+// Each routed IPv4 subnet is mapped to the encryption public key of the node
+// that it's behind. IPv4 packets read from the adapter are sent in a session
+// with the node that their destination is routed to, which is found by its
+// full NodeID, so that a node with a similar address can't take its place.
+// IPv4 packets received in a session are only written to the adapter if their
+// source is routed to the node that sent them, and packets read from the
+// adapter are only sent if their source is one of our own subnets, so that
+// nodes can't spoof each other's addresses. The host must route the subnets
+// through the adapter itself. This only works in TUN mode, as there's no ARP.
+// Routes can also be added and removed through the admin socket while the node
+// runs, which lasts until the configuration is next loaded, and each route
+// counts the packets sent and received over it.
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type cryptokeyRouting struct {
+	core    *Core
+	mutex   sync.RWMutex
+	enabled bool
+	routes  []*cryptokey_route // Sorted by prefix length, longest first
+	sources []*net.IPNet       // Subnets that packets read from the adapter may come from
+}
+
+// An IPv4 subnet, and the node that it's routed to.
+type cryptokey_route struct {
+	packetsSent  uint64 // Atomic, and first so that it's aligned on 32-bit platforms
+	bytesSent    uint64 // Atomic
+	packetsRecvd uint64 // Atomic
+	bytesRecvd   uint64 // Atomic
+	subnet       *net.IPNet
+	key          boxPubKey
+	addr         address // The node's address, which packets received from it are checked against
+}
+
+// Parses a route from an IPv4 subnet and the encryption public key of the node that it's routed to.
+func cryptokey_parseRoute(prefix string, keyString string) (*cryptokey_route, error) {
+	_, subnet, err := net.ParseCIDR(prefix)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil, errors.New("invalid IPv4 subnet: " + prefix)
+	}
+	keyBytes, err := hex.DecodeString(keyString)
+	if err != nil || len(keyBytes) != boxPubKeyLen {
+		return nil, errors.New("invalid encryption public key for " + prefix + ": " + keyString)
+	}
+	route := &cryptokey_route{subnet: subnet}
+	copy(route.key[:], keyBytes)
+	route.addr = *address_addrForNodeID(getNodeID(&route.key))
+	return route, nil
+}
+
+// Sorts the routes by prefix length, longest first, so that the first one that contains an address is the best match.
+func cryptokey_sortRoutes(routes []*cryptokey_route) {
+	sort.Slice(routes, func(i, j int) bool {
+		iOnes, _ := routes[i].subnet.Mask.Size()
+		jOnes, _ := routes[j].subnet.Mask.Size()
+		if iOnes != jOnes {
+			return iOnes > jOnes
+		}
+		return routes[i].subnet.String() < routes[j].subnet.String()
+	})
+}
+
+// Initializes the cryptokeyRouting struct.
+func (c *cryptokeyRouting) init(core *Core) {
+	c.core = core
+}
+
+// Sets whether crypto-key routing is enabled, the subnets that are routed to each key, and the subnets that we may send from.
+// If any of them are invalid then the existing routes are left unchanged.
+func (c *cryptokeyRouting) setConfig(enabled bool, destinations map[string]string, sources []string) error {
+	var routes []*cryptokey_route
+	for prefix, keyString := range destinations {
+		route, err := cryptokey_parseRoute(prefix, keyString)
+		if err != nil {
+			return err
+		}
+		routes = append(routes, route)
+	}
+	cryptokey_sortRoutes(routes)
+	var nets []*net.IPNet
+	for _, prefix := range sources {
+		_, subnet, err := net.ParseCIDR(prefix)
+		if err != nil || subnet.IP.To4() == nil {
+			return errors.New("invalid IPv4 subnet: " + prefix)
+		}
+		nets = append(nets, subnet)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// Routes that haven't changed keep their counters
+	for idx, route := range routes {
+		if old := c.find(route.subnet); old != nil && old.key == route.key {
+			routes[idx] = old
+		}
+	}
+	c.enabled = enabled
+	c.routes = routes
+	c.sources = nets
+	return nil
+}
+
+// Finds the route for exactly the subnet. Must be called with the mutex held.
+func (c *cryptokeyRouting) find(subnet *net.IPNet) *cryptokey_route {
+	for _, route := range c.routes {
+		if route.subnet.String() == subnet.String() {
+			return route
+		}
+	}
+	return nil
+}
+
+// Routes an IPv4 subnet to the node with the encryption public key, replacing any route for the same subnet.
+func (c *cryptokeyRouting) addRoute(prefix string, keyString string) error {
+	route, err := cryptokey_parseRoute(prefix, keyString)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if old := c.find(route.subnet); old != nil && old.key == route.key {
+		return nil
+	}
+	routes := []*cryptokey_route{route}
+	for _, old := range c.routes {
+		if old.subnet.String() != route.subnet.String() {
+			routes = append(routes, old)
+		}
+	}
+	cryptokey_sortRoutes(routes)
+	c.routes = routes
+	return nil
+}
+
+// Removes the route for an IPv4 subnet.
+func (c *cryptokeyRouting) removeRoute(prefix string) error {
+	_, subnet, err := net.ParseCIDR(prefix)
+	if err != nil || subnet.IP.To4() == nil {
+		return errors.New("invalid IPv4 subnet: " + prefix)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var routes []*cryptokey_route
+	for _, route := range c.routes {
+		if route.subnet.String() != subnet.String() {
+			routes = append(routes, route)
+		}
+	}
+	if len(routes) == len(c.routes) {
+		return errors.New("no route for " + subnet.String())
+	}
+	c.routes = routes
+	return nil
+}
+
+// Removes every route, returning how many there were.
+func (c *cryptokeyRouting) flushRoutes() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	count := len(c.routes)
+	c.routes = nil
+	return count
+}
+
+// Checks if crypto-key routing is enabled.
+func (c *cryptokeyRouting) isEnabled() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.enabled
+}
+
+// Finds the route with the longest prefix that contains the address. Must be called with the mutex held.
+func (c *cryptokeyRouting) lookup(ip net.IP) *cryptokey_route {
+	for _, route := range c.routes {
+		if route.subnet.Contains(ip) {
+			return route
+		}
+	}
+	return nil
+}
+
+// Gets the key and address of the node that an IPv4 packet read from the adapter should be sent to.
+// Returns false if it shouldn't be sent, because there's no route for its destination or it isn't from one of our subnets.
+func (c *cryptokeyRouting) getIPv4Destination(packet []byte) (boxPubKey, address, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if !c.enabled || len(packet) < tun_IPv4_HEADER_LENGTH {
+		return boxPubKey{}, address{}, false
+	}
+	source := net.IP(packet[12:16])
+	fromUs := false
+	for _, subnet := range c.sources {
+		if subnet.Contains(source) {
+			fromUs = true
+			break
+		}
+	}
+	if !fromUs {
+		return boxPubKey{}, address{}, false
+	}
+	route := c.lookup(net.IP(packet[16:20]))
+	if route == nil {
+		return boxPubKey{}, address{}, false
+	}
+	atomic.AddUint64(&route.packetsSent, 1)
+	atomic.AddUint64(&route.bytesSent, uint64(len(packet)))
+	return route.key, route.addr, true
+}
+
+// Checks if an IPv4 packet received in a session with the node at the address comes from a subnet that's routed to that node.
+func (c *cryptokeyRouting) checkIPv4Source(packet []byte, theirAddr *address) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if !c.enabled || len(packet) < tun_IPv4_HEADER_LENGTH {
+		return false
+	}
+	route := c.lookup(net.IP(packet[12:16]))
+	if route == nil || route.addr != *theirAddr {
+		return false
+	}
+	atomic.AddUint64(&route.packetsRecvd, 1)
+	atomic.AddUint64(&route.bytesRecvd, uint64(len(packet)))
+	return true
+}
+
+// Gets the routes, for the admin API.
+func (c *cryptokeyRouting) getRoutes() []admin_info {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	var routes []admin_info
+	for _, route := range c.routes {
+		routes = append(routes, admin_info{
+			"subnet":                route.subnet.String(),
+			"encryption_public_key": hex.EncodeToString(route.key[:]),
+			"ip":                    net.IP(route.addr[:]).String(),
+			"packets_sent":          atomic.LoadUint64(&route.packetsSent),
+			"bytes_sent":            atomic.LoadUint64(&route.bytesSent),
+			"packets_recvd":         atomic.LoadUint64(&route.packetsRecvd),
+			"bytes_recvd":           atomic.LoadUint64(&route.bytesRecvd),
+		})
+	}
+	return routes
+}
@@ -0,0 +1,127 @@
+package yggdrasil
+
+// This keeps track of other nodes that appear to be using the same keys as
+// this node, which usually happens when a configuration file or a disk image
+// containing one has been cloned onto several machines.
+// Nodes sharing an encryption key share an IPv6 address, so traffic for that
+// address will end up at whichever node the network happens to find first.
+// Nodes sharing a signing key share a TreeID, which confuses the spanning tree.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Number of recent collisions to remember for the admin API.
+const collisions_maxEvents = 32
+
+// Collisions of the same type aren't logged more than once in this period.
+const collisions_logInterval = time.Minute
+
+// A collision that was detected with another node.
+type collisionEvent struct {
+	time   time.Time
+	kind   string // "address" for the encryption key, "treeid" for the signing key, or "keys" for both
+	coords []byte // Coords of the other node, if known
+	remote string // Remote address of the other node, if directly connected
+}
+
+// The collision tracker, which is safe to use from any goroutine.
+type collisions struct {
+	core   *Core
+	mutex  sync.Mutex // Protects the below
+	events []collisionEvent
+	logged map[string]time.Time
+	exit   bool
+	shared bool          // Our keys are meant to be shared with other nodes, i.e. by anycast service instances
+	fatal  chan struct{} // Closed when a collision is detected while exit is set
+	closed bool          // Whether fatal has been closed
+}
+
+// Initializes the collisions struct.
+func (c *collisions) init(core *Core) {
+	c.core = core
+	c.logged = make(map[string]time.Time)
+	c.fatal = make(chan struct{})
+}
+
+// Gets a channel that's closed when a collision is detected while the node is set to exit on collisions.
+func (c *collisions) getFatal() <-chan struct{} {
+	return c.fatal
+}
+
+// Sets whether the node should shut down when a collision is detected.
+func (c *collisions) setExitOnCollision(exit bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.exit = exit
+}
+
+// Sets whether our keys are meant to be shared with other nodes, in which case nodes using the same keys aren't treated as collisions.
+func (c *collisions) setSharedKeys(shared bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.shared = shared
+}
+
+// Checks whether our keys are meant to be shared with other nodes.
+func (c *collisions) isSharedKeys() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.shared
+}
+
+// Records a collision with another node and logs it, then tells whatever runs
+// the node to shut it down if configured to do so.
+func (c *collisions) report(kind string, coords []byte, remote string) {
+	now := time.Now()
+	c.mutex.Lock()
+	c.events = append(c.events, collisionEvent{
+		time:   now,
+		kind:   kind,
+		coords: append([]byte(nil), coords...),
+		remote: remote,
+	})
+	if len(c.events) > collisions_maxEvents {
+		c.events = c.events[len(c.events)-collisions_maxEvents:]
+	}
+	doLog := now.Sub(c.logged[kind]) > collisions_logInterval
+	if doLog {
+		c.logged[kind] = now
+	}
+	exit := c.exit && !c.closed
+	if exit {
+		c.closed = true
+		close(c.fatal)
+	}
+	c.mutex.Unlock()
+	if doLog || exit {
+		var from string
+		switch {
+		case remote != "":
+			from = " at " + remote
+		case coords != nil:
+			from = " with coords " + fmt.Sprint(coords)
+		}
+		c.core.log.Println("********************************************************************************")
+		switch kind {
+		case "address":
+			c.core.log.Printf("WARNING: Another node%s is using the same encryption keys, and so the same IPv6 address, as this node!", from)
+		case "keys":
+			c.core.log.Printf("WARNING: Another node%s is using the same encryption and signing keys, and so the same IPv6 address and TreeID, as this node!", from)
+		default:
+			c.core.log.Printf("WARNING: Another node%s is using the same signing keys, and so the same TreeID, as this node!", from)
+		}
+		c.core.log.Println("This usually means that the configuration was copied from another machine.")
+		c.core.log.Println("Generate new keys for one of the nodes with yggdrasil -genconf.")
+		c.core.log.Println("********************************************************************************")
+	}
+}
+
+// Returns the recently detected collisions, oldest first.
+func (c *collisions) getEvents() []collisionEvent {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]collisionEvent(nil), c.events...)
+}
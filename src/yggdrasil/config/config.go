@@ -1,25 +1,226 @@
 package config
 
+import (
+	"net/url"
+	"strings"
+)
+
 // NodeConfig defines all configuration values needed to run a signle yggdrasil node
 type NodeConfig struct {
-	Listen                      string              `comment:"Listen address for peer connections. Default is to listen for all\nTCP connections over IPv4 and IPv6 with a random port."`
-	AdminListen                 string              `comment:"Listen address for admin connections Default is to listen for local\nconnections either on TCP/9001 or a UNIX socket depending on your\nplatform. Use this value for yggdrasilctl -endpoint=X."`
-	Peers                       []string            `comment:"List of connection strings for static peers in URI format, i.e.\ntcp://a.b.c.d:e or socks://a.b.c.d:e/f.g.h.i:j."`
-	InterfacePeers              map[string][]string `comment:"List of connection strings for static peers in URI format, arranged\nby source interface, i.e. { \"eth0\": [ tcp://a.b.c.d:e ] }. Note that\nSOCKS peerings will NOT be affected by this option and should go in\nthe \"Peers\" section instead."`
-	ReadTimeout                 int32               `comment:"Read timeout for connections, specified in milliseconds. If less\nthan 6000 and not negative, 6000 (the default) is used. If negative,\nreads won't time out."`
-	AllowedEncryptionPublicKeys []string            `comment:"List of peer encryption public keys to allow or incoming TCP\nconnections from. If left empty/undefined then all connections\nwill be allowed by default."`
-	EncryptionPublicKey         string              `comment:"Your public encryption key. Your peers may ask you for this to put\ninto their AllowedEncryptionPublicKeys configuration."`
-	EncryptionPrivateKey        string              `comment:"Your private encryption key. DO NOT share this with anyone!"`
-	SigningPublicKey            string              `comment:"Your public signing key. You should not ordinarily need to share\nthis with anyone."`
-	SigningPrivateKey           string              `comment:"Your private signing key. DO NOT share this with anyone!"`
-	MulticastInterfaces         []string            `comment:"Regular expressions for which interfaces multicast peer discovery\nshould be enabled on. If none specified, multicast peer discovery is\ndisabled. The default value is .* which uses all interfaces."`
-	IfName                      string              `comment:"Local network interface name for TUN/TAP adapter, or \"auto\" to select\nan interface automatically, or \"none\" to run without TUN/TAP."`
-	IfTAPMode                   bool                `comment:"Set local network interface to TAP mode rather than TUN mode if\nsupported by your platform - option will be ignored if not."`
-	IfMTU                       int                 `comment:"Maximux Transmission Unit (MTU) size for your local TUN/TAP interface.\nDefault is the largest supported size for your platform. The lowest\npossible value is 1280."`
-	SessionFirewall             SessionFirewall     `comment:"The session firewall controls who can send/receive network traffic\nto/from. This is useful if you want to protect this node without\nresorting to using a real firewall. This does not affect traffic\nbeing routed via this node to somewhere else. Rules are prioritised as\nfollows: blacklist, whitelist, always allow outgoing, direct, remote."`
+	Listen                      string                    `comment:"Listen address for peer connections. Default is to listen for all\nTCP connections over IPv4 and IPv6 with a random port. Set to \"none\"\nto not listen for peer connections at all."`
+	Listeners                   []ListenerConfig          `comment:"Additional listen addresses for peer connections. Each listener has its\nown peering policy and allowed keys, i.e. to leave a LAN listener open\nwhile restricting a WAN listener to known peers."`
+	AdminListen                 string                    `comment:"Listen address for admin connections Default is to listen for local\nconnections either on TCP/9001 or a UNIX socket depending on your\nplatform. Use this value for yggdrasilctl -endpoint=X. Set to \"none\" to disable\nthe admin socket."`
+	Peers                       []string                  `comment:"List of connection strings for static peers in URI format, i.e.\ntcp://a.b.c.d:e or socks://a.b.c.d:e/f.g.h.i:j, or proxy://f.g.h.i:j to\nconnect through the first of the Proxies below that works. Nodes on\nthe same host can be peered with over a unix socket, given as\nunix:///path/to/socket, which the other node lists in Listeners.\nIn-memory links to other nodes in the same process, used for tests and\nsimulations, are given as mem://name?latency=20ms&bandwidth=10000000.\nA link carried by a program that runs this node, like SSH, is given as\nstdio:// for stdin/stdout, or pipe://?in=3&out=4 for inherited pipes,\nand the log is then written to stderr.\nThe MTU of sessions whose traffic leaves through a peer, i.e. one\nreached through a tunnel with a small MTU, can be capped with\ntcp://a.b.c.d:e?mtu=1280."`
+	InterfacePeers              map[string][]string       `comment:"List of connection strings for static peers in URI format, arranged\nby source interface, i.e. { \"eth0\": [ tcp://a.b.c.d:e ] }. Link-local\npeers can be listed here without a zone, i.e. tcp://[fe80::1]:e, or in\nPeers with one, i.e. tcp://[fe80::1%eth0]:e. Note that SOCKS peerings\nwill NOT be affected by this option and should go in the \"Peers\"\nsection instead."`
+	Transports                  map[string]string         `comment:"Pluggable transports for obfuscating peering traffic, arranged by\nname, i.e. { \"obfs4\": \"/usr/local/bin/obfs4-client\" }. The command is\nrun for each connection with the peer address and any other parameters\nfrom the peer URI as arguments, and must carry the connection over its\nstdin/stdout. Select a transport with tcp://a.b.c.d:e?transport=obfs4."`
+	Proxies                     ProxiesConfig             `comment:"Ordered list of outbound proxies for peers given as proxy://f.g.h.i:j.\nProxies are tried in order, starting with those that are healthy, so\nthat peers still come up through an alternate when the primary proxy\nis unreachable."`
+	ReadTimeout                 int32                     `comment:"Read timeout for connections, specified in milliseconds, after which\na peer that has sent nothing is assumed to be gone. If less than 1.5\ntimes KeepaliveInterval and not negative, 1.5 times KeepaliveInterval\n(6000 by default) is used. If negative, reads won't time out. Can be\nset for a single peer with i.e. tcp://a.b.c.d:e?timeout=30s."`
+	KeepaliveInterval           int32                     `comment:"Time between keep-alive messages on idle connections, specified in\nmilliseconds. If zero, 4000 is used. Peers must use a ReadTimeout longer\nthan this, so lower it on both ends to detect dead links sooner. Can be\nset for a single peer with i.e. tcp://a.b.c.d:e?keepalive=2s."`
+	HandshakeTimeout            int32                     `comment:"Time allowed for a new connection to exchange keys and versions with\nthe peer, specified in milliseconds. Peers reached over Tor or satellite\nlinks can need much longer than ReadTimeout to complete this. If zero,\nReadTimeout is used, and if negative, it never times out. Can be set for\na single peer with i.e. tcp://a.b.c.d:e?handshake=60s."`
+	PassiveKeepalive            bool                      `comment:"Stop sending keep-alive messages and timing out reads on TCP\nconnections, and let the operating system probe idle connections\ninstead, every KeepaliveInterval. This saves traffic on connections\nthat carry data, but dead peers take longer to notice. Both ends of\na connection must use it. It can also be enabled for a single outgoing\npeer with i.e. tcp://a.b.c.d:e?passive=true, as long as the remote node\nenables it for incoming connections."`
+	AllowedEncryptionPublicKeys []string                  `comment:"List of peer encryption public keys to allow or incoming TCP\nconnections from. If left empty/undefined then all connections\nwill be allowed by default."`
+	EncryptionPublicKey         string                    `comment:"Your public encryption key. Your peers may ask you for this to put\ninto their AllowedEncryptionPublicKeys configuration."`
+	EncryptionPrivateKey        string                    `comment:"Your private encryption key. DO NOT share this with anyone!"`
+	SigningPublicKey            string                    `comment:"Your public signing key. You should not ordinarily need to share\nthis with anyone."`
+	SigningPrivateKey           string                    `comment:"Your private signing key. DO NOT share this with anyone!"`
+	MulticastInterfaces         []string                  `comment:"Regular expressions for which interfaces multicast peer discovery\nshould be enabled on. If none specified, multicast peer discovery is\ndisabled. The default value is .* which uses all interfaces."`
+	IfName                      string                    `comment:"Local network interface name for TUN/TAP adapter, or \"auto\" to select\nan interface automatically, or \"none\" to run without TUN/TAP. Without\nTUN/TAP, pings to this node's address are still answered."`
+	IfTAPMode                   bool                      `comment:"Set local network interface to TAP mode rather than TUN mode if\nsupported by your platform - option will be ignored if not."`
+	IfTAPMulticast              string                    `comment:"How broadcast and multicast frames received on the TAP adapter are\nhandled. \"forward\" passes IPv6 multicast to the node, which answers\nneighbor discovery, learns groups from MLD reports and forwards the\ngroups allowed by MulticastForwarding. \"local\" does the same but never\nforwards, and \"drop\" discards everything but neighbor discovery.\nBroadcast and non-IPv6 frames are always dropped. Default is \"forward\"."`
+	IfTAPNeighbors              TapNeighborsConfig        `comment:"MAC addresses of the hosts on the TAP adapter, for bridged setups\nwhere sending to the last host that sent us ICMPv6 picks the wrong\none. Only used in TAP mode."`
+	IfMTU                       int                       `comment:"Maximux Transmission Unit (MTU) size for your local TUN/TAP interface.\nDefault is the largest supported size for your platform. The lowest\npossible value is 1280."`
+	IfPeerAddress               string                    `comment:"Address of the other end of the TUN adapter, which puts it in\npoint-to-point mode. This node's address is then assigned as a /128\nwith this peer address, and 200::/7 is routed through the adapter,\ninstead of the adapter being on-link for 200::/7. Some routing daemons\nand policy routing setups need this. Not supported in TAP mode, and\nonly supported on Linux. If left empty then the /7 is on-link."`
+	IfGroup                     string                    `comment:"Interface group to assign the TUN/TAP adapter to, either a number or\na name from /etc/iproute2/group, so that firewall and policy routing\nrules can match all Yggdrasil interfaces, i.e. with \"oifgroup\". Only\nsupported on Linux."`
+	IfAlias                     string                    `comment:"Alias, or description, to set on the TUN/TAP adapter. Only supported\non Linux."`
+	IfAltNames                  []string                  `comment:"Alternative names to add to the TUN/TAP adapter, which rules and\ntools can refer to it by as well as by IfName. Only supported on Linux\n5.5 or later."`
+	IfBuffers                   TunBuffersConfig          `comment:"Queue and buffer sizes for the TUN/TAP adapter. Longer queues absorb\nbigger bursts of traffic on fast links, at the cost of memory and\nlatency. When a queue is full, whatever is adding to it waits for room,\nunless DropWhenFull is set. Any option set to 0 uses the default."`
+	IfOffload                   bool                      `comment:"Let the kernel pass large TCP segments through the TUN adapter in one\nread, and leave their checksums to this node, which splits them into\npackets of the MTU. This saves a read for every packet of a bulk\ntransfer, which helps most when IfMTU is lower than the default. Only\nsupported on Linux in TUN mode."`
+	IfHelperSocket              string                    `comment:"Path to the unix socket of an interface helper, started with\n\"yggdrasil -ifhelper path\" as a user with CAP_NET_ADMIN, which creates\nthe TUN adapter and hands it to this node, so that this node can run\nas an unprivileged user. The user must be in the helper's group to use\nthe socket. Only supported on Linux in TUN mode. If left empty then\nthis node creates the adapter itself."`
+	ExtraInterfaces             []ExtraInterfaceConfig    `comment:"Additional TUN adapters, each of which is given the packets from the\nmesh whose destinations are in its prefixes, so that traffic for this\nnode's address and for subnets reached with tunnel routing can be\nsplit onto different devices for policy routing on the host. Packets\nfor anywhere else go to the main adapter. Only supported on Linux in\nTUN mode."`
+	PacketFilter                []PacketFilterRule        `comment:"Rules for the packets that pass through the TUN/TAP adapter, i.e. to\ndrop multicast noise or block ports without a firewall on the host.\nPackets read from the adapter are \"out\", and packets from the mesh are\n\"in\". The first rule that matches a packet decides whether it is\naccepted or dropped, and packets that match no rule are accepted, i.e.\n[ { Action: \"drop\", Direction: \"in\", Protocol: \"tcp\", Ports: \"22\" } ].\nOnly IPv6 packets are filtered. IPv4 packets, which are only sent with\ncrypto-key routing, are always accepted, so they need a firewall on the\nhost to be filtered."`
+	ParentSelection             ParentSelectionConfig     `comment:"Controls over which peer is chosen as this node's parent in the\nspanning tree, which determines this node's coords. Every change of\nparent changes the coords, which interrupts sessions until the other\nends find the new coords, so stable routers may want to change less."`
+	SessionFirewall             SessionFirewall           `comment:"The session firewall controls who can send/receive network traffic\nto/from. This is useful if you want to protect this node without\nresorting to using a real firewall. This does not affect traffic\nbeing routed via this node to somewhere else. Rules are prioritised as\nfollows: blacklist, whitelist, always allow outgoing, deny inbound,\ndirect, remote."`
+	DHT                         DHTConfig                 `comment:"Tuning options for the DHT, which is used to look up the coords of\nother nodes. Lower intervals and higher sizes and parallelism find\nnodes faster at the cost of more memory and background traffic. Any\noption set to 0 uses the default."`
+	DHTCacheFile                string                    `comment:"Path to a file where nodes that were recently reachable through the\nDHT are saved, so that they can be contacted straight away after a\nrestart instead of rebuilding the DHT from your peers alone. If left\nempty then the DHT is not saved."`
+	AddressBookFile             string                    `comment:"Path to a file where an address book of the nodes that this node has\nhad sessions with is kept, with their keys, addresses and when they\nwere last seen, so that they can be found again with the admin API\nafter their coords change. If empty, no address book is kept."`
+	NodeInfo                    map[string]interface{}    `comment:"Optional node info. This must be a { \"key\": \"value\", ... } map\nor set as null. This is entirely optional but, if set, is visible\nto the whole network on request. The \"services\" key may list the\nservices this node offers, i.e. [ { \"name\": \"www\", \"port\": 80,\n\"proto\": \"tcp\" } ], which other nodes can query with getNodeServices."`
+	Aliases                     map[string]string         `comment:"Names for other nodes, which can be used in place of their keys or\naddresses in yggdrasilctl and the admin API, i.e. \"yggdrasilctl ping\nmyserver\", and which name the nodes in admin output. Each name is given\nthe node's encryption public key, or just its address or /64 subnet,\ni.e. { \"myserver\": \"0123...cdef\", \"router\": \"200:1234::1\" }."`
+	NodeInfoCacheTTL            int                       `comment:"Time for which NodeInfo responses from other nodes are cached, so\nthat repeated getNodeInfo requests don't generate network traffic,\nspecified in seconds. If 0 then 300 (the default) is used."`
+	ExitOnCollision             bool                      `comment:"Shut down if another node is found to be using the same keys, and so\nthe same IPv6 address or TreeID, as this node. This usually happens\nwhen a configuration has been copied between machines. Collisions are\nalways logged and reported by getCollisions in the admin API."`
+	AllowBench                  bool                      `comment:"Allow other nodes to run bandwidth tests against this node with\n\"yggdrasilctl bench\". A test sends as much traffic as the path\nallows for up to 30 seconds, so this is disabled by default."`
+	RouteExport                 RouteExportConfig         `comment:"Announce this node's routed /64 to a local routing daemon, so that\nrouters on the local network learn to reach it through this node."`
+	PolicyRouting               PolicyRoutingConfig       `comment:"Route the traffic of selected users and cgroups over Yggdrasil, while\nthe rest of the system keeps using its usual routes. Their packets are\nmarked, and an ip rule sends marked packets to a routing table that\nroutes the prefixes below through the TUN/TAP adapter. The rules and\nroutes are removed when the node stops. Only supported on Linux."`
+	RouterAdvertisement         RouterAdvertisementConfig `comment:"Send IPv6 router advertisements on a LAN interface, so that hosts on\nthe LAN automatically get addresses in this node's routed /64 and a\nroute to the rest of the network through this node, without radvd."`
+	NDPProxyInterface           string                    `comment:"LAN interface to answer IPv6 neighbor solicitations on for addresses\nin this node's routed /64, so that hosts on the LAN can use addresses\nin it without running their own node. Addresses that hosts on the LAN\nuse themselves are left for them to answer for. This node must be\nallowed to forward IPv6 traffic. Only supported on Linux. If left\nempty then no solicitations are answered."`
+	CjdnsBridge                 map[string]string         `comment:"Bridge addresses on a cjdns network, reached through a cjdns node on\nthis host, into Yggdrasil. Each cjdns address is given an alias in\nthis node's routed /64, i.e. { \"300:1234:5678:9abc::1\": \"fc12:...\" },\nand packets sent to the alias are forwarded to the cjdns address. The\nhost must route fc00::/8 through cjdns and masquerade traffic leaving\nthrough the cjdns interface."`
+	TunnelRouting               TunnelRoutingConfig       `comment:"Tunnel IPv4 over Yggdrasil with crypto-key routing, so that IPv4\nnetworks behind nodes can reach each other. Each IPv4 subnet is routed\nto the node with the given encryption public key, and the host must\nroute the subnets through the TUN adapter. Only supported in TUN mode."`
+	DSCPPriority                map[string]string         `comment:"Priorities of packets read from the TUN/TAP adapter by their DSCP\nvalue, which every node on the path uses to queue interactive traffic\nahead of normal traffic, and normal traffic ahead of background\ntraffic, when links are busy. Each DSCP value is given by number and\nmapped to \"interactive\", \"normal\" or \"background\", i.e.\n{ \"10\": \"interactive\" }. Values that aren't listed follow RFC 4594,\nso that i.e. EF and AF21, which SSH uses for interactive sessions,\nare interactive, CS1 is background, and video is normal. Interactive\ntraffic only gets three quarters of a busy link ahead of normal and\nbackground traffic, as any node can mark its traffic as interactive."`
+	SessionPadding              bool                      `comment:"Pad session traffic to fixed size buckets and send dummy traffic at\nrandom intervals while sessions are active, to make traffic analysis\nof low-volume links harder. This is only used with remote nodes that\nhave also enabled it, and uses additional bandwidth."`
+	SessionCongestionControl    string                    `comment:"Congestion control for traffic sent in sessions, which paces it to\nthe rate that the path to the remote node can carry, instead of\nfilling the queues of slow links on the way. \"bbr\" is the default,\nand \"none\" sends as fast as possible. This only takes effect with\nremote nodes that send feedback about what they receive."`
+	SessionCleanup              SessionCleanupConfig      `comment:"How long sessions and their keys are kept once nothing is heard from\nthe remote node. Nodes with little memory that serve many short-lived\nclients can lower these to free it sooner."`
+	StoreAndForward             StoreAndForwardConfig     `comment:"Hold packets for a few seconds while a session is being set up, or\nset up again after coords change or a peer flaps, instead of dropping\nall but the most recent one, so that brief outages don't interrupt\napplications."`
+	MulticastForwarding         MulticastForwardingConfig `comment:"Forward IPv6 multicast traffic for selected groups between nodes that\nhave joined them. Local hosts join groups as usual, which this node\nlearns from the MLD reports they send to the TUN/TAP adapter, and\nmemberships are exchanged with the remote nodes listed below. Nothing\nis forwarded unless some groups are allowed."`
+	AnycastServices             []AnycastServiceConfig    `comment:"Anycast services which this node answers for. Every node configured\nwith the same service keys answers for the same address, and traffic\nfor it goes to the nearest of them. Generate the keys as you would for\na node, and assign the resulting address to the TUN/TAP adapter or a\nloopback interface so that the host accepts traffic for it."`
+	SNMP                        SNMPConfig                `comment:"Run an SNMPv2c agent, so that network management systems can poll\ninterface-style counters for the TUN/TAP adapter and for each peer\nlink. The layout of the MIB is described in src/yggdrasil/snmp.go."`
+	StatsExport                 StatsExportConfig         `comment:"Periodically write stats, such as peer, session and traffic counts,\nand histograms of peer RTTs, session handshake times and search\ndurations, to a local unix datagram socket, for supervisors that\ncollect metrics without polling the admin socket."`
+	CrashDirectory              string                    `comment:"Directory to write crash reports to, with the stack traces of every\ngoroutine, recent log lines, version and config with secrets redacted,\nfor attaching to bug reports. A report is only kept if the node\ncrashes, and its path is logged when the node next starts. If left\nempty then crash reports aren't written."`
+	WebUI                       WebUIConfig               `comment:"Serve a web UI, showing the status of the node, its peers and sessions\nand recent traffic, with controls for adding and removing peers."`
 	//Net                         NetConfig `comment:"Extended options for connecting to peers over other networks."`
 }
 
+// ListenerConfig defines an additional listener for peer connections
+type ListenerConfig struct {
+	Listen                      string   `comment:"Listen address for peer connections on this listener, or a unix\nsocket given as unix:///path/to/socket for peering with other nodes on\nthe same host."`
+	Policy                      string   `comment:"Peering policy for this listener. \"default\" uses the global\nAllowedEncryptionPublicKeys and allows link-local peers, \"open\" allows\nall peers and \"restricted\" allows only the keys listed below (or the\nglobal AllowedEncryptionPublicKeys if none are listed below)."`
+	AllowedEncryptionPublicKeys []string `comment:"List of peer encryption public keys to allow incoming TCP connections\nfrom on this listener. Only used by the \"restricted\" policy."`
+}
+
+// ProxiesConfig defines the outbound proxies that peers can be dialled through
+type ProxiesConfig struct {
+	List          []string `comment:"Proxies in order of preference, either SOCKS5 proxies given as\nsocks://[user:pass@]host:port or HTTP proxies that support CONNECT given\nas http://[user:pass@]host:port."`
+	CheckInterval int      `comment:"Time between checks that each proxy can be reached, specified in\nseconds. A proxy is also marked unhealthy when connecting through it\nfails. Default is 60."`
+}
+
+// DHTConfig defines the tuning options for the DHT
+type DHTConfig struct {
+	MaintenanceInterval int     `comment:"Time between rounds of DHT maintenance, in which nodes are pinged to\ncheck that they are reachable and to discover new nodes, specified in\nmilliseconds. Default is 1000, which is also the lowest possible value."`
+	BucketSize          int     `comment:"Number of nodes, not counting peers, to keep in each DHT bucket.\nDefault is 2."`
+	SearchSize          int     `comment:"Maximum number of nodes to keep track of for querying in each search.\nDefault is 16."`
+	SearchParallelism   int     `comment:"Number of nodes to query in parallel when a search starts or is\nretried. Default is 1."`
+	SearchTimeout       int     `comment:"Time after which an unfinished search is abandoned, specified in\nmilliseconds. Default is 60000."`
+	SearchRetryInterval int     `comment:"Time to wait for a search to make progress before retrying it,\nspecified in milliseconds. Searches are used to find the coords of a\nnode before opening a session to it. Default is 1000."`
+	SearchRetries       int     `comment:"Number of times to retry a search before giving up on it until there\nis more traffic for the node. Default is 0, which keeps retrying until\nthe search times out."`
+	SearchRetryBackoff  float64 `comment:"Factor by which the retry interval grows after each retry, i.e. 2\ndoubles the time between retries. Default is 1, which retries at a\nsteady rate."`
+}
+
+// RouteExportConfig defines where and how routes are announced to a local routing daemon
+type RouteExportConfig struct {
+	Target   string   `comment:"Named pipe, or unix:///path or tcp://host:port socket, to which\nExaBGP API commands (\"announce route ... next-hop ...\") are written.\nIf left empty then routes are not exported."`
+	NextHop  string   `comment:"Next hop address to announce for the routes. Default is \"self\",\nwhich lets the routing daemon use its own address."`
+	Prefixes []string `comment:"Additional prefixes in CIDR notation to announce as well as this\nnode's /64, i.e. for other subnets routed through this node."`
+}
+
+// PolicyRoutingConfig defines whose traffic is routed over Yggdrasil and how
+type PolicyRoutingConfig struct {
+	Enable   bool     `comment:"Enable policy routing."`
+	Table    uint32   `comment:"Routing table for marked packets. Default is 121."`
+	Mark     uint32   `comment:"Firewall mark of packets to route over Yggdrasil. Applications can\nalso set it on their own sockets with SO_MARK. Default is 121."`
+	Priority uint32   `comment:"Priority of the ip rules, which must come before the main table's.\nDefault is 1000."`
+	Prefixes []string `comment:"IPv6 prefixes in CIDR notation to route over Yggdrasil. Traffic from\nthe selected users and cgroups to anywhere else uses the usual routes.\nDefault is ::/0, which keeps all of their IPv6 traffic in Yggdrasil."`
+	Users    []string `comment:"Users whose traffic is routed over Yggdrasil, by name, user ID or\nrange of user IDs, i.e. [ \"alice\", \"1000-1999\" ]."`
+	CGroups  []string `comment:"Cgroups whose traffic is routed over Yggdrasil, by path in the cgroup\nv2 hierarchy, i.e. [ \"system.slice/myapp.service\" ]. This uses\nip6tables to mark the packets."`
+}
+
+// RouterAdvertisementConfig defines how this node's routed /64 is advertised on a LAN
+type RouterAdvertisementConfig struct {
+	Interface         string   `comment:"LAN interface to send router advertisements on. This node must be\nallowed to forward IPv6 traffic, and the interface should have an\naddress in this node's /64. If left empty then nothing is advertised."`
+	Interval          int      `comment:"Time between router advertisements, specified in seconds. Default\nis 200."`
+	DefaultRouter     bool     `comment:"Also advertise this node as a default router for the LAN. Leave this\ndisabled if the LAN has another router for non-Yggdrasil traffic."`
+	TAP               bool     `comment:"Send router advertisements into the TAP adapter instead of on\nInterface, and answer router solicitations read from it. This reaches\nthe LAN when the adapter is bridged to it. Only in TAP mode."`
+	ValidLifetime     int      `comment:"Valid lifetime of the /64 and the route to the rest of the network,\nspecified in seconds. Default is 10 times the interval."`
+	PreferredLifetime int      `comment:"Preferred lifetime of addresses in the /64, specified in seconds.\nDefault is 5 times the interval."`
+	RouterLifetime    int      `comment:"Lifetime of this node as a default router and of the DNS options,\nspecified in seconds, up to 9000. Default is 3 times the interval."`
+	DNSServers        []string `comment:"IPv6 addresses of DNS servers to advertise, i.e. [ \"200:1234::53\" ]."`
+	DNSSearchList     []string `comment:"DNS search domains to advertise, i.e. [ \"example.com\" ]."`
+}
+
+// MulticastForwardingConfig defines which multicast groups are forwarded and who with
+type MulticastForwardingConfig struct {
+	Groups  []string `comment:"Multicast groups, or prefixes of groups in CIDR notation, which may\nbe forwarded, i.e. \"ff0e::1234\" or \"ff05::/16\". Groups with\nlink-local or smaller scope are never forwarded."`
+	Join    []string `comment:"Multicast groups which this node always joins, for hosts that don't\nsend MLD reports. These must be allowed by Groups."`
+	Members []string `comment:"Encryption public keys of remote nodes to exchange memberships with.\nMemberships are also exchanged with directly connected peers, but not\nwith any other nodes, so both nodes of a pair that aren't peers need\nto list each other."`
+}
+
+// SessionCleanupConfig defines when sessions are closed
+type SessionCleanupConfig struct {
+	Timeout  int `comment:"Time after which a session that nothing has been received in is\nclosed, specified in milliseconds. Default is 60000."`
+	Interval int `comment:"Time between checks for timed out sessions, specified in\nmilliseconds. Timed out sessions aren't used, but hold memory until\nthe next check. Default is 60000."`
+}
+
+// StoreAndForwardConfig defines how packets are held for destinations without a session
+type StoreAndForwardConfig struct {
+	Enable   bool `comment:"Hold packets for destinations that a session is being set up with."`
+	Packets  int  `comment:"Most packets held for each destination. Default is 32."`
+	Holdtime int  `comment:"Time that packets are held for, specified in milliseconds. Default\nis 3000."`
+}
+
+// AnycastServiceConfig defines the keys of an anycast service
+type AnycastServiceConfig struct {
+	EncryptionPublicKey  string `comment:"Public encryption key of the service, which determines its address."`
+	EncryptionPrivateKey string `comment:"Private encryption key of the service, shared by all of the nodes\nthat answer for it."`
+}
+
+// SNMPConfig defines where the SNMP agent listens and how it answers
+type SNMPConfig struct {
+	Listen    string `comment:"UDP address to listen for SNMP requests on, i.e. \"[::1]:161\". If left\nempty then the agent isn't started."`
+	Community string `comment:"Community which requests must use. Default is \"public\"."`
+	BaseOID   string `comment:"OID that the node's objects are found under. Default is\n1.3.6.1.4.1.99999, which isn't a registered enterprise number, so\nchange it if it clashes with anything else that you monitor."`
+}
+
+// WebUIConfig defines where the web UI is served
+type WebUIConfig struct {
+	Listen string `comment:"TCP address to serve the web UI on, i.e. \"localhost:9002\". If left\nempty then the web UI isn't served. There's no authentication, so only\nlisten on an address that untrusted users can't reach."`
+}
+
+// StatsExportConfig defines where, how often and in which format stats are written
+type StatsExportConfig struct {
+	Target   string `comment:"Path of the unix datagram socket to write stats to. If left empty\nthen stats are not written."`
+	Interval int    `comment:"Time between writing stats, specified in seconds. Default is 10."`
+	Format   string `comment:"Either \"statsd\", which writes one statsd line per stat with counters\nas the change since the last interval, or \"json\", which writes a\nsingle JSON object with the current value of every stat. Default is\n\"statsd\"."`
+	Prefix   string `comment:"Prefix of the stat names. Default is \"yggdrasil\"."`
+}
+
+// TapNeighborsConfig defines the static neighbors on the TAP adapter
+type TapNeighborsConfig struct {
+	Static          map[string]string `comment:"MAC addresses of hosts by IPv6 address, i.e.\n{ \"fe80::1\": \"02:00:00:00:00:01\" }. Unicast frames to these addresses\nalways go to these MAC addresses."`
+	DefaultMAC      string            `comment:"MAC address that other unicast frames are sent to, until one is\nlearned or always if learning is disabled."`
+	DisableLearning bool              `comment:"Don't learn which MAC address to send unicast frames to from the\nICMPv6 frames that hosts send, so that only the static addresses and\nthe default are used. This needs DefaultMAC to be set."`
+}
+
+// TunBuffersConfig defines the queue and buffer sizes for the TUN/TAP adapter
+type TunBuffersConfig struct {
+	TxQueueLength  int  `comment:"Length of the adapter's transmit queue in the kernel, in packets.\nOnly supported on Linux. Default is to leave the kernel's setting alone."`
+	ReadBufferSize int  `comment:"Size of the buffer that packets are read from the adapter into, in\nbytes. Default and minimum is the MTU, plus the ethernet header in TAP\nmode."`
+	SendQueueSize  int  `comment:"Number of packets read from the adapter that can wait to be sent by\nthe router. Default is 32."`
+	RecvQueueSize  int  `comment:"Number of packets received by the router that can wait to be written\nto the adapter. When the queue is full, i.e. while the adapter is\nstalled, the oldest packets are dropped to make room if DropWhenFull\nis set. Default is 32."`
+	Queues         int  `comment:"Number of queues to open on the adapter, each of which is read and\nwritten by its own goroutine, so that several CPU cores can handle\npackets at once. Only supported on Linux. Default is 1."`
+	BatchSize      int  `comment:"Most packets read from or written to each queue of the adapter at a\ntime. Packets that are already waiting are handled together, which\nsaves waking up the reader and writer for each one. Reads are only\nbatched on Linux. getTunTap shows the average batch sizes, which tell\nwhether a bigger size would help. Default is 16."`
+	DropWhenFull   bool `comment:"Drop packets when a queue is full instead of waiting for room. Waiting\npushes back on the sender, as a real interface would, but a stalled\nadapter then stalls the router, and all traffic through this node,\nalong with it. Dropped packets are counted by getTunTap. Default is\nfalse."`
+}
+
+// ExtraInterfaceConfig defines an additional TUN adapter and the destinations that are written to it
+type ExtraInterfaceConfig struct {
+	Name     string   `comment:"Name of the adapter, i.e. \"tun1\"."`
+	MTU      int      `comment:"MTU of the adapter. If 0 then IfMTU is used."`
+	Address  string   `comment:"Address to assign to the adapter in CIDR notation, either IPv6 or\nIPv4. If empty then no address is assigned."`
+	Prefixes []string `comment:"Destinations in CIDR notation of the packets from the mesh that are\nwritten to this adapter, i.e. [ \"200:1234::/64\", \"192.168.2.0/24\" ]."`
+}
+
+// TunnelRoutingConfig defines which IPv4 subnets are routed to which nodes
+type TunnelRoutingConfig struct {
+	Enable           bool              `comment:"Enable crypto-key routing of IPv4."`
+	IPv4Destinations map[string]string `comment:"IPv4 subnets in CIDR notation, each mapped to the encryption public key\nof the node that packets to it are sent to, i.e.\n{ \"192.168.2.0/24\": \"a1b2...\" }. Packets from a node are only accepted\nif their source is in a subnet that is mapped to that node."`
+	IPv4Sources      []string          `comment:"IPv4 subnets in CIDR notation that packets read from the adapter may\ncome from, i.e. this node's own LAN. Packets from anywhere else are\ndropped."`
+}
+
+// PacketFilterRule defines a rule for IPv6 packets that pass through the TUN/TAP adapter
+type PacketFilterRule struct {
+	Action      string `comment:"Either \"accept\" or \"drop\"."`
+	Direction   string `comment:"Either \"in\" for packets from the mesh, \"out\" for packets read from\nthe adapter, or \"both\". Default is \"both\"."`
+	Protocol    string `comment:"Either \"tcp\", \"udp\", \"icmpv6\" or a protocol number. If empty then\nany protocol matches."`
+	Source      string `comment:"Source address, or prefix in CIDR notation. If empty then any\nsource matches."`
+	Destination string `comment:"Destination address, or prefix in CIDR notation. If empty then any\ndestination matches."`
+	Ports       string `comment:"Destination port, or range of ports, i.e. \"8000-8999\". Only for tcp\nor udp. If empty then any port matches."`
+	Multicast   bool   `comment:"Only match packets to multicast destinations."`
+}
+
+// ParentSelectionConfig defines how the parent in the spanning tree is chosen
+type ParentSelectionConfig struct {
+	PreferredEncryptionPublicKeys []string `comment:"Encryption public keys of peers to use as parent in preference to\nany other peer whenever one of them is connected and leads to the same\nroot, even if another peer offers a shorter path to the root."`
+	Pin                           bool     `comment:"Never use any peer other than the preferred peers as parent. If none\nof them is connected, this node becomes the root of its own tree, which\ncuts it and anything below it off from the rest of the network."`
+	Holddown                      int      `comment:"Time after changing parent during which this node won't change parent\nagain just because another peer offers a shorter path to the root,\nspecified in milliseconds. Changes forced by the parent going away or\nchanging coords still happen straight away. Default is 0."`
+}
+
 // NetConfig defines network/proxy related configuration values
 type NetConfig struct {
 	Tor TorConfig `comment:"Experimental options for configuring peerings over Tor."`
@@ -31,6 +232,25 @@ type SessionFirewall struct {
 	AllowFromDirect               bool     `comment:"Allow network traffic from directly connected peers."`
 	AllowFromRemote               bool     `comment:"Allow network traffic from remote nodes on the network that you are\nnot directly peered with."`
 	AlwaysAllowOutbound           bool     `comment:"Allow outbound network traffic regardless of AllowFromDirect or\nAllowFromRemote. This does allow a remote node to send unsolicited\ntraffic back to you for the length of the session."`
+	DenyInbound                   bool     `comment:"Reject sessions opened by remote nodes unless they are whitelisted,\nwhile still allowing sessions opened by this node. This makes the\nnode behave like an outbound-only client and overrides AllowFromDirect\nand AllowFromRemote."`
 	WhitelistEncryptionPublicKeys []string `comment:"List of public keys from which network traffic is always accepted,\nregardless of AllowFromDirect or AllowFromRemote."`
 	BlacklistEncryptionPublicKeys []string `comment:"List of public keys from which network traffic is always rejected,\nregardless of the whitelist, AllowFromDirect or AllowFromRemote."`
+	WhitelistPrefixes             []string `comment:"List of address or subnet prefixes in CIDR notation, i.e. \"200::/7\"\nor \"300:1234:5678:9abc::/64\", from which network traffic is always\naccepted. A node matches if either its address or its subnet falls\nwithin the prefix. This is useful when keys are rotated frequently."`
+	BlacklistPrefixes             []string `comment:"List of address or subnet prefixes in CIDR notation from which\nnetwork traffic is always rejected, regardless of the whitelists,\nAllowFromDirect or AllowFromRemote."`
+}
+
+// EscapeZone escapes the zone of a link-local address in a peer URI, i.e. tcp://[fe80::1%eth0]:1234, which url.Parse otherwise rejects, as zones must be written as %25eth0 in URLs.
+// Zone names that need escaping, like Windows interface names with spaces, are escaped too, and zones that are already escaped are left alone.
+func EscapeZone(uri string) string {
+	start := strings.Index(uri, "[")
+	end := strings.Index(uri, "]")
+	if start < 0 || end < start {
+		return uri
+	}
+	host := uri[start+1 : end]
+	idx := strings.Index(host, "%")
+	if idx < 0 || strings.HasPrefix(host[idx:], "%25") {
+		return uri
+	}
+	return uri[:start+1] + host[:idx] + "%25" + url.PathEscape(host[idx+1:]) + uri[end:]
 }
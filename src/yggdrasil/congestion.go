@@ -0,0 +1,442 @@
+package yggdrasil
+
+// This implements congestion control for session traffic, so that a session
+// sends at the rate that its path can deliver, instead of as fast as the TUN/TAP
+// adapter hands it packets, which fills the queues of slow transit links until
+// they collapse.
+// The receiving end of a session sends feedback every few packets, inside the
+// session, saying how much it has received and the newest nonce it has seen.
+// The sender looks that nonce up in a log of what it sent, which gives the
+// round trip time and how much is still in flight. Feedback is only sent to
+// nodes that ask for it in their session pings, and only sessions with nodes
+// that ask for it are paced, so sessions with older nodes are sent as before.
+// Controllers are pluggable, and selected with SessionCongestionControl. The
+// default is a simplified BBR, which estimates the bottleneck bandwidth and
+// minimum round trip time of the path, and paces packets at the bandwidth
+// while keeping about two bandwidth-delay products in flight.
+
+import (
+	"errors"
+	"time"
+)
+
+// CongestionControl is implemented by session congestion controllers, which
+// can be added to a node with Core.AddCongestionControl. Each session has its
+// own controller, which is only used from the session's goroutine.
+type CongestionControl interface {
+	// Returns how long to wait before sending a packet of the given size, or
+	// 0 if it can be sent now.
+	Delay(now time.Time, size int) time.Duration
+	// Called when a packet of the given size is sent.
+	OnSend(now time.Time, size int)
+	// Called when feedback arrives from the other end of the session.
+	OnFeedback(now time.Time, sample CongestionSample)
+	// Describes the state of the controller, for the admin API.
+	Info() map[string]interface{}
+}
+
+// CongestionSample is the feedback from the other end of a session.
+type CongestionSample struct {
+	RTT       time.Duration // Round trip time, or 0 if it couldn't be measured
+	InFlight  uint64        // Bytes sent that the feedback doesn't cover yet
+	Delivered uint64        // Bytes that the other end has received in the session
+	CE        uint64        // Packets that the other end has received marked Congestion Experienced
+}
+
+// The default controller, and the one that disables congestion control.
+const congestion_default = "bbr"
+const congestion_none = "none"
+
+// The built-in controllers.
+var congestion_builtin = map[string]func() CongestionControl{
+	"bbr": func() CongestionControl { return &congestion_bbr{} },
+}
+
+// The receiving end of a session sends feedback after this many packets, or after this long once a packet has arrived, whichever comes first.
+const congestion_feedbackPackets = 16
+const congestion_feedbackInterval = 20 * time.Millisecond
+
+// How many sent packets are remembered for matching feedback to, and how many packets may wait for the controller before more are dropped.
+const congestion_logSize = 1024
+const congestion_maxHeld = 128
+
+// Feedback is sent inside a session, with this first byte, which can't start an IPv6 packet or a dummy packet.
+const congestion_feedbackMarker = 0x01
+
+// Feedback about the packets received in a session.
+type congestion_feedback struct {
+	Nonce     boxNonce      // The newest nonce received
+	Delay     time.Duration // How long after receiving that nonce the feedback was sent
+	Delivered uint64        // Bytes of traffic received in the session
+	CE        uint64        // Packets received marked Congestion Experienced
+}
+
+// A packet that was sent, for matching feedback to.
+type congestion_sent struct {
+	nonce boxNonce
+	time  time.Time
+	total uint64 // Bytes sent in the session, up to and including this packet
+}
+
+// Encodes feedback for sending inside a session.
+func (f *congestion_feedback) encode() []byte {
+	bs := append(util_getBytes(), congestion_feedbackMarker)
+	bs = append(bs, f.Nonce[:]...)
+	bs = wire_put_uint64(uint64(f.Delay/time.Microsecond), bs)
+	bs = wire_put_uint64(f.Delivered, bs)
+	bs = wire_put_uint64(f.CE, bs)
+	return bs
+}
+
+// Decodes feedback received inside a session, which may be followed by padding.
+func (f *congestion_feedback) decode(bs []byte) bool {
+	var delay uint64
+	if len(bs) < 1 || bs[0] != congestion_feedbackMarker {
+		return false
+	}
+	bs = bs[1:]
+	switch {
+	case !wire_chop_slice(f.Nonce[:], &bs):
+		return false
+	case !wire_chop_uint64(&delay, &bs):
+		return false
+	case !wire_chop_uint64(&f.Delivered, &bs):
+		return false
+	case !wire_chop_uint64(&f.CE, &bs):
+		return false
+	}
+	f.Delay = time.Duration(delay) * time.Microsecond
+	return true
+}
+
+// Sets the congestion controller that new sessions use, by name.
+func (ss *sessions) setCongestionControl(name string) error {
+	if name == "" {
+		name = congestion_default
+	}
+	if _, isIn := ss.congestionControls[name]; !isIn && name != congestion_none {
+		return errors.New("unknown congestion control: " + name)
+	}
+	ss.congestionControl = name
+	return nil
+}
+
+// Makes a new congestion controller for a session, or returns nil if congestion control is disabled.
+func (ss *sessions) newCongestionControl() CongestionControl {
+	if newControl, isIn := ss.congestionControls[ss.congestionControl]; isIn {
+		return newControl()
+	}
+	return nil
+}
+
+// Returns true if we have a congestion controller, and the other end will send it feedback, as they asked for feedback too.
+func (sinfo *sessionInfo) isPaced() bool {
+	return sinfo.congestion != nil && sinfo.theirFeedback
+}
+
+// Sends a packet now if the congestion controller allows it, or else holds it until it does.
+// Packets are dropped once too many are held, which is what tells TCP and the like to slow down.
+func (sinfo *sessionInfo) doPacedSend(bs []byte) {
+	if !sinfo.isPaced() || (len(sinfo.held) == 0 && sinfo.congestion.Delay(time.Now(), len(bs)) == 0) {
+		sinfo.doSend(bs)
+		return
+	}
+	if len(sinfo.held) >= congestion_maxHeld {
+		sinfo.heldDropped++
+		util_putBytes(bs)
+		return
+	}
+	sinfo.held = append(sinfo.held, bs)
+}
+
+// Sends as many of the held packets as the congestion controller allows, and returns how long to wait before trying again, or 0 if nothing is held.
+func (sinfo *sessionInfo) sendHeld() time.Duration {
+	for len(sinfo.held) > 0 {
+		// If they stopped asking for feedback, then everything held is sent now
+		if sinfo.isPaced() {
+			if delay := sinfo.congestion.Delay(time.Now(), len(sinfo.held[0])); delay > 0 {
+				return delay
+			}
+		}
+		bs := sinfo.held[0]
+		sinfo.held[0] = nil
+		sinfo.held = sinfo.held[1:]
+		sinfo.doSend(bs)
+	}
+	sinfo.held = nil
+	return 0
+}
+
+// Records a packet that was sent, so that feedback can be matched to it, and tells the congestion controller if it's traffic.
+// Every packet is recorded, including dummy packets and feedback, as feedback is for the newest nonce that the other end received, whatever the packet was.
+func (sinfo *sessionInfo) logSent(nonce *boxNonce, size int, isTraffic bool) {
+	if sinfo.congestion == nil {
+		return
+	}
+	now := time.Now()
+	sinfo.sentLog[sinfo.sentLogPos] = congestion_sent{nonce: *nonce, time: now, total: sinfo.bytesSent}
+	sinfo.sentLogPos = (sinfo.sentLogPos + 1) % congestion_logSize
+	if isTraffic {
+		sinfo.congestion.OnSend(now, size)
+	}
+}
+
+// Passes feedback from the other end to the congestion controller, with the round trip time and bytes in flight worked out from the packet that it's for.
+// Bytes in flight are those sent after that packet, so anything lost before it no longer counts.
+// Feedback for a packet that isn't in the log is ignored, as there's nothing to tell how much is in flight, and the controller times out on its own if no other feedback arrives.
+func (sinfo *sessionInfo) handleFeedback(f *congestion_feedback) {
+	if sinfo.congestion == nil {
+		return
+	}
+	now := time.Now()
+	for idx := 1; idx <= congestion_logSize; idx++ {
+		sent := &sinfo.sentLog[(sinfo.sentLogPos-idx+congestion_logSize)%congestion_logSize]
+		if sent.time.IsZero() {
+			break
+		}
+		if sent.nonce == f.Nonce {
+			sample := CongestionSample{
+				InFlight:  sinfo.bytesSent - sent.total,
+				Delivered: f.Delivered,
+				CE:        f.CE,
+			}
+			if rtt := now.Sub(sent.time) - f.Delay; rtt > 0 {
+				sample.RTT = rtt
+			}
+			sinfo.congestion.OnFeedback(now, sample)
+			return
+		}
+	}
+}
+
+// Counts a packet received in the session, and returns true if it's time to send feedback.
+func (sinfo *sessionInfo) countForFeedback() bool {
+	if !sinfo.theirFeedback {
+		return false
+	}
+	sinfo.theirNonceTime = time.Now()
+	sinfo.unacked++
+	return sinfo.unacked >= congestion_feedbackPackets
+}
+
+// Sends feedback about the packets received since the last feedback, if there are any.
+func (sinfo *sessionInfo) doSendFeedback() {
+	if sinfo.unacked == 0 || !sinfo.init {
+		return
+	}
+	sinfo.unacked = 0
+	f := congestion_feedback{
+		Nonce:     sinfo.theirNonce,
+		Delay:     time.Since(sinfo.theirNonceTime),
+		Delivered: sinfo.bytesRecvd,
+		CE:        sinfo.ceRecvd,
+	}
+	sinfo.doSend(f.encode())
+}
+
+// The states of the BBR controller.
+const (
+	congestion_bbrStartup = iota
+	congestion_bbrDrain
+	congestion_bbrProbeBW
+	congestion_bbrProbeRTT
+)
+
+var congestion_bbrStateNames = []string{"startup", "drain", "probe_bw", "probe_rtt"}
+
+// The gains that BBR paces at in each state, and the cycle of gains in probe_bw.
+const congestion_bbrHighGain = 2.885
+const congestion_bbrCwndGain = 2
+
+var congestion_bbrCycle = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// The congestion window until there's feedback and the minimum, in bytes, and how long to wait to try again when the window is full.
+const congestion_bbrInitialCwnd = 10 * 1500
+const congestion_bbrMinCwnd = 4 * 1500
+const congestion_bbrCwndRetry = 5 * time.Millisecond
+
+// How long the minimum round trip time is trusted before probing for it again, and how long the probe lasts.
+const congestion_bbrMinRTTWindow = 10 * time.Second
+const congestion_bbrProbeRTTTime = 200 * time.Millisecond
+
+// How long to wait for feedback before assuming that everything in flight was lost.
+const congestion_bbrFeedbackTimeout = time.Second
+
+// Packets up to this far ahead of the pacing rate are sent straight away, since timers aren't precise enough to pace them individually.
+const congestion_bbrMaxBurst = time.Millisecond
+
+// A delivery rate sample, in bytes per second.
+type congestion_bbrSample struct {
+	rate float64
+	time time.Time
+}
+
+// A simplified BBR, without the per-packet delivery rate sampling of the real
+// thing, since feedback only says how much has been delivered in total.
+type congestion_bbr struct {
+	state         int
+	samples       []congestion_bbrSample // Delivery rates over the bandwidth window
+	btlBw         float64                // Estimated bottleneck bandwidth, in bytes per second, or 0 until there's feedback
+	minRTT        time.Duration
+	minRTTTime    time.Time // When minRTT was last measured or confirmed
+	inFlight      uint64
+	lastDelivered uint64
+	lastFeedback  time.Time
+	roundStart    time.Time // When the current round trip started, for checks done once per round
+	fullBw        float64   // Bandwidth when startup last saw it grow
+	fullBwRounds  int       // Rounds since then without growth
+	cycleIndex    int
+	cycleStart    time.Time
+	probeRTTEnd   time.Time
+	nextSend      time.Time
+	firstSend     time.Time
+}
+
+func (b *congestion_bbr) pacingGain() float64 {
+	switch b.state {
+	case congestion_bbrStartup:
+		return congestion_bbrHighGain
+	case congestion_bbrDrain:
+		return 1 / congestion_bbrHighGain
+	case congestion_bbrProbeBW:
+		return congestion_bbrCycle[b.cycleIndex]
+	default:
+		return 1
+	}
+}
+
+// The estimated bandwidth-delay product of the path, in bytes.
+func (b *congestion_bbr) bdp() float64 {
+	return b.btlBw * b.minRTT.Seconds()
+}
+
+func (b *congestion_bbr) cwnd() uint64 {
+	if b.btlBw == 0 {
+		return congestion_bbrInitialCwnd
+	}
+	cwnd := uint64(congestion_bbrCwndGain * b.bdp())
+	if b.state == congestion_bbrProbeRTT || cwnd < congestion_bbrMinCwnd {
+		cwnd = congestion_bbrMinCwnd
+	}
+	return cwnd
+}
+
+func (b *congestion_bbr) Delay(now time.Time, size int) time.Duration {
+	if b.inFlight+uint64(size) > b.cwnd() {
+		last := b.lastFeedback
+		if last.IsZero() {
+			last = b.firstSend
+		}
+		if now.Sub(last) < congestion_bbrFeedbackTimeout {
+			return congestion_bbrCwndRetry
+		}
+		// The feedback for what's in flight was lost, and probably the packets too
+		b.inFlight = 0
+	}
+	if b.btlBw == 0 {
+		// Nothing to pace at until there's feedback
+		return 0
+	}
+	if wait := b.nextSend.Sub(now); wait > congestion_bbrMaxBurst {
+		return wait
+	}
+	return 0
+}
+
+func (b *congestion_bbr) OnSend(now time.Time, size int) {
+	if b.firstSend.IsZero() {
+		b.firstSend = now
+	}
+	b.inFlight += uint64(size)
+	if b.btlBw == 0 {
+		return
+	}
+	if b.nextSend.Before(now) {
+		b.nextSend = now
+	}
+	b.nextSend = b.nextSend.Add(time.Duration(float64(size) / (b.pacingGain() * b.btlBw) * float64(time.Second)))
+}
+
+func (b *congestion_bbr) OnFeedback(now time.Time, s CongestionSample) {
+	b.inFlight = s.InFlight
+	if s.RTT > 0 && (b.minRTT == 0 || s.RTT <= b.minRTT || b.state == congestion_bbrProbeRTT) {
+		b.minRTT = s.RTT
+		b.minRTTTime = now
+	}
+	if !b.lastFeedback.IsZero() && s.Delivered > b.lastDelivered {
+		if elapsed := now.Sub(b.lastFeedback).Seconds(); elapsed > 0 {
+			b.samples = append(b.samples, congestion_bbrSample{float64(s.Delivered-b.lastDelivered) / elapsed, now})
+		}
+	}
+	if s.Delivered >= b.lastDelivered {
+		b.lastDelivered = s.Delivered
+	}
+	b.lastFeedback = now
+	// The bottleneck bandwidth is the highest delivery rate over the last 10 round trips
+	window := 10 * b.minRTT
+	if window < 100*time.Millisecond {
+		window = 100 * time.Millisecond
+	}
+	b.btlBw = 0
+	for len(b.samples) > 1 && now.Sub(b.samples[0].time) > window {
+		b.samples = b.samples[1:]
+	}
+	for _, sample := range b.samples {
+		if sample.rate > b.btlBw {
+			b.btlBw = sample.rate
+		}
+	}
+	if b.btlBw == 0 || b.minRTT == 0 {
+		return
+	}
+	newRound := now.Sub(b.roundStart) >= b.minRTT
+	if newRound {
+		b.roundStart = now
+	}
+	if b.state != congestion_bbrProbeRTT && now.Sub(b.minRTTTime) > congestion_bbrMinRTTWindow {
+		// Drain the queue to see if the round trip time has gone down
+		b.state = congestion_bbrProbeRTT
+		b.probeRTTEnd = now.Add(congestion_bbrProbeRTTTime)
+	}
+	switch b.state {
+	case congestion_bbrStartup:
+		if !newRound {
+			break
+		}
+		if b.btlBw >= 1.25*b.fullBw {
+			b.fullBw = b.btlBw
+			b.fullBwRounds = 0
+		} else if b.fullBwRounds++; b.fullBwRounds >= 3 {
+			// The bandwidth stopped growing, so the pipe is full, and the queue that startup built can drain
+			b.state = congestion_bbrDrain
+		}
+	case congestion_bbrDrain:
+		if float64(b.inFlight) <= b.bdp() {
+			b.state = congestion_bbrProbeBW
+			b.cycleIndex = 2
+			b.cycleStart = now
+		}
+	case congestion_bbrProbeBW:
+		if now.Sub(b.cycleStart) >= b.minRTT {
+			b.cycleIndex = (b.cycleIndex + 1) % len(congestion_bbrCycle)
+			b.cycleStart = now
+		}
+	case congestion_bbrProbeRTT:
+		if now.After(b.probeRTTEnd) {
+			b.minRTTTime = now
+			b.state = congestion_bbrProbeBW
+			b.cycleStart = now
+		}
+	}
+}
+
+func (b *congestion_bbr) Info() map[string]interface{} {
+	return map[string]interface{}{
+		"state":           congestion_bbrStateNames[b.state],
+		"bottleneck_bps":  uint64(8 * b.btlBw),
+		"pacing_rate_bps": uint64(8 * b.btlBw * b.pacingGain()),
+		"min_rtt_ms":      float64(b.minRTT) / float64(time.Millisecond),
+		"cwnd_bytes":      b.cwnd(),
+		"in_flight_bytes": b.inFlight,
+	}
+}
@@ -0,0 +1,107 @@
+package yggdrasil
+
+import (
+	"testing"
+	"time"
+)
+
+// A congestion controller that records the samples it's given.
+type congestion_testRecorder struct {
+	samples []CongestionSample
+}
+
+func (r *congestion_testRecorder) Delay(now time.Time, size int) time.Duration { return 0 }
+func (r *congestion_testRecorder) OnSend(now time.Time, size int)              {}
+func (r *congestion_testRecorder) OnFeedback(now time.Time, s CongestionSample) {
+	r.samples = append(r.samples, s)
+}
+func (r *congestion_testRecorder) Info() map[string]interface{} { return nil }
+
+func TestCongestionFeedback(t *testing.T) {
+	// Each packet sent is 1000 bytes of traffic, apart from those marked as feedback
+	tests := []struct {
+		name      string
+		sent      int   // Packets sent, with nonces 1 to sent
+		feedback  []int // Nonces of the packets that were our own feedback, not traffic
+		acked     byte  // Nonce that the other end's feedback is for
+		delivered uint64
+		sample    bool // Whether the controller should get a sample
+		inFlight  uint64
+	}{
+		{"nothing lost", 10, nil, 10, 10000, true, 0},
+		{"newest packet acked after loss", 10, nil, 10, 4000, true, 0},
+		{"older packet acked after loss", 10, nil, 8, 5000, true, 2000},
+		{"feedback packet acked after loss", 10, []int{10}, 10, 4000, true, 0},
+		{"traffic after a feedback packet", 10, []int{6}, 6, 5000, true, 4000},
+		{"unknown nonce", 10, nil, 200, 5000, false, 0},
+		{"nothing sent", 0, nil, 1, 0, false, 0},
+	}
+	for _, test := range tests {
+		recorder := &congestion_testRecorder{}
+		sinfo := &sessionInfo{congestion: recorder, sentLog: make([]congestion_sent, congestion_logSize)}
+		for n := 1; n <= test.sent; n++ {
+			isTraffic := true
+			for _, f := range test.feedback {
+				isTraffic = isTraffic && f != n
+			}
+			if isTraffic {
+				sinfo.bytesSent += 1000
+			}
+			var nonce boxNonce
+			nonce[len(nonce)-1] = byte(n)
+			sinfo.logSent(&nonce, 1000, isTraffic)
+		}
+		f := congestion_feedback{Delivered: test.delivered}
+		f.Nonce[len(f.Nonce)-1] = test.acked
+		sinfo.handleFeedback(&f)
+		switch {
+		case len(recorder.samples) != 0 && !test.sample:
+			t.Errorf("%s: got a sample, want none", test.name)
+		case len(recorder.samples) == 0 && test.sample:
+			t.Errorf("%s: got no sample", test.name)
+		case test.sample && recorder.samples[0].InFlight != test.inFlight:
+			t.Errorf("%s: got %d bytes in flight, want %d", test.name, recorder.samples[0].InFlight, test.inFlight)
+		case test.sample && recorder.samples[0].Delivered != test.delivered:
+			t.Errorf("%s: got %d bytes delivered, want %d", test.name, recorder.samples[0].Delivered, test.delivered)
+		}
+	}
+}
+
+func TestCongestionBBRLoss(t *testing.T) {
+	sinfo := &sessionInfo{congestion: &congestion_bbr{}, sentLog: make([]congestion_sent, congestion_logSize)}
+	b := sinfo.congestion.(*congestion_bbr)
+	send := func(n int) {
+		var nonce boxNonce
+		nonce[len(nonce)-1] = byte(n)
+		sinfo.bytesSent += 1500
+		sinfo.logSent(&nonce, 1500, true)
+	}
+	for n := 1; n <= 10; n++ {
+		send(n)
+	}
+	if delay := b.Delay(time.Now(), 1500); delay == 0 {
+		t.Fatal("the initial window isn't full after sending it")
+	}
+	// Feedback for the newest packet after most were lost, which must open the window again
+	f := congestion_feedback{Delivered: 3000}
+	f.Nonce[len(f.Nonce)-1] = 10
+	sinfo.handleFeedback(&f)
+	if b.inFlight != 0 {
+		t.Errorf("got %d bytes in flight after the newest packet was acked, want 0", b.inFlight)
+	}
+	if delay := b.Delay(time.Now(), 1500); delay != 0 {
+		t.Errorf("still waiting %v after the newest packet was acked", delay)
+	}
+	// Fill the window again, then keep getting feedback that can't be matched, which mustn't hold it shut
+	for n := 11; b.inFlight+1500 <= b.cwnd(); n++ {
+		send(n)
+	}
+	for idx := 0; idx < 10; idx++ {
+		f := congestion_feedback{Delivered: 3000}
+		f.Nonce[0] = 0xff
+		sinfo.handleFeedback(&f)
+	}
+	if delay := b.Delay(time.Now().Add(2*congestion_bbrFeedbackTimeout), 1500); delay == congestion_bbrCwndRetry {
+		t.Error("the window stayed full after the feedback timed out")
+	}
+}
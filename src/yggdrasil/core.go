@@ -2,16 +2,23 @@ package yggdrasil
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"regexp"
+	"strings"
+	"time"
 
 	"yggdrasil/config"
 	"yggdrasil/defaults"
 )
 
+// The name and version of the build, which are set by the build script with
+// i.e. -ldflags="-X yggdrasil.buildName=yggdrasil -X yggdrasil.buildVersion=0.2".
+var buildName, buildVersion string
+
 // The Core object represents the Yggdrasil node. You should create a Core
 // object for each Yggdrasil node you plan to run.
 type Core struct {
@@ -27,12 +34,41 @@ type Core struct {
 	router      router
 	dht         dht
 	tun         tunDevice
+	extraTun    tunExtras
 	admin       admin
 	searches    searches
 	multicast   multicast
 	tcp         tcpInterface
+	collisions  collisions
+	crawler     crawler
+	nodeinfo    nodeinfo
+	bench       bench
+	routeExport routeExport
+	policyRoute policyRouting
+	routerAdv   routerAdv
+	ndpProxy    ndpProxy
+	addrWatch   addrWatch
+	resumeWatch resumeWatch
+	cjdns       cjdnsBridge
+	mcastFwd    mcastForward
+	anycast     anycast
+	snmp        snmpAgent
+	statsExport statsExport
+	proxies     proxyList
+	aliases     aliases
+	webUI       webUI
+	crashes     crashReports
+	flowTrace   flowTracer
+	pktFilter   packetFilter
+	priority    trafficPriority
+	capture     packetCapture
+	ckr         cryptokeyRouting
+	addrBook    addressBook
+	storeFwd    storeForward
 	log         *log.Logger
-	ifceExpr    []*regexp.Regexp // the zone of link-local IPv6 peers must match this
+	startTime   time.Time                           // When the node was started, for its uptime
+	ifceExpr    []*regexp.Regexp                    // the zone of link-local IPv6 peers must match this
+	congestion  map[string]func() CongestionControl // added with AddCongestionControl
 }
 
 func (c *Core) init(bpub *boxPubKey,
@@ -50,8 +86,34 @@ func (c *Core) init(bpub *boxPubKey,
 	c.boxPub, c.boxPriv = *bpub, *bpriv
 	c.sigPub, c.sigPriv = *spub, *spriv
 	c.admin.core = c
+	c.collisions.init(c)
 	c.sigs.init()
 	c.searches.init(c)
+	c.crawler.init(c)
+	c.nodeinfo.init(c)
+	c.bench.init(c)
+	c.routeExport.init(c)
+	c.policyRoute.init(c)
+	c.routerAdv.init(c)
+	c.ndpProxy.init(c)
+	c.addrWatch.init(c)
+	c.resumeWatch.init(c)
+	c.cjdns.init(c)
+	c.mcastFwd.init(c)
+	c.storeFwd.init(c)
+	c.addrBook.init(c)
+	c.anycast.init(c)
+	c.snmp.init(c)
+	c.statsExport.init(c)
+	c.proxies.init(c)
+	c.aliases.init(c)
+	c.webUI.init(c)
+	c.crashes.init(c)
+	c.flowTrace.init(c)
+	c.pktFilter.init(c)
+	c.capture.init(c)
+	c.ckr.init(c)
+	c.priority.init()
 	c.dht.init(c)
 	c.sessions.init(c)
 	c.multicast.init(c)
@@ -59,6 +121,7 @@ func (c *Core) init(bpub *boxPubKey,
 	c.router.init(c)
 	c.switchTable.init(c, c.sigPub) // TODO move before peers? before router?
 	c.tun.init(c)
+	c.extraTun.init(c)
 }
 
 // Starts up Yggdrasil using the provided NodeConfig, and outputs debug logging
@@ -68,6 +131,7 @@ func (c *Core) init(bpub *boxPubKey,
 func (c *Core) Start(nc *config.NodeConfig, log *log.Logger) error {
 	c.log = log
 	c.log.Println("Starting up...")
+	c.startTime = time.Now()
 
 	var boxPub boxPubKey
 	var boxPriv boxPrivKey
@@ -95,13 +159,67 @@ func (c *Core) Start(nc *config.NodeConfig, log *log.Logger) error {
 	copy(sigPriv[:], sigPrivHex)
 
 	c.init(&boxPub, &boxPriv, &sigPub, &sigPriv)
+
+	if err := c.crashes.setConfig(nc.CrashDirectory, nc); err != nil {
+		c.log.Println("Failed to configure crash reports")
+		return err
+	}
+	if err := c.crashes.start(); err != nil {
+		c.log.Println("Failed to start crash reports")
+		return err
+	}
+
 	c.admin.init(c, nc.AdminListen)
 
-	if err := c.tcp.init(c, nc.Listen, nc.ReadTimeout); err != nil {
+	if err := c.tcp.init(c, nc.Listen, nc.ReadTimeout, nc.KeepaliveInterval, nc.HandshakeTimeout, nc.PassiveKeepalive); err != nil {
 		c.log.Println("Failed to start TCP interface")
 		return err
 	}
 
+	for name, command := range nc.Transports {
+		c.tcp.addTransport(name, &commandTransport{command: strings.Fields(command)})
+	}
+
+	if err := c.proxies.setConfig(nc.Proxies.List, time.Duration(nc.Proxies.CheckInterval)*time.Second); err != nil {
+		c.log.Println("Failed to configure proxies")
+		return err
+	}
+
+	for _, l := range nc.Listeners {
+		if err := c.tcp.addListener(l.Listen, l.Policy, l.AllowedEncryptionPublicKeys); err != nil {
+			c.log.Println("Failed to start TCP listener on", l.Listen)
+			return err
+		}
+	}
+
+	if err := c.switchTable.setParentPreferences(
+		nc.ParentSelection.PreferredEncryptionPublicKeys,
+		nc.ParentSelection.Pin,
+		time.Duration(nc.ParentSelection.Holddown)*time.Millisecond,
+	); err != nil {
+		c.log.Println("Failed to configure parent selection")
+		return err
+	}
+
+	c.router.setTunQueues(nc.IfBuffers.SendQueueSize, nc.IfBuffers.RecvQueueSize)
+	c.tun.setBuffers(nc.IfBuffers.TxQueueLength, nc.IfBuffers.ReadBufferSize, nc.IfBuffers.Queues, nc.IfBuffers.BatchSize)
+	c.tun.setDropWhenFull(nc.IfBuffers.DropWhenFull)
+	c.tun.setOffload(nc.IfOffload)
+	c.tun.setHelper(nc.IfHelperSocket)
+	c.tun.setLinkNames(nc.IfGroup, nc.IfAlias, nc.IfAltNames)
+	if err := c.tun.setPeerAddress(nc.IfPeerAddress); err != nil {
+		c.log.Println("Failed to configure TUN/TAP peer address")
+		return err
+	}
+	if err := c.tun.setTAPMulticast(nc.IfTAPMulticast); err != nil {
+		c.log.Println("Failed to configure TAP multicast policy")
+		return err
+	}
+	if err := c.SetTAPNeighbors(nc.IfTAPNeighbors); err != nil {
+		c.log.Println("Failed to configure TAP neighbors")
+		return err
+	}
+
 	if err := c.switchTable.start(); err != nil {
 		c.log.Println("Failed to start switch")
 		return err
@@ -112,9 +230,141 @@ func (c *Core) Start(nc *config.NodeConfig, log *log.Logger) error {
 		nc.SessionFirewall.AllowFromDirect,
 		nc.SessionFirewall.AllowFromRemote,
 		nc.SessionFirewall.AlwaysAllowOutbound,
+		nc.SessionFirewall.DenyInbound,
 	)
 	c.sessions.setSessionFirewallWhitelist(nc.SessionFirewall.WhitelistEncryptionPublicKeys)
 	c.sessions.setSessionFirewallBlacklist(nc.SessionFirewall.BlacklistEncryptionPublicKeys)
+	if err := c.sessions.setSessionFirewallWhitelistPrefixes(nc.SessionFirewall.WhitelistPrefixes); err != nil {
+		c.log.Println("Failed to set session firewall whitelist prefixes")
+		return err
+	}
+	if err := c.sessions.setSessionFirewallBlacklistPrefixes(nc.SessionFirewall.BlacklistPrefixes); err != nil {
+		c.log.Println("Failed to set session firewall blacklist prefixes")
+		return err
+	}
+	c.sessions.setSessionPadding(nc.SessionPadding)
+	c.sessions.setCleanup(
+		time.Duration(nc.SessionCleanup.Timeout)*time.Millisecond,
+		time.Duration(nc.SessionCleanup.Interval)*time.Millisecond,
+	)
+	for name, newControl := range c.congestion {
+		c.sessions.congestionControls[name] = newControl
+	}
+	if err := c.sessions.setCongestionControl(nc.SessionCongestionControl); err != nil {
+		c.log.Println("Failed to set session congestion control")
+		return err
+	}
+	c.collisions.setExitOnCollision(nc.ExitOnCollision)
+	c.storeFwd.setConfig(
+		nc.StoreAndForward.Enable,
+		nc.StoreAndForward.Packets,
+		time.Duration(nc.StoreAndForward.Holdtime)*time.Millisecond,
+	)
+
+	if err := c.nodeinfo.setNodeInfo(nc.NodeInfo); err != nil {
+		c.log.Println("Failed to set NodeInfo")
+		return err
+	}
+	if err := c.aliases.setAliases(nc.Aliases); err != nil {
+		c.log.Println("Failed to configure aliases")
+		return err
+	}
+	c.addrBook.setFile(nc.AddressBookFile)
+	c.nodeinfo.setCacheTTL(time.Duration(nc.NodeInfoCacheTTL) * time.Second)
+	c.bench.setEnabled(nc.AllowBench)
+
+	if err := c.routeExport.setConfig(nc.RouteExport.Target, nc.RouteExport.NextHop, nc.RouteExport.Prefixes); err != nil {
+		c.log.Println("Failed to configure route export")
+		return err
+	}
+	if err := c.policyRoute.setConfig(
+		nc.PolicyRouting.Enable,
+		nc.PolicyRouting.Table,
+		nc.PolicyRouting.Mark,
+		nc.PolicyRouting.Priority,
+		nc.PolicyRouting.Prefixes,
+		nc.PolicyRouting.Users,
+		nc.PolicyRouting.CGroups,
+	); err != nil {
+		c.log.Println("Failed to configure policy routing")
+		return err
+	}
+	if err := c.pktFilter.setRules(nc.PacketFilter); err != nil {
+		c.log.Println("Failed to configure packet filter")
+		return err
+	}
+	if err := c.ckr.setConfig(
+		nc.TunnelRouting.Enable,
+		nc.TunnelRouting.IPv4Destinations,
+		nc.TunnelRouting.IPv4Sources,
+	); err != nil {
+		c.log.Println("Failed to configure tunnel routing")
+		return err
+	}
+	if err := c.priority.setConfig(nc.DSCPPriority); err != nil {
+		c.log.Println("Failed to configure DSCP priorities")
+		return err
+	}
+	if err := c.cjdns.setMappings(nc.CjdnsBridge); err != nil {
+		c.log.Println("Failed to configure cjdns bridge")
+		return err
+	}
+	if err := c.mcastFwd.setConfig(
+		nc.MulticastForwarding.Groups,
+		nc.MulticastForwarding.Join,
+		nc.MulticastForwarding.Members,
+	); err != nil {
+		c.log.Println("Failed to configure multicast forwarding")
+		return err
+	}
+	for _, service := range nc.AnycastServices {
+		if err := c.anycast.addService(service.EncryptionPublicKey, service.EncryptionPrivateKey); err != nil {
+			c.log.Println("Failed to configure anycast service")
+			return err
+		}
+	}
+	if err := c.snmp.setConfig(nc.SNMP.Listen, nc.SNMP.Community, nc.SNMP.BaseOID); err != nil {
+		c.log.Println("Failed to configure SNMP agent")
+		return err
+	}
+	if err := c.webUI.setConfig(nc.WebUI.Listen); err != nil {
+		c.log.Println("Failed to configure web UI")
+		return err
+	}
+	if err := c.statsExport.setConfig(
+		nc.StatsExport.Target,
+		time.Duration(nc.StatsExport.Interval)*time.Second,
+		nc.StatsExport.Format,
+		nc.StatsExport.Prefix,
+	); err != nil {
+		c.log.Println("Failed to configure stats export")
+		return err
+	}
+	if err := c.routerAdv.setConfig(nc.RouterAdvertisement); err != nil {
+		c.log.Println("Failed to configure router advertisements")
+		return err
+	}
+	c.ndpProxy.setConfig(nc.NDPProxyInterface)
+	if err := c.extraTun.setConfig(nc.ExtraInterfaces); err != nil {
+		c.log.Println("Failed to configure extra TUN adapters")
+		return err
+	}
+
+	c.dht.setCacheFile(nc.DHTCacheFile)
+	c.dht.setParameters(
+		nc.DHT.BucketSize,
+		time.Duration(nc.DHT.MaintenanceInterval)*time.Millisecond,
+	)
+	c.searches.setParameters(
+		nc.DHT.SearchSize,
+		nc.DHT.SearchParallelism,
+		time.Duration(nc.DHT.SearchTimeout)*time.Millisecond,
+	)
+	c.searches.setRetries(
+		time.Duration(nc.DHT.SearchRetryInterval)*time.Millisecond,
+		nc.DHT.SearchRetries,
+		nc.DHT.SearchRetryBackoff,
+	)
 
 	if err := c.router.start(); err != nil {
 		c.log.Println("Failed to start router")
@@ -137,6 +387,59 @@ func (c *Core) Start(nc *config.NodeConfig, log *log.Logger) error {
 		return err
 	}
 
+	if err := c.extraTun.start(); err != nil {
+		c.log.Println("Failed to start extra TUN adapters")
+		return err
+	}
+
+	if err := c.policyRoute.start(); err != nil {
+		c.log.Println("Failed to start policy routing")
+		return err
+	}
+
+	if err := c.anycast.start(); err != nil {
+		c.log.Println("Failed to start anycast services")
+		return err
+	}
+
+	c.addrWatch.start()
+	c.resumeWatch.start()
+
+	if err := c.routerAdv.start(); err != nil {
+		c.log.Println("Failed to start router advertisements")
+		return err
+	}
+
+	if err := c.ndpProxy.start(); err != nil {
+		c.log.Println("Failed to start NDP proxy")
+		return err
+	}
+
+	if err := c.routeExport.start(); err != nil {
+		c.log.Println("Failed to start route export")
+		return err
+	}
+
+	if err := c.proxies.start(); err != nil {
+		c.log.Println("Failed to start proxy health checks")
+		return err
+	}
+
+	if err := c.snmp.start(); err != nil {
+		c.log.Println("Failed to start SNMP agent")
+		return err
+	}
+
+	if err := c.statsExport.start(); err != nil {
+		c.log.Println("Failed to start stats export")
+		return err
+	}
+
+	if err := c.webUI.start(); err != nil {
+		c.log.Println("Failed to start web UI")
+		return err
+	}
+
 	c.log.Println("Startup complete")
 	return nil
 }
@@ -144,8 +447,32 @@ func (c *Core) Start(nc *config.NodeConfig, log *log.Logger) error {
 // Stops the Yggdrasil node.
 func (c *Core) Stop() {
 	c.log.Println("Stopping...")
-	c.tun.close()
+	c.webUI.close()
+	c.statsExport.close()
+	c.snmp.close()
+	c.proxies.close()
+	c.routeExport.close()
+	c.policyRoute.close()
+	c.routerAdv.close()
+	c.ndpProxy.close()
+	c.addrWatch.close()
+	c.resumeWatch.close()
+	c.anycast.close()
+	memlink_unlisten(c)
+	c.capture.close()
+	c.extraTun.close()
+	c.tun.shutdown()
 	c.admin.close()
+	c.addrBook.close()
+	c.crashes.close()
+}
+
+// Accepts in-memory links from other Cores in the same process, which connect
+// by adding the peer mem://name. This is mainly useful for tests and
+// simulations, which can then run without any real sockets by also setting
+// Listen, AdminListen and IfName to "none".
+func (c *Core) ListenMem(name string) error {
+	return memlink_listen(name, c)
 }
 
 // Generates a new encryption keypair. The encryption keys are used to
@@ -154,6 +481,39 @@ func (c *Core) NewEncryptionKeys() (*boxPubKey, *boxPrivKey) {
 	return newBoxKeys()
 }
 
+// The highest strength that NewEncryptionKeysWithStrength accepts, which
+// already takes around 2^24 keypairs to reach.
+const core_maxKeyStrength = 24
+
+// NewEncryptionKeysWithStrength gives up after this many times the expected
+// number of tries, which it only reaches if the keys aren't random.
+const core_keyStrengthTries = 256
+
+// Generates new encryption keypairs until one is found whose NodeID begins
+// with at least the given number of leading 1 bits. Every extra leading 1 bit
+// adds another bit of the NodeID to the IPv6 address, making the address
+// harder to collide with, but also doubles the expected time taken to find a
+// suitable keypair. Returns an error if the strength is out of range, or if
+// no keypair was found within core_keyStrengthTries times the expected tries.
+func (c *Core) NewEncryptionKeysWithStrength(strength int) (*boxPubKey, *boxPrivKey, error) {
+	if strength < 0 || strength > core_maxKeyStrength {
+		return nil, nil, fmt.Errorf("strength must be between 0 and %d", core_maxKeyStrength)
+	}
+	for tries := uint64(0); tries < core_keyStrengthTries<<uint(strength); tries++ {
+		pub, priv := newBoxKeys()
+		if c.GetEncryptionKeyStrength(pub) >= strength {
+			return pub, priv, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no keys with strength %d found", strength)
+}
+
+// Returns the number of leading 1 bits in the NodeID derived from the given
+// encryption public key, which is also encoded into the IPv6 address.
+func (c *Core) GetEncryptionKeyStrength(pub *boxPubKey) int {
+	return int(address_addrForNodeID(getNodeID(pub))[len(address_prefix)])
+}
+
 // Generates a new signing keypair. The signing keys are used to derive the
 // structure of the spanning tree.
 func (c *Core) NewSigningKeys() (*sigPubKey, *sigPrivKey) {
@@ -183,6 +543,29 @@ func (c *Core) GetSubnet() *net.IPNet {
 	return &net.IPNet{IP: subnet, Mask: net.CIDRMask(64, 128)}
 }
 
+// Returns the nodes in the DHT that are closest in keyspace to the given key,
+// closest first. The key is either a full encryption public key or a full or
+// partial NodeID, in hex. Each node is described by its IP address, keys,
+// coords and the number of seconds since it was last seen.
+func (c *Core) GetClosestNodes(key string) ([]map[string]interface{}, error) {
+	infos, err := c.admin.getData_getClosestNodes(key)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []map[string]interface{}
+	for _, info := range infos {
+		nodes = append(nodes, info.asMap())
+	}
+	return nodes, nil
+}
+
+// Returns a channel that's closed when another node is found to be using the
+// same keys as this node while ExitOnCollision is enabled, so that the node
+// can be shut down.
+func (c *Core) CollisionExit() <-chan struct{} {
+	return c.collisions.getFatal()
+}
+
 // Sets the output logger of the Yggdrasil node after startup. This may be
 // useful if you want to redirect the output later.
 func (c *Core) SetLogger(log *log.Logger) {
@@ -190,11 +573,70 @@ func (c *Core) SetLogger(log *log.Logger) {
 }
 
 // Adds a peer. This should be specified in the peer URI format, i.e.
-// tcp://a.b.c.d:e, udp://a.b.c.d:e, socks://a.b.c.d:e/f.g.h.i:j
+// tcp://a.b.c.d:e, udp://a.b.c.d:e, socks://a.b.c.d:e/f.g.h.i:j, or
+// proxy://f.g.h.i:j to go through the configured proxies, or unix:///path for
+// a node on the same host, or stdio:// or pipe://?in=3&out=4 for a link carried
+// by whatever runs this process
 func (c *Core) AddPeer(addr string, sintf string) error {
 	return c.admin.addPeer(addr, sintf)
 }
 
+// Adds a pluggable transport, which can then be used by peers with the
+// transport parameter in their URI, i.e. tcp://a.b.c.d:e?transport=name. This
+// should be done after calling Start, and replaces any transport with the same
+// name, including those from the configuration.
+func (c *Core) AddTransport(name string, transport Transport) {
+	c.tcp.addTransport(name, transport)
+}
+
+// Adds a pluggable congestion controller for sessions, which can then be
+// selected with SessionCongestionControl in the configuration. The function is
+// called to make a controller for each new session. This should be done before
+// calling Start, and replaces any controller with the same name, including the
+// built-in ones.
+func (c *Core) AddCongestionControl(name string, newControl func() CongestionControl) {
+	if c.congestion == nil {
+		c.congestion = make(map[string]func() CongestionControl)
+	}
+	c.congestion[name] = newControl
+}
+
+// Adds a hook that sees each packet passing through the TUN/TAP adapter, after
+// the PacketFilter rules from the configuration, and can drop or change it.
+// Hooks are called in the order they were added, from the goroutines that
+// read and write the adapter, so they must be quick and safe to call
+// concurrently. This can be done before or after calling Start.
+func (c *Core) AddPacketHook(hook PacketHook) {
+	c.pktFilter.addHook(hook)
+}
+
+// Replaces the PacketFilter rules, i.e. when the configuration is reloaded. If
+// any of them are invalid then the existing rules are left unchanged.
+func (c *Core) SetPacketFilter(rules []config.PacketFilterRule) error {
+	return c.pktFilter.setRules(rules)
+}
+
+// Replaces the TunnelRouting configuration, i.e. when the configuration is
+// reloaded. If any of the subnets or keys are invalid then the existing routes
+// are left unchanged.
+func (c *Core) SetTunnelRouting(tr config.TunnelRoutingConfig) error {
+	return c.ckr.setConfig(tr.Enable, tr.IPv4Destinations, tr.IPv4Sources)
+}
+
+// Replaces the static neighbors on the TAP adapter, i.e. when the configuration
+// is reloaded. If any of the addresses are invalid then the existing neighbors
+// are left unchanged.
+func (c *Core) SetTAPNeighbors(tn config.TapNeighborsConfig) error {
+	return c.tun.icmpv6.setNeighbors(tn.Static, tn.DefaultMAC, tn.DisableLearning)
+}
+
+// Replaces the mapping of DSCP values to traffic priorities, i.e. when the
+// configuration is reloaded. If any of the values or priorities are invalid
+// then the existing mapping is left unchanged.
+func (c *Core) SetDSCPPriority(mapping map[string]string) error {
+	return c.priority.setConfig(mapping)
+}
+
 // Adds an expression to select multicast interfaces for peer discovery. This
 // should be done before calling Start. This function can be called multiple
 // times to add multiple search expressions.
@@ -208,6 +650,41 @@ func (c *Core) AddAllowedEncryptionPublicKey(boxStr string) error {
 	return c.admin.addAllowedEncryptionPublicKey(boxStr)
 }
 
+// Removes an allowed public key. Existing peerings are not affected, but the
+// key will no longer be allowed to connect in future.
+func (c *Core) RemoveAllowedEncryptionPublicKey(boxStr string) error {
+	return c.admin.removeAllowedEncryptionPublicKey(boxStr)
+}
+
+// Replaces the list of allowed public keys. This is used to reload the list at
+// runtime and takes effect for all future handshakes. If any of the keys are
+// invalid then the existing list is left unchanged.
+func (c *Core) SetAllowedEncryptionPublicKeys(boxStrs []string) error {
+	return c.admin.setAllowedEncryptionPublicKeys(boxStrs)
+}
+
+// Sets whether packets in the session with the node that has the given
+// encryption public key are delivered as they arrive, rather than kept in order
+// on the way. This suits latency-sensitive applications, such as voice, that
+// would rather have a late packet overtaken than wait for it. It only takes
+// effect if the other node asks for the same, and applies to the session that
+// exists now as well as future ones. This should be done after calling Start.
+func (c *Core) SetSessionUnordered(boxStr string, unordered bool) error {
+	boxBytes, err := hex.DecodeString(boxStr)
+	if err != nil {
+		return err
+	}
+	if len(boxBytes) != boxPubKeyLen {
+		return errors.New("Invalid key length")
+	}
+	var box boxPubKey
+	copy(box[:], boxBytes)
+	c.router.doAdmin(func() {
+		c.sessions.setUnordered(&box, unordered)
+	})
+	return nil
+}
+
 // Gets the default admin listen address for your platform.
 func (c *Core) GetAdminDefaultListen() string {
 	return defaults.GetDefaults().DefaultAdminListen
@@ -235,12 +712,41 @@ func (c *Core) GetTUNDefaultIfTAPMode() bool {
 	return defaults.GetDefaults().DefaultIfTAPMode
 }
 
+// Removes the TAP adapter that was installed for the given interface name, or
+// for "auto", when uninstalling. This is only supported on Windows, and must be
+// called when the node isn't running.
+func (c *Core) RemoveTUNAdapter(ifname string) error {
+	return tap_uninstall(ifname)
+}
+
+// Closes the TUN/TAP adapter and opens it again with a new interface name, TAP
+// mode and MTU, i.e. when the configuration is reloaded. Open sessions are told
+// about the new MTU, and policy routes are set up again on the new adapter.
+func (c *Core) ReconfigureTUN(ifname string, iftapmode bool, mtu int) error {
+	c.tun.lifecycle.Lock()
+	defer c.tun.lifecycle.Unlock()
+	// The new settings replace any attempt to re-create the adapter with the old ones
+	c.tun.recovering = false
+	c.policyRoute.close()
+	ip := net.IP(c.router.addr[:]).String()
+	if err := c.tun.restart(ifname, iftapmode, fmt.Sprintf("%s/%d", ip, 8*len(address_prefix)-1), mtu); err != nil {
+		return err
+	}
+	c.router.doAdmin(func() {
+		for _, sinfo := range c.sessions.sinfos {
+			sinfo.myMTU = uint16(c.tun.getState().mtu)
+			c.sessions.sendPingPong(sinfo, false)
+		}
+	})
+	return c.policyRoute.start()
+}
+
 // Gets the current TUN/TAP interface name.
 func (c *Core) GetTUNIfName() string {
-	return c.tun.iface.Name()
+	return c.tun.getState().name()
 }
 
 // Gets the current TUN/TAP interface MTU.
 func (c *Core) GetTUNIfMTU() int {
-	return c.tun.mtu
+	return c.tun.getState().mtu
 }
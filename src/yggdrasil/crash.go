@@ -0,0 +1,247 @@
+package yggdrasil
+
+// This collects crash reports, so that a node which panics in the field leaves
+// behind something more useful than the end of a truncated journal.
+// While the node runs, a report file is kept open in the crash directory,
+// holding the version, platform and redacted config of the node, followed by
+// its most recent log lines. The runtime is told to write the stack traces of
+// every goroutine to that file if the process crashes, which also covers
+// panics in goroutines that nothing recovers. The file is removed when the
+// node stops cleanly. A report that's left over with a crash in it is renamed
+// and its path logged when the node next starts, and old reports are pruned.
+// The runtime can only be told where to write crashes since Go 1.23, so crash
+// reports can't be started by builds from older versions.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"yggdrasil/config"
+)
+
+// How many of the most recent log lines are kept in the report, and how much the file may grow before it's rewritten to hold only those.
+const crash_recentEvents = 200
+const crash_maxGrowth = 256 * 1024
+
+// How many reports with crashes in them are kept in the crash directory.
+const crash_maxReports = 10
+
+// The report of a running node is named running-<time>-<pid>.txt, and renamed to crash-<time>-<pid>.txt once it's found to have a crash in it.
+const crash_runningPrefix = "running-"
+const crash_crashedPrefix = "crash-"
+const crash_fileSuffix = ".txt"
+
+type crashReports struct {
+	core      *Core
+	mutex     sync.Mutex // Protecting the below
+	dir       string     // Directory that reports are written to, or empty if disabled
+	config    []byte     // Redacted config, as indented JSON
+	file      *os.File
+	header    int64    // Length of the report before the recent events
+	growth    int      // Bytes of events written since the file was last rewritten
+	events    []string // The most recent log lines
+	logOutput io.Writer
+}
+
+// Initializes the crashReports struct.
+func (r *crashReports) init(core *Core) {
+	r.core = core
+}
+
+// Sets the directory that crash reports are written to, and the config that they include with secrets redacted.
+// An empty directory disables crash reports.
+func (r *crashReports) setConfig(dir string, nc *config.NodeConfig) error {
+	bs, err := json.Marshal(nc)
+	if err != nil {
+		return err
+	}
+	var cfg interface{}
+	if err := json.Unmarshal(bs, &cfg); err != nil {
+		return err
+	}
+	redacted, err := json.MarshalIndent(crash_redact("", cfg), "", "  ")
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.dir = dir
+	r.config = redacted
+	return nil
+}
+
+// Starts a new report, logs any reports of crashes in previous runs, and has the runtime write crashes to the new report.
+func (r *crashReports) start() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return err
+	}
+	r.checkPrevious()
+	name := fmt.Sprintf("%s%s-%d%s", crash_runningPrefix, time.Now().Format("20060102-150405"), os.Getpid(), crash_fileSuffix)
+	file, err := os.OpenFile(filepath.Join(r.dir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	var header bytes.Buffer
+	fmt.Fprintln(&header, "== Yggdrasil crash report ==")
+	fmt.Fprintln(&header, "Build name:   ", admin_orUnknown(buildName))
+	fmt.Fprintln(&header, "Build version:", admin_orUnknown(buildVersion))
+	fmt.Fprintln(&header, "Go version:   ", runtime.Version())
+	fmt.Fprintln(&header, "Platform:     ", runtime.GOOS+"/"+runtime.GOARCH)
+	fmt.Fprintln(&header, "Started:      ", r.core.startTime.Format(time.RFC3339))
+	fmt.Fprintln(&header, "Address:      ", r.core.GetAddress().String())
+	fmt.Fprint(&header, "\n== Config (redacted) ==\n", string(r.config), "\n\n== Recent events ==\n")
+	if _, err := file.Write(header.Bytes()); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := crash_setOutput(file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	r.file = file
+	r.header = int64(header.Len())
+	r.growth = 0
+	r.events = nil
+	// Logged before the logger writes to the report, since that needs the mutex
+	r.core.log.Println("Writing crash reports to", r.dir)
+	r.logOutput = crash_logOutput(r.core.log)
+	r.core.log.SetOutput(io.MultiWriter(r.logOutput, crash_logWriter{r}))
+	return nil
+}
+
+// Stops writing crashes to the report and removes it, since the node didn't crash.
+func (r *crashReports) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return
+	}
+	r.core.log.SetOutput(r.logOutput)
+	crash_setOutput(nil)
+	r.file.Close()
+	os.Remove(r.file.Name())
+	r.file = nil
+}
+
+// Renames and logs the reports left over from previous runs that have a crash in them, and removes those that don't, which are from runs that were killed.
+// Only the most recent crash reports are kept.
+func (r *crashReports) checkPrevious() {
+	running, err := filepath.Glob(filepath.Join(r.dir, crash_runningPrefix+"*"+crash_fileSuffix))
+	if err != nil {
+		return
+	}
+	for _, name := range running {
+		bs, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		if !crash_hasTraces(bs) {
+			os.Remove(name)
+			continue
+		}
+		crashed := filepath.Join(r.dir, crash_crashedPrefix+strings.TrimPrefix(filepath.Base(name), crash_runningPrefix))
+		if err := os.Rename(name, crashed); err == nil {
+			r.core.log.Println("The node crashed during a previous run, see", crashed)
+		}
+	}
+	crashed, err := filepath.Glob(filepath.Join(r.dir, crash_crashedPrefix+"*"+crash_fileSuffix))
+	if err != nil {
+		return
+	}
+	// The names start with the time, so this sorts them from the oldest
+	sort.Strings(crashed)
+	for len(crashed) > crash_maxReports {
+		os.Remove(crashed[0])
+		crashed = crashed[1:]
+	}
+}
+
+// Records a log line in the report. Once the file has grown enough, it's rewritten to hold only the most recent lines.
+func (r *crashReports) addEvent(line string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return
+	}
+	r.events = append(r.events, line)
+	if len(r.events) > crash_recentEvents {
+		r.events = r.events[len(r.events)-crash_recentEvents:]
+	}
+	if r.growth+len(line) > crash_maxGrowth {
+		if err := r.file.Truncate(r.header); err == nil {
+			r.growth = 0
+			line = strings.Join(r.events, "")
+		}
+	}
+	if n, err := r.file.Write([]byte(line)); err == nil {
+		r.growth += n
+	}
+}
+
+// Checks if a report has stack traces written by the runtime after its recent events.
+func crash_hasTraces(bs []byte) bool {
+	return bytes.Contains(bs, []byte("\ngoroutine ")) &&
+		(bytes.Contains(bs, []byte("\npanic: ")) || bytes.Contains(bs, []byte("\nfatal error: ")))
+}
+
+// Passes log lines to the report. Lines are copied, since the logger reuses its buffer.
+type crash_logWriter struct {
+	r *crashReports
+}
+
+func (w crash_logWriter) Write(bs []byte) (int, error) {
+	w.r.addEvent(string(bs))
+	return len(bs), nil
+}
+
+// Replaces the secrets in a config, decoded from JSON, with "redacted".
+// Fields are secret if their name contains "Private", "Password" or "Community", and passwords are removed from URIs.
+func crash_redact(key string, value interface{}) interface{} {
+	lower := strings.ToLower(key)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			v[k] = crash_redact(k, val)
+		}
+		return v
+	case []interface{}:
+		for idx, val := range v {
+			v[idx] = crash_redact(key, val)
+		}
+		return v
+	case string:
+		if v == "" {
+			return v
+		}
+		if strings.Contains(lower, "private") || strings.Contains(lower, "password") || strings.Contains(lower, "community") {
+			return "redacted"
+		}
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			if _, hasPassword := u.User.Password(); hasPassword {
+				u.User = url.UserPassword(u.User.Username(), "redacted")
+				return u.String()
+			}
+		}
+		return v
+	default:
+		return v
+	}
+}
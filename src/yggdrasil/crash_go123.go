@@ -0,0 +1,24 @@
+// +build go1.23
+
+package yggdrasil
+
+import (
+	"io"
+	"log"
+	"os"
+	"runtime/debug"
+)
+
+// Has the runtime write the stack traces of every goroutine to the file if the process crashes, or stops it if the file is nil.
+func crash_setOutput(file *os.File) error {
+	if file != nil {
+		// Show every goroutine, not just the one that crashed
+		debug.SetTraceback("all")
+	}
+	return debug.SetCrashOutput(file, debug.CrashOptions{})
+}
+
+// Gets the writer that the logger writes to, so that it can be put back once the report is closed.
+func crash_logOutput(logger *log.Logger) io.Writer {
+	return logger.Writer()
+}
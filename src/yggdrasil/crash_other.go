@@ -0,0 +1,23 @@
+// +build !go1.23
+
+package yggdrasil
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// The runtime can't be told where to write crashes before Go 1.23.
+func crash_setOutput(file *os.File) error {
+	if file == nil {
+		return nil
+	}
+	return errors.New("crash reports need a build from Go 1.23 or later")
+}
+
+// This is never called, since crash reports can't be started without crash_setOutput.
+func crash_logOutput(logger *log.Logger) io.Writer {
+	return os.Stderr
+}
@@ -0,0 +1,189 @@
+package yggdrasil
+
+// This implements a crawler, which walks the DHT outwards from this node to
+// discover the shape of the network, for use by network maps and other
+// visualisation tools via the admin API.
+// Each node we learn about is sent a DHT lookup request for a few targets in
+// different regions of its keyspace, and the nodes in each response are
+// recorded as links from the responding node and crawled in turn.
+// Requests are rate limited, and crawler responses are not added to our own
+// DHT, so crawling shouldn't disturb normal operation.
+
+import (
+	"errors"
+	"time"
+)
+
+// Number of lookup requests sent to each node, for targets that differ from
+// the node's own NodeID at each of the first few bits.
+const crawl_targets = 8
+
+// Time to wait between crawling each node, to rate-limit crawls.
+const crawl_interval = 250 * time.Millisecond
+
+// Time to wait for outstanding responses once there's nothing left to crawl.
+const crawl_timeout = 5 * time.Second
+
+// Default and maximum number of nodes that a single crawl will discover.
+const crawl_defaultMaxNodes = 256
+const crawl_maxNodes = 4096
+
+// A node discovered by a crawl.
+type crawlNode struct {
+	coords    []byte
+	links     map[boxPubKey]struct{} // Nodes that this node told us about
+	responded bool                   // Whether the node responded to us
+}
+
+// The state of a crawl that is in progress.
+type crawlInfo struct {
+	nodes    map[boxPubKey]*crawlNode
+	toVisit  []*dhtInfo
+	pending  map[boxPubKey]map[NodeID]bool // Requests we're waiting for responses to
+	maxNodes int
+	recv     time.Time // When we last received a response
+}
+
+// The crawler, which runs at most one crawl at a time.
+// Apart from crawl itself, which blocks, these functions must only be called from the router goroutine.
+type crawler struct {
+	core    *Core
+	current *crawlInfo
+}
+
+// Initializes the crawler struct.
+func (c *crawler) init(core *Core) {
+	c.core = core
+}
+
+// Starts a new crawl from the nodes in our DHT.
+func (c *crawler) start(maxNodes int) error {
+	if c.current != nil {
+		return errors.New("a crawl is already in progress")
+	}
+	info := &crawlInfo{
+		nodes:    make(map[boxPubKey]*crawlNode),
+		pending:  make(map[boxPubKey]map[NodeID]bool),
+		maxNodes: maxNodes,
+		recv:     time.Now(),
+	}
+	loc := c.core.switchTable.getLocator()
+	self := &crawlNode{
+		coords:    loc.getCoords(),
+		links:     make(map[boxPubKey]struct{}),
+		responded: true,
+	}
+	info.nodes[c.core.boxPub] = self
+	for bidx := 0; bidx < c.core.dht.nBuckets(); bidx++ {
+		b := c.core.dht.getBucket(bidx)
+		for _, dinfo := range append(append([]*dhtInfo(nil), b.peers...), b.other...) {
+			c.add(info, dinfo)
+			if _, isIn := info.nodes[dinfo.key]; isIn {
+				self.links[dinfo.key] = struct{}{}
+			}
+		}
+	}
+	c.current = info
+	return nil
+}
+
+// Records a node that we've heard about, and queues it to be crawled if it's new.
+func (c *crawler) add(info *crawlInfo, dinfo *dhtInfo) {
+	if _, isIn := info.nodes[dinfo.key]; isIn || len(info.nodes) >= info.maxNodes {
+		return
+	}
+	info.nodes[dinfo.key] = &crawlNode{
+		coords: dinfo.coords,
+		links:  make(map[boxPubKey]struct{}),
+	}
+	info.toVisit = append(info.toVisit, dinfo)
+}
+
+// Sends lookup requests to the next node to be crawled.
+// Returns false once there is nothing left to do, and every response has either arrived or timed out.
+func (c *crawler) step() bool {
+	info := c.current
+	if len(info.toVisit) == 0 {
+		return time.Since(info.recv) < crawl_timeout
+	}
+	var dinfo *dhtInfo
+	dinfo, info.toVisit = info.toVisit[0], info.toVisit[1:]
+	loc := c.core.switchTable.getLocator()
+	coords := loc.getCoords()
+	pending := make(map[NodeID]bool)
+	for bidx := 0; bidx < crawl_targets; bidx++ {
+		target := *dinfo.getNodeID()
+		target[bidx/8] ^= 0x80 >> byte(bidx%8)
+		req := dhtReq{
+			Key:    c.core.boxPub,
+			Coords: coords,
+			Dest:   target,
+		}
+		c.core.dht.sendReqPacket(&req, dinfo)
+		pending[target] = true
+	}
+	info.pending[dinfo.key] = pending
+	info.recv = time.Now()
+	return true
+}
+
+// Handles a lookup response, if it's one that the current crawl is waiting for.
+func (c *crawler) handleDHTRes(res *dhtRes) {
+	info := c.current
+	if info == nil || !info.pending[res.Key][res.Dest] {
+		return
+	}
+	delete(info.pending[res.Key], res.Dest)
+	info.recv = time.Now()
+	node := info.nodes[res.Key]
+	node.responded = true
+	node.coords = res.Coords
+	infos := res.Infos
+	if len(infos) > dht_lookup_size {
+		infos = infos[:dht_lookup_size]
+	}
+	for _, dinfo := range infos {
+		if dinfo.key == c.core.boxPub {
+			node.links[dinfo.key] = struct{}{}
+			continue
+		}
+		c.add(info, dinfo)
+		if _, isIn := info.nodes[dinfo.key]; isIn {
+			node.links[dinfo.key] = struct{}{}
+		}
+	}
+}
+
+// Finishes the current crawl and returns the nodes that it discovered.
+func (c *crawler) finish() map[boxPubKey]*crawlNode {
+	nodes := c.current.nodes
+	c.current = nil
+	return nodes
+}
+
+// Runs a crawl to completion, discovering at most maxNodes nodes, and returns the nodes discovered.
+// This blocks until the crawl is finished, and must not be called from the router goroutine.
+func (c *crawler) crawl(maxNodes int) (map[boxPubKey]*crawlNode, error) {
+	if maxNodes <= 0 {
+		maxNodes = crawl_defaultMaxNodes
+	}
+	if maxNodes > crawl_maxNodes {
+		maxNodes = crawl_maxNodes
+	}
+	var err error
+	c.core.router.doAdmin(func() { err = c.start(maxNodes) })
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var more bool
+		c.core.router.doAdmin(func() { more = c.step() })
+		if !more {
+			break
+		}
+		time.Sleep(crawl_interval)
+	}
+	var nodes map[boxPubKey]*crawlNode
+	c.core.router.doAdmin(func() { nodes = c.finish() })
+	return nodes, nil
+}
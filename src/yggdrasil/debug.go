@@ -305,15 +305,12 @@ func (c *Core) DEBUG_startTun(ifname string, iftapmode bool) {
 func (c *Core) DEBUG_startTunWithMTU(ifname string, iftapmode bool, mtu int) {
 	addr := c.DEBUG_getAddr()
 	straddr := fmt.Sprintf("%s/%v", net.IP(addr[:]).String(), 8*len(address_prefix))
-	if ifname != "none" {
-		err := c.tun.setup(ifname, iftapmode, straddr, mtu)
-		if err != nil {
-			panic(err)
-		}
-		c.log.Println("Setup TUN/TAP:", c.tun.iface.Name(), straddr)
-		go func() { panic(c.tun.read()) }()
+	if err := c.tun.restart(ifname, iftapmode, straddr, mtu); err != nil {
+		panic(err)
+	}
+	if !tun_isHeadless(ifname) {
+		c.log.Println("Setup TUN/TAP:", c.tun.name(), straddr)
 	}
-	go func() { panic(c.tun.write()) }()
 }
 
 func (c *Core) DEBUG_stopTun() {
@@ -427,7 +424,7 @@ func (c *Core) DEBUG_addSOCKSConn(socksaddr, peeraddr string) {
 
 //*
 func (c *Core) DEBUG_setupAndStartGlobalTCPInterface(addrport string) {
-	if err := c.tcp.init(c, addrport, 0); err != nil {
+	if err := c.tcp.init(c, addrport, 0, 0, 0, false); err != nil {
 		c.log.Println("Failed to start TCP interface:", err)
 		panic(err)
 	}
@@ -438,7 +435,7 @@ func (c *Core) DEBUG_getGlobalTCPAddr() *net.TCPAddr {
 }
 
 func (c *Core) DEBUG_addTCPConn(saddr string) {
-	c.tcp.call(saddr, nil, "")
+	c.tcp.call(saddr, nil, "", nil, nil)
 }
 
 //*/
@@ -533,6 +530,7 @@ func DEBUG_simLinkPeers(p, q *peer) {
 
 func (c *Core) DEBUG_simFixMTU() {
 	c.tun.mtu = 65535
+	c.tun.publish()
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -19,6 +19,11 @@ Slight changes *do* make it blackhole hard, bootstrapping isn't an easy problem
 */
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
 	"sort"
 	"time"
 )
@@ -27,14 +32,30 @@ import (
 // Note that, in practice, nearly all of these will be empty.
 const dht_bucket_number = 8 * NodeIDLen
 
-// Number of nodes to keep in each DHT bucket.
+// Default number of nodes to keep in each DHT bucket.
 // Additional entries may be kept for peers, for bootstrapping reasons, if they don't already have an entry in the bucket.
 const dht_bucket_size = 2
 
+// Default time between rounds of DHT maintenance.
+// Maintenance is driven by the router's once per second ticker, so shorter intervals have no effect.
+const dht_maintenance_interval = time.Second
+
+// How early a round of maintenance may start, which is half of the router's tick, so that a tick that's handled a little late doesn't skip a round.
+const dht_maintenance_slack = 500 * time.Millisecond
+
 // Number of responses to include in a lookup.
 // If extras are given, they will be truncated from the response handler to prevent abuse.
 const dht_lookup_size = 16
 
+// Maximum number of nodes to store in the DHT cache file.
+const dht_cache_size = 4 * dht_lookup_size
+
+// How often the DHT cache file is written, if enabled.
+const dht_cache_interval = 5 * time.Minute
+
+// The time for which a closer instance of an anycast service is kept in the DHT in favour of a further one, without hearing from it.
+const dht_anycast_hold = 2 * time.Minute
+
 // dhtInfo represents everything we know about a node in the DHT.
 // This includes its key, a cache of it's NodeID, coords, and timing/ping related info for deciding who/when to ping nodes for maintenance.
 type dhtInfo struct {
@@ -98,6 +119,18 @@ type dht struct {
 	reqs           map[boxPubKey]map[NodeID]time.Time
 	offset         int
 	rumorMill      []dht_rumor
+	cacheFile      string        // Where to persist known nodes, if not empty
+	cacheSave      time.Time     // When the cache file was last written
+	cacheLoaded    bool          // Whether the cache file has been loaded yet
+	bucketSize     int           // Number of non-peer nodes to keep in each bucket
+	maintInterval  time.Duration // Time between rounds of maintenance
+	maintTime      time.Time     // When maintenance was last done
+}
+
+// An entry in the DHT cache file, describing a node that recently responded to us.
+type dht_cacheEntry struct {
+	Key    string `json:"key"`
+	Coords string `json:"coords"`
 }
 
 // Initializes the DHT.
@@ -106,6 +139,20 @@ func (t *dht) init(c *Core) {
 	t.nodeID = *t.core.GetNodeID()
 	t.peers = make(chan *dhtInfo, 1024)
 	t.reqs = make(map[boxPubKey]map[NodeID]time.Time)
+	t.cacheSave = time.Now()
+	t.bucketSize = dht_bucket_size
+	t.maintInterval = dht_maintenance_interval
+}
+
+// Sets the number of non-peer nodes to keep in each bucket, and the time between rounds of maintenance.
+// Values that are zero or less leave the current setting unchanged.
+func (t *dht) setParameters(bucketSize int, maintInterval time.Duration) {
+	if bucketSize > 0 {
+		t.bucketSize = bucketSize
+	}
+	if maintInterval > 0 {
+		t.maintInterval = maintInterval
+	}
 }
 
 // Reads a request, performs a lookup, and responds.
@@ -136,6 +183,7 @@ func (t *dht) handleReq(req *dhtReq) {
 // This mainly consists of updating the node we asked in our DHT (they responded, so we know they're still alive), and adding the response info to the rumor mill.
 func (t *dht) handleRes(res *dhtRes) {
 	t.core.searches.handleDHTRes(res)
+	t.core.crawler.handleDHTRes(res)
 	reqs, isIn := t.reqs[res.Key]
 	if !isIn {
 		return
@@ -275,6 +323,10 @@ func (t *dht) insert(info *dhtInfo, isPeer bool) {
 	if isPeer || info.throttle > time.Minute {
 		info.throttle = time.Minute
 	}
+	if !isPeer && b.containsCloserInstance(info, t.core.switchTable.getLocator()) {
+		// Keep the closer instance of an anycast service
+		return
+	}
 	// First drop any existing entry from the bucket
 	b.drop(&info.key)
 	// Now add to the *end* of the bucket
@@ -285,11 +337,23 @@ func (t *dht) insert(info *dhtInfo, isPeer bool) {
 	}
 	b.other = append(b.other, info)
 	// Shrink from the *front* to requied size
-	for len(b.other) > dht_bucket_size {
+	for len(b.other) > t.bucketSize {
 		b.other = b.other[1:]
 	}
 }
 
+// Returns true if the bucket contains another node with the same key but different coords, i.e. another instance of an anycast service, which is closer to us on the tree and has been heard from recently.
+func (b *bucket) containsCloserInstance(info *dhtInfo, loc switchLocator) bool {
+	for _, other := range b.other {
+		if other.key == info.key && !bytes.Equal(other.coords, info.coords) &&
+			time.Since(other.recv) < dht_anycast_hold &&
+			loc.dist(other.coords) < loc.dist(info.coords) {
+			return true
+		}
+	}
+	return false
+}
+
 // Gets the bucket index for the bucket where we would put the given NodeID.
 func (t *dht) getBucketIndex(nodeID *NodeID) (int, bool) {
 	for bidx := 0; bidx < t.nBuckets(); bidx++ {
@@ -364,8 +428,23 @@ func (b *bucket) drop(key *boxPubKey) {
 	b.other = clean(b.other)
 }
 
-// Sends a lookup request to the specified node.
+// Sends a lookup request to the specified node, and tracks it so that the response is accepted.
 func (t *dht) sendReq(req *dhtReq, dest *dhtInfo) {
+	t.sendReqPacket(req, dest)
+	reqsToDest, isIn := t.reqs[dest.key]
+	if !isIn {
+		t.reqs[dest.key] = make(map[NodeID]time.Time)
+		reqsToDest, isIn = t.reqs[dest.key]
+		if !isIn {
+			panic("This should never happen")
+		}
+	}
+	reqsToDest[req.Dest] = time.Now()
+}
+
+// Sends a lookup request to the specified node, without tracking it.
+// Responses to untracked requests aren't added to the DHT, but are still seen by searches and the crawler.
+func (t *dht) sendReqPacket(req *dhtReq, dest *dhtInfo) {
 	// Send a dhtReq to the node in dhtInfo
 	bs := req.encode()
 	shared := t.core.sessions.getSharedKey(&t.core.boxPriv, &dest.key)
@@ -379,15 +458,6 @@ func (t *dht) sendReq(req *dhtReq, dest *dhtInfo) {
 	}
 	packet := p.encode()
 	t.core.router.out(packet)
-	reqsToDest, isIn := t.reqs[dest.key]
-	if !isIn {
-		t.reqs[dest.key] = make(map[NodeID]time.Time)
-		reqsToDest, isIn = t.reqs[dest.key]
-		if !isIn {
-			panic("This should never happen")
-		}
-	}
-	reqsToDest[req.Dest] = time.Now()
 }
 
 // Sends a lookup response to the specified node.
@@ -488,6 +558,10 @@ func (t *dht) addToMill(info *dhtInfo, target *NodeID) {
 // The second is used for bootstrapping, and attempts to fill some bucket, iterating over buckets and resetting after it hits the last non-empty one.
 // If the mill is not empty, it pops nodes from the mill until it finds one that would be useful to ping (see: shouldInsert), and then pings it.
 func (t *dht) doMaintenance() {
+	if time.Since(t.maintTime) < t.maintInterval-dht_maintenance_slack {
+		return
+	}
+	t.maintTime = time.Now()
 	// First clean up reqs
 	for key, reqs := range t.reqs {
 		for target, timeout := range reqs {
@@ -553,6 +627,9 @@ func (t *dht) doMaintenance() {
 		}()
 		//t.offset++
 	}
+	if t.cacheFile != "" && time.Since(t.cacheSave) > dht_cache_interval {
+		t.saveCache()
+	}
 	for len(t.rumorMill) > 0 {
 		var rumor dht_rumor
 		rumor, t.rumorMill = t.rumorMill[0], t.rumorMill[1:]
@@ -580,7 +657,7 @@ func (t *dht) shouldInsert(info *dhtInfo) bool {
 	if b.containsOther(info) {
 		return false
 	}
-	if len(b.other) < dht_bucket_size {
+	if len(b.other) < t.bucketSize {
 		return true
 	}
 	for _, other := range b.other {
@@ -624,3 +701,93 @@ func (t *dht) reset() {
 		b.other = b.other[:0]
 	}
 }
+
+// Sets the path of the file used to persist known nodes between restarts.
+// An empty path disables the cache.
+func (t *dht) setCacheFile(path string) {
+	t.cacheFile = path
+}
+
+// Loads nodes from the cache file, if there is one, and adds them to the rumor mill.
+// This is done once we first get coords from a peer, as there's no way to reach the nodes before then.
+// This lets a restarted node quickly rebuild its view of the DHT, instead of relying on bootstrapping through its peers alone.
+// Nodes that have since moved or gone away will fail to respond to pings, and are never added to the table.
+func (t *dht) loadCache() {
+	if t.cacheFile == "" || t.cacheLoaded {
+		return
+	}
+	t.cacheLoaded = true
+	bs, err := ioutil.ReadFile(t.cacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			t.core.log.Println("Failed to read DHT cache:", err)
+		}
+		return
+	}
+	var entries []dht_cacheEntry
+	if err := json.Unmarshal(bs, &entries); err != nil {
+		t.core.log.Println("Failed to parse DHT cache:", err)
+		return
+	}
+	if len(entries) > dht_cache_size {
+		entries = entries[:dht_cache_size]
+	}
+	for _, entry := range entries {
+		key, err := hex.DecodeString(entry.Key)
+		if err != nil || len(key) != boxPubKeyLen {
+			continue
+		}
+		coords, err := hex.DecodeString(entry.Coords)
+		if err != nil {
+			continue
+		}
+		info := &dhtInfo{
+			coords:   coords,
+			throttle: time.Second,
+		}
+		copy(info.key[:], key)
+		if info.key == t.core.boxPub {
+			continue
+		}
+		t.addToMill(info, info.getNodeID())
+	}
+	t.core.log.Println("Loaded", len(entries), "nodes from the DHT cache")
+}
+
+// Writes nodes that have recently responded to us to the cache file.
+// The file is written atomically, by writing to a temporary file and renaming it.
+func (t *dht) saveCache() {
+	t.cacheSave = time.Now()
+	var entries []dht_cacheEntry
+	for bidx := 0; bidx < t.nBuckets() && len(entries) < dht_cache_size; bidx++ {
+		b := t.getBucket(bidx)
+		for _, infos := range [][]*dhtInfo{b.peers, b.other} {
+			for _, info := range infos {
+				if info.pings != 0 || len(entries) >= dht_cache_size {
+					continue
+				}
+				entries = append(entries, dht_cacheEntry{
+					Key:    hex.EncodeToString(info.key[:]),
+					Coords: hex.EncodeToString(info.coords),
+				})
+			}
+		}
+	}
+	if len(entries) == 0 {
+		// Don't replace a useful cache just because we're not connected right now
+		return
+	}
+	bs, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		t.core.log.Println("Failed to encode DHT cache:", err)
+		return
+	}
+	tmp := t.cacheFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		t.core.log.Println("Failed to write DHT cache:", err)
+		return
+	}
+	if err := os.Rename(tmp, t.cacheFile); err != nil {
+		t.core.log.Println("Failed to write DHT cache:", err)
+	}
+}
@@ -0,0 +1,234 @@
+package yggdrasil
+
+// This implements per-flow debug tracing, for working out why one particular
+// connection is slow or broken. Once enabled for a pair of addresses with the
+// traceFlow admin call, each stage of processing that a packet between them
+// passes through is logged with a timestamp:
+//  tun read      read from the TUN/TAP adapter
+//  router        session lookup, searches and MTU checks
+//  session send  encrypted and passed to the switch
+//  switch        sent to a peer, queued, or dropped from the queue
+//  session recv  received and decrypted
+//  tun write     passed to the TUN/TAP adapter, or dropped
+// Packets in both directions are traced. The switch only sees encrypted
+// packets, so outgoing packets are matched there by the nonce that the session
+// encrypted them with. Logging is rate limited per trace, and traces expire,
+// so that a busy flow can't flood the log.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The default time that a trace lasts for, and the default number of lines per second that it logs.
+const flowTrace_defaultDuration = time.Minute
+const flowTrace_defaultRate = 20
+
+// The most outgoing packets that are remembered while they pass through the switch.
+const flowTrace_maxPending = 256
+
+type flowTracer struct {
+	core    *Core
+	active  int32 // Number of traces, accessed atomically so that packets aren't slowed down when there are none
+	mutex   sync.Mutex
+	traces  map[flowTrace_key]*flowTrace
+	pending map[boxNonce]*flowTrace // Outgoing packets that the switch hasn't sent yet
+}
+
+// A pair of addresses, in the order that the trace was enabled with.
+type flowTrace_key struct {
+	source      address
+	destination address
+}
+
+type flowTrace struct {
+	key        flowTrace_key
+	expires    time.Time
+	rate       float64
+	bucket     util_tokenBucket
+	logged     uint64
+	suppressed uint64
+}
+
+// Initializes the flowTracer struct.
+func (f *flowTracer) init(core *Core) {
+	f.core = core
+	f.traces = make(map[flowTrace_key]*flowTrace)
+	f.pending = make(map[boxNonce]*flowTrace)
+}
+
+// Starts tracing packets between the two addresses for the given duration, logging at most rate lines per second.
+// A zero duration or rate uses the default, and a negative duration stops the trace.
+func (f *flowTracer) setTrace(source, destination net.IP, duration time.Duration, rate float64) error {
+	var key flowTrace_key
+	if source.To16() == nil || destination.To16() == nil {
+		return errors.New("invalid address")
+	}
+	copy(key.source[:], source.To16())
+	copy(key.destination[:], destination.To16())
+	if rate < 0 {
+		return errors.New("invalid rate")
+	} else if rate == 0 {
+		rate = flowTrace_defaultRate
+	}
+	if duration == 0 {
+		duration = flowTrace_defaultDuration
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if duration < 0 {
+		if trace, isIn := f.traces[key]; isIn {
+			f.remove(trace)
+		}
+		return nil
+	}
+	f.traces[key] = &flowTrace{
+		key:     key,
+		expires: time.Now().Add(duration),
+		rate:    rate,
+		bucket:  util_tokenBucket{tokens: rate, last: time.Now()},
+	}
+	atomic.StoreInt32(&f.active, int32(len(f.traces)))
+	f.core.log.Printf("Tracing flow %s <-> %s for %s", source, destination, duration)
+	return nil
+}
+
+// Removes a trace and any of its outgoing packets. Must be called with the mutex held.
+func (f *flowTracer) remove(trace *flowTrace) {
+	delete(f.traces, trace.key)
+	for nonce, t := range f.pending {
+		if t == trace {
+			delete(f.pending, nonce)
+		}
+	}
+	atomic.StoreInt32(&f.active, int32(len(f.traces)))
+	f.core.log.Printf("Stopped tracing flow %s <-> %s after logging %d lines (%d suppressed)",
+		net.IP(trace.key.source[:]), net.IP(trace.key.destination[:]), trace.logged, trace.suppressed)
+}
+
+// Gets the trace for an IPv6 packet, if it's between a pair of addresses that are being traced. Must be called with the mutex held.
+// Expired traces are removed.
+func (f *flowTracer) getTrace(packet []byte) *flowTrace {
+	if len(packet) < tun_IPv6_HEADER_LENGTH || packet[0]&0xf0 != 0x60 {
+		return nil
+	}
+	var key flowTrace_key
+	copy(key.source[:], packet[8:24])
+	copy(key.destination[:], packet[24:40])
+	trace, isIn := f.traces[key]
+	if !isIn {
+		key.source, key.destination = key.destination, key.source
+		if trace, isIn = f.traces[key]; !isIn {
+			return nil
+		}
+	}
+	if time.Now().After(trace.expires) {
+		f.remove(trace)
+		return nil
+	}
+	return trace
+}
+
+// Logs a stage of processing for an IPv6 packet, if it's being traced.
+// This may be called from any goroutine.
+func (f *flowTracer) trace(packet []byte, stage string, format string, args ...interface{}) {
+	if atomic.LoadInt32(&f.active) == 0 {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if trace := f.getTrace(packet); trace != nil {
+		f.log(trace, net.IP(packet[8:24]), net.IP(packet[24:40]), stage, fmt.Sprintf(format, args...))
+	}
+}
+
+// Remembers the nonce that a traced packet was encrypted with, so that the switch can log what it does with the packet.
+// This may be called from any goroutine.
+func (f *flowTracer) tracePending(packet []byte, nonce *boxNonce) {
+	if atomic.LoadInt32(&f.active) == 0 {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if trace := f.getTrace(packet); trace != nil {
+		if len(f.pending) >= flowTrace_maxPending {
+			// Anything still pending by now was most likely dropped without being noticed
+			f.pending = make(map[boxNonce]*flowTrace)
+		}
+		f.pending[*nonce] = trace
+	}
+}
+
+// Logs a stage of processing in the switch for an encrypted packet, if it's an outgoing packet that's being traced.
+// The packet is forgotten once it's done with, i.e. sent or dropped.
+func (f *flowTracer) traceSwitch(packet []byte, done bool, format string, args ...interface{}) {
+	if atomic.LoadInt32(&f.active) == 0 {
+		return
+	}
+	var pType uint64
+	var coords []byte
+	var h handle
+	var nonce boxNonce
+	bs := packet
+	switch {
+	case !wire_chop_uint64(&pType, &bs) || pType != wire_Traffic:
+		return
+	case !wire_chop_coords(&coords, &bs):
+		return
+	case !wire_chop_slice(h[:], &bs):
+		return
+	case !wire_chop_slice(nonce[:], &bs):
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	trace, isIn := f.pending[nonce]
+	if !isIn {
+		return
+	}
+	if done {
+		delete(f.pending, nonce)
+	}
+	f.log(trace, net.IP(trace.key.source[:]), net.IP(trace.key.destination[:]), "switch", fmt.Sprintf(format, args...))
+}
+
+// Logs a line for a trace, unless it's over its rate limit. Must be called with the mutex held.
+func (f *flowTracer) log(trace *flowTrace, source, destination net.IP, stage string, details string) {
+	if !trace.bucket.take(time.Now(), trace.rate, trace.rate) {
+		trace.suppressed++
+		return
+	}
+	trace.logged++
+	f.core.log.Printf("Flow trace %s %s -> %s %s: %s",
+		time.Now().Format("15:04:05.000000"), source, destination, stage, details)
+}
+
+// Gets the traces that are active, for getFlowTraces.
+func (f *flowTracer) getTraces() []admin_info {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var traces []admin_info
+	for _, trace := range f.traces {
+		if time.Now().After(trace.expires) {
+			f.remove(trace)
+			continue
+		}
+		traces = append(traces, admin_info{
+			"source":      net.IP(trace.key.source[:]).String(),
+			"destination": net.IP(trace.key.destination[:]).String(),
+			"expires_in":  int(time.Until(trace.expires).Seconds()),
+			"rate":        trace.rate,
+			"logged":      trace.logged,
+			"suppressed":  trace.suppressed,
+		})
+	}
+	sort.Slice(traces, func(i, j int) bool {
+		return fmt.Sprint(traces[i]["source"], traces[i]["destination"]) < fmt.Sprint(traces[j]["source"], traces[j]["destination"])
+	})
+	return traces
+}
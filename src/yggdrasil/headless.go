@@ -0,0 +1,104 @@
+package yggdrasil
+
+// This answers for the node's own address when there's no TUN/TAP adapter,
+// i.e. when IfName is "none" or "dummy", so that headless nodes which only
+// forward traffic for others can still be pinged by monitoring. Echo requests
+// to our address are answered, and anything else sent to our address or our
+// /64 gets the ICMPv6 error that a host would send, port unreachable or address
+// unreachable, so that connections fail straight away instead of timing out.
+// Errors are rate limited, as RFC 4443 asks, and are never sent in response to
+// other errors or to multicast.
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+// The rate and burst of ICMPv6 errors, per second.
+const tun_headlessErrorRate = 10
+const tun_headlessErrorBurst = 10
+
+// The MTU that sessions are offered while there's no adapter, which is enough for pings and errors.
+// Without one, remote nodes would treat us as having no adapter at all and not send anything.
+const tun_headlessMTU = 1280
+
+// Checks if the adapter name means that there's no adapter.
+func tun_isHeadless(ifname string) bool {
+	return ifname == "none" || ifname == "dummy"
+}
+
+// Answers the packets sent to us while there's no adapter, until stopped.
+func (tun *tunDevice) respond(stop chan struct{}) {
+	limit := util_tokenBucket{tokens: tun_headlessErrorBurst, last: time.Now()}
+	for {
+		select {
+		case packet := <-tun.recv:
+			tun.respondTo(packet, &limit)
+			util_putBytes(packet)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Sends the answer to a packet, if it needs one, back through the router as if it had been read from an adapter.
+func (tun *tunDevice) respondTo(packet []byte, limit *util_tokenBucket) {
+	if len(packet) < tun_IPv6_HEADER_LENGTH || packet[0]&0xf0 != 0x60 || packet[24] == 0xff {
+		return
+	}
+	source, dest := net.IP(packet[8:24]), net.IP(packet[24:40])
+	var addr address
+	copy(addr[:], dest)
+	isOurs := addr == tun.core.router.addr
+	protocol, header := packetFilter_transport(packet)
+	if protocol == packetFilter_icmpv6 && len(header) > 0 {
+		switch {
+		case isOurs && header[0] == byte(ipv6.ICMPTypeEchoRequest):
+			msg, err := icmp.ParseMessage(packetFilter_icmpv6, header)
+			if err != nil {
+				return
+			}
+			echo, ok := msg.Body.(*icmp.Echo)
+			if !ok {
+				return
+			}
+			tun.sendResponse(source, dest, ipv6.ICMPTypeEchoReply, 0, echo)
+			atomic.AddUint64(&tun.counters.echoReplies, 1)
+			return
+		case header[0] < 128:
+			// Never answer an error with another error
+			return
+		}
+	}
+	if !limit.take(time.Now(), tun_headlessErrorRate, tun_headlessErrorBurst) {
+		return
+	}
+	// As much of the packet as fits in the minimum MTU is returned with the error
+	window := len(packet)
+	if window > 1280-tun_IPv6_HEADER_LENGTH-8 {
+		window = 1280 - tun_IPv6_HEADER_LENGTH - 8
+	}
+	code := 3 // Address unreachable, as there's nothing else in our /64
+	if isOurs {
+		code = 4 // Port unreachable
+	}
+	tun.sendResponse(source, dest, ipv6.ICMPTypeDestinationUnreachable, code, &icmp.DstUnreach{Data: packet[:window]})
+	atomic.AddUint64(&tun.counters.errorsSent, 1)
+}
+
+// Sends an ICMPv6 message from the address that a packet was sent to, back to its source.
+func (tun *tunDevice) sendResponse(dst, src net.IP, mtype ipv6.ICMPType, code int, body icmp.MessageBody) {
+	response, err := tun.icmpv6.create_icmpv6_tun(dst, src, mtype, code, body)
+	if err != nil {
+		return
+	}
+	select {
+	case tun.send <- append(util_getBytes(), response...):
+	default:
+		// Dropped, like any other packet when the router's queue is full
+	}
+}
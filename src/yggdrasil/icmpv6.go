@@ -13,21 +13,54 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv6"
+
+	water "github.com/yggdrasil-network/water"
 )
 
 type macAddress [6]byte
 
 const len_ETHER = 14
 
+// Most neighbors that are kept in the table, so that a host sending from lots of addresses can't make it grow without bound.
+const icmpv6_maxNeighbors = 256
+
+// Neighbors that haven't sent a frame for this long are removed from the table once it's full.
+const icmpv6_neighborTimeout = 10 * time.Minute
+
 type icmpv6 struct {
 	tun        *tunDevice
-	peermac    macAddress
+	peermac    atomic.Value // macAddress of the host that last sent us ICMPv6, which unicast frames are sent to
 	peerlladdr net.IP
 	mylladdr   net.IP
 	mymac      macAddress
+	peermacs   map[address]neighbor // Neighbors seen on the TAP adapter, by IPv6 address
+	mutex      sync.Mutex           // Protects peermacs, as packets are parsed in their own goroutines
+	neighbors  atomic.Value         // *icmpv6_neighbors, the static neighbors on the TAP adapter
+}
+
+// The static neighbors on the TAP adapter, i.e. on bridged setups where
+// learning the MAC address from the last host to send us ICMPv6 picks the
+// wrong host. Unicast frames to a static neighbor always go to its MAC
+// address, and other unicast frames go to the learned MAC address, or to the
+// default if nothing has been learned or learning is disabled.
+type icmpv6_neighbors struct {
+	static     map[address]macAddress
+	defaultMAC macAddress
+	noLearning bool
+}
+
+// A neighbor seen on the TAP adapter, kept for debugging bridging problems.
+type neighbor struct {
+	mac              macAddress
+	learned          bool      // The MAC address came from the neighbor's own NDP messages, not just a frame header
+	lastsolicitation time.Time // When the neighbor last solicited one of our addresses
+	lastseen         time.Time // When we last received a frame from the neighbor
 }
 
 // Marshal returns the binary encoding of h.
@@ -52,6 +85,8 @@ func ipv6Header_Marshal(h *ipv6.Header) ([]byte, error) {
 // addresses.
 func (i *icmpv6) init(t *tunDevice) {
 	i.tun = t
+	i.peermacs = make(map[address]neighbor)
+	i.neighbors.Store(&icmpv6_neighbors{})
 
 	// Our MAC address and link-local address
 	copy(i.mymac[:], []byte{
@@ -61,19 +96,89 @@ func (i *icmpv6) init(t *tunDevice) {
 		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0xFE}
 }
 
+// Sets the static neighbors on the TAP adapter, given as MAC addresses by IPv6
+// address, the MAC address that other unicast frames are sent to until one is
+// learned, and whether learning is disabled, in which case the default is
+// needed. If any addresses are invalid then the neighbors are left unchanged.
+func (i *icmpv6) setNeighbors(static map[string]string, defaultMAC string, disableLearning bool) error {
+	neighbors := &icmpv6_neighbors{static: make(map[address]macAddress), noLearning: disableLearning}
+	for ipStr, macStr := range static {
+		ip := net.ParseIP(ipStr)
+		if ip == nil || ip.To4() != nil {
+			return errors.New("invalid IPv6 address: " + ipStr)
+		}
+		mac, err := icmpv6_parseMAC(macStr)
+		if err != nil {
+			return err
+		}
+		var addr address
+		copy(addr[:], ip.To16())
+		neighbors.static[addr] = mac
+	}
+	switch {
+	case defaultMAC != "":
+		mac, err := icmpv6_parseMAC(defaultMAC)
+		if err != nil {
+			return err
+		}
+		neighbors.defaultMAC = mac
+	case disableLearning:
+		return errors.New("a default MAC address is needed when learning is disabled")
+	}
+	i.neighbors.Store(neighbors)
+	return nil
+}
+
+// Parses an ethernet MAC address.
+func icmpv6_parseMAC(macStr string) (macAddress, error) {
+	var mac macAddress
+	hw, err := net.ParseMAC(macStr)
+	if err != nil || len(hw) != len(mac) {
+		return mac, errors.New("invalid MAC address: " + macStr)
+	}
+	copy(mac[:], hw)
+	return mac, nil
+}
+
+// Gets the MAC address that a unicast packet to the destination, or to nowhere in particular if it's nil, is sent to on the TAP adapter.
+// This may be called from any goroutine.
+func (i *icmpv6) destMAC(dest []byte) macAddress {
+	neighbors := i.neighbors.Load().(*icmpv6_neighbors)
+	if len(dest) == len(address{}) && len(neighbors.static) > 0 {
+		var addr address
+		copy(addr[:], dest)
+		if mac, isIn := neighbors.static[addr]; isIn {
+			return mac
+		}
+	}
+	if !neighbors.noLearning {
+		if mac, ok := i.peermac.Load().(macAddress); ok {
+			return mac
+		}
+	}
+	return neighbors.defaultMAC
+}
+
+// Gets the static neighbors, for the admin API.
+func (i *icmpv6) getStaticNeighbors() map[address]macAddress {
+	return i.neighbors.Load().(*icmpv6_neighbors).static
+}
+
 // Parses an incoming ICMPv6 packet. The packet provided may be either an
 // ethernet frame containing an IP packet, or the IP packet alone. This is
 // determined by whether the TUN/TAP adapter is running in TUN (layer 3) or
 // TAP (layer 2) mode.
-func (i *icmpv6) parse_packet(datain []byte) {
+// The adapter is the one that the packet was read from, which the response is
+// written to, even if the adapter has been closed or re-created since.
+func (i *icmpv6) parse_packet(iface *water.Interface, datain []byte) {
 	var response []byte
 	var err error
 
 	// Parse the frame/packet
-	if i.tun.iface.IsTAP() {
+	if iface.IsTAP() {
 		response, err = i.parse_packet_tap(datain)
 	} else {
-		response, err = i.parse_packet_tun(datain)
+		response, err = i.parse_packet_tun(datain, false)
 	}
 
 	if err != nil {
@@ -81,7 +186,12 @@ func (i *icmpv6) parse_packet(datain []byte) {
 	}
 
 	// Write the packet to TUN/TAP
-	i.tun.iface.Write(response)
+	i.tun.core.capture.captureTUN(response)
+	if i.tun.getState().vnetHdr {
+		response = append(append([]byte(nil), tun_vnetHdrNone...), response...)
+	}
+	// This fails harmlessly if the adapter has been closed in the meantime
+	iface.Write(response)
 }
 
 // Unwraps the ethernet headers of an incoming ICMPv6 packet and hands off
@@ -89,16 +199,23 @@ func (i *icmpv6) parse_packet(datain []byte) {
 // A response buffer is also created for the response message, also complete
 // with ethernet headers.
 func (i *icmpv6) parse_packet_tap(datain []byte) ([]byte, error) {
-	// Store the peer MAC address
-	copy(i.peermac[:6], datain[6:12])
+	// Store the peer MAC address, unless only static neighbors are used
+	if !i.neighbors.Load().(*icmpv6_neighbors).noLearning {
+		var mac macAddress
+		copy(mac[:], datain[6:12])
+		i.peermac.Store(mac)
+	}
 
 	// Ignore non-IPv6 frames
 	if binary.BigEndian.Uint16(datain[12:14]) != uint16(0x86DD) {
 		return nil, nil
 	}
 
+	// Remember the neighbor that sent it
+	i.updateNeighbor(datain)
+
 	// Hand over to parse_packet_tun to interpret the IPv6 packet
-	ipv6packet, err := i.parse_packet_tun(datain[len_ETHER:])
+	ipv6packet, err := i.parse_packet_tun(datain[len_ETHER:], true)
 	if err != nil {
 		return nil, err
 	}
@@ -116,11 +233,69 @@ func (i *icmpv6) parse_packet_tap(datain []byte) ([]byte, error) {
 	return dataout, nil
 }
 
+// Records the source MAC and IPv6 addresses of an ICMPv6 frame received on the
+// TAP adapter in the neighbor table, along with whether it was an NDP message.
+func (i *icmpv6) updateNeighbor(datain []byte) {
+	if len(datain) < len_ETHER+ipv6.HeaderLen+1 {
+		return
+	}
+	var addr address
+	copy(addr[:], datain[len_ETHER+8:len_ETHER+24])
+	mtype := ipv6.ICMPType(datain[len_ETHER+ipv6.HeaderLen])
+	now := time.Now()
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	n, isIn := i.peermacs[addr]
+	if !isIn && len(i.peermacs) >= icmpv6_maxNeighbors {
+		i.expireNeighbors(now)
+	}
+	copy(n.mac[:], datain[6:12])
+	n.lastseen = now
+	switch mtype {
+	case ipv6.ICMPTypeNeighborSolicitation:
+		n.learned = true
+		n.lastsolicitation = now
+	case ipv6.ICMPTypeNeighborAdvertisement:
+		n.learned = true
+	}
+	i.peermacs[addr] = n
+}
+
+// Removes the neighbors that haven't been seen for icmpv6_neighborTimeout, or
+// the one seen longest ago if that leaves the table full. Must be called with
+// the mutex held.
+func (i *icmpv6) expireNeighbors(now time.Time) {
+	var oldest address
+	var oldestSeen time.Time
+	for addr, n := range i.peermacs {
+		switch {
+		case now.Sub(n.lastseen) > icmpv6_neighborTimeout:
+			delete(i.peermacs, addr)
+		case oldestSeen.IsZero() || n.lastseen.Before(oldestSeen):
+			oldest, oldestSeen = addr, n.lastseen
+		}
+	}
+	if len(i.peermacs) >= icmpv6_maxNeighbors {
+		delete(i.peermacs, oldest)
+	}
+}
+
+// Gets a copy of the neighbor table.
+func (i *icmpv6) getNeighbors() map[address]neighbor {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	neighbors := make(map[address]neighbor, len(i.peermacs))
+	for addr, n := range i.peermacs {
+		neighbors[addr] = n
+	}
+	return neighbors
+}
+
 // Unwraps the IP headers of an incoming IPv6 packet and performs various
 // sanity checks on the packet - i.e. is the packet an ICMPv6 packet, does the
 // ICMPv6 message match a known expected type. The relevant handler function
 // is then called and a response packet may be returned.
-func (i *icmpv6) parse_packet_tun(datain []byte) ([]byte, error) {
+func (i *icmpv6) parse_packet_tun(datain []byte, fromTAP bool) ([]byte, error) {
 	// Parse the IPv6 packet headers
 	ipv6Header, err := ipv6.ParseHeader(datain[:ipv6.HeaderLen])
 	if err != nil {
@@ -148,6 +323,12 @@ func (i *icmpv6) parse_packet_tun(datain []byte) ([]byte, error) {
 
 	// Check for a supported message type
 	switch icmpv6Header.Type {
+	case ipv6.ICMPTypeRouterSolicitation:
+		// Answered with an advertisement to all nodes, if we're advertising into the TAP adapter
+		if fromTAP {
+			i.tun.core.routerAdv.solicited(true)
+		}
+		return nil, errors.New("Router solicitation answered separately")
 	case ipv6.ICMPTypeNeighborSolicitation:
 		{
 			response, err := i.handle_ndp(datain[ipv6.HeaderLen:])
@@ -0,0 +1,28 @@
+package yggdrasil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireNeighbors(t *testing.T) {
+	now := time.Now()
+	i := &icmpv6{peermacs: make(map[address]neighbor)}
+	for idx := 0; idx < icmpv6_maxNeighbors; idx++ {
+		var addr address
+		addr[0], addr[1] = byte(idx>>8), byte(idx)
+		i.peermacs[addr] = neighbor{lastseen: now.Add(-time.Duration(idx) * time.Second)}
+	}
+	// A full table with nothing stale loses only the neighbor seen longest ago
+	i.expireNeighbors(now)
+	var oldest address
+	oldest[0], oldest[1] = byte((icmpv6_maxNeighbors-1)>>8), byte(icmpv6_maxNeighbors-1)
+	if _, isIn := i.peermacs[oldest]; isIn || len(i.peermacs) != icmpv6_maxNeighbors-1 {
+		t.Errorf("got %d neighbors, including the oldest %v, want %d without it", len(i.peermacs), isIn, icmpv6_maxNeighbors-1)
+	}
+	// Everything stale goes at once, which is the older half
+	i.expireNeighbors(now.Add(icmpv6_neighborTimeout - time.Duration(icmpv6_maxNeighbors/2)*time.Second + time.Second/2))
+	if len(i.peermacs) != icmpv6_maxNeighbors/2 {
+		t.Errorf("got %d neighbors after they went stale, want %d", len(i.peermacs), icmpv6_maxNeighbors/2)
+	}
+}
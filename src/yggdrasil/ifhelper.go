@@ -0,0 +1,204 @@
+package yggdrasil
+
+// This lets the node run as an unprivileged user, by leaving the creation and
+// addressing of the TUN adapter to a small helper process that has
+// CAP_NET_ADMIN. The helper listens on a unix socket, and for each request it
+// creates an adapter with the name, address and MTU that the node asks for,
+// then passes the adapter's file descriptor back over the socket, so that the
+// node can read and write packets without being able to configure interfaces
+// itself. The adapter is removed by the kernel once the node closes it. The
+// socket is only accessible to its owner and group, so the user that the node
+// runs as should be in the helper's group, which is checked again against the
+// credentials of each connection. The helper only creates adapters the way a
+// node would, with a node address in the network's /7 prefix, a name that
+// isn't taken by an interface other than a TUN adapter, and a supported MTU,
+// so that it can't be used to configure anything else on the host. Only TUN
+// mode on Linux is supported, as water can't be handed an adapter in TAP mode.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"time"
+
+	water "github.com/yggdrasil-network/water"
+
+	"yggdrasil/defaults"
+)
+
+// How long the node and the helper wait for each other before giving up on a request.
+const ifHelper_timeout = 10 * time.Second
+
+// The names that an adapter from the helper can be given, which are the same as the kernel allows for an interface.
+var ifHelper_namePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+
+// What the node asks the helper for.
+type ifHelper_request struct {
+	Name    string
+	Address string
+	MTU     int
+}
+
+// What the helper answers with, alongside the file descriptor of the adapter unless there's an error.
+type ifHelper_response struct {
+	Name  string
+	MTU   int
+	Error string
+}
+
+// Runs the interface helper, creating TUN adapters for nodes that connect to the unix socket at the path, until it fails.
+// This doesn't need the Core to be started.
+func (c *Core) RunInterfaceHelper(path string, log *log.Logger) error {
+	if !ifHelper_supported {
+		return errors.New("the interface helper is only supported on Linux")
+	}
+	c.log = log
+	// Remove the socket that a previous helper left behind, but nothing else
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(path, 0660); err != nil {
+		return err
+	}
+	c.log.Println("Interface helper listening on", path)
+	for {
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			return err
+		}
+		go c.serveInterfaceHelper(conn)
+	}
+}
+
+// Answers a request from a node on a connection to the helper.
+func (c *Core) serveInterfaceHelper(conn *net.UnixConn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ifHelper_timeout))
+	if err := ifHelper_checkPeer(conn); err != nil {
+		c.log.Println("Refused interface helper connection:", err)
+		return
+	}
+	var req ifHelper_request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+	var res ifHelper_response
+	tun := tunDevice{}
+	tun.init(c)
+	if err := ifHelper_checkRequest(&req); err != nil {
+		res.Error = err.Error()
+	} else if err := tun.setup(req.Name, false, req.Address, req.MTU); err != nil {
+		res.Error = err.Error()
+	}
+	var file *os.File
+	if res.Error == "" {
+		var ok bool
+		if file, ok = tun.iface.ReadWriteCloser.(*os.File); !ok {
+			res.Error = "the adapter has no file descriptor"
+		}
+	}
+	if res.Error == "" {
+		res.Name, res.MTU = tun.name(), tun.mtu
+	}
+	msg, _ := json.Marshal(res)
+	if err := ifHelper_sendFile(conn, msg, file); err != nil {
+		c.log.Println("Failed to send adapter to node:", err)
+	} else if res.Error != "" {
+		c.log.Println("Failed to create adapter for node:", res.Error)
+	} else {
+		c.log.Println("Created adapter", res.Name, "with address", req.Address)
+	}
+	// The node holds its own copy of the file descriptor, which keeps the adapter open
+	tun.close()
+}
+
+// Checks that a request is for an adapter that a node would create, clamping the MTU to the supported range.
+func ifHelper_checkRequest(req *ifHelper_request) error {
+	if req.Name != "" && req.Name != "auto" {
+		if !ifHelper_namePattern.MatchString(req.Name) {
+			return errors.New("invalid interface name: " + req.Name)
+		}
+		if _, err := net.InterfaceByName(req.Name); err == nil && !ifHelper_isTUN(req.Name) {
+			return errors.New("interface exists and isn't a TUN adapter: " + req.Name)
+		}
+	}
+	ip, ipnet, err := net.ParseCIDR(req.Address)
+	if err != nil {
+		return errors.New("invalid address: " + req.Address)
+	}
+	var addr address
+	copy(addr[:], ip.To16())
+	if ones, _ := ipnet.Mask.Size(); ip.To4() != nil || !addr.isValid() || ones != 8*len(address_prefix)-1 {
+		return fmt.Errorf("address isn't a node address with a /%d prefix: %s", 8*len(address_prefix)-1, req.Address)
+	}
+	if req.MTU < 1280 {
+		req.MTU = 1280
+	}
+	if max := defaults.GetDefaults().MaximumIfMTU; req.MTU > max {
+		req.MTU = max
+	}
+	return nil
+}
+
+// Sets the path of the unix socket of the interface helper that creates the adapter, or empty to create it ourselves.
+// This takes effect the next time the adapter is started.
+func (tun *tunDevice) setHelper(path string) {
+	tun.helperPath = path
+}
+
+// Asks the interface helper to create the adapter, instead of creating it ourselves.
+func (tun *tunDevice) setupFromHelper(ifname string, iftapmode bool, addr string, mtu int) error {
+	switch {
+	case !ifHelper_supported:
+		return errors.New("the interface helper is only supported on Linux")
+	case iftapmode:
+		return errors.New("the interface helper can't be used in TAP mode")
+	case tun.peerAddr != nil:
+		return errors.New("the interface helper can't be used in point-to-point mode")
+	}
+	if tun.queueCount > 1 || tun.offload {
+		tun.core.log.Println("The interface helper opens a single queue without offload")
+	}
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: tun.helperPath, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ifHelper_timeout))
+	if err := json.NewEncoder(conn).Encode(ifHelper_request{ifname, addr, mtu}); err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	n, file, err := ifHelper_recvFile(conn, buf)
+	if err != nil {
+		return err
+	}
+	var res ifHelper_response
+	if err := json.Unmarshal(buf[:n], &res); err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}
+	if res.Error != "" || file == nil {
+		if file != nil {
+			file.Close()
+		}
+		return errors.New("the interface helper failed to create the adapter: " + res.Error)
+	}
+	tun.iface = &water.Interface{ReadWriteCloser: ifHelper_adapter(file, res.Name)}
+	tun.queues = nil
+	tun.vnetHdr = false
+	tun.mtu = res.MTU
+	tun.core.log.Println("Interface name:", res.Name, "(created by the interface helper)")
+	return nil
+}
@@ -0,0 +1,117 @@
+package yggdrasil
+
+// The linux platform specific parts of the interface helper
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const ifHelper_supported = true
+
+// Sends a message over the connection, along with the file descriptor of the file if it isn't nil.
+func ifHelper_sendFile(conn *net.UnixConn, msg []byte, file *os.File) error {
+	var oob []byte
+	if file != nil {
+		oob = syscall.UnixRights(int(file.Fd()))
+	}
+	_, _, err := conn.WriteMsgUnix(msg, oob, nil)
+	return err
+}
+
+// Receives a message into the buffer, along with a file descriptor if one was sent.
+// The file descriptor is made non-blocking, so that the adapter can be read in batches.
+func ifHelper_recvFile(conn *net.UnixConn, buf []byte) (int, *os.File, error) {
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return 0, nil, err
+	}
+	if oobn == 0 {
+		return n, nil, nil
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return 0, nil, errors.New("invalid control message from the interface helper")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return 0, nil, errors.New("invalid file descriptor from the interface helper")
+	}
+	syscall.CloseOnExec(fds[0])
+	if err := syscall.SetNonblock(fds[0], true); err != nil {
+		syscall.Close(fds[0])
+		return 0, nil, err
+	}
+	return n, os.NewFile(uintptr(fds[0]), "/dev/net/tun"), nil
+}
+
+// Wraps the file of an adapter from the helper, which water doesn't know the name of.
+func ifHelper_adapter(file *os.File, name string) io.ReadWriteCloser {
+	return &tun_vnetFile{File: file, name: name}
+}
+
+// Checks the credentials of the process on the other end of a connection to
+// the helper, which must be root, the user the helper runs as, or in the group
+// that owns the socket.
+func ifHelper_checkPeer(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return err
+	}
+	if credErr != nil {
+		return credErr
+	}
+	if cred.Uid == 0 || int(cred.Uid) == os.Getuid() {
+		return nil
+	}
+	info, err := os.Stat(conn.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("can't find the group of the socket")
+	}
+	if cred.Gid == stat.Gid {
+		return nil
+	}
+	// The supplementary groups of the process are only listed in /proc
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", cred.Pid))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if !strings.HasPrefix(scanner.Text(), "Groups:") {
+			continue
+		}
+		for _, group := range strings.Fields(strings.TrimPrefix(scanner.Text(), "Groups:")) {
+			if gid, err := strconv.ParseUint(group, 10, 32); err == nil && uint32(gid) == stat.Gid {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("process %d of user %d isn't in the group of the socket", cred.Pid, cred.Uid)
+}
+
+// Returns true if the interface with the given name is a TUN/TAP adapter.
+func ifHelper_isTUN(name string) bool {
+	_, err := os.Stat("/sys/class/net/" + name + "/tun_flags")
+	return err == nil
+}
@@ -0,0 +1,33 @@
+// +build !linux
+
+package yggdrasil
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+)
+
+// The interface helper isn't supported on this platform.
+const ifHelper_supported = false
+
+func ifHelper_sendFile(conn *net.UnixConn, msg []byte, file *os.File) error {
+	return errors.New("not supported")
+}
+
+func ifHelper_recvFile(conn *net.UnixConn, buf []byte) (int, *os.File, error) {
+	return 0, nil, errors.New("not supported")
+}
+
+func ifHelper_checkPeer(conn *net.UnixConn) error {
+	return errors.New("not supported")
+}
+
+func ifHelper_isTUN(name string) bool {
+	return false
+}
+
+func ifHelper_adapter(file *os.File, name string) io.ReadWriteCloser {
+	return file
+}
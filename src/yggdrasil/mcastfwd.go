@@ -0,0 +1,409 @@
+package yggdrasil
+
+// This forwards IPv6 multicast traffic for selected groups between nodes that
+// have joined them, so that i.e. service discovery and streaming work across
+// the network and not just on the local link.
+// We learn which groups local hosts have joined by snooping the MLD reports
+// that they send to the TUN/TAP adapter, and tell the remote nodes that we
+// exchange memberships with by sending them announcements in protocol traffic.
+// A multicast packet read from the TUN/TAP adapter is then copied into the
+// session to each remote node that has joined its group, and a packet that
+// arrives in a session is only written to the TUN/TAP adapter if we've joined
+// its group.
+// There's no MLD querier, so we only forget a group when a host says it's
+// leaving, even if other local hosts are still in it. Groups that must stay
+// joined regardless can be joined statically in the configuration.
+// Forwarding is opt-in: nothing is forwarded unless some groups are allowed,
+// and groups with link-local or smaller scope are never forwarded.
+// Memberships are only accepted from the remote nodes in the configuration and
+// from our directly connected peers, so that other nodes can't have traffic
+// sent to them, and a remote node's memberships expire unless it announces
+// them again. The number of remote nodes that aren't configured is capped.
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// How often memberships are announced to remote nodes, and how long a remote node's memberships last without being announced again.
+const (
+	mcastFwd_announceInterval = 10 * time.Second
+	mcastFwd_memberTimeout    = 3 * mcastFwd_announceInterval
+)
+
+// The maximum number of groups in an announcement.
+const mcastFwd_maxGroups = 64
+
+// The maximum number of remote nodes that aren't in the configuration whose memberships are kept.
+const mcastFwd_maxRemotes = 64
+
+// ICMPv6 types of MLD messages.
+const (
+	mcastFwd_mldQuery    = 130
+	mcastFwd_mldReport   = 131
+	mcastFwd_mldDone     = 132
+	mcastFwd_mldv2Report = 143
+)
+
+// Types of MLDv2 multicast address records.
+const (
+	mcastFwd_modeIsInclude   = 1
+	mcastFwd_modeIsExclude   = 2
+	mcastFwd_changeToInclude = 3
+	mcastFwd_changeToExclude = 4
+	mcastFwd_allowNewSources = 5
+)
+
+// Represents an announcement of the groups a node has joined, which is sent inside protocol traffic.
+type mcastMembership struct {
+	SendCoords []byte    // Sender's coords
+	Groups     []address // Groups the sender has joined
+}
+
+// The groups a remote node has joined.
+type mcastRemote struct {
+	coords []byte
+	groups map[address]struct{}
+	seen   time.Time
+}
+
+type mcastForward struct {
+	core     *Core
+	mutex    sync.RWMutex // Protects allowed and joined, which are also checked by the session workers
+	allowed  []*net.IPNet
+	joined   map[address]struct{}   // Groups joined by local hosts or the configuration
+	static   map[address]struct{}   // Groups joined by the configuration
+	members  map[boxPubKey]struct{} // Remote nodes we always announce our memberships to
+	remotes  map[boxPubKey]*mcastRemote
+	announce time.Time // When our memberships were last announced
+	changed  bool      // Our memberships changed since they were last announced
+}
+
+// Initializes the mcastForward struct.
+func (f *mcastForward) init(core *Core) {
+	f.core = core
+	f.joined = make(map[address]struct{})
+	f.static = make(map[address]struct{})
+	f.members = make(map[boxPubKey]struct{})
+	f.remotes = make(map[boxPubKey]*mcastRemote)
+}
+
+// Sets the groups which may be forwarded, the groups which are always joined, and the remote nodes that memberships are exchanged with.
+// This must be called before the router is started.
+func (f *mcastForward) setConfig(groups []string, join []string, members []string) error {
+	var allowed []*net.IPNet
+	for _, g := range groups {
+		_, prefix, err := net.ParseCIDR(g)
+		if err != nil {
+			ip := net.ParseIP(g)
+			if ip == nil {
+				return errors.New("invalid multicast group " + g)
+			}
+			prefix = &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+		}
+		if ones, _ := prefix.Mask.Size(); ones < 16 || !mcastFwd_isForwardable(prefix.IP) {
+			return errors.New("multicast group " + g + " is not a group with more than link-local scope")
+		}
+		allowed = append(allowed, prefix)
+	}
+	f.allowed = allowed
+	for _, g := range join {
+		var group address
+		ip := net.ParseIP(g)
+		if ip == nil {
+			return errors.New("invalid multicast group " + g)
+		}
+		copy(group[:], ip.To16())
+		if !f.isAllowed(&group) {
+			return errors.New("multicast group " + g + " is not allowed to be forwarded")
+		}
+		f.static[group] = struct{}{}
+		f.joined[group] = struct{}{}
+	}
+	for _, m := range members {
+		keyBytes, err := hex.DecodeString(m)
+		if err != nil {
+			return err
+		}
+		if len(keyBytes) != boxPubKeyLen {
+			return errors.New("invalid key length: " + m)
+		}
+		var key boxPubKey
+		copy(key[:], keyBytes)
+		f.members[key] = struct{}{}
+	}
+	f.changed = true
+	return nil
+}
+
+// Checks that an address is a multicast group with more than link-local scope.
+func mcastFwd_isForwardable(ip net.IP) bool {
+	return len(ip) == net.IPv6len && ip[0] == 0xff && ip[1]&0x0f > 2
+}
+
+// Checks if a group may be forwarded.
+func (f *mcastForward) isAllowed(group *address) bool {
+	if !mcastFwd_isForwardable(group[:]) {
+		return false
+	}
+	for _, prefix := range f.allowed {
+		if prefix.Contains(group[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if a packet that arrived in a session is for a group that we've joined.
+// This is called by the session workers.
+func (f *mcastForward) isJoined(group *address) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	_, isIn := f.joined[*group]
+	return isIn
+}
+
+// Handles a multicast packet read from the TUN/TAP adapter.
+// MLD messages update our memberships, and other packets are copied to the remote nodes that have joined the group.
+// If forward is false, i.e. because of the TAP multicast policy, only MLD messages are used.
+// This is only called from the router goroutine.
+func (f *mcastForward) sendPacket(bs []byte, forward bool) {
+	defer util_putBytes(bs)
+	if len(f.allowed) == 0 || f.snoop(bs) || !forward {
+		return
+	}
+	var source address
+	copy(source[:], bs[8:24])
+	var snet subnet
+	copy(snet[:], bs[8:24])
+	if source != f.core.router.addr && snet != *address_subnetForNodeID(&f.core.dht.nodeID) {
+		return
+	}
+	var group address
+	copy(group[:], bs[24:40])
+	if !f.isAllowed(&group) {
+		return
+	}
+	for key, remote := range f.remotes {
+		if _, isIn := remote.groups[group]; !isIn || time.Since(remote.seen) > mcastFwd_memberTimeout {
+			continue
+		}
+		sinfo, isIn := f.core.sessions.getByTheirPerm(&key)
+		switch {
+		case !isIn || !sinfo.init:
+			f.openSession(&key)
+		case len(bs) <= int(sinfo.getMTU()):
+			sinfo.send <- append(util_getBytes(), bs...)
+		}
+	}
+}
+
+// Checks if a packet is an MLD message, and if so, updates our memberships from any reports in it.
+func (f *mcastForward) snoop(bs []byte) bool {
+	next, offset := bs[6], tun_IPv6_HEADER_LENGTH
+	if next == 0 {
+		// MLD messages are sent with a hop-by-hop options header
+		if len(bs) < offset+8 {
+			return false
+		}
+		next = bs[offset]
+		offset += (int(bs[offset+1]) + 1) * 8
+	}
+	if next != 58 || len(bs) < offset+8 {
+		return false
+	}
+	var group address
+	switch bs[offset] {
+	case mcastFwd_mldQuery:
+	case mcastFwd_mldReport, mcastFwd_mldDone:
+		if len(bs) < offset+24 {
+			break
+		}
+		copy(group[:], bs[offset+8:])
+		f.setJoined(&group, bs[offset] == mcastFwd_mldReport)
+	case mcastFwd_mldv2Report:
+		records := int(binary.BigEndian.Uint16(bs[offset+6:]))
+		record := offset + 8
+		for idx := 0; idx < records && len(bs) >= record+20; idx++ {
+			recType, auxLen := bs[record], int(bs[record+1])
+			sources := int(binary.BigEndian.Uint16(bs[record+2:]))
+			copy(group[:], bs[record+4:])
+			switch recType {
+			case mcastFwd_modeIsExclude, mcastFwd_changeToExclude:
+				f.setJoined(&group, true)
+			case mcastFwd_modeIsInclude, mcastFwd_changeToInclude, mcastFwd_allowNewSources:
+				// Including no sources means leaving the group
+				f.setJoined(&group, sources > 0)
+			}
+			record += 20 + 16*sources + 4*auxLen
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// Joins or leaves a group on behalf of local hosts.
+func (f *mcastForward) setJoined(group *address, joined bool) {
+	if !f.isAllowed(group) {
+		return
+	}
+	if _, isIn := f.static[*group]; isIn {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, isIn := f.joined[*group]; isIn == joined {
+		return
+	}
+	if joined {
+		f.joined[*group] = struct{}{}
+	} else {
+		delete(f.joined, *group)
+	}
+	f.changed = true
+}
+
+// Forgets remote nodes that haven't announced their memberships recently, and announces ours if they've changed or it's time to.
+// This is only called from the router goroutine.
+func (f *mcastForward) doMaintenance() {
+	if len(f.allowed) == 0 {
+		return
+	}
+	for key, remote := range f.remotes {
+		if time.Since(remote.seen) > mcastFwd_memberTimeout {
+			delete(f.remotes, key)
+		}
+	}
+	if f.changed || time.Since(f.announce) >= mcastFwd_announceInterval {
+		for key := range f.members {
+			f.sendMembership(&key)
+		}
+		for key := range f.remotes {
+			if _, isIn := f.members[key]; !isIn {
+				f.sendMembership(&key)
+			}
+		}
+		f.changed = false
+		f.announce = time.Now()
+	}
+}
+
+// Sends our memberships to a remote node, using the session's coords if there is one, or else the coords the node last announced from.
+func (f *mcastForward) sendMembership(key *boxPubKey) {
+	var coords []byte
+	if sinfo, isIn := f.core.sessions.getByTheirPerm(key); isIn && sinfo.init {
+		coords = sinfo.coords
+	} else if remote, isIn := f.remotes[*key]; isIn {
+		coords = remote.coords
+	} else {
+		f.openSession(key)
+		return
+	}
+	loc := f.core.switchTable.getLocator()
+	m := mcastMembership{SendCoords: loc.getCoords()}
+	f.mutex.RLock()
+	for group := range f.joined {
+		if len(m.Groups) == mcastFwd_maxGroups {
+			break
+		}
+		m.Groups = append(m.Groups, group)
+	}
+	f.mutex.RUnlock()
+	shared := f.core.sessions.getSharedKey(&f.core.boxPriv, key)
+	payload, nonce := boxSeal(shared, m.encode(), nil)
+	p := wire_protoTrafficPacket{
+		Coords:  coords,
+		ToKey:   *key,
+		FromKey: f.core.boxPub,
+		Nonce:   *nonce,
+		Payload: payload,
+	}
+	f.core.router.out(p.encode())
+}
+
+// Searches for a remote node so that a session is opened to it.
+func (f *mcastForward) openSession(key *boxPubKey) {
+	nodeID := getNodeID(key)
+	var mask NodeID
+	for idx := range mask {
+		mask[idx] = 0xff
+	}
+	sinfo, isIn := f.core.searches.searches[*nodeID]
+	if !isIn {
+		sinfo = f.core.searches.newIterSearch(nodeID, &mask)
+	}
+	f.core.searches.continueSearch(sinfo)
+}
+
+// Checks if a remote node may announce its memberships to us, because it's in the configuration or is one of our peers.
+func (f *mcastForward) isMember(key *boxPubKey) bool {
+	if _, isIn := f.members[*key]; isIn {
+		return true
+	}
+	for _, p := range f.core.peers.getPorts() {
+		if p.port != 0 && p.box == *key {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts the remote nodes that we know the memberships of which aren't in the configuration.
+func (f *mcastForward) countUnlisted() int {
+	var count int
+	for key := range f.remotes {
+		if _, isIn := f.members[key]; !isIn {
+			count++
+		}
+	}
+	return count
+}
+
+// Handles an announcement of the groups a remote node has joined.
+// A node we didn't know about is sent our memberships straight away, so that it doesn't have to wait for our next announcement.
+func (f *mcastForward) handleMembership(m *mcastMembership, fromKey *boxPubKey) {
+	if len(f.allowed) == 0 || !f.core.sessions.isSessionAllowed(fromKey, false) || !f.isMember(fromKey) {
+		return
+	}
+	remote, isIn := f.remotes[*fromKey]
+	if !isIn {
+		if _, isListed := f.members[*fromKey]; !isListed && f.countUnlisted() >= mcastFwd_maxRemotes {
+			return
+		}
+		remote = &mcastRemote{}
+		f.remotes[*fromKey] = remote
+	}
+	remote.coords = m.SendCoords
+	remote.groups = make(map[address]struct{})
+	remote.seen = time.Now()
+	for _, group := range m.Groups {
+		if f.isAllowed(&group) {
+			remote.groups[group] = struct{}{}
+		}
+	}
+	if !isIn {
+		f.sendMembership(fromKey)
+	}
+}
+
+// Gets the groups we've joined and the remote nodes that have joined each group, for the admin API.
+// This is only called from the router goroutine.
+func (f *mcastForward) getGroups() (joined []address, remote map[address][]boxPubKey) {
+	f.mutex.RLock()
+	for group := range f.joined {
+		joined = append(joined, group)
+	}
+	f.mutex.RUnlock()
+	remote = make(map[address][]boxPubKey)
+	for key, r := range f.remotes {
+		for group := range r.groups {
+			remote[group] = append(remote[group], key)
+		}
+	}
+	return joined, remote
+}
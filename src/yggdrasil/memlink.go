@@ -0,0 +1,274 @@
+package yggdrasil
+
+// This implements in-memory links, which connect Cores running in the same
+// process without using real sockets. They're intended for integration tests
+// and network simulations with large numbers of nodes.
+// A Core accepts in-memory links after calling Core.ListenMem with a name that
+// is unique within the process, and other Cores connect to it by adding the
+// peer mem://name. The link can be slowed down to look more like a real one
+// with the latency and bandwidth parameters of the URI, i.e.
+//  mem://node1?latency=20ms&bandwidth=10000000
+// where the bandwidth is in bits per second, and zero means unlimited.
+// Links without latency or a bandwidth limit skip the timing altogether and
+// coalesce data written back to back, so they're much faster than loopback
+// TCP, which makes them suitable for gateways running several nodes in one
+// process. Nodes in different processes on the same host can use unix://
+// links instead.
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Cores that accept in-memory links, by name, shared by all Cores in the process.
+var memlink_listeners = struct {
+	sync.Mutex
+	cores map[string]*Core
+}{cores: make(map[string]*Core)}
+
+// Registers the Core to accept in-memory links with the given name.
+func memlink_listen(name string, core *Core) error {
+	memlink_listeners.Lock()
+	defer memlink_listeners.Unlock()
+	if _, isIn := memlink_listeners.cores[name]; isIn {
+		return errors.New("in-memory link name already in use: " + name)
+	}
+	memlink_listeners.cores[name] = core
+	return nil
+}
+
+// Stops the Core from accepting in-memory links under any name.
+func memlink_unlisten(core *Core) {
+	memlink_listeners.Lock()
+	defer memlink_listeners.Unlock()
+	for name, c := range memlink_listeners.cores {
+		if c == core {
+			delete(memlink_listeners.cores, name)
+		}
+	}
+}
+
+// Connects to the Core listening with the given name, returning our end of the link.
+// The remote Core handles its end as an incoming connection, subject to its peering policy.
+func memlink_dial(name string, latency time.Duration, bandwidth float64) (net.Conn, error) {
+	memlink_listeners.Lock()
+	remote, isIn := memlink_listeners.cores[name]
+	memlink_listeners.Unlock()
+	if !isIn {
+		return nil, errors.New("no in-memory listener: " + name)
+	}
+	local, theirs := memlink_pair(name, latency, bandwidth)
+	go remote.tcp.handler(theirs, &tcpListener{policy: tcp_policyDefault}, nil)
+	return local, nil
+}
+
+// Creates both ends of an in-memory link, with the given name as the address of both ends.
+func memlink_pair(name string, latency time.Duration, bandwidth float64) (net.Conn, net.Conn) {
+	a, b := memlink_newQueue(), memlink_newQueue()
+	addr := &wrappedAddr{network: "mem", addr: "mem://" + name}
+	local := &memlink_conn{in: a, out: b, latency: latency, bandwidth: bandwidth, laddr: addr, raddr: addr}
+	theirs := &memlink_conn{in: b, out: a, latency: latency, bandwidth: bandwidth, laddr: addr, raddr: addr}
+	return local, theirs
+}
+
+// Parses the latency and bandwidth parameters of a mem:// peer URI.
+func memlink_parseArgs(args url.Values) (time.Duration, float64, error) {
+	var latency time.Duration
+	var bandwidth float64
+	var err error
+	if s := args.Get("latency"); s != "" {
+		if latency, err = time.ParseDuration(s); err != nil {
+			return 0, 0, err
+		}
+	}
+	if s := args.Get("bandwidth"); s != "" {
+		if bandwidth, err = strconv.ParseFloat(s, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	return latency, bandwidth, nil
+}
+
+// Data in flight in one direction of an in-memory link.
+type memlink_chunk struct {
+	data []byte
+	at   time.Time // When the data arrives at the other end
+}
+
+// One direction of an in-memory link.
+type memlink_queue struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	chunks    []memlink_chunk
+	busyUntil time.Time // When the link finishes sending what has already been written, for the bandwidth limit
+	closed    bool
+}
+
+func memlink_newQueue() *memlink_queue {
+	q := &memlink_queue{}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Marks the queue as closed and wakes up anything waiting on it.
+func (q *memlink_queue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Returned by reads that pass the read deadline.
+type memlink_timeoutError struct{}
+
+func (e *memlink_timeoutError) Error() string   { return "i/o timeout" }
+func (e *memlink_timeoutError) Timeout() bool   { return true }
+func (e *memlink_timeoutError) Temporary() bool { return true }
+
+// memlink_conn implements net.Conn for one end of an in-memory link.
+type memlink_conn struct {
+	in        *memlink_queue
+	out       *memlink_queue
+	latency   time.Duration
+	bandwidth float64 // In bits per second, or 0 for unlimited
+	deadline  time.Time
+	laddr     net.Addr
+	raddr     net.Addr
+}
+
+// Queues a copy of the data to arrive after the link's latency.
+// If the link has a bandwidth limit, this blocks until the link has finished sending earlier data, which pushes back on the writer like a real socket would.
+func (c *memlink_conn) Write(data []byte) (int, error) {
+	q := c.out
+	if c.latency == 0 && c.bandwidth == 0 {
+		return c.writeUnimpaired(data)
+	}
+	q.mutex.Lock()
+	now := time.Now()
+	start := now
+	if q.busyUntil.After(now) {
+		start = q.busyUntil
+	}
+	q.busyUntil = start
+	if c.bandwidth > 0 {
+		q.busyUntil = start.Add(time.Duration(float64(8*len(data)) / c.bandwidth * float64(time.Second)))
+	}
+	q.mutex.Unlock()
+	time.Sleep(start.Sub(now))
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return 0, io.ErrClosedPipe
+	}
+	q.chunks = append(q.chunks, memlink_chunk{
+		data: append([]byte(nil), data...),
+		at:   start.Add(c.latency),
+	})
+	q.cond.Broadcast()
+	return len(data), nil
+}
+
+// Queues a copy of the data to arrive straight away, adding it to the end of the last chunk that hasn't been read yet.
+// Chunks are kept to the size of a message, so a reader that falls behind doesn't make every write copy a large buffer.
+func (c *memlink_conn) writeUnimpaired(data []byte) (int, error) {
+	q := c.out
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if n := len(q.chunks); n > 0 && len(q.chunks[n-1].data)+len(data) <= tcp_msgSize {
+		q.chunks[n-1].data = append(q.chunks[n-1].data, data...)
+	} else {
+		q.chunks = append(q.chunks, memlink_chunk{data: append([]byte(nil), data...)})
+	}
+	q.cond.Broadcast()
+	return len(data), nil
+}
+
+// Reads data that has arrived, blocking until some arrives, the read deadline passes or the link is closed.
+func (c *memlink_conn) Read(data []byte) (int, error) {
+	q := c.in
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for {
+		now := time.Now()
+		var n int
+		for n < len(data) && len(q.chunks) > 0 && !now.Before(q.chunks[0].at) {
+			// Read as many of the chunks that have arrived as fit
+			copied := copy(data[n:], q.chunks[0].data)
+			if copied < len(q.chunks[0].data) {
+				q.chunks[0].data = q.chunks[0].data[copied:]
+			} else {
+				q.chunks = q.chunks[1:]
+			}
+			n += copied
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if q.closed && len(q.chunks) == 0 {
+			return 0, io.EOF
+		}
+		if !c.deadline.IsZero() && !now.Before(c.deadline) {
+			return 0, &memlink_timeoutError{}
+		}
+		// Wait to be woken up by a write or close, or until the next chunk arrives or the deadline passes
+		var wake time.Time
+		if len(q.chunks) > 0 {
+			wake = q.chunks[0].at
+		}
+		if !c.deadline.IsZero() && (wake.IsZero() || c.deadline.Before(wake)) {
+			wake = c.deadline
+		}
+		var timer *time.Timer
+		if !wake.IsZero() {
+			timer = time.AfterFunc(wake.Sub(now), func() {
+				q.mutex.Lock()
+				defer q.mutex.Unlock()
+				q.cond.Broadcast()
+			})
+		}
+		q.cond.Wait()
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Closes both directions of the link. Data already in flight can still be read by the other end.
+func (c *memlink_conn) Close() error {
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *memlink_conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memlink_conn) SetReadDeadline(t time.Time) error {
+	c.in.mutex.Lock()
+	defer c.in.mutex.Unlock()
+	c.deadline = t
+	c.in.cond.Broadcast()
+	return nil
+}
+
+// Write deadlines aren't supported, as writes only block to enforce the bandwidth limit.
+func (c *memlink_conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memlink_conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *memlink_conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
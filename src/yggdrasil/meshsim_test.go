@@ -0,0 +1,488 @@
+package yggdrasil
+
+// This runs a simulated network of nodes in one process, and checks that the
+// network converges and that nodes can reach each other, as a regression test
+// for changes to routing: a scenario that passes before a change should still
+// pass after it.
+//
+// Each node is a full Core, without a TUN/TAP adapter or any sockets, and nodes
+// are connected with in-memory mem:// links, which can have latency and a
+// bandwidth limit. Keys are generated from the scenario's seed, so a scenario
+// always runs with the same node addresses and tree root.
+//
+// The simulation waits and measures time with its own clock, but the Cores use
+// the system clock throughout, so the timing of individual messages isn't
+// reproducible. Expectations therefore wait for up to a timeout for the network
+// to reach the expected state, rather than checking it at an exact moment.
+//
+// A scenario has one command per line, which are run in order. Blank lines and
+// anything after a # are ignored.
+//
+//	node <name>                          Adds a node, which is also done by link
+//	link <a> <b> [latency] [bandwidth]   Connects two nodes, i.e. link a b 20ms 10000000
+//	unlink <a> <b>                       Disconnects two nodes
+//	wait <duration>                      Waits, i.e. wait 5s
+//	expect converged [timeout]           Waits for the tree to settle so that the
+//	                                     switch can route between every pair of nodes
+//	expect reachable <a> <b> [timeout]   Waits for a packet sent from a to arrive at b,
+//	                                     where * means every node
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+
+	"yggdrasil/config"
+)
+
+// The timeout used by expect commands that don't give one.
+const meshSim_defaultTimeout = 30 * time.Second
+
+// How often the network is checked while waiting for an expectation.
+const meshSim_pollInterval = 100 * time.Millisecond
+
+// The time that the simulation waits and measures timeouts with.
+type meshSim_clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// The system clock, which is the one that the Cores use.
+type meshSim_systemClock struct{}
+
+func (meshSim_systemClock) Now() time.Time        { return time.Now() }
+func (meshSim_systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+type meshSim_node struct {
+	name  string
+	core  Core
+	mutex sync.Mutex
+	seen  map[uint64]bool // Probe IDs that have arrived at this node
+}
+
+type meshSim struct {
+	t      *testing.T
+	clock  meshSim_clock
+	rng    *rand.Rand
+	nodes  map[string]*meshSim_node
+	order  []*meshSim_node             // Nodes in the order they were added, so output is stable
+	byKey  map[sigPubKey]*meshSim_node // Nodes by signing key, to follow switch lookups
+	coords map[*meshSim_node]string    // Coords of each node at the last check, to tell when they settle
+	probe  uint64                      // The ID of the last probe sent
+	links  map[[2]string]struct{}      // Links that have been made, in both directions
+}
+
+func meshSim_new(t *testing.T, seed int64, clock meshSim_clock) *meshSim {
+	return &meshSim{
+		t:      t,
+		clock:  clock,
+		rng:    rand.New(rand.NewSource(seed)),
+		nodes:  make(map[string]*meshSim_node),
+		byKey:  make(map[sigPubKey]*meshSim_node),
+		coords: make(map[*meshSim_node]string),
+		links:  make(map[[2]string]struct{}),
+	}
+}
+
+// Stops every node.
+func (s *meshSim) stop() {
+	for _, n := range s.order {
+		n.core.Stop()
+	}
+}
+
+// Creates and starts a node with keys from the simulation's source of randomness.
+func (s *meshSim) newNode(name string) (*meshSim_node, error) {
+	bpub, bpriv, err := box.GenerateKey(s.rng)
+	if err != nil {
+		return nil, err
+	}
+	spub, spriv, err := ed25519.GenerateKey(s.rng)
+	if err != nil {
+		return nil, err
+	}
+	cfg := config.NodeConfig{
+		Listen:               "none",
+		AdminListen:          "none",
+		IfName:               "none",
+		EncryptionPublicKey:  hex.EncodeToString(bpub[:]),
+		EncryptionPrivateKey: hex.EncodeToString(bpriv[:]),
+		SigningPublicKey:     hex.EncodeToString(spub[:]),
+		SigningPrivateKey:    hex.EncodeToString(spriv[:]),
+	}
+	cfg.SessionFirewall.AllowFromDirect = true
+	cfg.SessionFirewall.AllowFromRemote = true
+	n := &meshSim_node{name: name, seen: make(map[uint64]bool)}
+	if err := n.core.Start(&cfg, log.New(ioutil.Discard, "", 0)); err != nil {
+		return nil, err
+	}
+	// Stop the responder for the missing adapter, so that every packet for the node arrives here instead
+	n.core.tun.lifecycle.Lock()
+	close(n.core.tun.stop)
+	n.core.tun.stop = nil
+	n.core.tun.lifecycle.Unlock()
+	if err := n.core.ListenMem(name); err != nil {
+		n.core.Stop()
+		return nil, err
+	}
+	go n.receive()
+	return n, nil
+}
+
+// Records the probes that arrive at the node, and discards everything else.
+func (n *meshSim_node) receive() {
+	for packet := range n.core.tun.recv {
+		if len(packet) == 48 {
+			n.mutex.Lock()
+			n.seen[binary.BigEndian.Uint64(packet[40:])] = true
+			n.mutex.Unlock()
+		}
+		util_putBytes(packet)
+	}
+}
+
+// Sends a probe with the given ID to another node.
+func (n *meshSim_node) sendProbe(dest *meshSim_node, id uint64) {
+	packet := make([]byte, 48)
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], 8)
+	packet[6] = tun_nextHeaderNone
+	packet[7] = 64
+	copy(packet[8:24], n.core.router.addr[:])
+	copy(packet[24:40], dest.core.router.addr[:])
+	binary.BigEndian.PutUint64(packet[40:], id)
+	n.core.tun.send <- packet
+}
+
+// Checks whether a probe with the given ID has arrived.
+func (n *meshSim_node) hasSeen(id uint64) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.seen[id]
+}
+
+// Gets the node with the given name, creating it if it doesn't exist yet.
+func (s *meshSim) getNode(name string) (*meshSim_node, error) {
+	if n, isIn := s.nodes[name]; isIn {
+		return n, nil
+	}
+	n, err := s.newNode(name)
+	if err != nil {
+		return nil, err
+	}
+	s.nodes[name] = n
+	s.order = append(s.order, n)
+	s.byKey[n.core.sigPub] = n
+	return n, nil
+}
+
+// Gets the nodes matching a name from a command, where * matches all of them.
+func (s *meshSim) matchNodes(name string) ([]*meshSim_node, error) {
+	if name == "*" {
+		return s.order, nil
+	}
+	n, isIn := s.nodes[name]
+	if !isIn {
+		return nil, errors.New("unknown node: " + name)
+	}
+	return []*meshSim_node{n}, nil
+}
+
+// Connects two nodes with an in-memory link, with optional latency and bandwidth in bits per second.
+func (s *meshSim) link(a, b string, args []string) error {
+	if a == b {
+		return errors.New("can't link a node to itself")
+	}
+	if _, isIn := s.links[[2]string{a, b}]; isIn {
+		return nil
+	}
+	m, err := s.getNode(a)
+	if err != nil {
+		return err
+	}
+	if _, err := s.getNode(b); err != nil {
+		return err
+	}
+	uri := "mem://" + b
+	var params []string
+	if len(args) > 0 {
+		if _, err := time.ParseDuration(args[0]); err != nil {
+			return err
+		}
+		params = append(params, "latency="+args[0])
+	}
+	if len(args) > 1 {
+		if _, err := strconv.ParseFloat(args[1], 64); err != nil {
+			return err
+		}
+		params = append(params, "bandwidth="+args[1])
+	}
+	if len(params) > 0 {
+		uri += "?" + strings.Join(params, "&")
+	}
+	if err := m.core.AddPeer(uri, ""); err != nil {
+		return err
+	}
+	s.links[[2]string{a, b}] = struct{}{}
+	s.links[[2]string{b, a}] = struct{}{}
+	return nil
+}
+
+// Disconnects two nodes, closing the link between them from both ends.
+func (s *meshSim) unlink(a, b string) error {
+	m, isIn := s.nodes[a]
+	n, isIn2 := s.nodes[b]
+	if !isIn || !isIn2 {
+		return errors.New("unknown node")
+	}
+	for _, pair := range [][2]*meshSim_node{{m, n}, {n, m}} {
+		for port, p := range pair[0].core.peers.getPorts() {
+			if p != nil && p.sig == pair[1].core.sigPub {
+				pair[0].core.peers.removePeer(port)
+			}
+		}
+	}
+	delete(s.links, [2]string{a, b})
+	delete(s.links, [2]string{b, a})
+	return nil
+}
+
+// Checks whether the switch would route a packet from source to dest, by following the lookup at each hop.
+func (s *meshSim) canRoute(source, dest *meshSim_node) bool {
+	loc := dest.core.switchTable.getLocator()
+	coords := loc.getCoords()
+	here := source
+	for hops := 0; here != dest; hops++ {
+		if hops > len(s.order) {
+			return false // Loop
+		}
+		port := here.core.switchTable.bestPortForCoords(coords)
+		p := here.core.peers.getPorts()[port]
+		if p == nil {
+			return false
+		}
+		next := s.byKey[p.sig]
+		if next == nil || next == here {
+			return false // Dropped
+		}
+		here = next
+	}
+	return true
+}
+
+// Checks whether the network has converged: every node's coords are unchanged since the last check, and the switch routes between every pair of nodes.
+func (s *meshSim) isConverged() bool {
+	stable := true
+	for _, n := range s.order {
+		loc := n.core.switchTable.getLocator()
+		coords := fmt.Sprint(loc.getCoords())
+		if s.coords[n] != coords {
+			stable = false
+		}
+		s.coords[n] = coords
+	}
+	if !stable {
+		return false
+	}
+	for _, source := range s.order {
+		for _, dest := range s.order {
+			if !s.canRoute(source, dest) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Waits for the network to converge.
+func (s *meshSim) expectConverged(timeout time.Duration) error {
+	s.coords = make(map[*meshSim_node]string)
+	start := s.clock.Now()
+	for !s.isConverged() {
+		if s.clock.Now().Sub(start) > timeout {
+			return errors.New("not converged")
+		}
+		s.clock.Sleep(meshSim_pollInterval)
+	}
+	s.t.Logf("converged after %s", s.clock.Now().Sub(start).Round(time.Millisecond))
+	return nil
+}
+
+// Waits for a probe from each source to arrive at each destination, resending it until it does.
+// The first probes are usually dropped while the source searches for the destination and opens a session.
+func (s *meshSim) expectReachable(sources, dests []*meshSim_node, timeout time.Duration) error {
+	var unreachable []string
+	for _, source := range sources {
+		for _, dest := range dests {
+			if source == dest {
+				continue
+			}
+			s.probe++
+			id := s.probe
+			start := s.clock.Now()
+			for !dest.hasSeen(id) {
+				if s.clock.Now().Sub(start) > timeout {
+					unreachable = append(unreachable, source.name+"->"+dest.name)
+					break
+				}
+				source.sendProbe(dest, id)
+				s.clock.Sleep(meshSim_pollInterval)
+			}
+		}
+	}
+	if len(unreachable) > 0 {
+		return errors.New("unreachable: " + strings.Join(unreachable, " "))
+	}
+	return nil
+}
+
+// Parses an optional timeout argument.
+func meshSim_parseTimeout(args []string, idx int) (time.Duration, error) {
+	if len(args) <= idx {
+		return meshSim_defaultTimeout, nil
+	}
+	return time.ParseDuration(args[idx])
+}
+
+// Runs one command from a scenario. Errors in the command itself are returned, while failed expectations are reported as test errors.
+func (s *meshSim) run(fields []string) error {
+	usage := errors.New("wrong number of arguments")
+	switch fields[0] {
+	case "node":
+		if len(fields) != 2 {
+			return usage
+		}
+		_, err := s.getNode(fields[1])
+		return err
+	case "link":
+		if len(fields) < 3 || len(fields) > 5 {
+			return usage
+		}
+		return s.link(fields[1], fields[2], fields[3:])
+	case "unlink":
+		if len(fields) != 3 {
+			return usage
+		}
+		return s.unlink(fields[1], fields[2])
+	case "wait":
+		if len(fields) != 2 {
+			return usage
+		}
+		d, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return err
+		}
+		s.clock.Sleep(d)
+		return nil
+	case "expect":
+		if len(fields) < 2 {
+			return usage
+		}
+		var err error
+		switch fields[1] {
+		case "converged":
+			if len(fields) > 3 {
+				return usage
+			}
+			timeout, perr := meshSim_parseTimeout(fields, 2)
+			if perr != nil {
+				return perr
+			}
+			err = s.expectConverged(timeout)
+		case "reachable":
+			if len(fields) < 4 || len(fields) > 5 {
+				return usage
+			}
+			sources, perr := s.matchNodes(fields[2])
+			if perr != nil {
+				return perr
+			}
+			dests, perr := s.matchNodes(fields[3])
+			if perr != nil {
+				return perr
+			}
+			timeout, perr := meshSim_parseTimeout(fields, 4)
+			if perr != nil {
+				return perr
+			}
+			err = s.expectReachable(sources, dests, timeout)
+		default:
+			return errors.New("unknown expectation: " + fields[1])
+		}
+		if err != nil {
+			s.t.Errorf("%s: %v", strings.Join(fields, " "), err)
+		}
+		return nil
+	default:
+		return errors.New("unknown command: " + fields[0])
+	}
+}
+
+// Runs a scenario, stopping at the first invalid command.
+func (s *meshSim) runScenario(scenario string) error {
+	for line, text := range strings.Split(scenario, "\n") {
+		if idx := strings.Index(text, "#"); idx >= 0 {
+			text = text[:idx]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		s.t.Logf("%d: %s", line+1, strings.Join(fields, " "))
+		if err := s.run(fields); err != nil {
+			return fmt.Errorf("line %d: %v", line+1, err)
+		}
+	}
+	return nil
+}
+
+func TestMeshSim(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the simulation runs in real time")
+	}
+	tests := []struct {
+		name     string
+		seed     int64
+		scenario string
+	}{
+		{"ring with a shortcut", 1, `
+			# A ring of six nodes with a shortcut, which must still work after the shortcut and then one ring link fail
+			link a b 10ms
+			link b c 10ms
+			link c d 10ms
+			link d e 10ms
+			link e f 10ms
+			link f a 10ms
+			link a d 50ms 1000000
+			expect converged 30s
+			expect reachable * * 30s
+			unlink a d
+			expect converged 30s
+			expect reachable a d 30s
+			unlink c d
+			expect converged 60s
+			expect reachable * * 60s
+		`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sim := meshSim_new(t, test.seed, meshSim_systemClock{})
+			defer sim.stop()
+			if err := sim.runScenario(test.scenario); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package yggdrasil
+
+// This clamps the maximum segment size that TCP connections through a session
+// announce in their SYNs to what the session's MTU can carry, in both
+// directions, so that hosts only ever send segments that fit. Hosts pick the
+// MSS from the MTU of their own interface, which is usually the largest that
+// any session allows, so without this a connection to a node with a smaller
+// MTU only finds out with a Packet Too Big once it has already sent a full
+// segment. Only connections through sessions with a smaller MTU are clamped,
+// and the announced MSS is never raised.
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// TCP flags and options that clamping needs.
+const (
+	mssClamp_flagSYN    = 0x02
+	mssClamp_optEnd     = 0
+	mssClamp_optNOP     = 1
+	mssClamp_optMSS     = 2
+	mssClamp_tcpHdrSize = 20
+)
+
+// Clamps the MSS option of a TCP SYN in an IPv6 packet, or IPv4 from crypto-key routing, to fit the MTU, fixing up the checksum.
+// Returns true if the MSS was lowered.
+func mssClamp_packet(packet []byte, mtu uint16) bool {
+	var tcp []byte
+	switch {
+	case mtu == 0:
+		return false
+	case len(packet) >= tun_IPv6_HEADER_LENGTH && packet[0]&0xf0 == 0x60:
+		protocol, header := packetFilter_transport(packet)
+		if protocol != packetFilter_tcp {
+			return false
+		}
+		tcp = header
+	case len(packet) >= tun_IPv4_HEADER_LENGTH && packet[0]&0xf0 == 0x40:
+		headerLen := 4 * int(packet[0]&0x0f)
+		fragment := binary.BigEndian.Uint16(packet[6:8]) & 0x1fff
+		if packet[9] != packetFilter_tcp || fragment != 0 || headerLen < tun_IPv4_HEADER_LENGTH || len(packet) < headerLen {
+			return false
+		}
+		tcp = packet[headerLen:]
+	default:
+		return false
+	}
+	if len(tcp) < mssClamp_tcpHdrSize || tcp[13]&mssClamp_flagSYN == 0 {
+		return false
+	}
+	// The IP header includes any options or extension headers, which take room from the segment
+	maxMSS := int(mtu) - (len(packet) - len(tcp)) - mssClamp_tcpHdrSize
+	if maxMSS <= 0 {
+		return false
+	}
+	dataOffset := 4 * int(tcp[12]>>4)
+	if dataOffset < mssClamp_tcpHdrSize || dataOffset > len(tcp) {
+		return false
+	}
+	for idx := mssClamp_tcpHdrSize; idx < dataOffset; {
+		switch tcp[idx] {
+		case mssClamp_optEnd:
+			return false
+		case mssClamp_optNOP:
+			idx++
+			continue
+		}
+		if idx+1 >= dataOffset || tcp[idx+1] < 2 || idx+int(tcp[idx+1]) > dataOffset {
+			return false
+		}
+		if tcp[idx] == mssClamp_optMSS && tcp[idx+1] == 4 {
+			oldMSS := binary.BigEndian.Uint16(tcp[idx+2 : idx+4])
+			if int(oldMSS) <= maxMSS {
+				return false
+			}
+			newMSS := uint16(maxMSS)
+			binary.BigEndian.PutUint16(tcp[idx+2:idx+4], newMSS)
+			if (idx+2)%2 == 1 {
+				// The checksum is summed over 16-bit words, which this straddles
+				oldMSS, newMSS = oldMSS<<8|oldMSS>>8, newMSS<<8|newMSS>>8
+			}
+			// Update the checksum for the change, as in RFC 1624
+			sum := uint32(^binary.BigEndian.Uint16(tcp[16:18])) + uint32(^oldMSS) + uint32(newMSS)
+			binary.BigEndian.PutUint16(tcp[16:18], tun_checksumFold(sum))
+			return true
+		}
+		idx += int(tcp[idx+1])
+	}
+	return false
+}
+
+// Clamps the MSS of a packet sent or received in the session to the session's MTU, counting it if it was lowered.
+func (sinfo *sessionInfo) clampMSS(packet []byte) {
+	if mssClamp_packet(packet, sinfo.getMTU()) {
+		atomic.AddUint64(&sinfo.core.tun.counters.mssClamped, 1)
+	}
+}
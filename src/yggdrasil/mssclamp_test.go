@@ -0,0 +1,96 @@
+package yggdrasil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestClampMSS(t *testing.T) {
+	tests := []struct {
+		name    string
+		ipv4    bool
+		options []byte
+		flags   byte
+		mtu     uint16
+		clamped bool
+		want    uint16 // The MSS after clamping, or 0 if there's no MSS option to find
+	}{
+		{"IPv6 SYN", false, []byte{2, 4, 0x05, 0xa0}, mssClamp_flagSYN, 1280, true, 1220},
+		{"IPv6 SYN-ACK", false, []byte{2, 4, 0xfd, 0xe8}, mssClamp_flagSYN | 0x10, 9000, true, 8940},
+		{"IPv4 SYN", true, []byte{2, 4, 0x05, 0xb4}, mssClamp_flagSYN, 1280, true, 1240},
+		{"MSS at an odd offset", false, []byte{1, 2, 4, 0x05, 0xa0, 1, 1, 1}, mssClamp_flagSYN, 1280, true, 1220},
+		{"IPv4 MSS at an odd offset", true, []byte{1, 2, 4, 0x05, 0xb4, 1, 1, 1}, mssClamp_flagSYN, 1280, true, 1240},
+		{"MSS after another option", false, []byte{4, 2, 2, 4, 0x05, 0xa0, 1, 1}, mssClamp_flagSYN, 1280, true, 1220},
+		{"MSS that fits already", false, []byte{2, 4, 0x04, 0xb0}, mssClamp_flagSYN, 1280, false, 1200},
+		{"MSS that fits exactly", false, []byte{2, 4, 0x04, 0xc4}, mssClamp_flagSYN, 1280, false, 1220},
+		{"not a SYN", false, []byte{2, 4, 0x05, 0xa0}, 0x10, 1280, false, 1440},
+		{"no MTU", false, []byte{2, 4, 0x05, 0xa0}, mssClamp_flagSYN, 0, false, 1440},
+		{"MTU too small for the headers", false, []byte{2, 4, 0x05, 0xa0}, mssClamp_flagSYN, 60, false, 1440},
+		{"no options", false, nil, mssClamp_flagSYN, 1280, false, 0},
+		{"MSS after the end of options", false, []byte{0, 0, 0, 0, 2, 4, 0x05, 0xa0}, mssClamp_flagSYN, 1280, false, 1440},
+		{"option longer than the header", false, []byte{8, 12, 2, 4, 0x05, 0xa0, 0, 0}, mssClamp_flagSYN, 1280, false, 1440},
+	}
+	for _, test := range tests {
+		ipLen := tun_IPv6_HEADER_LENGTH
+		if test.ipv4 {
+			ipLen = tun_IPv4_HEADER_LENGTH
+		}
+		packet := make([]byte, ipLen+tun_tcpHeaderLength+len(test.options))
+		if test.ipv4 {
+			packet[0] = 0x45
+			binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+			packet[9] = packetFilter_tcp
+		} else {
+			packet[0] = 0x60
+			binary.BigEndian.PutUint16(packet[4:6], uint16(len(packet)-ipLen))
+			packet[6] = packetFilter_tcp
+		}
+		tcp := packet[ipLen:]
+		binary.BigEndian.PutUint16(tcp[0:2], 1234)
+		binary.BigEndian.PutUint16(tcp[2:4], 80)
+		tcp[12] = byte((tun_tcpHeaderLength+len(test.options))/4) << 4
+		tcp[13] = test.flags
+		binary.BigEndian.PutUint16(tcp[16:18], 0x1234)
+		copy(tcp[tun_tcpHeaderLength:], test.options)
+		// The addresses don't change, so the checksum is right if the segment still adds up to the same sum
+		sum := tun_checksumFold(tun_checksumAdd(0, tcp))
+		before := append([]byte(nil), packet...)
+		if clamped := mssClamp_packet(packet, test.mtu); clamped != test.clamped {
+			t.Errorf("%s: got %v, want %v", test.name, clamped, test.clamped)
+		}
+		if !test.clamped && !bytes.Equal(packet, before) {
+			t.Errorf("%s: the packet was changed", test.name)
+		}
+		if got := tun_checksumFold(tun_checksumAdd(0, tcp)); got != sum {
+			t.Errorf("%s: the checksum wasn't updated to match", test.name)
+		}
+		if idx := bytes.Index(tcp[tun_tcpHeaderLength:], []byte{2, 4}); test.want != 0 {
+			if got := binary.BigEndian.Uint16(tcp[tun_tcpHeaderLength+idx+2:]); got != test.want {
+				t.Errorf("%s: got MSS %d, want %d", test.name, got, test.want)
+			}
+		}
+	}
+}
+
+func TestClampMSSIgnored(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"UDP", []byte{0x60, 0, 0, 0, 0, 28, packetFilter_udp, 64, 39: 0, 48: 0x02, 67: 0}},
+		{"IPv4 fragment", []byte{0x45, 0, 0, 44, 0, 0, 0, 1, 64, packetFilter_tcp, 32: 0x60, 0x02, 40: 2, 4, 0x05, 0xb4}},
+		{"IPv4 header length too short", []byte{0x44, 0, 0, 44, 0, 0, 0, 0, 64, packetFilter_tcp, 32: 0x60, 0x02, 40: 2, 4, 0x05, 0xb4}},
+		{"truncated TCP header", []byte{0x60, 0, 0, 0, 0, 20, packetFilter_tcp, 64, 39: 0, 49: 0}},
+		{"not IP", make([]byte, 64)},
+	}
+	for _, test := range tests {
+		before := append([]byte(nil), test.packet...)
+		if mssClamp_packet(test.packet, 1280) {
+			t.Errorf("%s: was clamped", test.name)
+		}
+		if !bytes.Equal(before, test.packet) {
+			t.Errorf("%s: was changed", test.name)
+		}
+	}
+}
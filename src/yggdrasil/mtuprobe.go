@@ -0,0 +1,165 @@
+package yggdrasil
+
+// This finds the largest packet that actually gets through to the other end of
+// a session, instead of assuming that anything up to the smaller of the two
+// nodes' MTUs will. Packets that are too big for a link on the path are
+// silently dropped, so rather than waiting for an error that may never come
+// back, we send padded probes of different sizes and see which are answered,
+// as in packetization layer path MTU discovery (RFC 8899).
+// The search starts with the largest size the session allows, and only falls
+// back to a binary search if that's lost, so it costs one probe on a healthy
+// path. It's repeated every so often, and when the remote coords change, in
+// case the path has changed.
+// Probes carry a little more header than traffic packets of the same size, so
+// the result errs on the small side.
+// Nodes that don't understand probes never answer them, which we notice when
+// even a probe of the minimum size is lost, and we then leave the MTU alone.
+
+import "time"
+
+// The minimum MTU, which every path must support.
+const mtuProbe_min = 1280
+
+// How long to wait for a probe to be answered, and how many times a size is tried before deciding it's too big.
+const (
+	mtuProbe_timeout = time.Second
+	mtuProbe_tries   = 3
+)
+
+// The search stops once the largest size that got through is within this many bytes of the smallest that didn't.
+const mtuProbe_precision = 16
+
+// How often the search is repeated, in case the path has changed.
+const mtuProbe_refresh = 10 * time.Minute
+
+// The state of the search for a session's path MTU.
+// This is only used from the router goroutine.
+type mtuProbe struct {
+	supported int       // 1 if the remote node has answered a probe, -1 if it doesn't seem to support them, 0 if we don't know yet
+	lo        uint16    // The largest size known to get through
+	hi        uint16    // The largest size that might get through
+	size      uint16    // The size of the probe we're waiting on, or 0 if we aren't searching
+	tries     int       // How many times the current size has been sent
+	sent      time.Time // When the current probe was last sent
+	next      time.Time // When to start the next search
+}
+
+// Represents a probe or its answer, which is sent inside protocol traffic.
+type sessionProbe struct {
+	Size  uint64 // The size of the probe, which the answer repeats
+	IsAck bool
+}
+
+// Advances the search for the path MTU of every session, sending probes and treating unanswered ones as lost.
+// Called from the router goroutine every second.
+func (ss *sessions) probeMTUs() {
+	now := time.Now()
+	for _, sinfo := range ss.sinfos {
+		if !sinfo.init {
+			continue
+		}
+		p := &sinfo.mtuProbe
+		limit := sinfo.getLocalMTU()
+		switch {
+		case limit <= mtuProbe_min || p.supported < 0:
+			p.size = 0
+		case p.size == 0 && !now.Before(p.next):
+			// Start a new search, checking first that the remote node answers probes at all
+			p.lo, p.hi = 0, limit
+			if p.supported > 0 {
+				p.lo = mtuProbe_min
+			}
+			ss.nextMTUProbe(sinfo, now)
+		case p.size != 0 && now.Sub(p.sent) >= mtuProbe_timeout:
+			if p.tries < mtuProbe_tries {
+				ss.sendMTUProbe(sinfo, now)
+				break
+			}
+			if p.size == mtuProbe_min {
+				// Not even the minimum got through, so they don't answer probes
+				p.supported = -1
+				p.size = 0
+				sinfo.pathMTU = 0
+				break
+			}
+			p.hi = p.size - 1
+			ss.nextMTUProbe(sinfo, now)
+		}
+	}
+}
+
+// Sends a probe of the next size to try, or finishes the search if the MTU has been found.
+func (ss *sessions) nextMTUProbe(sinfo *sessionInfo, now time.Time) {
+	p := &sinfo.mtuProbe
+	switch {
+	case p.lo == 0:
+		p.size = mtuProbe_min
+	case p.lo == mtuProbe_min && p.hi == sinfo.getLocalMTU() && p.hi > p.lo:
+		// Try the full size first, as most paths support it
+		p.size = p.hi
+	case p.hi-p.lo < mtuProbe_precision:
+		p.size = 0
+		p.next = now.Add(mtuProbe_refresh)
+		sinfo.pathMTU = p.lo
+		if p.lo >= sinfo.getLocalMTU() {
+			sinfo.pathMTU = 0 // Nothing on the path is smaller than the session allows
+		}
+		return
+	default:
+		p.size = p.lo + (p.hi-p.lo+1)/2
+	}
+	p.tries = 0
+	ss.sendMTUProbe(sinfo, now)
+}
+
+// Sends a probe of the current size.
+func (ss *sessions) sendMTUProbe(sinfo *sessionInfo, now time.Time) {
+	p := &sinfo.mtuProbe
+	p.tries++
+	p.sent = now
+	probe := sessionProbe{Size: uint64(p.size)}
+	ss.sendProbePacket(sinfo.coords, &sinfo.theirPermPub, &probe)
+}
+
+// Handles a probe or an answer from the given key.
+// Probes are answered by anyone with a session to the sender, while answers move the search on if they're for the size we're waiting on.
+func (ss *sessions) handleProbe(probe *sessionProbe, fromKey *boxPubKey) {
+	sinfo, isIn := ss.getByTheirPerm(fromKey)
+	if !isIn {
+		return
+	}
+	if !probe.IsAck {
+		ack := sessionProbe{Size: probe.Size, IsAck: true}
+		ss.sendProbePacket(sinfo.coords, fromKey, &ack)
+		return
+	}
+	p := &sinfo.mtuProbe
+	if p.size == 0 || probe.Size != uint64(p.size) {
+		return
+	}
+	p.supported = 1
+	p.lo = p.size
+	if p.lo == mtuProbe_min {
+		p.hi = sinfo.getLocalMTU()
+	}
+	ss.nextMTUProbe(sinfo, time.Now())
+}
+
+// Sends a probe or answer to the given key and coords.
+// Probes are padded to their size, while answers are kept small, so that only the size of the probe is being tested.
+func (ss *sessions) sendProbePacket(coords []byte, toKey *boxPubKey, probe *sessionProbe) {
+	bs := probe.encode()
+	if !probe.IsAck && uint64(len(bs)) < probe.Size {
+		bs = append(bs, make([]byte, int(probe.Size)-len(bs))...)
+	}
+	shared := ss.getSharedKey(&ss.core.boxPriv, toKey)
+	payload, nonce := boxSeal(shared, bs, nil)
+	p := wire_protoTrafficPacket{
+		Coords:  priority_markMeasurement(coords),
+		ToKey:   *toKey,
+		FromKey: ss.core.boxPub,
+		Nonce:   *nonce,
+		Payload: payload,
+	}
+	ss.core.router.out(p.encode())
+}
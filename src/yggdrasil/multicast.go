@@ -1,22 +1,68 @@
 package yggdrasil
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/ipv6"
 )
 
+// Beacons larger than this are ignored, as a valid beacon only ever contains
+// a link-local address, zone and port, our nonce and the nonces we echo.
+const multicast_maxBeaconSize = 512
+
+// Most nonces of other nodes that we echo in each beacon.
+const multicast_maxEchoes = 16
+
+// We respond to beacons from the same source at most this often.
+const multicast_responseInterval = 10 * time.Second
+
+// Sources that we haven't heard a beacon from for this long are forgotten.
+const multicast_sourceTimeout = time.Minute
+
+// Maximum number of beacon sources that we keep track of at once.
+const multicast_maxSources = 256
+
+// Beacons are the address that we listen on, as older nodes expect, followed
+// by a nonce and the nonces of the other nodes that we've heard beacons from
+// on the same interface, separated by spaces. We only respond to a beacon by
+// connecting once it echoes our nonce, which proves that the node really is on
+// the link and hears us, so that spoofed beacons can't be used to make us
+// connect to a victim. Beacons without a nonce are sent as well, so that older
+// nodes, which can't parse the new ones, still connect to us.
 type multicast struct {
 	core      *Core
 	sock      *ipv6.PacketConn
 	groupAddr string
+	nonce     string // Our nonce, in hex, which other nodes echo back
+	mutex     sync.Mutex
+	sources   map[string]*multicast_source // Protected by the mutex, as beacons are sent from another goroutine
+}
+
+// Information about a node that we've received discovery beacons from, used
+// to stop spoofed beacons from making us repeatedly connect to a victim.
+type multicast_source struct {
+	zone     string    // The interface that we received the beacons on
+	nonce    string    // The source's nonce, which we echo in our beacons, or empty if it's an older node
+	lastSeen time.Time // When we last received a beacon from this source
+	lastCall time.Time // When we last responded by trying to connect
+	call     string    // The address that we last connected to, which is the name that tcp.getOutgoing gives the connection
 }
 
 func (m *multicast) init(core *Core) {
 	m.core = core
 	m.groupAddr = "[ff02::114]:9001"
+	m.sources = make(map[string]*multicast_source)
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	m.nonce = hex.EncodeToString(nonce[:])
 	// Check if we've been given any expressions
 	if len(m.core.ifceExpr) == 0 {
 		return
@@ -86,14 +132,18 @@ func (m *multicast) announce() {
 		panic(err)
 	}
 	var anAddr net.TCPAddr
-	myAddr := m.core.tcp.getAddr()
-	anAddr.Port = myAddr.Port
 	destAddr, err := net.ResolveUDPAddr("udp6", m.groupAddr)
 	if err != nil {
 		panic(err)
 	}
 	for {
+		// Look up the port every time, as the listener may have been bound again since
+		anAddr.Port = m.core.tcp.getAddr().Port
 		for _, iface := range m.interfaces() {
+			if anAddr.Port == 0 {
+				// The listener isn't bound, so there's nothing to announce
+				break
+			}
 			m.sock.JoinGroup(&iface, groupAddr)
 			addrs, err := iface.Addrs()
 			if err != nil {
@@ -110,7 +160,8 @@ func (m *multicast) announce() {
 				anAddr.IP = addrIP
 				anAddr.Zone = iface.Name
 				destAddr.Zone = iface.Name
-				msg := []byte(anAddr.String())
+				m.sock.WriteTo([]byte(anAddr.String()), nil, destAddr)
+				msg := []byte(anAddr.String() + " " + m.nonce + m.getEchoes(iface.Name))
 				m.sock.WriteTo(msg, nil, destAddr)
 				break
 			}
@@ -142,8 +193,14 @@ func (m *multicast) listen() {
 				continue
 			}
 		}
-		anAddr := string(bs[:nBytes])
-		addr, err := net.ResolveTCPAddr("tcp6", anAddr)
+		if nBytes > multicast_maxBeaconSize {
+			continue
+		}
+		fields := strings.Fields(string(bs[:nBytes]))
+		if len(fields) == 0 {
+			continue
+		}
+		addr, err := net.ResolveTCPAddr("tcp6", fields[0])
 		if err != nil {
 			continue
 		}
@@ -151,8 +208,109 @@ func (m *multicast) listen() {
 		if addr.IP.String() != from.IP.String() {
 			continue
 		}
+		if !m.shouldRespond(from, fields[1:], time.Now()) {
+			continue
+		}
+		if !m.isAnnouncingOn(from.Zone) {
+			// Only peer over interfaces that we also send beacons on, so that
+			// discovery is always a two-way exchange
+			continue
+		}
 		addr.Zone = from.Zone
 		saddr := addr.String()
-		m.core.tcp.connect(saddr, "")
+		m.setCall(from, saddr)
+		m.core.tcp.connect(saddr, "", nil)
+	}
+}
+
+// Records a beacon from the given source, with the fields after its address,
+// and returns true if we should respond to it by connecting. The beacon must
+// echo our nonce, and we respond to each source at most once per interval, so
+// that a spoofed beacon can't be used to make us repeatedly connect to a victim.
+func (m *multicast) shouldRespond(from *net.UDPAddr, fields []string, now time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := from.IP.String() + "%" + from.Zone
+	src, isIn := m.sources[key]
+	if !isIn {
+		if len(m.sources) >= multicast_maxSources {
+			for k, v := range m.sources {
+				if now.Sub(v.lastSeen) > multicast_sourceTimeout {
+					delete(m.sources, k)
+				}
+			}
+		}
+		if len(m.sources) >= multicast_maxSources {
+			return false
+		}
+		src = &multicast_source{zone: from.Zone}
+		m.sources[key] = src
+	}
+	src.lastSeen = now
+	if len(fields) == 0 {
+		// A beacon for older nodes, which doesn't say anything about the nonces
+		return false
+	}
+	if len(fields[0]) == len(m.nonce) {
+		// Nonces of any other length aren't echoed, so that our beacons stay small
+		src.nonce = fields[0]
+	}
+	var isEchoed bool
+	for _, echo := range fields[1:] {
+		isEchoed = isEchoed || echo == m.nonce
+	}
+	if !isEchoed || now.Sub(src.lastCall) < multicast_responseInterval {
+		return false
+	}
+	src.lastCall = now
+	return true
+}
+
+// Gets the nonces to echo in our beacons on the interface with the given name, each preceded by a space.
+func (m *multicast) getEchoes(zone string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var echoes []string
+	for _, src := range m.sources {
+		if src.zone != zone || src.nonce == "" || time.Since(src.lastSeen) > multicast_sourceTimeout {
+			continue
+		}
+		if echoes = append(echoes, " "+src.nonce); len(echoes) == multicast_maxEchoes {
+			break
+		}
+	}
+	return strings.Join(echoes, "")
+}
+
+// Records the address that we connected to in response to beacons from the given source.
+func (m *multicast) setCall(from *net.UDPAddr, saddr string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if src, isIn := m.sources[from.IP.String()+"%"+from.Zone]; isIn {
+		src.call = saddr
+	}
+}
+
+// Gets the addresses that we've connected to in response to beacons, so that
+// outgoing connections to discovered nodes can be told apart from static peers.
+func (m *multicast) getCalls() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var calls []string
+	for _, src := range m.sources {
+		if src.call != "" {
+			calls = append(calls, src.call)
+		}
+	}
+	return calls
+}
+
+// Returns true if we are sending beacons on the interface with the given name.
+func (m *multicast) isAnnouncingOn(name string) bool {
+	for _, iface := range m.interfaces() {
+		if iface.Name == name {
+			return true
+		}
 	}
+	return false
 }
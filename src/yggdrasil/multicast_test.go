@@ -0,0 +1,44 @@
+package yggdrasil
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMulticastShouldRespond(t *testing.T) {
+	const theirs = "0123456789abcdef"
+	m := &multicast{nonce: "fedcba9876543210", sources: make(map[string]*multicast_source)}
+	from := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}
+	now := time.Now()
+	tests := []struct {
+		name    string
+		fields  string // After the address
+		after   time.Duration
+		respond bool
+	}{
+		{"older beacon", "", 0, false},
+		{"nonce without echoes", theirs, time.Second, false},
+		{"echoes someone else", theirs + " 1111111111111111", 2 * time.Second, false},
+		{"echoes ours", theirs + " 1111111111111111 fedcba9876543210", 3 * time.Second, true},
+		{"echoes ours again too soon", theirs + " fedcba9876543210", 4 * time.Second, false},
+		{"echoes ours after the interval", theirs + " fedcba9876543210", 3*time.Second + multicast_responseInterval, true},
+	}
+	for _, test := range tests {
+		if respond := m.shouldRespond(from, strings.Fields(test.fields), now.Add(test.after)); respond != test.respond {
+			t.Errorf("%s: got %v, want %v", test.name, respond, test.respond)
+		}
+	}
+	if echoes := m.getEchoes("eth0"); echoes != " "+theirs {
+		t.Errorf("got echoes %q on the same interface, want %q", echoes, " "+theirs)
+	}
+	if echoes := m.getEchoes("eth1"); echoes != "" {
+		t.Errorf("got echoes %q on another interface", echoes)
+	}
+	m.setCall(from, "[fe80::1%eth0]:1234")
+	m.setCall(&net.UDPAddr{IP: net.ParseIP("fe80::2"), Zone: "eth0"}, "[fe80::2%eth0]:1234")
+	if calls := m.getCalls(); len(calls) != 1 || calls[0] != "[fe80::1%eth0]:1234" {
+		t.Errorf("got calls %q, want only the source that we've heard from", calls)
+	}
+}
@@ -0,0 +1,261 @@
+package yggdrasil
+
+// This answers IPv6 neighbor solicitations on a LAN interface for addresses in
+// our routed /64, so that hosts on the LAN can send traffic for those addresses
+// to this node, which forwards it into Yggdrasil, without running their own
+// node or needing a route. Addresses that hosts on the LAN are seen using, i.e.
+// in duplicate address detection or in their own solicitations and
+// advertisements, are left for those hosts to answer for. Our advertisements
+// also don't set the override flag, as RFC 4861 asks of proxies, so that a
+// host's own answer always wins. Solicitations are sent to multicast groups
+// that depend on the address being looked for, so the interface is put into
+// all-multicast mode and read with a packet socket, which is only supported on
+// Linux. This node must still forward packets between the LAN and the TUN/TAP.
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long an address that a host on the LAN was seen using is left for it to answer for.
+const ndpProxy_hostLifetime = 5 * time.Minute
+
+// ICMPv6 types and the NDP option that we handle.
+const (
+	ndpProxy_neighborSolicitation  = 135
+	ndpProxy_neighborAdvertisement = 136
+	ndpProxy_optTargetLinkAddr     = 2
+)
+
+type ndpProxy struct {
+	core      *Core
+	mutex     sync.Mutex
+	ifname    string // Interface to answer solicitations on, or empty if disabled
+	iface     *net.Interface
+	prefix    *net.IPNet // Our /64
+	linkLocal net.IP     // The source of our advertisements
+	ownAddrs  []net.IP
+	sock      io.ReadWriteCloser
+	hosts     map[address]time.Time // Addresses in our /64 that hosts on the LAN were last seen using
+	pruned    time.Time
+	answered  uint64
+}
+
+// Initializes the ndpProxy struct.
+func (p *ndpProxy) init(core *Core) {
+	p.core = core
+	p.hosts = make(map[address]time.Time)
+}
+
+// Sets the interface to answer solicitations on. An empty interface name disables the proxy.
+func (p *ndpProxy) setConfig(ifname string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.ifname = ifname
+}
+
+// Starts answering solicitations, if an interface is configured.
+// This needs permission to open a packet socket.
+func (p *ndpProxy) start() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.ifname == "" {
+		return nil
+	}
+	if !ndpProxy_supported {
+		return errors.New("the NDP proxy is only supported on Linux")
+	}
+	iface, err := net.InterfaceByName(p.ifname)
+	if err != nil {
+		return err
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return errors.New("interface " + p.ifname + " doesn't have an ethernet address")
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return err
+	}
+	p.linkLocal, p.ownAddrs = nil, nil
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil {
+			continue
+		}
+		p.ownAddrs = append(p.ownAddrs, ipNet.IP)
+		if ipNet.IP.IsLinkLocalUnicast() && p.linkLocal == nil {
+			p.linkLocal = ipNet.IP
+		}
+	}
+	if p.linkLocal == nil {
+		return errors.New("interface " + p.ifname + " doesn't have a link-local IPv6 address")
+	}
+	sock, err := ndpProxy_open(iface)
+	if err != nil {
+		return err
+	}
+	p.iface = iface
+	p.prefix = p.core.GetSubnet()
+	p.sock = sock
+	p.core.log.Println("Answering neighbor solicitations for", p.prefix.String(), "on", p.ifname)
+	go p.listen(sock)
+	return nil
+}
+
+// Stops answering solicitations.
+func (p *ndpProxy) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.sock == nil {
+		return
+	}
+	p.sock.Close()
+	p.sock = nil
+}
+
+// Reads the solicitations and advertisements on the interface until the socket is closed.
+func (p *ndpProxy) listen(sock io.ReadWriteCloser) {
+	bs := make([]byte, 65535)
+	for {
+		n, err := sock.Read(bs)
+		if err != nil {
+			return // Closed
+		}
+		p.mutex.Lock()
+		if p.sock == sock {
+			p.handleFrame(bs[:n])
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// Learns which addresses hosts on the LAN use from an ethernet frame carrying NDP, and answers it if it's a solicitation for an address that we proxy.
+// Must be called with the mutex held.
+func (p *ndpProxy) handleFrame(frame []byte) {
+	if len(frame) < len_ETHER+tun_IPv6_HEADER_LENGTH+24 ||
+		binary.BigEndian.Uint16(frame[12:14]) != 0x86dd {
+		return
+	}
+	if string(frame[6:12]) == string(p.iface.HardwareAddr) {
+		// Sent by this host, either by us or the kernel answering for its own addresses
+		return
+	}
+	packet := frame[len_ETHER:]
+	if packet[6] != 58 || packet[7] != 255 {
+		// Not ICMPv6, or forwarded from another link, which NDP never is
+		return
+	}
+	source := net.IP(packet[8:24])
+	icmp := packet[tun_IPv6_HEADER_LENGTH:]
+	target := net.IP(icmp[8:24])
+	switch icmp[0] {
+	case ndpProxy_neighborSolicitation:
+		if source.IsUnspecified() {
+			// Duplicate address detection, so a host is about to use the target
+			p.rememberHost(target)
+			return
+		}
+		p.rememberHost(source)
+		if !p.shouldAnswer(target) || target.Equal(source) {
+			return
+		}
+		p.sendAdvert(frame[6:12], source, target)
+	case ndpProxy_neighborAdvertisement:
+		p.rememberHost(target)
+	}
+}
+
+// Remembers that a host on the LAN uses an address, if it's in our /64.
+// Must be called with the mutex held.
+func (p *ndpProxy) rememberHost(ip net.IP) {
+	if !p.prefix.Contains(ip) {
+		return
+	}
+	var addr address
+	copy(addr[:], ip)
+	now := time.Now()
+	p.hosts[addr] = now
+	if now.Sub(p.pruned) > ndpProxy_hostLifetime {
+		for host, seen := range p.hosts {
+			if now.Sub(seen) > ndpProxy_hostLifetime {
+				delete(p.hosts, host)
+			}
+		}
+		p.pruned = now
+	}
+}
+
+// Checks if we should answer a solicitation for the address, which we do if it's in our /64, and isn't used by a host on the LAN or this interface.
+// Must be called with the mutex held.
+func (p *ndpProxy) shouldAnswer(target net.IP) bool {
+	if !p.prefix.Contains(target) {
+		return false
+	}
+	var addr address
+	copy(addr[:], target)
+	if seen, isIn := p.hosts[addr]; isIn && time.Since(seen) <= ndpProxy_hostLifetime {
+		return false
+	}
+	for _, own := range p.ownAddrs {
+		if own.Equal(target) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sends a neighbor advertisement for the target to the host with the MAC and IP address that solicited it.
+// The router and solicited flags are set, and the override flag isn't.
+// Must be called with the mutex held.
+func (p *ndpProxy) sendAdvert(dstmac []byte, dst net.IP, target net.IP) {
+	frame := make([]byte, len_ETHER+tun_IPv6_HEADER_LENGTH+32)
+	copy(frame[0:6], dstmac)
+	copy(frame[6:12], p.iface.HardwareAddr)
+	binary.BigEndian.PutUint16(frame[12:14], 0x86dd)
+	packet := frame[len_ETHER:]
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], 32)
+	packet[6] = 58
+	packet[7] = 255
+	copy(packet[8:24], p.linkLocal.To16())
+	copy(packet[24:40], dst.To16())
+	icmp := packet[tun_IPv6_HEADER_LENGTH:]
+	icmp[0] = ndpProxy_neighborAdvertisement
+	icmp[4] = 0xc0 // Router and solicited flags
+	copy(icmp[8:24], target.To16())
+	icmp[24] = ndpProxy_optTargetLinkAddr
+	icmp[25] = 1
+	copy(icmp[26:32], p.iface.HardwareAddr)
+	sum := tun_checksumAdd(0, packet[8:40])
+	sum += uint32(len(icmp)) + 58
+	binary.BigEndian.PutUint16(icmp[2:4], tun_checksumFold(tun_checksumAdd(sum, icmp)))
+	if _, err := p.sock.Write(frame); err != nil {
+		p.core.log.Println("Failed to send neighbor advertisement on", p.iface.Name+":", err)
+		return
+	}
+	p.answered++
+}
+
+// Gets the state of the proxy, for the admin API.
+func (p *ndpProxy) getInfo() admin_info {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var hosts []string
+	for host, seen := range p.hosts {
+		if time.Since(seen) <= ndpProxy_hostLifetime {
+			hosts = append(hosts, net.IP(host[:]).String())
+		}
+	}
+	sort.Strings(hosts)
+	return admin_info{
+		"interface": p.ifname,
+		"running":   p.sock != nil,
+		"answered":  p.answered,
+		"lan_hosts": hosts,
+	}
+}
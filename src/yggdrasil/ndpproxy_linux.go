@@ -0,0 +1,51 @@
+package yggdrasil
+
+// The linux platform specific parts of the NDP proxy
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const ndpProxy_supported = true
+
+const ndpProxy_ETH_P_IPV6 = 0x86dd
+
+// Opens a packet socket on the interface that reads neighbor solicitations and advertisements, including those sent to any multicast group.
+// The socket is non-blocking, so that closing it stops a read.
+func ndpProxy_open(iface *net.Interface) (io.ReadWriteCloser, error) {
+	protocol := int(ndpProxy_ETH_P_IPV6>>8 | ndpProxy_ETH_P_IPV6&0xff<<8) // In network byte order
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return nil, err
+	}
+	// Only pass up ICMPv6 neighbor solicitations and advertisements, as everything forwarded through the interface is seen too
+	filter := []syscall.SockFilter{
+		*syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, len_ETHER+6),
+		*syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, 58, 0, 4),
+		*syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, len_ETHER+tun_IPv6_HEADER_LENGTH),
+		*syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, ndpProxy_neighborSolicitation, 1, 0),
+		*syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, ndpProxy_neighborAdvertisement, 0, 1),
+		*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, 65535),
+		*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, 0),
+	}
+	if err := syscall.AttachLsf(fd, filter); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: uint16(protocol), Ifindex: iface.Index}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// Put the interface into all-multicast mode, which syscall has no socket option for
+	mreq := unix.PacketMreq{Ifindex: int32(iface.Index), Type: unix.PACKET_MR_ALLMULTI}
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "ndp-proxy"), nil
+}
@@ -0,0 +1,16 @@
+// +build !linux
+
+package yggdrasil
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// The NDP proxy isn't supported on this platform.
+const ndpProxy_supported = false
+
+func ndpProxy_open(iface *net.Interface) (io.ReadWriteCloser, error) {
+	return nil, errors.New("not supported")
+}
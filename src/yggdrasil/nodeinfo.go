@@ -0,0 +1,253 @@
+package yggdrasil
+
+// This implements NodeInfo, which lets a node publish a small amount of
+// arbitrary JSON about itself, i.e. a name or contact details, that any other
+// node on the network can request.
+// The "services" key of NodeInfo is reserved for a list of the services that
+// the node offers, each with a name, port and protocol, which other nodes can
+// query with getNodeServices to find out what a node offers.
+// Responses from remote nodes are cached for a configurable time, so that
+// repeated queries from crawlers and dashboards don't generate traffic across
+// the network every time.
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// The largest NodeInfo that we will send, after encoding to JSON.
+const nodeinfo_maxSize = 16384
+
+// The NodeInfo key which lists the services that a node offers.
+const nodeinfo_servicesKey = "services"
+
+// The default time for which NodeInfo responses are cached.
+const nodeinfo_defaultCacheTTL = 5 * time.Minute
+
+// Callbacks for requests that haven't been answered within this time are dropped.
+const nodeinfo_callbackTimeout = time.Minute
+
+// The NodeInfo of a node, which is JSON encoded.
+type nodeinfoPayload []byte
+
+// A cached NodeInfo response from a remote node.
+type nodeinfoCached struct {
+	payload nodeinfoPayload
+	created time.Time
+}
+
+// A function to call when a response to a NodeInfo request is received.
+type nodeinfoCallback struct {
+	call    func(nodeinfo *nodeinfoPayload)
+	created time.Time
+}
+
+// Represents a NodeInfo request or response packet.
+type nodeinfoReqRes struct {
+	SendPermPub boxPubKey // Sender's permanent key
+	SendCoords  []byte    // Sender's coords
+	IsResponse  bool
+	NodeInfo    nodeinfoPayload
+}
+
+// A service offered by a node, as listed in its NodeInfo.
+type nodeinfoService struct {
+	Name  string `json:"name"`
+	Port  uint16 `json:"port"`
+	Proto string `json:"proto"` // "tcp", "udp" or "sctp"
+}
+
+// Checks that a service has a name, a port and a known protocol.
+func (s *nodeinfoService) check() error {
+	switch {
+	case s.Name == "":
+		return errors.New("NodeInfo service has no name")
+	case s.Port == 0:
+		return errors.New("NodeInfo service " + s.Name + " has no port")
+	case s.Proto != "tcp" && s.Proto != "udp" && s.Proto != "sctp":
+		return errors.New("NodeInfo service " + s.Name + " has unknown protocol " + s.Proto)
+	}
+	return nil
+}
+
+// Gets the services listed in a NodeInfo payload.
+// Services that aren't valid are left out, so that one bad entry in a remote node's NodeInfo doesn't hide the rest.
+func nodeinfo_getServices(payload nodeinfoPayload) ([]nodeinfoService, error) {
+	var nodeinfo struct {
+		Services []json.RawMessage `json:"services"`
+	}
+	if err := json.Unmarshal(payload, &nodeinfo); err != nil {
+		return nil, err
+	}
+	var services []nodeinfoService
+	for _, raw := range nodeinfo.Services {
+		var service nodeinfoService
+		if json.Unmarshal(raw, &service) == nil && service.check() == nil {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// The NodeInfo state of this node, including our own NodeInfo, callbacks for outstanding requests and cached responses.
+type nodeinfo struct {
+	core            *Core
+	myNodeInfo      nodeinfoPayload
+	myNodeInfoMutex sync.RWMutex
+	callbacks       map[boxPubKey]nodeinfoCallback
+	callbacksMutex  sync.Mutex
+	cache           map[boxPubKey]nodeinfoCached
+	cacheTTL        time.Duration
+	cacheMutex      sync.RWMutex
+}
+
+// Initialises the nodeinfo struct.
+func (m *nodeinfo) init(core *Core) {
+	m.core = core
+	m.callbacks = make(map[boxPubKey]nodeinfoCallback)
+	m.cache = make(map[boxPubKey]nodeinfoCached)
+	m.cacheTTL = nodeinfo_defaultCacheTTL
+	m.myNodeInfo = nodeinfoPayload("{}")
+}
+
+// Sets the time for which NodeInfo responses are cached.
+// Values that are zero or less leave the current setting unchanged.
+func (m *nodeinfo) setCacheTTL(ttl time.Duration) {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	if ttl > 0 {
+		m.cacheTTL = ttl
+	}
+}
+
+// Sets our own NodeInfo, which is given to any node that asks for it.
+func (m *nodeinfo) setNodeInfo(given map[string]interface{}) error {
+	if given == nil {
+		given = make(map[string]interface{})
+	}
+	bs, err := json.Marshal(given)
+	if err != nil {
+		return err
+	}
+	if len(bs) > nodeinfo_maxSize {
+		return errors.New("NodeInfo exceeds maximum length")
+	}
+	if _, isIn := given[nodeinfo_servicesKey]; isIn {
+		var nodeinfo struct {
+			Services []nodeinfoService `json:"services"`
+		}
+		if err := json.Unmarshal(bs, &nodeinfo); err != nil {
+			return errors.New("NodeInfo services must be a list of { \"name\", \"port\", \"proto\" }")
+		}
+		for _, service := range nodeinfo.Services {
+			if err := service.check(); err != nil {
+				return err
+			}
+		}
+	}
+	m.myNodeInfoMutex.Lock()
+	defer m.myNodeInfoMutex.Unlock()
+	m.myNodeInfo = bs
+	return nil
+}
+
+// Gets our own NodeInfo.
+func (m *nodeinfo) getNodeInfo() nodeinfoPayload {
+	m.myNodeInfoMutex.RLock()
+	defer m.myNodeInfoMutex.RUnlock()
+	return m.myNodeInfo
+}
+
+// Adds a callback to be called when a NodeInfo response is received from the given key.
+// Any existing callback for the key is replaced.
+func (m *nodeinfo) addCallback(sender boxPubKey, call func(nodeinfo *nodeinfoPayload)) {
+	m.callbacksMutex.Lock()
+	defer m.callbacksMutex.Unlock()
+	now := time.Now()
+	for key, callback := range m.callbacks {
+		if now.Sub(callback.created) > nodeinfo_callbackTimeout {
+			delete(m.callbacks, key)
+		}
+	}
+	m.callbacks[sender] = nodeinfoCallback{
+		call:    call,
+		created: now,
+	}
+}
+
+// Calls and removes the callback for the given key, returning false if there was no callback.
+func (m *nodeinfo) callback(sender boxPubKey, nodeinfo nodeinfoPayload) bool {
+	m.callbacksMutex.Lock()
+	callback, isIn := m.callbacks[sender]
+	delete(m.callbacks, sender)
+	m.callbacksMutex.Unlock()
+	if isIn {
+		callback.call(&nodeinfo)
+	}
+	return isIn
+}
+
+// Gets a cached NodeInfo response for the given key, if we have one that hasn't expired.
+func (m *nodeinfo) getCachedNodeInfo(key boxPubKey) (nodeinfoPayload, error) {
+	m.cacheMutex.RLock()
+	defer m.cacheMutex.RUnlock()
+	if nodeinfo, isIn := m.cache[key]; isIn && time.Since(nodeinfo.created) < m.cacheTTL {
+		return nodeinfo.payload, nil
+	}
+	return nodeinfoPayload{}, errors.New("No cache entry found")
+}
+
+// Caches a NodeInfo response for the given key, and removes any expired entries.
+func (m *nodeinfo) addCachedNodeInfo(key boxPubKey, payload nodeinfoPayload) {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+	now := time.Now()
+	for k, nodeinfo := range m.cache {
+		if now.Sub(nodeinfo.created) > m.cacheTTL {
+			delete(m.cache, k)
+		}
+	}
+	m.cache[key] = nodeinfoCached{
+		payload: payload,
+		created: now,
+	}
+}
+
+// Handles a NodeInfo request or response.
+// Requests are answered with our own NodeInfo, while responses are cached and passed to the callback for the sender, if we asked for them.
+func (m *nodeinfo) handleNodeInfo(nodeinfo *nodeinfoReqRes) {
+	if nodeinfo.IsResponse {
+		if m.callback(nodeinfo.SendPermPub, nodeinfo.NodeInfo) {
+			m.addCachedNodeInfo(nodeinfo.SendPermPub, nodeinfo.NodeInfo)
+		}
+	} else {
+		m.sendNodeInfo(nodeinfo.SendPermPub, nodeinfo.SendCoords, true)
+	}
+}
+
+// Sends a NodeInfo request, or a response containing our own NodeInfo, to the given key and coords.
+// This must be called from the router goroutine.
+func (m *nodeinfo) sendNodeInfo(key boxPubKey, coords []byte, isResponse bool) {
+	loc := m.core.switchTable.getLocator()
+	nodeinfo := nodeinfoReqRes{
+		SendCoords: loc.getCoords(),
+		IsResponse: isResponse,
+	}
+	if isResponse {
+		nodeinfo.NodeInfo = m.getNodeInfo()
+	}
+	bs := nodeinfo.encode()
+	shared := m.core.sessions.getSharedKey(&m.core.boxPriv, &key)
+	payload, nonce := boxSeal(shared, bs, nil)
+	p := wire_protoTrafficPacket{
+		Coords:  coords,
+		ToKey:   key,
+		FromKey: m.core.boxPub,
+		Nonce:   *nonce,
+		Payload: payload,
+	}
+	packet := p.encode()
+	m.core.router.out(packet)
+}
@@ -0,0 +1,260 @@
+package yggdrasil
+
+// This filters the packets that pass through the TUN/TAP adapter, so that
+// unwanted traffic, like multicast noise from the host or connections to ports
+// that shouldn't be reachable over Yggdrasil, can be dropped without setting
+// up a firewall on the host. Packets read from the adapter are outbound, and
+// packets from the mesh that are about to be written to it are inbound.
+// Packets are checked against the rules from the configuration in order, and
+// the first rule that matches decides whether the packet is accepted or
+// dropped. Packets that match no rule are accepted. Only IPv6 packets are
+// filtered, so IPv4 packets from crypto-key routing are always accepted, and
+// have to be filtered by a firewall on the host instead. Programs that embed
+// Yggdrasil can also add hooks with Core.AddPacketHook, which see each packet
+// that the rules accept, and can drop it or change it in place.
+// The rules and hooks are swapped as a whole, so that packets are never
+// slowed down by a lock.
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"yggdrasil/config"
+)
+
+// PacketHook is called with each IPv6 packet that passes through the TUN/TAP
+// adapter, and can be added to a running node with Core.AddPacketHook.
+// Outbound packets were read from the adapter, and inbound packets are about
+// to be written to it. The hook may change the packet in place, but not its
+// length, and returns false to drop it.
+type PacketHook func(packet []byte, outbound bool) bool
+
+// Directions that a rule applies to.
+const (
+	packetFilter_in = 1 << iota
+	packetFilter_out
+	packetFilter_both = packetFilter_in | packetFilter_out
+)
+
+// IPv6 next header values for the extension headers that are skipped to find the transport protocol, and for the protocols that rules name.
+const (
+	packetFilter_hopByHop    = 0
+	packetFilter_routing     = 43
+	packetFilter_fragment    = 44
+	packetFilter_destOptions = 60
+	packetFilter_tcp         = 6
+	packetFilter_udp         = 17
+	packetFilter_icmpv6      = 58
+)
+
+type packetFilter struct {
+	core  *Core
+	mutex sync.Mutex   // Held while changing the state, so that concurrent changes aren't lost
+	state atomic.Value // *packetFilter_state
+}
+
+// The rules and hooks in use, which are replaced rather than changed.
+type packetFilter_state struct {
+	rules []packetFilter_rule
+	hooks []PacketHook
+}
+
+type packetFilter_rule struct {
+	drop        bool
+	direction   int
+	protocol    int // Next header value, or -1 for any
+	source      *net.IPNet
+	destination *net.IPNet
+	minPort     int // Destination port range of TCP and UDP packets, or 0 for any
+	maxPort     int
+	multicast   bool // Only matches multicast destinations
+}
+
+// Initializes the packetFilter struct.
+func (f *packetFilter) init(core *Core) {
+	f.core = core
+	f.state.Store(&packetFilter_state{})
+}
+
+// Replaces the rules with those from the configuration. If any of them are invalid then the existing rules are left unchanged.
+func (f *packetFilter) setRules(rules []config.PacketFilterRule) error {
+	var parsed []packetFilter_rule
+	for idx, rule := range rules {
+		r, err := packetFilter_parseRule(rule)
+		if err != nil {
+			return errors.New("packet filter rule " + strconv.Itoa(idx+1) + ": " + err.Error())
+		}
+		parsed = append(parsed, r)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	old := f.state.Load().(*packetFilter_state)
+	f.state.Store(&packetFilter_state{rules: parsed, hooks: old.hooks})
+	return nil
+}
+
+// Adds a hook, which sees packets after the rules.
+func (f *packetFilter) addHook(hook PacketHook) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	old := f.state.Load().(*packetFilter_state)
+	hooks := append(append([]PacketHook(nil), old.hooks...), hook)
+	f.state.Store(&packetFilter_state{rules: old.rules, hooks: hooks})
+}
+
+// Parses a rule from the configuration.
+func packetFilter_parseRule(rule config.PacketFilterRule) (packetFilter_rule, error) {
+	r := packetFilter_rule{protocol: -1, multicast: rule.Multicast}
+	switch strings.ToLower(rule.Action) {
+	case "accept":
+	case "drop":
+		r.drop = true
+	default:
+		return r, errors.New("unknown action: " + rule.Action)
+	}
+	switch strings.ToLower(rule.Direction) {
+	case "", "both":
+		r.direction = packetFilter_both
+	case "in":
+		r.direction = packetFilter_in
+	case "out":
+		r.direction = packetFilter_out
+	default:
+		return r, errors.New("unknown direction: " + rule.Direction)
+	}
+	switch strings.ToLower(rule.Protocol) {
+	case "":
+	case "tcp":
+		r.protocol = packetFilter_tcp
+	case "udp":
+		r.protocol = packetFilter_udp
+	case "icmpv6":
+		r.protocol = packetFilter_icmpv6
+	default:
+		protocol, err := strconv.ParseUint(rule.Protocol, 10, 8)
+		if err != nil {
+			return r, errors.New("unknown protocol: " + rule.Protocol)
+		}
+		r.protocol = int(protocol)
+	}
+	var err error
+	if r.source, err = packetFilter_parsePrefix(rule.Source); err != nil {
+		return r, err
+	}
+	if r.destination, err = packetFilter_parsePrefix(rule.Destination); err != nil {
+		return r, err
+	}
+	if rule.Ports != "" {
+		if r.protocol != packetFilter_tcp && r.protocol != packetFilter_udp {
+			return r, errors.New("ports can only be matched for tcp or udp")
+		}
+		bounds := strings.SplitN(rule.Ports, "-", 2)
+		min, err1 := strconv.ParseUint(bounds[0], 10, 16)
+		max, err2 := min, error(nil)
+		if len(bounds) == 2 {
+			max, err2 = strconv.ParseUint(bounds[1], 10, 16)
+		}
+		if err1 != nil || err2 != nil || min == 0 || min > max {
+			return r, errors.New("invalid ports: " + rule.Ports)
+		}
+		r.minPort, r.maxPort = int(min), int(max)
+	}
+	return r, nil
+}
+
+// Parses an address or a prefix in CIDR notation, or returns nil to match any address if empty.
+func packetFilter_parsePrefix(s string) (*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.Contains(s, "/") {
+		s += "/128"
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil || ipNet.IP.To4() != nil {
+		return nil, errors.New("invalid IPv6 prefix: " + s)
+	}
+	return ipNet, nil
+}
+
+// Finds the transport protocol and its header, skipping any extension headers.
+// The header is nil if it isn't in the packet, i.e. in fragments after the first.
+func packetFilter_transport(packet []byte) (int, []byte) {
+	protocol := int(packet[6])
+	payload := packet[tun_IPv6_HEADER_LENGTH:]
+	for {
+		switch protocol {
+		case packetFilter_hopByHop, packetFilter_routing, packetFilter_destOptions:
+			if len(payload) < 8 || len(payload) < 8+8*int(payload[1]) {
+				return protocol, nil
+			}
+			protocol, payload = int(payload[0]), payload[8+8*int(payload[1]):]
+		case packetFilter_fragment:
+			if len(payload) < 8 {
+				return protocol, nil
+			}
+			offset := (int(payload[2])<<8 | int(payload[3])) &^ 7
+			protocol, payload = int(payload[0]), payload[8:]
+			if offset != 0 {
+				return protocol, nil
+			}
+		default:
+			return protocol, payload
+		}
+	}
+}
+
+// Checks if a rule matches a packet going in the direction.
+func (r *packetFilter_rule) matches(packet []byte, direction int) bool {
+	switch {
+	case r.direction&direction == 0:
+		return false
+	case r.multicast && packet[24] != 0xff:
+		return false
+	case r.source != nil && !r.source.Contains(packet[8:24]):
+		return false
+	case r.destination != nil && !r.destination.Contains(packet[24:40]):
+		return false
+	case r.protocol < 0:
+		return true
+	}
+	protocol, header := packetFilter_transport(packet)
+	if protocol != r.protocol {
+		return false
+	}
+	if r.minPort == 0 {
+		return true
+	}
+	if len(header) < 4 {
+		return false
+	}
+	port := int(header[2])<<8 | int(header[3])
+	return port >= r.minPort && port <= r.maxPort
+}
+
+// Checks if an IPv6 packet going in the direction may pass, and runs the hooks, which may change it.
+// IPv4 packets from crypto-key routing always pass, as the rules and hooks are only for IPv6.
+func (f *packetFilter) allow(packet []byte, direction int) bool {
+	if len(packet) < tun_IPv6_HEADER_LENGTH || packet[0]&0xf0 != 0x60 {
+		return true
+	}
+	state := f.state.Load().(*packetFilter_state)
+	for idx := range state.rules {
+		if state.rules[idx].matches(packet, direction) {
+			if state.rules[idx].drop {
+				return false
+			}
+			break
+		}
+	}
+	for _, hook := range state.hooks {
+		if !hook(packet, direction == packetFilter_out) {
+			return false
+		}
+	}
+	return true
+}
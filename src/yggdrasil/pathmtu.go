@@ -0,0 +1,121 @@
+package yggdrasil
+
+// This remembers the lowest session MTU seen for each destination that packets
+// read from the TUN/TAP adapter are sent to, as the router finds it, so that
+// packets that are too big for the destination are answered with an ICMPv6
+// Packet Too Big as soon as they're read from the adapter, instead of being
+// copied and queued for the router first. Entries expire after a while, like
+// the path MTUs that hosts cache, so that a session whose MTU has gone up is
+// eventually used at its full size again.
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+// How long the MTU of a destination is remembered for, and the most destinations that are remembered.
+const pathMTU_lifetime = 10 * time.Minute
+const pathMTU_maxEntries = 4096
+
+type pathMTUCache struct {
+	mutex   sync.RWMutex
+	entries map[address]pathMTU_entry // By destination address
+}
+
+type pathMTU_entry struct {
+	mtu     uint16
+	expires time.Time
+}
+
+// Initializes the pathMTUCache struct.
+func (c *pathMTUCache) init() {
+	c.entries = make(map[address]pathMTU_entry)
+}
+
+// Records the MTU of the session that a packet to the destination was sent in, if it's lower than the one already remembered or that has expired.
+// This is called by the router for each packet, so it only takes the write lock when something changes.
+func (c *pathMTUCache) update(dest []byte, mtu uint16) {
+	var addr address
+	copy(addr[:], dest)
+	now := time.Now()
+	c.mutex.RLock()
+	entry, isIn := c.entries[addr]
+	c.mutex.RUnlock()
+	if isIn && entry.mtu <= mtu && now.Before(entry.expires) {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.entries) >= pathMTU_maxEntries {
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= pathMTU_maxEntries {
+			return
+		}
+	}
+	if entry, isIn := c.entries[addr]; isIn && entry.mtu < mtu && now.Before(entry.expires) {
+		// Lowered by another packet in the meantime
+		return
+	}
+	c.entries[addr] = pathMTU_entry{mtu: mtu, expires: now.Add(pathMTU_lifetime)}
+}
+
+// Gets the MTU remembered for the destination, or 0 if there isn't one.
+func (c *pathMTUCache) get(dest []byte) uint16 {
+	var addr address
+	copy(addr[:], dest)
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	entry, isIn := c.entries[addr]
+	if !isIn || time.Now().After(entry.expires) {
+		return 0
+	}
+	return entry.mtu
+}
+
+// Gets the remembered MTUs, for the admin API.
+func (c *pathMTUCache) getEntries() []admin_info {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	var entries []admin_info
+	for addr, entry := range c.entries {
+		if time.Now().After(entry.expires) {
+			continue
+		}
+		entries = append(entries, admin_info{
+			"destination": net.IP(addr[:]).String(),
+			"mtu":         entry.mtu,
+			"expires_in":  int(time.Until(entry.expires).Seconds()),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i]["destination"].(string) < entries[j]["destination"].(string)
+	})
+	return entries
+}
+
+// Answers an IPv6 packet that's too big for the MTU of its destination with an ICMPv6 Packet Too Big, which is written to the adapter.
+// This may be called from any goroutine.
+func (tun *tunDevice) sendPacketTooBig(bs []byte, mtu int) {
+	// Get the size of the oversized payload, up to a max of 900 bytes
+	window := 900
+	if mtu < window {
+		window = mtu
+	}
+	ptb := &icmp.PacketTooBig{
+		MTU:  mtu,
+		Data: bs[:window],
+	}
+	icmpv6Buf, err := tun.icmpv6.create_icmpv6_tun(bs[8:24], bs[24:40], ipv6.ICMPTypePacketTooBig, 0, ptb)
+	if err == nil {
+		tun.core.router.toTun(icmpv6Buf)
+	}
+}
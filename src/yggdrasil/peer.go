@@ -5,6 +5,9 @@ package yggdrasil
 //  Live code should be better commented
 
 import (
+	"errors"
+	"math"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,6 +23,7 @@ type peers struct {
 	ports                       atomic.Value //map[switchPort]*peer, use CoW semantics
 	authMutex                   sync.RWMutex
 	allowedEncryptionPublicKeys map[boxPubKey]struct{}
+	flaps                       map[boxPubKey]*peerFlaps // Flap histories, protected by mutex
 }
 
 // Initializes the peers struct.
@@ -29,6 +33,7 @@ func (ps *peers) init(c *Core) {
 	ps.putPorts(make(map[switchPort]*peer))
 	ps.core = c
 	ps.allowedEncryptionPublicKeys = make(map[boxPubKey]struct{})
+	ps.flaps = make(map[boxPubKey]*peerFlaps)
 }
 
 // Returns true if an incoming peer connection to a key is allowed, either because the key is in the whitelist or because the whitelist is empty.
@@ -39,6 +44,14 @@ func (ps *peers) isAllowedEncryptionPublicKey(box *boxPubKey) bool {
 	return isIn || len(ps.allowedEncryptionPublicKeys) == 0
 }
 
+// Returns true if the key is explicitly in the whitelist, regardless of whether the whitelist is empty.
+func (ps *peers) hasAllowedEncryptionPublicKey(box *boxPubKey) bool {
+	ps.authMutex.RLock()
+	defer ps.authMutex.RUnlock()
+	_, isIn := ps.allowedEncryptionPublicKeys[*box]
+	return isIn
+}
+
 // Adds a key to the whitelist.
 func (ps *peers) addAllowedEncryptionPublicKey(box *boxPubKey) {
 	ps.authMutex.Lock()
@@ -53,6 +66,17 @@ func (ps *peers) removeAllowedEncryptionPublicKey(box *boxPubKey) {
 	delete(ps.allowedEncryptionPublicKeys, *box)
 }
 
+// Replaces the whitelist with the given keys.
+func (ps *peers) setAllowedEncryptionPublicKeys(boxes []boxPubKey) {
+	allowed := make(map[boxPubKey]struct{}, len(boxes))
+	for _, box := range boxes {
+		allowed[box] = struct{}{}
+	}
+	ps.authMutex.Lock()
+	defer ps.authMutex.Unlock()
+	ps.allowedEncryptionPublicKeys = allowed
+}
+
 // Gets the whitelist of allowed keys for incoming connections.
 func (ps *peers) getAllowedEncryptionPublicKeys() []boxPubKey {
 	ps.authMutex.RLock()
@@ -74,10 +98,30 @@ func (ps *peers) putPorts(ports map[switchPort]*peer) {
 	ps.ports.Store(ports)
 }
 
+// Loss is only estimated when at least this many bytes were sent since the last estimate, so idle links keep their last estimate.
+const peer_lossMinBytes = 65536
+
+// How much weight each new loss sample is given in the smoothed loss estimate.
+const peer_lossSmoothing = 0.2
+
+// How much weight each new throughput sample is given in the smoothed throughput estimate.
+const peer_throughputSmoothing = 0.25
+
+// Artificial latency, jitter and loss added to traffic sent to a peer, for reproducing the behaviour of bad links in a local setup.
+type peerImpairment struct {
+	latency time.Duration // Added to every packet
+	jitter  time.Duration // Up to this much more is added at random, which can reorder packets
+	loss    float64       // Percentage of packets to drop
+}
+
 // Information known about a peer, including thier box/sig keys, precomputed shared keys (static and ephemeral) and a handler for their outgoing traffic
 type peer struct {
 	bytesSent  uint64 // To track bandwidth usage for getPeers
 	bytesRecvd uint64 // To track bandwidth usage for getPeers
+	loss       uint64 // To track estimated packet loss for getPeers, as the bits of a float64 percentage
+	throughput uint64 // Estimated throughput in bits per second, as the bits of a float64, or 0 if not known yet
+	rtt        int64  // Round trip time of the link, as a time.Duration, or 0 if not known
+	rttvar     int64  // Variation in the round trip time, as a time.Duration
 	// BUG: sync/atomic, 32 bit platforms need the above to be the first element
 	core       *Core
 	port       switchPort
@@ -86,11 +130,25 @@ type peer struct {
 	shared     boxSharedKey
 	linkShared boxSharedKey
 	firstSeen  time.Time       // To track uptime for getPeers
+	version    uint64          // The minor protocol version agreed with the peer, which may be older than ours
+	endpoint   string          // The remote address of the link, i.e. "[fe80::1%eth0]:1234", for getPeers
+	mtu        uint16          // Caps the MTU of our sessions whose traffic leaves through this peer, or 0 for no cap
 	linkOut    (chan []byte)   // used for protocol traffic (to bypass queues)
 	doSend     (chan struct{}) // tell the linkLoop to send a switchMsg
 	dinfo      *dhtInfo        // used to keep the DHT working
 	out        func([]byte)    // Set up by whatever created the peers struct, used to send packets to other nodes
 	close      func()          // Called when a peer is removed, to close the underlying connection, or via admin api
+	// Used to estimate packet loss, if set up by whatever created the peers struct
+	getRetransmits func() (retrans uint64, mss uint64, ok bool)
+	lossKnown      int32        // Set atomically once there's enough data to estimate loss
+	lastRetrans    uint64       // Only used by linkLoop
+	lastBytesSent  uint64       // Only used by linkLoop
+	impairment     atomic.Value // *peerImpairment, or nil if traffic isn't impaired
+	// Gets the MTU of the underlying path to the peer, if set up by whatever created the peers struct and known
+	getPathMTU func() (mtu uint64, ok bool)
+	// Gets the round trip time of the link and its variation, if set up by whatever created the peers struct and known
+	getLinkRTT func() (rtt time.Duration, rttvar time.Duration, ok bool)
+	flaps      *peerFlaps // The flap history of the peer's key
 }
 
 // Creates a new peer with the specified box, sig, and linkShared keys, using the lowest unocupied port number.
@@ -101,10 +159,12 @@ func (ps *peers) newPeer(box *boxPubKey, sig *sigPubKey, linkShared *boxSharedKe
 		shared:     *getSharedKey(&ps.core.boxPriv, box),
 		linkShared: *linkShared,
 		firstSeen:  now,
+		version:    version_getBaseMetadata().minorVer,
 		doSend:     make(chan struct{}, 1),
 		core:       ps.core}
 	ps.mutex.Lock()
 	defer ps.mutex.Unlock()
+	p.flaps = ps.getFlaps(box)
 	oldPorts := ps.getPorts()
 	newPorts := make(map[switchPort]*peer)
 	for k, v := range oldPorts {
@@ -140,6 +200,9 @@ func (ps *peers) removePeer(port switchPort) {
 	ps.putPorts(newPorts)
 	ps.mutex.Unlock()
 	if isIn {
+		if p.flaps != nil {
+			p.flaps.flap()
+		}
 		if p.close != nil {
 			p.close()
 		}
@@ -186,15 +249,68 @@ func (p *peer) linkLoop() {
 			if p.dinfo != nil {
 				p.core.dht.peers <- p.dinfo
 			}
+			p.updateLoss()
+			p.updateRTT()
 		}
 	}
 }
 
+// Updates the estimated packet loss from the number of retransmissions on the link since the last update.
+// The estimate is the fraction of segments sent that had to be retransmitted, smoothed over time so that occasional bursts don't dominate it.
+// Segments sent are estimated from bytes sent and the link's MSS, as not all platforms can tell us how many were sent.
+func (p *peer) updateLoss() {
+	if p.getRetransmits == nil {
+		return
+	}
+	retrans, mss, ok := p.getRetransmits()
+	if !ok || mss == 0 {
+		return
+	}
+	bytesSent := atomic.LoadUint64(&p.bytesSent)
+	if retrans < p.lastRetrans || bytesSent-p.lastBytesSent < peer_lossMinBytes {
+		// Not enough traffic since the last update to say anything useful
+		return
+	}
+	segments := (bytesSent - p.lastBytesSent + mss - 1) / mss
+	sample := 100 * float64(retrans-p.lastRetrans) / float64(segments+retrans-p.lastRetrans)
+	p.lastRetrans, p.lastBytesSent = retrans, bytesSent
+	loss := sample
+	if atomic.LoadInt32(&p.lossKnown) != 0 {
+		old := math.Float64frombits(atomic.LoadUint64(&p.loss))
+		loss = old + peer_lossSmoothing*(sample-old)
+	}
+	atomic.StoreUint64(&p.loss, math.Float64bits(loss))
+	atomic.StoreInt32(&p.lossKnown, 1)
+}
+
+// Gets the estimated packet loss percentage for the link, or false if it isn't known.
+func (p *peer) getLoss() (float64, bool) {
+	if atomic.LoadInt32(&p.lossKnown) == 0 {
+		return 0, false
+	}
+	return math.Float64frombits(atomic.LoadUint64(&p.loss)), true
+}
+
+// Updates the estimated throughput of the link with the rate, in bits per second, at which it was observed to carry traffic while it had a backlog.
+func (p *peer) updateThroughput(sample float64) {
+	throughput := sample
+	if old := p.getThroughput(); old != 0 {
+		throughput = old + peer_throughputSmoothing*(sample-old)
+	}
+	atomic.StoreUint64(&p.throughput, math.Float64bits(throughput))
+}
+
+// Gets the estimated throughput of the link in bits per second, or 0 if it isn't known yet.
+func (p *peer) getThroughput() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&p.throughput))
+}
+
 // Called to handle incoming packets.
 // Passes the packet to a handler for that packet type.
 func (p *peer) handlePacket(packet []byte) {
 	// FIXME this is off by stream padding and msg length overhead, should be done in tcp.go
 	atomic.AddUint64(&p.bytesRecvd, uint64(len(packet)))
+	p.core.capture.capturePeer(p.port, packet)
 	pType, pTypeLen := wire_decode_uint64(packet)
 	if pTypeLen == 0 {
 		return
@@ -221,13 +337,45 @@ func (p *peer) handleTraffic(packet []byte, pTypeLen int) {
 	p.core.switchTable.packetIn <- packet
 }
 
-// This just calls p.out(packet) for now.
+// This just calls p.out(packet) for now, unless the link is impaired for testing.
 func (p *peer) sendPacket(packet []byte) {
 	// Is there ever a case where something more complicated is needed?
 	// What if p.out blocks?
+	p.core.capture.capturePeer(p.port, packet)
+	if imp, _ := p.impairment.Load().(*peerImpairment); imp != nil {
+		if imp.loss > 0 && rand.Float64()*100 < imp.loss {
+			util_putBytes(packet)
+			return
+		}
+		delay := imp.latency
+		if imp.jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(imp.jitter)))
+		}
+		if delay > 0 {
+			time.AfterFunc(delay, func() { p.out(packet) })
+			return
+		}
+	}
 	p.out(packet)
 }
 
+// Sets the artificial latency, jitter and loss percentage for traffic sent to the peer.
+// This only affects traffic, not the link protocol traffic that keeps the peering up, so the peer stays connected however bad the link is made.
+// Setting everything to zero removes the impairment.
+func (p *peer) setImpairment(latency time.Duration, jitter time.Duration, loss float64) error {
+	switch {
+	case latency < 0 || jitter < 0:
+		return errors.New("latency and jitter can't be negative")
+	case loss < 0 || loss > 100:
+		return errors.New("loss must be a percentage")
+	case latency == 0 && jitter == 0 && loss == 0:
+		p.impairment.Store((*peerImpairment)(nil))
+	default:
+		p.impairment.Store(&peerImpairment{latency: latency, jitter: jitter, loss: loss})
+	}
+	return nil
+}
+
 // This wraps the packet in the inner (ephemeral) and outer (permanent) crypto layers.
 // It sends it to p.linkOut, which bypasses the usual packet queues.
 func (p *peer) sendLinkPacket(packet []byte) {
@@ -243,6 +391,7 @@ func (p *peer) sendLinkPacket(packet []byte) {
 		Payload: bs,
 	}
 	packet = linkPacket.encode()
+	p.core.capture.capturePeer(p.port, packet)
 	p.linkOut <- packet
 }
 
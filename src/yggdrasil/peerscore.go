@@ -0,0 +1,136 @@
+package yggdrasil
+
+// This scores the quality of the link to each peer, from its estimated loss,
+// the variation in its round trip time, and how often the peer has
+// disconnected recently, which is reported by getPeers and used by the switch
+// when choosing a parent.
+// Disconnections are damped in the same way as BGP route flaps: each one adds
+// to a penalty that decays exponentially, and once the penalty passes a
+// threshold the peer is suppressed, so that it isn't chosen as parent while
+// another peer is available, until the penalty decays below a lower threshold.
+// The penalty is kept by key, so it survives the peer reconnecting.
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The time it takes the flap penalty to decay by half, and the penalties above which a peer is suppressed and below which it's used again.
+const (
+	peer_flapHalfLife = 10 * time.Minute
+	peer_flapSuppress = 3
+	peer_flapReuse    = 1.5
+)
+
+// The most points of the score, out of 100, that each of loss, round trip time variation and flaps can cost.
+const (
+	peer_scoreLossMax   = 50
+	peer_scoreJitterMax = 25
+	peer_scoreFlapMax   = 50
+)
+
+// The most peers that flap penalties are remembered for once they disconnect.
+const peer_maxFlapHistory = 256
+
+// The flap history of a peer, which is shared by its connections.
+type peerFlaps struct {
+	mutex      sync.Mutex
+	penalty    float64   // Decays over time, as of updated
+	updated    time.Time // When the penalty was last decayed
+	suppressed bool
+	count      uint64 // Disconnections since the node started
+}
+
+// Decays the penalty to the current time, and lifts suppression once it's low enough. Must be called with the mutex held.
+func (f *peerFlaps) decay(now time.Time) {
+	if !f.updated.IsZero() {
+		f.penalty *= math.Exp2(-now.Sub(f.updated).Seconds() / peer_flapHalfLife.Seconds())
+	}
+	f.updated = now
+	if f.suppressed && f.penalty < peer_flapReuse {
+		f.suppressed = false
+	}
+}
+
+// Records a disconnection.
+func (f *peerFlaps) flap() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.decay(time.Now())
+	f.penalty++
+	f.count++
+	if f.penalty >= peer_flapSuppress {
+		f.suppressed = true
+	}
+}
+
+// Gets the decayed penalty, whether the peer is suppressed, and the number of disconnections.
+func (f *peerFlaps) get() (float64, bool, uint64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.decay(time.Now())
+	return f.penalty, f.suppressed, f.count
+}
+
+// Gets the flap history for a peer's key, creating it if there isn't one. Must be called with the peers mutex held.
+// Histories that have decayed to nothing are forgotten when there are too many.
+func (ps *peers) getFlaps(box *boxPubKey) *peerFlaps {
+	if f, isIn := ps.flaps[*box]; isIn {
+		return f
+	}
+	if len(ps.flaps) >= peer_maxFlapHistory {
+		inUse := make(map[*peerFlaps]bool)
+		for _, p := range ps.getPorts() {
+			inUse[p.flaps] = true
+		}
+		for key, f := range ps.flaps {
+			if penalty, _, _ := f.get(); penalty < 0.1 && !inUse[f] {
+				delete(ps.flaps, key)
+			}
+		}
+	}
+	f := &peerFlaps{}
+	ps.flaps[*box] = f
+	return f
+}
+
+// Updates the round trip time of the link, if the link can measure it.
+func (p *peer) updateRTT() {
+	if p.getLinkRTT == nil {
+		return
+	}
+	if rtt, rttvar, ok := p.getLinkRTT(); ok {
+		atomic.StoreInt64(&p.rtt, int64(rtt))
+		atomic.StoreInt64(&p.rttvar, int64(rttvar))
+		p.core.statsExport.peerRTT.observe(rtt)
+	}
+}
+
+// Gets the round trip time of the link and its variation, or false if they aren't known.
+func (p *peer) getRTT() (time.Duration, time.Duration, bool) {
+	rtt := time.Duration(atomic.LoadInt64(&p.rtt))
+	return rtt, time.Duration(atomic.LoadInt64(&p.rttvar)), rtt != 0
+}
+
+// Gets the quality score of the link, from 0 to 100, and whether the peer is suppressed for flapping.
+// Whatever isn't known about the link doesn't count against it.
+func (p *peer) getScore() (float64, bool) {
+	score := 100.0
+	if loss, ok := p.getLoss(); ok {
+		// 10% loss is as bad as it gets
+		score -= math.Min(peer_scoreLossMax, loss*peer_scoreLossMax/10)
+	}
+	if rtt, rttvar, ok := p.getRTT(); ok {
+		// Variation as large as the round trip time itself is as bad as it gets
+		score -= math.Min(peer_scoreJitterMax, peer_scoreJitterMax*rttvar.Seconds()/rtt.Seconds())
+	}
+	var suppressed bool
+	if p.flaps != nil {
+		var penalty float64
+		penalty, suppressed, _ = p.flaps.get()
+		score -= math.Min(peer_scoreFlapMax, penalty*peer_scoreFlapMax/peer_flapSuppress)
+	}
+	return math.Max(0, score), suppressed
+}
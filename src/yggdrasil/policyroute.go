@@ -0,0 +1,162 @@
+package yggdrasil
+
+// This routes the traffic of selected applications over Yggdrasil, while the
+// rest of the system keeps using its usual routes. Packets from the selected
+// users and cgroups are marked, and an ip rule sends marked packets to a
+// routing table of our own, which routes the configured prefixes through the
+// TUN/TAP adapter with our address as the source. Applications can also mark
+// their own packets, i.e. with SO_MARK.
+// The rules, routes and packet marking are set up when the node starts and
+// removed when it stops, and any left behind by a node that didn't stop
+// cleanly are removed first. This is only supported on Linux, where users are
+// matched by ip rules and cgroups by ip6tables.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The default routing table, firewall mark and ip rule priority.
+// The table and mark are "y" in ASCII, and the rule comes before the main table's.
+const (
+	policyRoute_defaultTable    = 121
+	policyRoute_defaultMark     = 121
+	policyRoute_defaultPriority = 1000
+)
+
+// A range of user IDs, inclusive.
+type policyRoute_uidRange struct {
+	start uint32
+	end   uint32
+}
+
+type policyRouting struct {
+	core     *Core
+	mutex    sync.Mutex
+	enabled  bool
+	table    uint32
+	mark     uint32
+	priority uint32
+	prefixes []*net.IPNet
+	uids     []policyRoute_uidRange
+	cgroups  []string // Paths of cgroups, relative to the root of the cgroup v2 hierarchy
+	active   bool     // Whether the routes and rules are in place
+}
+
+// Initializes the policyRouting struct.
+func (r *policyRouting) init(core *Core) {
+	r.core = core
+}
+
+// Sets whether policy routing is enabled, and which table, mark and rule priority it uses, which prefixes are routed and whose traffic.
+// Zero uses the default, and no prefixes routes everything.
+func (r *policyRouting) setConfig(enabled bool, table, mark, priority uint32, prefixes, uids, cgroups []string) error {
+	if table == 0 {
+		table = policyRoute_defaultTable
+	}
+	if mark == 0 {
+		mark = policyRoute_defaultMark
+	}
+	if priority == 0 {
+		priority = policyRoute_defaultPriority
+	}
+	if len(prefixes) == 0 {
+		prefixes = []string{"::/0"}
+	}
+	var nets []*net.IPNet
+	for _, prefix := range prefixes {
+		_, ipNet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return err
+		}
+		if ipNet.IP.To4() != nil {
+			return errors.New("only IPv6 prefixes can be routed: " + prefix)
+		}
+		nets = append(nets, ipNet)
+	}
+	var ranges []policyRoute_uidRange
+	for _, uid := range uids {
+		uidRange, err := policyRoute_parseUIDs(uid)
+		if err != nil {
+			return err
+		}
+		ranges = append(ranges, uidRange)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.enabled = enabled
+	r.table = table
+	r.mark = mark
+	r.priority = priority
+	r.prefixes = nets
+	r.uids = ranges
+	r.cgroups = cgroups
+	return nil
+}
+
+// Parses a user ID, a range of them like "1000-1999", or a user name.
+func policyRoute_parseUIDs(s string) (policyRoute_uidRange, error) {
+	if bounds := strings.SplitN(s, "-", 2); len(bounds) == 2 {
+		start, err1 := strconv.ParseUint(bounds[0], 10, 32)
+		end, err2 := strconv.ParseUint(bounds[1], 10, 32)
+		if err1 == nil && err2 == nil && start <= end {
+			return policyRoute_uidRange{uint32(start), uint32(end)}, nil
+		}
+	}
+	if uid, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return policyRoute_uidRange{uint32(uid), uint32(uid)}, nil
+	}
+	u, err := user.Lookup(s)
+	if err != nil {
+		return policyRoute_uidRange{}, fmt.Errorf("invalid user: %s", s)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return policyRoute_uidRange{}, fmt.Errorf("invalid user: %s", s)
+	}
+	return policyRoute_uidRange{uint32(uid), uint32(uid)}, nil
+}
+
+// Sets up the routes, rules and packet marking, if enabled. This must be called after the TUN/TAP adapter is started.
+func (r *policyRouting) start() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.enabled {
+		return nil
+	}
+	if !policyRoute_supported {
+		return errors.New("policy routing is only supported on Linux")
+	}
+	state := r.core.tun.getState()
+	if state.iface == nil {
+		return errors.New("policy routing needs the TUN/TAP adapter")
+	}
+	netIF, err := net.InterfaceByName(state.name())
+	if err != nil {
+		return err
+	}
+	// Anything left behind by a node that didn't stop cleanly would get in the way
+	r.remove()
+	if err := r.add(netIF, net.IP(r.core.router.addr[:])); err != nil {
+		r.remove()
+		return err
+	}
+	r.active = true
+	r.core.log.Printf("Policy routing packets with mark %d through table %d", r.mark, r.table)
+	return nil
+}
+
+// Removes the routes, rules and packet marking.
+func (r *policyRouting) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.active {
+		r.remove()
+		r.active = false
+	}
+}
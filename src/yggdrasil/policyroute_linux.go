@@ -0,0 +1,150 @@
+package yggdrasil
+
+// The linux platform specific policy routing parts
+
+import (
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Netlink attributes for routes and rules that the syscall package doesn't have, and the ip6tables chain that packets are marked in.
+const (
+	policyRoute_RTA_PREFSRC   = 7
+	policyRoute_RTA_TABLE     = 15
+	policyRoute_FRA_PRIORITY  = 6
+	policyRoute_FRA_FWMARK    = 10
+	policyRoute_FRA_TABLE     = 15
+	policyRoute_FRA_FWMASK    = 16
+	policyRoute_FRA_UID_RANGE = 20
+	policyRoute_FR_ACT_TO_TBL = 1
+	policyRoute_chain         = "yggdrasil-policy"
+)
+
+// Policy routing is supported on Linux.
+const policyRoute_supported = true
+
+// Adds the routes, rules and packet marking. Must be called with the mutex held.
+func (r *policyRouting) add(netIF *net.Interface, src net.IP) error {
+	for _, prefix := range r.prefixes {
+		if err := policyRoute_route(syscall.RTM_NEWROUTE, netIF, prefix, src, r.table); err != nil {
+			return err
+		}
+	}
+	if err := policyRoute_rule(syscall.RTM_NEWRULE, r.priority, r.table, &r.mark, nil); err != nil {
+		return err
+	}
+	for idx := range r.uids {
+		if err := policyRoute_rule(syscall.RTM_NEWRULE, r.priority, r.table, nil, &r.uids[idx]); err != nil {
+			return err
+		}
+	}
+	if len(r.cgroups) == 0 {
+		return nil
+	}
+	mark := strconv.FormatUint(uint64(r.mark), 10)
+	if err := r.ip6tables("-N", policyRoute_chain); err != nil {
+		return err
+	}
+	for _, cgroup := range r.cgroups {
+		if err := r.ip6tables("-A", policyRoute_chain, "-m", "cgroup", "--path", cgroup, "-j", "MARK", "--set-mark", mark); err != nil {
+			return err
+		}
+	}
+	return r.ip6tables("-A", "OUTPUT", "-j", policyRoute_chain)
+}
+
+// Removes whatever there is of the routes, rules and packet marking, ignoring anything that's already gone. Must be called with the mutex held.
+func (r *policyRouting) remove() {
+	for _, prefix := range r.prefixes {
+		policyRoute_route(syscall.RTM_DELROUTE, nil, prefix, nil, r.table)
+	}
+	// Rules can be added more than once, so keep deleting until there are none left
+	for policyRoute_rule(syscall.RTM_DELRULE, r.priority, r.table, &r.mark, nil) == nil {
+	}
+	for idx := range r.uids {
+		for policyRoute_rule(syscall.RTM_DELRULE, r.priority, r.table, nil, &r.uids[idx]) == nil {
+		}
+	}
+	if _, err := exec.LookPath("ip6tables"); err != nil {
+		return
+	}
+	for exec.Command("ip6tables", "-t", "mangle", "-D", "OUTPUT", "-j", policyRoute_chain).Run() == nil {
+	}
+	exec.Command("ip6tables", "-t", "mangle", "-F", policyRoute_chain).Run()
+	exec.Command("ip6tables", "-t", "mangle", "-X", policyRoute_chain).Run()
+}
+
+// Runs ip6tables on the mangle table, logging the command and its output if it fails.
+func (r *policyRouting) ip6tables(args ...string) error {
+	cmd := exec.Command("ip6tables", append([]string{"-t", "mangle"}, args...)...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		r.core.log.Printf("ip6tables command: %v", strings.Join(cmd.Args, " "))
+		r.core.log.Printf("Linux ip6tables failed: %v.", err)
+		r.core.log.Println(string(output))
+	}
+	return err
+}
+
+// Encodes a uint32 for a netlink attribute.
+func policyRoute_uint32(n uint32) []byte {
+	bs := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&bs[0])) = n
+	return bs
+}
+
+// Adds or deletes a route to the prefix in the table, as "ip route add prefix dev interface src src table table" would.
+// The interface and source may be nil when deleting.
+func policyRoute_route(msgType uint16, netIF *net.Interface, prefix *net.IPNet, src net.IP, table uint32) error {
+	header := make([]byte, syscall.SizeofRtMsg)
+	rt := (*syscall.RtMsg)(unsafe.Pointer(&header[0]))
+	rt.Family = syscall.AF_INET6
+	ones, _ := prefix.Mask.Size()
+	rt.Dst_len = uint8(ones)
+	rt.Table = syscall.RT_TABLE_UNSPEC // The table is given by the attribute, as it may not fit in a byte
+	rt.Protocol = syscall.RTPROT_BOOT
+	rt.Scope = syscall.RT_SCOPE_UNIVERSE
+	rt.Type = syscall.RTN_UNICAST
+	attrs := tun_netlinkAttr(tun_RTA_DST, prefix.IP.To16())
+	attrs = append(attrs, tun_netlinkAttr(policyRoute_RTA_TABLE, policyRoute_uint32(table))...)
+	if netIF != nil {
+		attrs = append(attrs, tun_netlinkAttr(tun_RTA_OIF, policyRoute_uint32(uint32(netIF.Index)))...)
+	}
+	if src != nil {
+		attrs = append(attrs, tun_netlinkAttr(policyRoute_RTA_PREFSRC, src.To16())...)
+	}
+	var flags uint16
+	if msgType == syscall.RTM_NEWROUTE {
+		flags = syscall.NLM_F_CREATE | syscall.NLM_F_EXCL
+	}
+	return tun_netlinkRequest(msgType, flags, header, attrs)
+}
+
+// Adds or deletes a rule that looks up the table for packets with the mark, or from the users, as "ip -6 rule add fwmark mark lookup table priority priority" or "ip -6 rule add uidrange start-end ..." would.
+func policyRoute_rule(msgType uint16, priority, table uint32, mark *uint32, uids *policyRoute_uidRange) error {
+	// A struct fib_rule_hdr, which is the same as an rtmsg apart from the meaning of the fields
+	header := make([]byte, syscall.SizeofRtMsg)
+	rule := (*syscall.RtMsg)(unsafe.Pointer(&header[0]))
+	rule.Family = syscall.AF_INET6
+	rule.Table = syscall.RT_TABLE_UNSPEC
+	rule.Type = policyRoute_FR_ACT_TO_TBL // The action field
+	attrs := tun_netlinkAttr(policyRoute_FRA_PRIORITY, policyRoute_uint32(priority))
+	attrs = append(attrs, tun_netlinkAttr(policyRoute_FRA_TABLE, policyRoute_uint32(table))...)
+	if mark != nil {
+		attrs = append(attrs, tun_netlinkAttr(policyRoute_FRA_FWMARK, policyRoute_uint32(*mark))...)
+		attrs = append(attrs, tun_netlinkAttr(policyRoute_FRA_FWMASK, policyRoute_uint32(0xffffffff))...)
+	}
+	if uids != nil {
+		uidRange := append(policyRoute_uint32(uids.start), policyRoute_uint32(uids.end)...)
+		attrs = append(attrs, tun_netlinkAttr(policyRoute_FRA_UID_RANGE, uidRange)...)
+	}
+	var flags uint16
+	if msgType == syscall.RTM_NEWRULE {
+		flags = syscall.NLM_F_CREATE | syscall.NLM_F_EXCL
+	}
+	return tun_netlinkRequest(msgType, flags, header, attrs)
+}
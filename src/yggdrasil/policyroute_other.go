@@ -0,0 +1,14 @@
+// +build !linux
+
+package yggdrasil
+
+import "net"
+
+// Policy routing isn't supported on this platform.
+const policyRoute_supported = false
+
+func (r *policyRouting) add(netIF *net.Interface, src net.IP) error {
+	return nil
+}
+
+func (r *policyRouting) remove() {}
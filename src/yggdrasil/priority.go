@@ -0,0 +1,137 @@
+package yggdrasil
+
+// This maps the DSCP value in the traffic class of packets read from the
+// TUN/TAP adapter onto the priority that they're queued with by the switch of
+// every node on the path, so that interactive traffic like SSH and VoIP is
+// sent ahead of bulk transfers when links are busy, and traffic that's marked
+// as low priority is sent last and dropped first. As the source chooses the
+// priority, interactive traffic only gets a share of a busy link ahead of
+// other traffic, rather than all of it, so that it can't starve everyone else. The session carries the
+// priority in the top bits of the flow key that's appended after the coords,
+// which is the only part of a traffic packet that switches can read. Older
+// nodes treat the flow key as opaque, so they still forward these packets, but
+// queue them like any other traffic. The default mapping follows the service
+// classes of RFC 4594, and can be changed with DSCPPriority, although streaming
+// and conferencing video are normal rather than interactive, as they'd take
+// most of the interactive share.
+// Bench and MTU probe packets are protocol traffic, but they're marked the same
+// way, so that switches queue them like session traffic instead of sending them
+// ahead of it, as a flood of them would otherwise starve real traffic.
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+)
+
+// Priorities of session traffic, as carried in the flow key.
+// Normal traffic isn't marked, so that its flow keys are the same as those from older nodes.
+const (
+	priority_normal      = 0
+	priority_background  = 1
+	priority_interactive = 2
+	priority_measurement = 3 // Bench and MTU probe packets, which can't be chosen for session traffic
+)
+
+// Where the priority is carried in the flow key, which never uses these bits otherwise.
+const priority_flowKeyShift = 56
+const priority_flowKeyMask = 0x0f << priority_flowKeyShift
+
+// Names of the priorities, as used in DSCPPriority.
+var priority_names = map[string]uint8{
+	"background":  priority_background,
+	"normal":      priority_normal,
+	"interactive": priority_interactive,
+}
+
+// The default priority of each DSCP value, which is normal unless listed here.
+var priority_defaults = map[uint8]uint8{
+	1:  priority_background,  // Lower effort
+	8:  priority_background,  // CS1, low-priority data
+	16: priority_interactive, // CS2, OAM
+	18: priority_interactive, // AF21, low-latency data, i.e. interactive SSH
+	20: priority_interactive, // AF22
+	22: priority_interactive, // AF23
+	32: priority_interactive, // CS4, real-time interactive
+	40: priority_interactive, // CS5, signaling
+	44: priority_interactive, // Voice admit
+	46: priority_interactive, // EF, telephony
+	48: priority_interactive, // CS6, network control
+	56: priority_interactive, // CS7
+}
+
+type trafficPriority struct {
+	table atomic.Value // [64]uint8, the priority of each DSCP value
+}
+
+// Initializes the trafficPriority struct with the default mapping.
+func (p *trafficPriority) init() {
+	p.setConfig(nil)
+}
+
+// Sets the priorities of DSCP values, given by number, that differ from the defaults.
+// If any of them are invalid then the existing mapping is left unchanged.
+func (p *trafficPriority) setConfig(mapping map[string]string) error {
+	var table [64]uint8
+	for dscp, priority := range priority_defaults {
+		table[dscp] = priority
+	}
+	for dscpStr, name := range mapping {
+		dscp, err := strconv.ParseUint(dscpStr, 10, 8)
+		if err != nil || dscp >= 64 {
+			return errors.New("invalid DSCP value: " + dscpStr)
+		}
+		priority, isIn := priority_names[name]
+		if !isIn {
+			return errors.New("unknown priority: " + name)
+		}
+		table[dscp] = priority
+	}
+	p.table.Store(table)
+	return nil
+}
+
+// Gets the priority of an IPv6 or IPv4 packet from its DSCP value.
+func (p *trafficPriority) get(packet []byte) uint8 {
+	var dscp byte
+	switch {
+	case len(packet) >= tun_IPv6_HEADER_LENGTH && packet[0]&0xf0 == 0x60:
+		dscp = (packet[0]<<4 | packet[1]>>4) >> 2
+	case len(packet) >= tun_IPv4_HEADER_LENGTH && packet[0]&0xf0 == 0x40:
+		dscp = packet[1] >> 2
+	default:
+		return priority_normal
+	}
+	table := p.table.Load().([64]uint8)
+	return table[dscp]
+}
+
+// Returns a copy of the coords of a bench or MTU probe packet, marked so that switches queue it as session traffic.
+func priority_markMeasurement(coords []byte) []byte {
+	marked := append(append([]byte(nil), coords...), 0)
+	return wire_put_uint64(uint64(priority_measurement)<<priority_flowKeyShift, marked)
+}
+
+// Gets the priority that a session marked a traffic packet with, from the flow key after its coords.
+func priority_fromCoords(coords []byte) uint8 {
+	for len(coords) > 0 {
+		port, length := wire_decode_uint64(coords)
+		if length == 0 {
+			return priority_normal
+		}
+		coords = coords[length:]
+		if port != 0 {
+			continue
+		}
+		// The end of the destination's coords, which may be followed by a 0 that marks the packet as unordered
+		if next, length := wire_decode_uint64(coords); length != 0 && next == 0 {
+			coords = coords[length:]
+		}
+		flowkey, length := wire_decode_uint64(coords)
+		if length == 0 {
+			return priority_normal
+		}
+		return uint8((flowkey & priority_flowKeyMask) >> priority_flowKeyShift)
+	}
+	return priority_normal
+}
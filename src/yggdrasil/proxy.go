@@ -0,0 +1,413 @@
+package yggdrasil
+
+// This implements an ordered list of outbound proxies, which peers with a
+// proxy://a.b.c.d:e URI are dialled through. Each proxy is either a SOCKS5
+// proxy, given as socks://[user:pass@]host:port, or an HTTP proxy that supports
+// CONNECT, given as http://[user:pass@]host:port.
+// Proxies are tried in order, starting with those that are currently healthy,
+// so that roaming nodes whose primary proxy can't be reached still bring their
+// peers up through the alternates. A proxy is marked unhealthy when it can't
+// be connected to or its handshake fails, and is checked again periodically by
+// connecting to it. A proxy that works but can't reach the peer, i.e. because
+// the peer is down, keeps its health, so one dead peer doesn't demote it.
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default interval between health checks, and how long to wait for a proxy to connect and complete its handshake.
+const proxy_defaultCheckInterval = time.Minute
+const proxy_dialTimeout = default_tcp_timeout
+
+type proxyList struct {
+	core     *Core
+	mutex    sync.Mutex // Protecting the below
+	proxies  []*proxyInfo
+	interval time.Duration // Time between health checks
+	stop     chan struct{}
+}
+
+// An error from a proxy that works, but couldn't connect to the address.
+type proxy_targetError struct {
+	reason string
+}
+
+func (e *proxy_targetError) Error() string {
+	return "proxy couldn't connect: " + e.reason
+}
+
+// A proxy in the list, along with the result of the last attempt to use or check it.
+type proxyInfo struct {
+	uri       *url.URL
+	healthy   bool
+	lastError string
+	checked   time.Time
+}
+
+// Initializes the proxyList struct.
+func (l *proxyList) init(core *Core) {
+	l.core = core
+	l.interval = proxy_defaultCheckInterval
+}
+
+// Sets the proxies, in order of preference, and how often they are checked.
+// A zero interval uses the default. Every proxy starts out as healthy, until it fails.
+func (l *proxyList) setConfig(uris []string, interval time.Duration) error {
+	var proxies []*proxyInfo
+	for _, s := range uris {
+		u, err := url.Parse(s)
+		if err != nil {
+			return errors.New("invalid proxy: " + s)
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "socks", "socks5", "http":
+		default:
+			return errors.New("unsupported proxy: " + s)
+		}
+		if u.Host == "" {
+			return errors.New("invalid proxy: " + s)
+		}
+		proxies = append(proxies, &proxyInfo{uri: u, healthy: true})
+	}
+	if interval < 0 {
+		return errors.New("invalid proxy check interval")
+	} else if interval == 0 {
+		interval = proxy_defaultCheckInterval
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.proxies = proxies
+	l.interval = interval
+	return nil
+}
+
+// Starts checking the health of the proxies, if there are any.
+func (l *proxyList) start() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.proxies) == 0 {
+		return nil
+	}
+	l.stop = make(chan struct{})
+	go l.checkLoop(l.stop, l.interval)
+	return nil
+}
+
+// Stops checking the health of the proxies.
+func (l *proxyList) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+}
+
+// Checks every proxy each interval until stopped.
+func (l *proxyList) checkLoop(stop chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		l.mutex.Lock()
+		proxies := append([]*proxyInfo(nil), l.proxies...)
+		l.mutex.Unlock()
+		for _, info := range proxies {
+			conn, err := net.DialTimeout("tcp", info.uri.Host, proxy_dialTimeout)
+			if err == nil {
+				conn.Close()
+			}
+			l.setHealth(info, err)
+		}
+	}
+}
+
+// Records the result of using or checking a proxy, and logs when it becomes healthy or unhealthy.
+func (l *proxyList) setHealth(info *proxyInfo, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	info.checked = time.Now()
+	switch {
+	case err != nil && info.healthy:
+		l.core.log.Println("Proxy", proxy_displayName(info.uri), "is unreachable:", err)
+	case err == nil && !info.healthy:
+		l.core.log.Println("Proxy", proxy_displayName(info.uri), "is reachable again")
+	}
+	info.healthy = err == nil
+	if err != nil {
+		info.lastError = err.Error()
+	}
+}
+
+// Connects to the address through the first proxy that works, trying the healthy proxies in order before the unhealthy ones.
+func (l *proxyList) dial(addr string) (net.Conn, error) {
+	l.mutex.Lock()
+	var healthy, unhealthy []*proxyInfo
+	for _, info := range l.proxies {
+		if info.healthy {
+			healthy = append(healthy, info)
+		} else {
+			unhealthy = append(unhealthy, info)
+		}
+	}
+	l.mutex.Unlock()
+	err := errors.New("no proxies configured")
+	for _, info := range append(healthy, unhealthy...) {
+		var conn net.Conn
+		conn, err = proxy_dial(info.uri, addr)
+		if _, isTarget := err.(*proxy_targetError); !isTarget {
+			// Only failures to reach or talk to the proxy itself say anything about its health
+			l.setHealth(info, err)
+		}
+		if err == nil {
+			return &wrappedConn{
+				c: conn,
+				raddr: &wrappedAddr{
+					network: "tcp",
+					addr:    addr,
+				},
+			}, nil
+		}
+	}
+	return nil, err
+}
+
+// Gets the health of each proxy, along with its priority, where 0 is the most preferred.
+func (l *proxyList) getProxies() admin_info {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	out := make(admin_info)
+	for idx, info := range l.proxies {
+		proxy := admin_info{
+			"priority": idx,
+			"healthy":  info.healthy,
+		}
+		if info.lastError != "" {
+			proxy["last_error"] = info.lastError
+		}
+		if !info.checked.IsZero() {
+			proxy["last_checked"] = time.Since(info.checked).Seconds()
+		}
+		out[proxy_displayName(info.uri)] = proxy
+	}
+	return out
+}
+
+// Gets the proxy URI without its password, so that it can be logged.
+func proxy_displayName(u *url.URL) string {
+	name := u.Scheme + "://" + u.Host
+	if u.User != nil {
+		name = u.Scheme + "://" + u.User.Username() + "@" + u.Host
+	}
+	return name
+}
+
+// Connects to the address through the proxy.
+func proxy_dial(u *url.URL, addr string) (net.Conn, error) {
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return proxy_dialHTTP(u, addr)
+	default:
+		return proxy_dialSOCKS(u, addr)
+	}
+}
+
+// SOCKS5 authentication methods, commands and address types.
+const (
+	proxy_socksVersion    = 5
+	proxy_socksNoAuth     = 0
+	proxy_socksPassword   = 2
+	proxy_socksNoMethods  = 0xff
+	proxy_socksConnect    = 1
+	proxy_socksIPv4       = 1
+	proxy_socksDomainName = 3
+	proxy_socksIPv6       = 4
+)
+
+// The reasons a SOCKS5 proxy gives for failing to connect, indexed by the reply code.
+var proxy_socksReplies = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Connects to the address through a SOCKS5 proxy, as in RFC 1928, with username and password authentication as in RFC 1929 if the URI has a user.
+// Only a failure reply to the connect request is a proxy_targetError, as anything before that is the proxy's fault.
+func proxy_dialSOCKS(u *url.URL, addr string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid port: " + portString)
+	}
+	req := []byte{proxy_socksVersion, proxy_socksConnect, 0}
+	if ip := net.ParseIP(host); ip.To4() != nil {
+		req = append(append(req, proxy_socksIPv4), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, proxy_socksIPv6), ip.To16()...)
+	} else if len(host) <= 255 {
+		req = append(append(req, proxy_socksDomainName, byte(len(host))), host...)
+	} else {
+		return nil, errors.New("host name too long: " + host)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	conn, err := net.DialTimeout("tcp", u.Host, proxy_dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(proxy_dialTimeout))
+	if err := proxy_handshakeSOCKS(conn, u.User, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Negotiates authentication with a SOCKS5 proxy and sends the connect request, reading the reply.
+func proxy_handshakeSOCKS(conn net.Conn, user *url.Userinfo, req []byte) error {
+	methods := []byte{proxy_socksVersion, 1, proxy_socksNoAuth}
+	if user != nil {
+		methods = []byte{proxy_socksVersion, 2, proxy_socksNoAuth, proxy_socksPassword}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	switch {
+	case buf[0] != proxy_socksVersion:
+		return errors.New("not a SOCKS5 proxy")
+	case buf[1] == proxy_socksNoAuth:
+	case buf[1] == proxy_socksPassword && user != nil:
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("SOCKS username or password too long")
+		}
+		auth := append([]byte{1, byte(len(user.Username()))}, user.Username()...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("SOCKS username/password authentication failed")
+		}
+	case buf[1] == proxy_socksNoMethods:
+		return errors.New("no acceptable SOCKS authentication methods")
+	default:
+		return fmt.Errorf("unsupported SOCKS authentication method %d", buf[1])
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != proxy_socksVersion {
+		return errors.New("not a SOCKS5 proxy")
+	}
+	if buf[1] != 0 {
+		reason := fmt.Sprintf("SOCKS reply %d", buf[1])
+		if int(buf[1]) < len(proxy_socksReplies) {
+			reason = proxy_socksReplies[buf[1]]
+		}
+		return &proxy_targetError{reason}
+	}
+	// Skip the address that the proxy connected from, and its port
+	var length int
+	switch buf[3] {
+	case proxy_socksIPv4:
+		length = net.IPv4len + 2
+	case proxy_socksIPv6:
+		length = net.IPv6len + 2
+	case proxy_socksDomainName:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		length = int(buf[0]) + 2
+	default:
+		return fmt.Errorf("unknown SOCKS address type %d", buf[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, length))
+	return err
+}
+
+// Connects to the address through an HTTP proxy, using the CONNECT method.
+func proxy_dialHTTP(u *url.URL, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", u.Host, proxy_dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(proxy_dialTimeout))
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if u.User != nil {
+		password, _ := u.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusProxyAuthRequired, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		// The proxy won't let us, or doesn't support CONNECT at all
+		conn.Close()
+		return nil, errors.New("proxy refused CONNECT: " + resp.Status)
+	default:
+		// Usually the proxy couldn't reach the address, i.e. 502 or 504, or isn't allowed to
+		conn.Close()
+		return nil, &proxy_targetError{resp.Status}
+	}
+	conn.SetDeadline(time.Time{})
+	return &proxy_bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// A connection that first returns anything the proxy sent after its response, which was already read into the buffer.
+type proxy_bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *proxy_bufferedConn) Read(data []byte) (int, error) {
+	if c.reader.Buffered() > 0 {
+		return c.reader.Read(data)
+	}
+	return c.Conn.Read(data)
+}
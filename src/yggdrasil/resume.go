@@ -0,0 +1,79 @@
+package yggdrasil
+
+// This detects when the host resumes from sleep or suspend, and gets the node
+// back into the network straight away, rather than waiting for links, sessions
+// and DHT entries to time out one by one, which can take minutes.
+// There's no portable way to be told about suspend, so it's detected from the
+// clock instead: a ticker that should fire every second finds that much more
+// time has passed, either on the wall clock (Linux, where the monotonic clock
+// stops during suspend) or on both clocks (other platforms).
+
+import (
+	"time"
+)
+
+// How often the clock is checked.
+const resume_interval = time.Second
+
+// How much more time than resume_interval must pass between checks for it to count as a resume.
+// This is long enough that a busy system or small NTP corrections don't trigger it.
+const resume_threshold = 10 * time.Second
+
+type resumeWatch struct {
+	core *Core
+	stop chan struct{}
+}
+
+// Initializes the resumeWatch struct.
+func (r *resumeWatch) init(core *Core) {
+	r.core = core
+}
+
+// Starts watching for resumes.
+func (r *resumeWatch) start() {
+	r.stop = make(chan struct{})
+	go r.watch(r.stop)
+}
+
+// Stops watching for resumes.
+func (r *resumeWatch) close() {
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+// Checks the clock every resume_interval until stopped, and recovers if it looks like we've been asleep.
+func (r *resumeWatch) watch(stop chan struct{}) {
+	ticker := time.NewTicker(resume_interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		now := time.Now()
+		elapsed := now.Sub(last) // Monotonic
+		if wall := now.Round(0).Sub(last.Round(0)); wall > elapsed {
+			elapsed = wall
+		}
+		last = now
+		if elapsed-resume_interval > resume_threshold {
+			r.core.log.Println("Resumed after", elapsed.Round(time.Second), "asleep, reconnecting")
+			r.recover()
+		}
+	}
+}
+
+// Reconnects outgoing links, sends our coords to our peers and resets sessions and the DHT, as after a coords change.
+// Incoming links are left to time out, which happens quickly as nothing has been read from them while we were asleep, and the remote nodes then dial us again.
+func (r *resumeWatch) recover() {
+	r.core.tcp.reconnect(nil)
+	r.core.peers.sendSwitchMsgs()
+	select {
+	case r.core.router.reset <- struct{}{}:
+	default:
+	}
+}
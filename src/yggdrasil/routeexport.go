@@ -0,0 +1,162 @@
+package yggdrasil
+
+// This announces our routed /64, and any other configured prefixes, to a local
+// routing daemon, so that routers on the local site learn that the prefixes
+// are reachable through this node without any static routes.
+// Routes are announced using the text API of ExaBGP, which can then announce
+// them to any BGP speaker on the site, i.e.
+//  announce route 300:1234:5678:9abc::/64 next-hop self
+// The commands are written to a named pipe or local socket that ExaBGP reads
+// from. They are repeated periodically, so that routes come back if the daemon
+// is restarted, and withdrawn when we shut down.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often routes are announced again, in case the routing daemon has restarted.
+const routeExport_interval = time.Minute
+
+// How long to wait to deliver commands to the routing daemon, i.e. while waiting for it to open a named pipe.
+const routeExport_timeout = 5 * time.Second
+
+type routeExport struct {
+	core     *Core
+	mutex    sync.Mutex
+	target   string   // Named pipe path, or unix:// or tcp:// socket, to write commands to
+	nextHop  string   // Next hop for announced routes, "self" to let the daemon choose
+	prefixes []string // Prefixes to announce as well as our /64
+	stop     chan struct{}
+}
+
+// Initializes the routeExport struct.
+func (r *routeExport) init(core *Core) {
+	r.core = core
+	r.nextHop = "self"
+}
+
+// Sets where commands are sent, the next hop to announce and any extra prefixes to announce.
+// An empty target disables route export, and an empty next hop uses "self".
+func (r *routeExport) setConfig(target string, nextHop string, prefixes []string) error {
+	for _, prefix := range prefixes {
+		if _, _, err := net.ParseCIDR(prefix); err != nil {
+			return err
+		}
+	}
+	if nextHop == "" {
+		nextHop = "self"
+	} else if nextHop != "self" && net.ParseIP(nextHop) == nil {
+		return errors.New("invalid next hop: " + nextHop)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.target = target
+	r.nextHop = nextHop
+	r.prefixes = prefixes
+	return nil
+}
+
+// Starts announcing routes, if a target is configured.
+func (r *routeExport) start() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.target == "" {
+		return nil
+	}
+	r.core.log.Println("Exporting routes to", r.target)
+	r.stop = make(chan struct{})
+	go r.announceLoop(r.stop)
+	return nil
+}
+
+// Stops announcing routes and withdraws them.
+func (r *routeExport) close() {
+	r.mutex.Lock()
+	if r.stop == nil {
+		r.mutex.Unlock()
+		return
+	}
+	close(r.stop)
+	r.stop = nil
+	r.mutex.Unlock()
+	if err := r.send("withdraw"); err != nil {
+		r.core.log.Println("Failed to withdraw routes:", err)
+	}
+}
+
+// Announces routes now and then again every routeExport_interval until stopped.
+// Failures are only logged when they start or stop happening, so a daemon that's down doesn't fill the log.
+func (r *routeExport) announceLoop(stop chan struct{}) {
+	ticker := time.NewTicker(routeExport_interval)
+	defer ticker.Stop()
+	var failing bool
+	for {
+		err := r.send("announce")
+		switch {
+		case err != nil && !failing:
+			r.core.log.Println("Failed to export routes:", err)
+		case err == nil && failing:
+			r.core.log.Println("Exporting routes again")
+		}
+		failing = err != nil
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Gets the prefixes to announce, starting with our /64.
+func (r *routeExport) getPrefixes() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{r.core.GetSubnet().String()}, r.prefixes...)
+}
+
+// Sends an announce or withdraw command for each prefix to the target.
+func (r *routeExport) send(action string) error {
+	var cmds []byte
+	r.mutex.Lock()
+	target, nextHop := r.target, r.nextHop
+	r.mutex.Unlock()
+	for _, prefix := range r.getPrefixes() {
+		cmds = append(cmds, fmt.Sprintf("%s route %s next-hop %s\n", action, prefix, nextHop)...)
+	}
+	result := make(chan error, 1)
+	go func() {
+		// Opening a named pipe blocks until there's a reader, so this is done in the background
+		w, err := r.open(target)
+		if err == nil {
+			_, err = w.Write(cmds)
+			w.Close()
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(routeExport_timeout):
+		return errors.New("timed out writing to " + target)
+	}
+}
+
+// Opens the target for writing, either as a unix:// or tcp:// socket, or otherwise as a named pipe or file.
+func (r *routeExport) open(target string) (io.WriteCloser, error) {
+	if u, err := url.Parse(target); err == nil {
+		switch u.Scheme {
+		case "unix":
+			return net.DialTimeout("unix", target[len("unix://"):], routeExport_timeout)
+		case "tcp":
+			return net.DialTimeout("tcp", u.Host, routeExport_timeout)
+		}
+	}
+	return os.OpenFile(target, os.O_WRONLY|os.O_APPEND, 0)
+}
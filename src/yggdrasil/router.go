@@ -23,6 +23,8 @@ package yggdrasil
 //  The router then runs some sanity checks before passing it to the tun
 
 import (
+	"bytes"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/icmp"
@@ -40,8 +42,29 @@ type router struct {
 	send  <-chan []byte // place where the tun puts outgoing packets
 	reset chan struct{} // signal that coords changed (re-init sessions/dht)
 	admin chan func()   // pass a lambda for the admin socket to query stuff
+	// Rate limits for inbound requests, so we can't be used as a traffic amplifier or kept busy by a single node
+	dhtLimit      *util_rateLimiter
+	nodeinfoLimit *util_rateLimiter
 }
 
+// Rate limits for inbound DHT lookup requests, per source node (with a burst) and across all nodes, in requests per second.
+const (
+	router_dhtRate       = 10
+	router_dhtBurst      = 40
+	router_dhtGlobalRate = 200
+)
+
+// Rate limits for inbound NodeInfo requests, per source node (with a burst) and across all nodes, in requests per second.
+// yggdrasilctl's ping is made of these requests, so it waits at least 1/router_nodeinfoRate between them.
+const (
+	router_nodeinfoRate       = 0.5
+	router_nodeinfoBurst      = 5
+	router_nodeinfoGlobalRate = 20
+)
+
+// The default number of packets that can wait in each direction between the router and the tun/tap.
+const router_tunQueueSize = 32
+
 // Initializes the router struct, which includes setting up channels to/from the tun/tap.
 func (r *router) init(core *Core) {
 	r.core = core
@@ -59,15 +82,64 @@ func (r *router) init(core *Core) {
 	}
 	r.in = in
 	r.out = func(packet []byte) { p.handlePacket(packet) } // The caller is responsible for go-ing if it needs to not block
-	recv := make(chan []byte, 32)
-	send := make(chan []byte, 32)
+	r.setTunQueues(router_tunQueueSize, router_tunQueueSize)
+	r.reset = make(chan struct{}, 1)
+	r.admin = make(chan func())
+	r.dhtLimit = util_newRateLimiter(router_dhtRate, router_dhtBurst, router_dhtGlobalRate)
+	r.nodeinfoLimit = util_newRateLimiter(router_nodeinfoRate, router_nodeinfoBurst, router_nodeinfoGlobalRate)
+	// go r.mainLoop()
+}
+
+// Sets up the channels to/from the tun/tap with room for the given numbers of packets, or the default if 0.
+// This must be called before the router and tun/tap are started.
+func (r *router) setTunQueues(sendQueue int, recvQueue int) {
+	if sendQueue <= 0 {
+		sendQueue = router_tunQueueSize
+	}
+	if recvQueue <= 0 {
+		recvQueue = router_tunQueueSize
+	}
+	recv := make(chan []byte, recvQueue)
+	send := make(chan []byte, sendQueue)
 	r.recv = recv
 	r.send = send
 	r.core.tun.recv = recv
 	r.core.tun.send = send
-	r.reset = make(chan struct{}, 1)
-	r.admin = make(chan func())
-	// go r.mainLoop()
+}
+
+// Queues a packet to be written to the tun/tap.
+// If the queue is full then this waits for room, which pushes back on the sender, unless the tun/tap drops packets when it's full.
+// This may be called from any goroutine.
+func (r *router) toTun(packet []byte) {
+	if extra := r.core.extraTun.lookup(packet); extra != nil {
+		router_queue(extra.recv, extra.recv, extra.tun.counters, packet, extra.tun.dropWhenFull)
+		return
+	}
+	router_queue(r.recv, r.core.tun.recv, r.core.tun.counters, packet, r.core.tun.dropWhenFull)
+}
+
+// Queues a packet for an adapter.
+// If drop is set then the oldest packets in the queue are dropped to make room if it's full, since they're the most likely to be stale, so that a stalled adapter can't block us.
+// Otherwise this waits for room.
+func router_queue(send chan<- []byte, recv <-chan []byte, counters *tunCounters, packet []byte, drop bool) {
+	if !drop {
+		send <- packet
+		return
+	}
+	for {
+		select {
+		case send <- packet:
+			return
+		default:
+		}
+		select {
+		case old := <-recv:
+			atomic.AddUint64(&counters.writeDropped, 1)
+			util_putBytes(old)
+		default:
+			// The tun/tap took a packet in the meantime, so try again
+		}
+	}
 }
 
 // Starts the mainLoop goroutine.
@@ -96,13 +168,20 @@ func (r *router) mainLoop() {
 		case <-r.reset:
 			r.core.sessions.resetInits()
 			r.core.dht.reset()
+			r.core.dht.loadCache() // Only does anything the first time we join a tree
 		case <-ticker.C:
 			{
 				// Any periodic maintenance stuff goes here
 				r.core.switchTable.doMaintenance()
 				r.core.dht.doMaintenance()
 				r.core.sessions.cleanup()
+				r.core.sessions.probeMTUs()
+				r.core.storeFwd.cleanup()
+				r.core.addrBook.doMaintenance()
+				r.core.mcastFwd.doMaintenance()
 				r.core.sigs.cleanup()
+				r.dhtLimit.cleanup()
+				r.nodeinfoLimit.cleanup()
 				util_getBytes() // To slowly drain things
 			}
 		case f := <-r.admin:
@@ -117,9 +196,24 @@ func (r *router) mainLoop() {
 // If the session hasn't responded recently, it triggers a ping or search to keep things alive or deal with broken coords *relatively* quickly.
 // It also deals with oversized packets if there are MTU issues by calling into icmpv6.go to spoof PacketTooBig traffic, or DestinationUnreachable if the other side has their tun/tap disabled.
 func (r *router) sendPacket(bs []byte) {
+	if len(bs) >= tun_IPv4_HEADER_LENGTH && bs[0]&0xf0 == 0x40 {
+		// IPv4, which is only sent to the node that crypto-key routing maps its destination to
+		key, dest, ok := r.core.ckr.getIPv4Destination(bs)
+		if !ok {
+			util_putBytes(bs)
+			return
+		}
+		r.sendToNode(bs, &dest, &subnet{}, &key)
+		return
+	}
 	if len(bs) < 40 {
 		panic("Tried to send a packet shorter than a header...")
 	}
+	if bs[24] == 0xff {
+		// Multicast, which is only forwarded to nodes that have joined the group
+		r.core.mcastFwd.sendPacket(bs, r.core.tun.forwardsMulticast())
+		return
+	}
 	var sourceAddr address
 	var sourceSubnet subnet
 	copy(sourceAddr[:], bs[8:])
@@ -127,6 +221,11 @@ func (r *router) sendPacket(bs []byte) {
 	if !sourceAddr.isValid() && !sourceSubnet.isValid() {
 		return
 	}
+	if service := r.core.anycast.getService(&sourceAddr); service != nil {
+		// Sent from an anycast service address, so it's sent by the Core answering for the service
+		service.tun.send <- bs
+		return
+	}
 	var dest address
 	copy(dest[:], bs[24:])
 	var snet subnet
@@ -134,6 +233,11 @@ func (r *router) sendPacket(bs []byte) {
 	if !dest.isValid() && !snet.isValid() {
 		return
 	}
+	r.sendToNode(bs, &dest, &snet, nil)
+}
+
+// Sends a packet in the session with the node that has the address or subnet, or with the key if it's given, searching for the node first if there's no session yet.
+func (r *router) sendToNode(bs []byte, dest *address, snet *subnet, key *boxPubKey) {
 	doSearch := func(packet []byte) {
 		var nodeID, mask *NodeID
 		if dest.isValid() {
@@ -142,6 +246,13 @@ func (r *router) sendPacket(bs []byte) {
 		if snet.isValid() {
 			nodeID, mask = snet.getNodeIDandMask()
 		}
+		if key != nil {
+			// Search for the whole NodeID, so that only the node with the key is found
+			nodeID, mask = getNodeID(key), &NodeID{}
+			for idx := range mask {
+				mask[idx] = 0xff
+			}
+		}
 		sinfo, isIn := r.core.searches.searches[*nodeID]
 		if !isIn {
 			sinfo = r.core.searches.newIterSearch(nodeID, mask)
@@ -153,15 +264,23 @@ func (r *router) sendPacket(bs []byte) {
 	}
 	var sinfo *sessionInfo
 	var isIn bool
-	if dest.isValid() {
-		sinfo, isIn = r.core.sessions.getByTheirAddr(&dest)
-	}
-	if snet.isValid() {
-		sinfo, isIn = r.core.sessions.getByTheirSubnet(&snet)
+	switch {
+	case key != nil:
+		sinfo, isIn = r.core.sessions.getByTheirPerm(key)
+	case dest.isValid():
+		sinfo, isIn = r.core.sessions.getByTheirAddr(dest)
+	case snet.isValid():
+		sinfo, isIn = r.core.sessions.getByTheirSubnet(snet)
 	}
 	switch {
 	case !isIn || !sinfo.init:
 		// No or unintiialized session, so we need to search first
+		if r.core.storeFwd.hold(bs, dest, snet) {
+			r.core.flowTrace.trace(bs, "router", "no session yet, stored until there is one")
+			doSearch(nil)
+			break
+		}
+		r.core.flowTrace.trace(bs, "router", "no session yet, held while searching")
 		doSearch(bs)
 	case time.Since(sinfo.time) > 6*time.Second:
 		if sinfo.time.Before(sinfo.pingTime) && time.Since(sinfo.pingTime) > 6*time.Second {
@@ -170,6 +289,13 @@ func (r *router) sendPacket(bs []byte) {
 			// They may have changed coords
 			// Try searching to discover new coords
 			// Note that search spam is throttled internally
+			// The old coords probably don't work any more, so hold the packet until the search finds the new ones
+			if r.core.storeFwd.hold(bs, dest, snet) {
+				r.core.flowTrace.trace(bs, "router", "no reply to pings for %s, stored while searching for new coords", time.Since(sinfo.time).Round(time.Millisecond))
+				doSearch(nil)
+				break
+			}
+			r.core.flowTrace.trace(bs, "router", "no reply to pings for %s, searching for new coords", time.Since(sinfo.time).Round(time.Millisecond))
 			doSearch(nil)
 		} else {
 			// We haven't heard about the dest in a while
@@ -183,12 +309,19 @@ func (r *router) sendPacket(bs []byte) {
 				sinfo.pingSend = now
 				r.core.sessions.sendPingPong(sinfo, false)
 			}
+			r.core.flowTrace.trace(bs, "router", "nothing heard for %s, pinging", time.Since(sinfo.time).Round(time.Millisecond))
 		}
 		fallthrough // Also send the packet
 	default:
 		// Drop packets if the session MTU is 0 - this means that one or other
 		// side probably has their TUN adapter disabled
 		if sinfo.getMTU() == 0 {
+			r.core.flowTrace.trace(bs, "router", "dropped, the session MTU is 0")
+			if bs[0]&0xf0 != 0x60 {
+				// Only IPv6 packets get an ICMPv6 error
+				util_putBytes(bs)
+				return
+			}
 			// Get the size of the oversized payload, up to a max of 900 bytes
 			window := 900
 			if len(bs) < window {
@@ -205,37 +338,27 @@ func (r *router) sendPacket(bs []byte) {
 				bs[8:24], bs[24:40],
 				ipv6.ICMPTypeDestinationUnreachable, 1, ptb)
 			if err == nil {
-				r.recv <- icmpv6Buf
+				r.toTun(icmpv6Buf)
 			}
 
 			// Don't continue - drop the packet
 			return
 		}
+		if bs[0]&0xf0 == 0x60 {
+			// Remember the MTU, so that later packets that are too big are answered as soon as they're read from the adapter
+			r.core.tun.pathMTU.update(bs[24:40], sinfo.getMTU())
+		}
 		// Generate an ICMPv6 Packet Too Big for packets larger than session MTU
 		if len(bs) > int(sinfo.getMTU()) {
-			// Get the size of the oversized payload, up to a max of 900 bytes
-			window := 900
-			if int(sinfo.getMTU()) < window {
-				window = int(sinfo.getMTU())
+			r.core.flowTrace.trace(bs, "router", "dropped, %d bytes is larger than the session MTU of %d", len(bs), sinfo.getMTU())
+			if bs[0]&0xf0 == 0x60 {
+				r.core.tun.sendPacketTooBig(bs, int(sinfo.getMTU()))
 			}
-
-			// Create the Packet Too Big response
-			ptb := &icmp.PacketTooBig{
-				MTU:  int(sinfo.getMTU()),
-				Data: bs[:window],
-			}
-
-			// Create the ICMPv6 response from it
-			icmpv6Buf, err := r.core.tun.icmpv6.create_icmpv6_tun(
-				bs[8:24], bs[24:40],
-				ipv6.ICMPTypePacketTooBig, 0, ptb)
-			if err == nil {
-				r.recv <- icmpv6Buf
-			}
-
 			// Don't continue - drop the packet
+			util_putBytes(bs)
 			return
 		}
+		r.core.flowTrace.trace(bs, "router", "passed to the session")
 		sinfo.send <- bs
 	}
 }
@@ -244,6 +367,14 @@ func (r *router) sendPacket(bs []byte) {
 // Checks that the IP address is correct (matches the session) and passes the packet to the tun/tap.
 func (r *router) recvPacket(bs []byte, theirAddr *address, theirSubnet *subnet) {
 	// Note: called directly by the session worker, not the router goroutine
+	if len(bs) >= tun_IPv4_HEADER_LENGTH && bs[0]&0xf0 == 0x40 {
+		if !r.core.ckr.checkIPv4Source(bs, theirAddr) {
+			util_putBytes(bs)
+			return
+		}
+		r.toTun(bs)
+		return
+	}
 	if len(bs) < 24 {
 		util_putBytes(bs)
 		return
@@ -256,11 +387,20 @@ func (r *router) recvPacket(bs []byte, theirAddr *address, theirSubnet *subnet)
 	case source.isValid() && source == *theirAddr:
 	case snet.isValid() && snet == *theirSubnet:
 	default:
+		r.core.flowTrace.trace(bs, "tun write", "dropped, the source address doesn't belong to the session")
 		util_putBytes(bs)
 		return
 	}
-	//go func() { r.recv<-bs }()
-	r.recv <- bs
+	if len(bs) >= tun_IPv6_HEADER_LENGTH && bs[24] == 0xff {
+		var group address
+		copy(group[:], bs[24:40])
+		if !r.core.mcastFwd.isJoined(&group) {
+			util_putBytes(bs)
+			return
+		}
+	}
+	r.core.flowTrace.trace(bs, "tun write", "%d bytes", len(bs))
+	r.toTun(bs)
 }
 
 // Checks incoming traffic type and passes it to the appropriate handler.
@@ -328,6 +468,14 @@ func (r *router) handleProto(packet []byte) {
 		r.handleDHTReq(bs, &p.FromKey)
 	case wire_DHTLookupResponse:
 		r.handleDHTRes(bs, &p.FromKey)
+	case wire_NodeInfoRequest, wire_NodeInfoResponse:
+		r.handleNodeInfo(bs, &p.FromKey)
+	case wire_BenchPacket:
+		r.handleBench(bs, &p.FromKey)
+	case wire_SessionProbe, wire_SessionProbeAck:
+		r.handleProbe(bs, &p.FromKey)
+	case wire_MulticastMembership:
+		r.handleMembership(bs, &p.FromKey)
 	default:
 		util_putBytes(packet)
 	}
@@ -340,6 +488,9 @@ func (r *router) handlePing(bs []byte, fromKey *boxPubKey) {
 		return
 	}
 	ping.SendPermPub = *fromKey
+	if r.isCollision(fromKey, ping.Coords) {
+		return
+	}
 	r.core.sessions.handlePing(&ping)
 }
 
@@ -355,6 +506,12 @@ func (r *router) handleDHTReq(bs []byte, fromKey *boxPubKey) {
 		return
 	}
 	req.Key = *fromKey
+	if r.isCollision(fromKey, req.Coords) {
+		return
+	}
+	if !r.dhtLimit.allow(fromKey) {
+		return
+	}
 	r.core.dht.handleReq(&req)
 }
 
@@ -365,9 +522,66 @@ func (r *router) handleDHTRes(bs []byte, fromKey *boxPubKey) {
 		return
 	}
 	res.Key = *fromKey
+	if r.isCollision(fromKey, res.Coords) {
+		return
+	}
 	r.core.dht.handleRes(&res)
 }
 
+// Decodes nodeinfo requests/responses and passes them to nodeinfo.handleNodeInfo.
+func (r *router) handleNodeInfo(bs []byte, fromKey *boxPubKey) {
+	req := nodeinfoReqRes{}
+	if !req.decode(bs) {
+		return
+	}
+	req.SendPermPub = *fromKey
+	if !req.IsResponse && !r.nodeinfoLimit.allow(fromKey) {
+		return
+	}
+	r.core.nodeinfo.handleNodeInfo(&req)
+}
+
+// Decodes bench packets and passes them to bench.handlePacket.
+func (r *router) handleBench(bs []byte, fromKey *boxPubKey) {
+	p := benchPacket{}
+	if !p.decode(bs) {
+		return
+	}
+	r.core.bench.handlePacket(&p, fromKey)
+}
+
+// Decodes session MTU probes and their answers, and passes them to the sessions.
+func (r *router) handleProbe(bs []byte, fromKey *boxPubKey) {
+	p := sessionProbe{}
+	if !p.decode(bs) {
+		return
+	}
+	r.core.sessions.handleProbe(&p, fromKey)
+}
+
+// Decodes multicast group memberships and passes them to mcastFwd.handleMembership.
+func (r *router) handleMembership(bs []byte, fromKey *boxPubKey) {
+	m := mcastMembership{}
+	if !m.decode(bs) {
+		return
+	}
+	r.core.mcastFwd.handleMembership(&m, fromKey)
+}
+
+// Checks if protocol traffic claims to be from our own key but from different coords, which means that another node is using the same keys as us.
+// If so, the collision is reported and true is returned, so that the traffic can be dropped.
+func (r *router) isCollision(fromKey *boxPubKey, coords []byte) bool {
+	if *fromKey != r.core.boxPub || r.core.collisions.isSharedKeys() {
+		return false
+	}
+	loc := r.core.switchTable.getLocator()
+	if bytes.Equal(coords, loc.getCoords()) {
+		return false
+	}
+	r.core.collisions.report("address", coords, "")
+	return true
+}
+
 // Passed a function to call.
 // This will send the function to r.admin and block until it finishes.
 // It's used by the admin socket to ask the router mainLoop goroutine about information in the session or dht structs, which cannot be read safely from outside that goroutine.
@@ -0,0 +1,367 @@
+package yggdrasil
+
+// This sends IPv6 router advertisements on a LAN interface, so that hosts on
+// the LAN give themselves addresses in our routed /64 with SLAAC, and learn
+// that the rest of the Yggdrasil address range is reachable through this node.
+// The /64 is announced with a prefix information option, and 200::/7 with a
+// route information option (RFC 4191), so hosts don't need any special setup.
+// We don't advertise ourself as a default router unless asked to, so that
+// hosts keep using their normal router for everything else.
+// This node must still forward packets between the LAN and the TUN/TAP, and
+// the LAN interface should have an address in the /64, which is left to the
+// operating system to configure. In TAP mode, the advertisements can be sent
+// into the TAP adapter instead, which reaches the LAN when the adapter is
+// bridged to it, and solicitations read from the adapter are answered. The
+// advertisements can also carry DNS servers and search domains (RFC 8106).
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+
+	"yggdrasil/config"
+)
+
+// The default time between unsolicited router advertisements.
+const routerAdv_defaultInterval = 200 * time.Second
+
+// We send solicited router advertisements at most this often (RFC 4861 MIN_DELAY_BETWEEN_RAS).
+const routerAdv_minDelay = 3 * time.Second
+
+// The default lifetimes that are advertised, as multiples of the advertisement interval.
+// These are long enough that a few lost advertisements don't cause hosts to drop the prefix.
+// The DNS options use the router lifetime, which RFC 8106 recommends.
+const (
+	routerAdv_validLifetimes     = 10
+	routerAdv_preferredLifetimes = 5
+	routerAdv_routerLifetimes    = 3
+)
+
+// Router advertisement option types.
+const (
+	routerAdv_optSourceLinkAddr = 1
+	routerAdv_optPrefixInfo     = 3
+	routerAdv_optRouteInfo      = 24
+	routerAdv_optRDNSS          = 25
+	routerAdv_optDNSSL          = 31
+)
+
+type routerAdv struct {
+	core          *Core
+	mutex         sync.Mutex
+	ifname        string        // Interface to advertise on, or empty if disabled
+	tap           bool          // Whether to advertise into the TAP adapter instead of on an interface
+	interval      time.Duration // Time between unsolicited advertisements
+	defaultRouter bool          // Whether to advertise ourself as a default router
+	valid         time.Duration // Lifetimes of the prefix and routes, or zero for the defaults
+	preferred     time.Duration
+	routerLife    time.Duration
+	dnsServers    []net.IP
+	dnsSearch     []string
+	sock          *ipv6.PacketConn
+	iface         *net.Interface
+	lastSent      time.Time
+	stop          chan struct{}
+}
+
+// Initializes the routerAdv struct.
+func (ra *routerAdv) init(core *Core) {
+	ra.core = core
+	ra.interval = routerAdv_defaultInterval
+}
+
+// Sets the interface to advertise on, or the TAP adapter, and what is advertised.
+// An empty interface name disables router advertisements unless TAP is set, and an interval or lifetime of zero or less uses the default.
+func (ra *routerAdv) setConfig(cfg config.RouterAdvertisementConfig) error {
+	var servers []net.IP
+	for _, s := range cfg.DNSServers {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() != nil {
+			return errors.New("invalid IPv6 DNS server: " + s)
+		}
+		servers = append(servers, ip)
+	}
+	for _, domain := range cfg.DNSSearchList {
+		if _, err := routerAdv_encodeDomain(domain); err != nil {
+			return err
+		}
+	}
+	if cfg.ValidLifetime > 0 && cfg.PreferredLifetime > cfg.ValidLifetime {
+		return errors.New("the preferred lifetime can't be longer than the valid lifetime")
+	}
+	if cfg.RouterLifetime > 9000 {
+		// The router lifetime is limited to 9000 seconds by RFC 4861
+		return errors.New("the router lifetime can't be longer than 9000 seconds")
+	}
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	ra.ifname = cfg.Interface
+	ra.tap = cfg.TAP
+	if cfg.Interval > 0 {
+		ra.interval = time.Duration(cfg.Interval) * time.Second
+	}
+	ra.defaultRouter = cfg.DefaultRouter
+	ra.valid = time.Duration(cfg.ValidLifetime) * time.Second
+	ra.preferred = time.Duration(cfg.PreferredLifetime) * time.Second
+	ra.routerLife = time.Duration(cfg.RouterLifetime) * time.Second
+	ra.dnsServers = servers
+	ra.dnsSearch = cfg.DNSSearchList
+	return nil
+}
+
+// Starts sending router advertisements, if an interface or the TAP adapter is configured.
+// This needs permission to open a raw ICMPv6 socket, unless advertising into the TAP adapter.
+// This must be called after the TUN/TAP adapter is started.
+func (ra *routerAdv) start() error {
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	if ra.tap {
+		if !ra.core.tun.getState().isTAP() {
+			return errors.New("router advertisements into the TAP adapter need it to be in TAP mode")
+		}
+		ra.stop = make(chan struct{})
+		ra.core.log.Println("Advertising", ra.core.GetSubnet().String(), "into the TAP adapter")
+		go ra.announce(ra.stop)
+		return nil
+	}
+	if ra.ifname == "" {
+		return nil
+	}
+	iface, err := net.InterfaceByName(ra.ifname)
+	if err != nil {
+		return err
+	}
+	if iface.Flags&net.FlagMulticast == 0 {
+		return errors.New("interface " + ra.ifname + " doesn't support multicast")
+	}
+	conn, err := net.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return err
+	}
+	sock := ipv6.NewPacketConn(conn)
+	if err := sock.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		// Not all platforms support this, in which case we answer solicitations from all interfaces
+	}
+	allRouters := &net.IPAddr{IP: net.ParseIP("ff02::2")}
+	if err := sock.JoinGroup(iface, allRouters); err != nil {
+		conn.Close()
+		return err
+	}
+	sock.SetMulticastInterface(iface)
+	sock.SetMulticastHopLimit(255)
+	sock.SetMulticastLoopback(false)
+	ra.sock = sock
+	ra.iface = iface
+	ra.stop = make(chan struct{})
+	ra.core.log.Println("Advertising", ra.core.GetSubnet().String(), "on", ra.ifname)
+	go ra.listen(sock)
+	go ra.announce(ra.stop)
+	return nil
+}
+
+// Stops sending router advertisements, and tells hosts to stop using the prefix and routes straight away.
+func (ra *routerAdv) close() {
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	if ra.stop == nil {
+		return
+	}
+	close(ra.stop)
+	ra.stop = nil
+	ra.sendAdvert(true)
+	if ra.sock != nil {
+		ra.sock.Close()
+		ra.sock = nil
+	}
+}
+
+// Sends unsolicited router advertisements until stopped.
+// The time between them is randomised a little, as recommended by RFC 4861, so routers on the same LAN don't synchronise.
+func (ra *routerAdv) announce(stop chan struct{}) {
+	for {
+		ra.mutex.Lock()
+		ra.sendAdvert(false)
+		interval := ra.interval
+		ra.mutex.Unlock()
+		jitter := time.Duration(rand.Int63n(int64(interval / 4)))
+		select {
+		case <-time.After(interval - jitter):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Listens for router solicitations on the interface and answers them, so that new hosts don't have to wait for the next unsolicited advertisement.
+func (ra *routerAdv) listen(sock *ipv6.PacketConn) {
+	bs := make([]byte, 1280)
+	for {
+		n, cm, _, err := sock.ReadFrom(bs)
+		if err != nil {
+			return // Closed
+		}
+		if n == 0 || ipv6.ICMPType(bs[0]) != ipv6.ICMPTypeRouterSolicitation {
+			continue
+		}
+		if cm == nil || ra.iface == nil || cm.IfIndex == ra.iface.Index {
+			ra.solicited(false)
+		}
+	}
+}
+
+// Answers a router solicitation received on the interface, or read from the TAP adapter if fromTAP is set, unless we've only just sent an advertisement.
+// This may be called from any goroutine.
+func (ra *routerAdv) solicited(fromTAP bool) {
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	if ra.stop != nil && ra.tap == fromTAP && time.Since(ra.lastSent) >= routerAdv_minDelay {
+		ra.sendAdvert(false)
+	}
+}
+
+// Sends a router advertisement to all nodes on the interface, or into the TAP adapter.
+// If final is set then all lifetimes are zero, so hosts stop using the prefix and routes.
+// Must be called with the mutex held.
+func (ra *routerAdv) sendAdvert(final bool) {
+	if ra.sock == nil && !ra.tap {
+		return
+	}
+	ra.lastSent = time.Now()
+	packet, err := ra.getAdvert(final)
+	if err != nil {
+		ra.core.log.Println("Failed to create router advertisement:", err)
+		return
+	}
+	if ra.tap {
+		// The kernel doesn't fill in the checksum here, so the whole packet is built, and the TAP writer adds the ethernet header for ff02::1
+		allNodes := net.ParseIP("ff02::1")
+		msg, err := ra.core.tun.icmpv6.create_icmpv6_tun(allNodes, ra.core.tun.icmpv6.mylladdr, ipv6.ICMPTypeRouterAdvertisement, 0,
+			&icmp.DefaultMessageBody{Data: packet[4:]})
+		if err != nil {
+			ra.core.log.Println("Failed to create router advertisement:", err)
+			return
+		}
+		ra.core.router.toTun(append(util_getBytes(), msg...))
+		return
+	}
+	cm := &ipv6.ControlMessage{HopLimit: 255, IfIndex: ra.iface.Index}
+	allNodes := &net.IPAddr{IP: net.ParseIP("ff02::1"), Zone: ra.iface.Name}
+	if _, err := ra.sock.WriteTo(packet, cm, allNodes); err != nil {
+		ra.core.log.Println("Failed to send router advertisement on", ra.iface.Name+":", err)
+	}
+}
+
+// Builds a router advertisement with the prefix, route, DNS and link-layer address options.
+// The checksum is left for the kernel to fill in, which it does for raw ICMPv6 sockets.
+// Must be called with the mutex held.
+func (ra *routerAdv) getAdvert(final bool) ([]byte, error) {
+	seconds := func(lifetime time.Duration, n int) uint32 {
+		if final {
+			return 0
+		}
+		if lifetime <= 0 {
+			lifetime = time.Duration(n) * ra.interval
+		}
+		return uint32(lifetime.Seconds())
+	}
+	// The router lifetime is limited to 9000 seconds by RFC 4861
+	dnsLifetime := seconds(ra.routerLife, routerAdv_routerLifetimes)
+	if dnsLifetime > 9000 {
+		dnsLifetime = 9000
+	}
+	var routerLifetime uint16
+	if ra.defaultRouter {
+		routerLifetime = uint16(dnsLifetime)
+	}
+	// Current hop limit, flags, router lifetime, reachable time and retransmit timer
+	body := make([]byte, 12)
+	body[0] = 64
+	binary.BigEndian.PutUint16(body[2:4], routerLifetime)
+	// Prefix information for our /64, with the on-link and autonomous flags set
+	prefix := make([]byte, 32)
+	prefix[0] = routerAdv_optPrefixInfo
+	prefix[1] = 4
+	prefix[2] = 64
+	prefix[3] = 0xc0
+	valid := seconds(ra.valid, routerAdv_validLifetimes)
+	preferred := seconds(ra.preferred, routerAdv_preferredLifetimes)
+	if preferred > valid {
+		preferred = valid
+	}
+	binary.BigEndian.PutUint32(prefix[4:8], valid)
+	binary.BigEndian.PutUint32(prefix[8:12], preferred)
+	copy(prefix[16:], ra.core.GetSubnet().IP.To16())
+	body = append(body, prefix...)
+	// Route information for the whole address range, with medium preference
+	route := make([]byte, 16)
+	route[0] = routerAdv_optRouteInfo
+	route[1] = 2
+	route[2] = byte(8*len(address_prefix) - 1)
+	binary.BigEndian.PutUint32(route[4:8], valid)
+	copy(route[8:], address_prefix[:])
+	body = append(body, route...)
+	// Recursive DNS servers
+	if len(ra.dnsServers) > 0 {
+		rdnss := make([]byte, 8, 8+16*len(ra.dnsServers))
+		rdnss[0] = routerAdv_optRDNSS
+		rdnss[1] = byte(1 + 2*len(ra.dnsServers))
+		binary.BigEndian.PutUint32(rdnss[4:8], dnsLifetime)
+		for _, server := range ra.dnsServers {
+			rdnss = append(rdnss, server.To16()...)
+		}
+		body = append(body, rdnss...)
+	}
+	// DNS search list, padded to a multiple of 8 bytes
+	if len(ra.dnsSearch) > 0 {
+		dnssl := make([]byte, 8)
+		dnssl[0] = routerAdv_optDNSSL
+		binary.BigEndian.PutUint32(dnssl[4:8], dnsLifetime)
+		for _, domain := range ra.dnsSearch {
+			encoded, err := routerAdv_encodeDomain(domain)
+			if err != nil {
+				return nil, err
+			}
+			dnssl = append(dnssl, encoded...)
+		}
+		for len(dnssl)%8 != 0 {
+			dnssl = append(dnssl, 0)
+		}
+		dnssl[1] = byte(len(dnssl) / 8)
+		body = append(body, dnssl...)
+	}
+	// Our link-layer address, if the interface has an ethernet-like one
+	switch {
+	case ra.tap:
+		body = append(body, routerAdv_optSourceLinkAddr, 1)
+		body = append(body, ra.core.tun.icmpv6.mymac[:]...)
+	case len(ra.iface.HardwareAddr) == 6:
+		body = append(body, routerAdv_optSourceLinkAddr, 1)
+		body = append(body, ra.iface.HardwareAddr...)
+	}
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeRouterAdvertisement,
+		Code: 0,
+		Body: &icmp.DefaultMessageBody{Data: body},
+	}
+	return msg.Marshal(nil)
+}
+
+// Encodes a domain name as DNS labels, for the search list option.
+func routerAdv_encodeDomain(domain string) ([]byte, error) {
+	var encoded []byte
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.New("invalid DNS search domain: " + domain)
+		}
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0), nil
+}
@@ -16,49 +16,102 @@ import (
 	"time"
 )
 
-// This defines the maximum number of dhtInfo that we keep track of for nodes to query in an ongoing search.
+// This defines the default maximum number of dhtInfo that we keep track of for nodes to query in an ongoing search.
 const search_MAX_SEARCH_SIZE = 16
 
-// This defines the time after which we send a new search packet.
+// This defines the default number of nodes that are queried in parallel when a search is started or retried.
+const search_PARALLELISM = 1
+
+// This defines the default time after which an unfinished search is abandoned.
+const search_TIMEOUT = time.Minute
+
+// This defines the default time after which we send a new search packet.
 // Search packets are sent automatically immediately after a response is received.
 // So this allows for timeouts and for long searches to become increasingly parallel.
 const search_RETRY_TIME = time.Second
 
+// This defines the default factor by which the time between retries grows after each retry.
+const search_RETRY_BACKOFF = 1.0
+
 // Information about an ongoing search.
 // Includes the targed NodeID, the bitmask to match it to an IP, and the list of nodes to visit / already visited.
 type searchInfo struct {
-	dest    NodeID
-	mask    NodeID
-	time    time.Time
-	packet  []byte
-	toVisit []*dhtInfo
-	visited map[NodeID]bool
+	dest     NodeID
+	mask     NodeID
+	time     time.Time
+	started  time.Time     // Time the search was created, for the search duration stats
+	interval time.Duration // Time to wait before the next retry
+	tries    int           // Number of times continueSearch has sent search packets
+	packet   []byte
+	toVisit  []*dhtInfo
+	visited  map[NodeID]bool
 }
 
 // This stores a map of active searches.
 type searches struct {
-	core     *Core
-	searches map[NodeID]*searchInfo
+	core        *Core
+	searches    map[NodeID]*searchInfo
+	size        int           // Maximum number of nodes to track in each search
+	parallelism int           // Number of nodes to query when starting or retrying a search
+	timeout     time.Duration // Time after which a search is abandoned
+	retryTime   time.Duration // Initial time between retries
+	retries     int           // Maximum number of retries, or 0 to retry until timeout
+	backoff     float64       // Factor by which the time between retries grows
 }
 
 // Intializes the searches struct.
 func (s *searches) init(core *Core) {
 	s.core = core
 	s.searches = make(map[NodeID]*searchInfo)
+	s.size = search_MAX_SEARCH_SIZE
+	s.parallelism = search_PARALLELISM
+	s.timeout = search_TIMEOUT
+	s.retryTime = search_RETRY_TIME
+	s.backoff = search_RETRY_BACKOFF
+}
+
+// Sets the maximum search size, the search parallelism and the search timeout.
+// Values that are zero or less leave the current setting unchanged.
+func (s *searches) setParameters(size int, parallelism int, timeout time.Duration) {
+	if size > 0 {
+		s.size = size
+	}
+	if parallelism > 0 {
+		s.parallelism = parallelism
+	}
+	if timeout > 0 {
+		s.timeout = timeout
+	}
+}
+
+// Sets the initial time between retries, the maximum number of retries and the backoff factor by which the time between retries grows.
+// A retryTime or retries of zero or less, or a backoff less than 1, leaves the current setting unchanged.
+func (s *searches) setRetries(retryTime time.Duration, retries int, backoff float64) {
+	if retryTime > 0 {
+		s.retryTime = retryTime
+	}
+	if retries > 0 {
+		s.retries = retries
+	}
+	if backoff >= 1 {
+		s.backoff = backoff
+	}
 }
 
 // Creates a new search info, adds it to the searches struct, and returns a pointer to the info.
 func (s *searches) createSearch(dest *NodeID, mask *NodeID) *searchInfo {
 	now := time.Now()
 	for dest, sinfo := range s.searches {
-		if now.Sub(sinfo.time) > time.Minute {
+		if now.Sub(sinfo.time) > s.timeout {
 			delete(s.searches, dest)
 		}
 	}
 	info := searchInfo{
-		dest: *dest,
-		mask: *mask,
-		time: now.Add(-time.Second),
+		dest:     *dest,
+		mask:     *mask,
+		time:     now.Add(-s.retryTime),
+		started:  now,
+		interval: s.retryTime,
 	}
 	s.searches[*dest] = &info
 	return &info
@@ -110,8 +163,8 @@ func (s *searches) addToSearch(sinfo *searchInfo, res *dhtRes) {
 		return dht_firstCloserThanThird(sinfo.toVisit[i].getNodeID(), &res.Dest, sinfo.toVisit[j].getNodeID())
 	})
 	// Truncate to some maximum size
-	if len(sinfo.toVisit) > search_MAX_SEARCH_SIZE {
-		sinfo.toVisit = sinfo.toVisit[:search_MAX_SEARCH_SIZE]
+	if len(sinfo.toVisit) > s.size {
+		sinfo.toVisit = sinfo.toVisit[:s.size]
 	}
 }
 
@@ -135,13 +188,28 @@ func (s *searches) doSearchStep(sinfo *searchInfo) {
 }
 
 // If we've recenty sent a ping for this search, do nothing.
-// Otherwise, doSearchStep and schedule another continueSearch to happen after search_RETRY_TIME.
+// If we've run out of retries, the search is abandoned, and a new one will be started if there's more traffic for the destination.
+// Otherwise, doSearchStep (once for each of the configured number of parallel queries) and schedule another continueSearch to happen after the retry interval, which grows by the backoff factor after each retry.
 func (s *searches) continueSearch(sinfo *searchInfo) {
-	if time.Since(sinfo.time) < search_RETRY_TIME {
+	if time.Since(sinfo.time) < sinfo.interval {
+		return
+	}
+	if s.retries > 0 && sinfo.tries > s.retries {
+		delete(s.searches, sinfo.dest)
 		return
 	}
+	if sinfo.tries > 0 {
+		sinfo.interval = time.Duration(float64(sinfo.interval) * s.backoff)
+		if sinfo.interval > s.timeout {
+			sinfo.interval = s.timeout
+		}
+	}
+	sinfo.tries++
 	sinfo.time = time.Now()
 	s.doSearchStep(sinfo)
+	for idx := 1; idx < s.parallelism && len(sinfo.toVisit) > 0; idx++ {
+		s.doSearchStep(sinfo)
+	}
 	// In case the search dies, try to spawn another thread later
 	// Note that this will spawn multiple parallel searches as time passes
 	// Any that die aren't restarted, but a new one will start later
@@ -152,8 +220,9 @@ func (s *searches) continueSearch(sinfo *searchInfo) {
 		}
 		s.continueSearch(sinfo)
 	}
+	delay := sinfo.interval
 	go func() {
-		time.Sleep(search_RETRY_TIME)
+		time.Sleep(delay)
 		s.core.router.admin <- retryLater
 	}()
 }
@@ -181,6 +250,7 @@ func (s *searches) checkDHTRes(info *searchInfo, res *dhtRes) bool {
 		return false
 	}
 	// They match, so create a session and send a sessionRequest
+	s.core.statsExport.search.observe(time.Since(info.started))
 	sinfo, isIn := s.core.sessions.getByTheirPerm(&res.Key)
 	if !isIn {
 		sinfo = s.core.sessions.createSession(&res.Key)
@@ -197,6 +267,10 @@ func (s *searches) checkDHTRes(info *searchInfo, res *dhtRes) bool {
 	sinfo.coords = res.Coords
 	sinfo.packet = info.packet
 	s.core.sessions.ping(sinfo)
+	if sinfo.init {
+		// An existing session was searched for because its coords changed, so packets held for it can go to the new ones now
+		s.core.storeFwd.flush(sinfo)
+	}
 	// Cleanup
 	delete(s.searches, res.Dest)
 	return true
@@ -6,10 +6,28 @@ package yggdrasil
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"math/rand"
+	"net"
+	"sync/atomic"
 	"time"
 )
 
+// When traffic padding is in use, packets are padded up to the next power of
+// two that is at least this size, or to the session MTU if that is smaller.
+const session_paddingMinSize = 128
+
+// When traffic padding is in use, dummy packets are sent at random intervals
+// while real traffic has been sent or received within this time.
+const session_paddingActiveTime = 30 * time.Second
+
+// By default, sessions that nothing has been received in for this long are
+// closed, and timed out sessions are looked for this often.
+const session_defaultTimeout = time.Minute
+const session_defaultCleanupInterval = time.Minute
+
 // All the information we know about an active session.
 // This includes coords, permanent and ephemeral keys, handles and nonces, various sorts of timing information for timeout and maintenance, and some metadata for the admin API.
 type sessionInfo struct {
@@ -41,6 +59,27 @@ type sessionInfo struct {
 	pingSend     time.Time // time the last ping was sent
 	bytesSent    uint64    // Bytes of real traffic sent in this session
 	bytesRecvd   uint64    // Bytes of real traffic received in this session
+	ceSent       uint64    // Packets sent in this session that were marked Congestion Experienced
+	ceRecvd      uint64    // Packets received in this session that were marked Congestion Experienced
+	myPadding    bool      // Whether we offered traffic padding in our pings
+	theirPadding bool      // Whether they offered traffic padding in their pings
+	realTime     time.Time // time real traffic was last sent or received
+	pathMTU      uint16    // Largest packet found to get through by probing, or 0 if there's no limit beyond the MTUs
+	linkMTU      uint32    // MTU of the peer that the session's traffic leaves through, or 0 if it isn't capped. Atomic, as the router sets it while the worker reads it
+	mtuProbe     mtuProbe  // State of the search for the path MTU
+	// Whether we and they asked for packets to be delivered as they arrive, without being kept in order on the way
+	myUnordered    bool
+	theirUnordered bool
+	// Congestion control, see congestion.go
+	congestion     CongestionControl // The controller for what we send, or nil if disabled
+	myFeedback     bool              // Whether we asked for congestion feedback in our pings
+	theirFeedback  bool              // Whether they asked for congestion feedback in their pings
+	held           [][]byte          // Packets waiting for the controller to allow them to be sent
+	heldDropped    uint64            // Packets dropped because too many were waiting
+	sentLog        []congestion_sent // Recently sent packets, for matching feedback to
+	sentLogPos     int
+	theirNonceTime time.Time // When the newest packet that feedback hasn't been sent for arrived
+	unacked        int       // Packets received since feedback was last sent
 }
 
 // Represents a session ping/pong packet, andincludes information like public keys, a session handle, coords, a timestamp to prevent replays, and the tun/tap MTU.
@@ -52,6 +91,9 @@ type sessionPing struct {
 	Tstamp      int64 // unix time, but the only real requirement is that it increases
 	IsPong      bool
 	MTU         uint16
+	Padding     bool // Whether the sender is willing to use traffic padding
+	Unordered   bool // Whether the sender wants packets delivered as they arrive, rather than kept in order
+	Feedback    bool // Whether the sender wants congestion feedback for the traffic it sends
 }
 
 // Updates session info in response to a ping, after checking that the ping is OK.
@@ -76,9 +118,15 @@ func (s *sessionInfo) update(p *sessionPing) bool {
 	if p.MTU >= 1280 || p.MTU == 0 {
 		s.theirMTU = p.MTU
 	}
+	s.theirPadding = p.Padding
+	s.theirUnordered = p.Unordered
+	s.theirFeedback = p.Feedback
 	if !bytes.Equal(s.coords, p.Coords) {
 		// allocate enough space for additional coords
 		s.coords = append(make([]byte, 0, len(p.Coords)+11), p.Coords...)
+		// The path may have changed, so search for the path MTU again
+		s.mtuProbe.size = 0
+		s.mtuProbe.next = time.Time{}
 	}
 	now := time.Now()
 	s.time = now
@@ -89,15 +137,17 @@ func (s *sessionInfo) update(p *sessionPing) bool {
 
 // Returns true if the session has been idle for longer than the allowed timeout.
 func (s *sessionInfo) timedout() bool {
-	return time.Since(s.time) > time.Minute
+	return time.Since(s.time) > s.core.sessions.timeout
 }
 
 // Struct of all active sessions.
 // Sessions are indexed by handle.
 // Additionally, stores maps of address/subnet onto keys, and keys onto handles.
 type sessions struct {
-	core        *Core
-	lastCleanup time.Time
+	core            *Core
+	lastCleanup     time.Time
+	timeout         time.Duration // How long a session lasts without receiving anything
+	cleanupInterval time.Duration // How often timed out sessions are closed
 	// Maps known permanent keys to their shared key, used by DHT a lot
 	permShared map[boxPubKey]*boxSharedKey
 	// Maps (secret) handle onto session info
@@ -113,8 +163,18 @@ type sessions struct {
 	sessionFirewallAllowsDirect         bool
 	sessionFirewallAllowsRemote         bool
 	sessionFirewallAlwaysAllowsOutbound bool
+	sessionFirewallDeniesInbound        bool
 	sessionFirewallWhitelist            []string
 	sessionFirewallBlacklist            []string
+	sessionFirewallWhitelistPrefixes    []*net.IPNet
+	sessionFirewallBlacklistPrefixes    []*net.IPNet
+	// Whether to offer traffic padding to new sessions
+	sessionPadding bool
+	// Nodes that sessions ask for out-of-order delivery with
+	unordered map[boxPubKey]struct{}
+	// Congestion controllers that sessions can use, and the one that new sessions use
+	congestionControls map[string]func() CongestionControl
+	congestionControl  string
 }
 
 // Initializes the session struct.
@@ -126,7 +186,28 @@ func (ss *sessions) init(core *Core) {
 	ss.byTheirPerm = make(map[boxPubKey]*handle)
 	ss.addrToPerm = make(map[address]*boxPubKey)
 	ss.subnetToPerm = make(map[subnet]*boxPubKey)
+	ss.unordered = make(map[boxPubKey]struct{})
+	ss.congestionControls = make(map[string]func() CongestionControl)
+	for name, newControl := range congestion_builtin {
+		ss.congestionControls[name] = newControl
+	}
+	ss.congestionControl = congestion_default
 	ss.lastCleanup = time.Now()
+	ss.timeout = session_defaultTimeout
+	ss.cleanupInterval = session_defaultCleanupInterval
+}
+
+// Sets how long sessions last without receiving anything, and how often timed
+// out sessions are closed. Zero uses the default.
+func (ss *sessions) setCleanup(timeout time.Duration, interval time.Duration) {
+	if timeout <= 0 {
+		timeout = session_defaultTimeout
+	}
+	if interval <= 0 {
+		interval = session_defaultCleanupInterval
+	}
+	ss.timeout = timeout
+	ss.cleanupInterval = interval
 }
 
 // Enable or disable the session firewall
@@ -135,11 +216,13 @@ func (ss *sessions) setSessionFirewallState(enabled bool) {
 }
 
 // Set the session firewall defaults (first parameter is whether to allow
-// sessions from direct peers, second is whether to allow from remote nodes).
-func (ss *sessions) setSessionFirewallDefaults(allowsDirect bool, allowsRemote bool, alwaysAllowsOutbound bool) {
+// sessions from direct peers, second is whether to allow from remote nodes,
+// last is whether to reject all inbound sessions that aren't whitelisted).
+func (ss *sessions) setSessionFirewallDefaults(allowsDirect bool, allowsRemote bool, alwaysAllowsOutbound bool, deniesInbound bool) {
 	ss.sessionFirewallAllowsDirect = allowsDirect
 	ss.sessionFirewallAllowsRemote = allowsRemote
 	ss.sessionFirewallAlwaysAllowsOutbound = alwaysAllowsOutbound
+	ss.sessionFirewallDeniesInbound = deniesInbound
 }
 
 // Set the session firewall whitelist - nodes always allowed to open sessions.
@@ -152,6 +235,81 @@ func (ss *sessions) setSessionFirewallBlacklist(blacklist []string) {
 	ss.sessionFirewallBlacklist = blacklist
 }
 
+// Set the session firewall whitelist prefixes - address or subnet prefixes of
+// nodes always allowed to open sessions.
+func (ss *sessions) setSessionFirewallWhitelistPrefixes(whitelist []string) error {
+	prefixes, err := session_parsePrefixes(whitelist)
+	if err != nil {
+		return err
+	}
+	ss.sessionFirewallWhitelistPrefixes = prefixes
+	return nil
+}
+
+// Set the session firewall blacklist prefixes - address or subnet prefixes of
+// nodes never allowed to open sessions. If any of them are invalid then the
+// existing blacklist is left unchanged, rather than letting those nodes in.
+func (ss *sessions) setSessionFirewallBlacklistPrefixes(blacklist []string) error {
+	prefixes, err := session_parsePrefixes(blacklist)
+	if err != nil {
+		return err
+	}
+	ss.sessionFirewallBlacklistPrefixes = prefixes
+	return nil
+}
+
+// Parses prefixes in CIDR notation.
+func session_parsePrefixes(prefixes []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range prefixes {
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, errors.New("invalid prefix: " + p)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// Enable or disable offering traffic padding to new sessions.
+func (ss *sessions) setSessionPadding(enabled bool) {
+	ss.sessionPadding = enabled
+}
+
+// Sets whether sessions with the given node ask for packets to be delivered as
+// they arrive, rather than kept in order on the way. An existing session pings
+// the node straight away, so that the change takes effect without waiting.
+func (ss *sessions) setUnordered(key *boxPubKey, unordered bool) {
+	if unordered {
+		ss.unordered[*key] = struct{}{}
+	} else {
+		delete(ss.unordered, *key)
+	}
+	if sinfo, isIn := ss.getByTheirPerm(key); isIn && sinfo.myUnordered != unordered {
+		sinfo.myUnordered = unordered
+		ss.sendPingPong(sinfo, false)
+	}
+}
+
+// Returns true if either the address or the subnet belonging to the given
+// publickey falls within one of the given prefixes.
+func (ss *sessions) isInPrefixes(pubkey *boxPubKey, prefixes []*net.IPNet) bool {
+	if len(prefixes) == 0 {
+		return false
+	}
+	nodeID := getNodeID(pubkey)
+	addr := *address_addrForNodeID(nodeID)
+	snet := *address_subnetForNodeID(nodeID)
+	var snetIP address
+	copy(snetIP[:], snet[:])
+	for _, ipnet := range prefixes {
+		if ipnet.Contains(net.IP(addr[:])) || ipnet.Contains(net.IP(snetIP[:])) {
+			return true
+		}
+	}
+	return false
+}
+
 // Determines whether the session with a given publickey is allowed based on
 // session firewall rules.
 func (ss *sessions) isSessionAllowed(pubkey *boxPubKey, initiator bool) bool {
@@ -171,6 +329,10 @@ func (ss *sessions) isSessionAllowed(pubkey *boxPubKey, initiator bool) bool {
 			}
 		}
 	}
+	// Reject nodes with blacklisted addresses or subnets
+	if ss.isInPrefixes(pubkey, ss.sessionFirewallBlacklistPrefixes) {
+		return false
+	}
 	// Allow whitelisted nodes
 	for _, b := range ss.sessionFirewallWhitelist {
 		key, err := hex.DecodeString(b)
@@ -181,12 +343,20 @@ func (ss *sessions) isSessionAllowed(pubkey *boxPubKey, initiator bool) bool {
 			}
 		}
 	}
+	// Allow nodes with whitelisted addresses or subnets
+	if ss.isInPrefixes(pubkey, ss.sessionFirewallWhitelistPrefixes) {
+		return true
+	}
 	// Allow outbound sessions if appropriate
-	if ss.sessionFirewallAlwaysAllowsOutbound {
+	if ss.sessionFirewallAlwaysAllowsOutbound || ss.sessionFirewallDeniesInbound {
 		if initiator {
 			return true
 		}
 	}
+	// Reject any remaining inbound sessions if we're in outbound-only mode
+	if ss.sessionFirewallDeniesInbound {
+		return false
+	}
 	// Look and see if the pubkey is that of a direct peer
 	var isDirectPeer bool
 	for _, peer := range ss.core.peers.ports.Load().(map[switchPort]*peer) {
@@ -273,7 +443,13 @@ func (ss *sessions) createSession(theirPermKey *boxPubKey) *sessionInfo {
 	sinfo.mySesPriv = *priv
 	sinfo.myNonce = *newBoxNonce()
 	sinfo.theirMTU = 1280
-	sinfo.myMTU = uint16(ss.core.tun.mtu)
+	sinfo.myMTU = uint16(ss.core.tun.getState().mtu)
+	sinfo.myPadding = ss.sessionPadding
+	_, sinfo.myUnordered = ss.unordered[*theirPermKey]
+	if sinfo.congestion = ss.newCongestionControl(); sinfo.congestion != nil {
+		sinfo.myFeedback = true
+		sinfo.sentLog = make([]congestion_sent, congestion_logSize)
+	}
 	now := time.Now()
 	sinfo.time = now
 	sinfo.mtuTime = now
@@ -310,16 +486,23 @@ func (ss *sessions) createSession(theirPermKey *boxPubKey) *sessionInfo {
 }
 
 func (ss *sessions) cleanup() {
-	// Time thresholds almost certainly could use some adjusting
-	if time.Since(ss.lastCleanup) < time.Minute {
+	if time.Since(ss.lastCleanup) < ss.cleanupInterval {
 		return
 	}
+	ss.sweep()
+}
+
+// Closes timed out sessions straight away, and returns how many were closed.
+func (ss *sessions) sweep() int {
+	var closed int
 	for _, s := range ss.sinfos {
 		if s.timedout() {
 			s.close()
+			closed++
 		}
 	}
 	ss.lastCleanup = time.Now()
+	return closed
 }
 
 // Closes a session, removing it from sessions maps and killing the worker goroutine.
@@ -337,13 +520,17 @@ func (sinfo *sessionInfo) close() {
 func (ss *sessions) getPing(sinfo *sessionInfo) sessionPing {
 	loc := ss.core.switchTable.getLocator()
 	coords := loc.getCoords()
+	atomic.StoreUint32(&sinfo.linkMTU, uint32(ss.getLinkMTU(sinfo.coords)))
 	ref := sessionPing{
 		SendPermPub: ss.core.boxPub,
 		Handle:      sinfo.myHandle,
 		SendSesPub:  sinfo.mySesPub,
 		Tstamp:      time.Now().Unix(),
 		Coords:      coords,
-		MTU:         sinfo.myMTU,
+		MTU:         sinfo.getMyMTU(),
+		Padding:     sinfo.myPadding,
+		Unordered:   sinfo.myUnordered,
+		Feedback:    sinfo.myFeedback,
 	}
 	sinfo.myNonce.update()
 	return ref
@@ -419,9 +606,15 @@ func (ss *sessions) handlePing(ping *sessionPing) {
 		}
 	}
 	// Update the session
+	opened := !sinfo.init
 	if !sinfo.update(ping) { /*panic("Should not happen in testing")*/
 		return
 	}
+	if opened && ping.IsPong {
+		// This answers the ping we started the session with
+		ss.core.statsExport.handshake.observe(time.Since(sinfo.pingTime))
+	}
+	ss.core.addrBook.see(&sinfo.theirPermPub, sinfo.coords)
 	if !ping.IsPong {
 		ss.sendPingPong(sinfo, true)
 	}
@@ -431,6 +624,7 @@ func (ss *sessions) handlePing(ping *sessionPing) {
 		bs, sinfo.packet = sinfo.packet, nil
 		ss.core.router.sendPacket(bs)
 	}
+	ss.core.storeFwd.flush(sinfo)
 }
 
 // Used to subtract one nonce from another, staying in the range +- 64.
@@ -453,17 +647,49 @@ func (n *boxNonce) minus(m *boxNonce) int64 {
 
 // Get the MTU of the session.
 // Will be equal to the smaller of this node's MTU or the remote node's MTU.
-// If sending over links with a maximum message size (this was a thing with the old UDP code), it could be further lowered, to a minimum of 1280.
+// If probing found that smaller packets than that get through the path, it's lowered to match, to a minimum of 1280.
 func (sinfo *sessionInfo) getMTU() uint16 {
-	if sinfo.theirMTU == 0 || sinfo.myMTU == 0 {
+	mtu := sinfo.getLocalMTU()
+	if sinfo.pathMTU != 0 && sinfo.pathMTU < mtu {
+		return sinfo.pathMTU
+	}
+	return mtu
+}
+
+// Gets the smaller of this node's MTU or the remote node's MTU, ignoring the path between them.
+func (sinfo *sessionInfo) getLocalMTU() uint16 {
+	myMTU := sinfo.getMyMTU()
+	if sinfo.theirMTU == 0 || myMTU == 0 {
 		return 0
 	}
-	if sinfo.theirMTU < sinfo.myMTU {
+	if sinfo.theirMTU < myMTU {
 		return sinfo.theirMTU
 	}
+	return myMTU
+}
+
+// Gets this node's MTU for the session, which is capped by the MTU of the peer that the session's traffic leaves through, if it has one.
+// This is what we tell the remote node, so its traffic is capped too, as it usually comes back over the same link.
+func (sinfo *sessionInfo) getMyMTU() uint16 {
+	linkMTU := uint16(atomic.LoadUint32(&sinfo.linkMTU))
+	if linkMTU != 0 && (sinfo.myMTU == 0 || linkMTU < sinfo.myMTU) {
+		return linkMTU
+	}
 	return sinfo.myMTU
 }
 
+// Gets the MTU of the peer that traffic to the given coords leaves through, or 0 if it isn't capped.
+func (ss *sessions) getLinkMTU(coords []byte) uint16 {
+	port := ss.core.switchTable.bestPortForCoords(coords)
+	if port == 0 {
+		return 0
+	}
+	if p, isIn := ss.core.peers.ports.Load().(map[switchPort]*peer)[port]; isIn {
+		return p.mtu
+	}
+	return 0
+}
+
 // Checks if a packet's nonce is recent enough to fall within the window of allowed packets, and not already received.
 func (sinfo *sessionInfo) nonceIsOK(theirNonce *boxNonce) bool {
 	// The bitmask is to allow for some non-duplicate out-of-order packets
@@ -490,6 +716,38 @@ func (sinfo *sessionInfo) updateNonce(theirNonce *boxNonce) {
 	}
 }
 
+// Returns true if both ends of the session have agreed to use traffic padding.
+func (sinfo *sessionInfo) isPadded() bool {
+	return sinfo.myPadding && sinfo.theirPadding
+}
+
+// Returns true if both sides asked for packets to be delivered as they arrive.
+func (sinfo *sessionInfo) isUnordered() bool {
+	return sinfo.myUnordered && sinfo.theirUnordered
+}
+
+// Returns the size that a packet of the given length should be padded to when
+// traffic padding is in use.
+func (sinfo *sessionInfo) getPaddedSize(length int) int {
+	size := session_paddingMinSize
+	for size < length {
+		size <<= 1
+	}
+	if mtu := int(sinfo.getMTU()); mtu != 0 && size > mtu {
+		size = mtu
+	}
+	if size < length {
+		size = length
+	}
+	return size
+}
+
+// Returns a random delay before the next dummy packet is sent, if traffic
+// padding is in use.
+func session_getPaddingDelay() time.Duration {
+	return 500*time.Millisecond + time.Duration(rand.Int63n(int64(2*time.Second)))
+}
+
 // Resets all sessions to an uninitialized state.
 // Called after coord changes, so attemtps to use a session will trigger a new ping and notify the remote end of the coord change.
 func (ss *sessions) resetInits() {
@@ -504,24 +762,77 @@ func (ss *sessions) resetInits() {
 // It handles calling the relatively expensive crypto operations.
 // It's also responsible for checking nonces and dropping out-of-date/duplicate packets, or else calling the function to update nonces if the packet is OK.
 func (sinfo *sessionInfo) doWorker() {
+	// Only set while traffic padding is in use, to send dummy packets
+	var dummy *time.Timer
+	var dummyC <-chan time.Time
+	defer func() {
+		if dummy != nil {
+			dummy.Stop()
+		}
+	}()
+	// Set while waiting to send held packets, or to send congestion feedback
+	var pace, feedback <-chan time.Time
 	for {
 		select {
 		case p, ok := <-sinfo.recv:
 			if ok {
 				sinfo.doRecv(p)
+				// Feedback may have opened up the congestion window
+				pace = nil
 			} else {
 				return
 			}
 		case bs, ok := <-sinfo.send:
 			if ok {
-				sinfo.doSend(bs)
+				sinfo.doPacedSend(bs)
 			} else {
 				return
 			}
+		case <-pace:
+			pace = nil
+		case <-feedback:
+			feedback = nil
+			sinfo.doSendFeedback()
+		case <-dummyC:
+			if !sinfo.isPadded() {
+				dummy, dummyC = nil, nil
+				break
+			}
+			if time.Since(sinfo.realTime) < session_paddingActiveTime {
+				sinfo.doSendDummy()
+			}
+			dummy.Reset(session_getPaddingDelay())
+		}
+		if dummy == nil && sinfo.isPadded() {
+			// Padding is agreed in the pings, so it may only be known once traffic has started
+			dummy = time.NewTimer(session_getPaddingDelay())
+			dummyC = dummy.C
+		}
+		if pace == nil && len(sinfo.held) > 0 {
+			if delay := sinfo.sendHeld(); delay > 0 {
+				pace = time.After(delay)
+			}
+		}
+		if feedback == nil && sinfo.unacked > 0 {
+			feedback = time.After(congestion_feedbackInterval)
 		}
 	}
 }
 
+// Sends a dummy packet, which is zero-filled and padded like real traffic.
+// The remote end drops it after decrypting, as it doesn't begin with an IPv6
+// header, so it only serves to make traffic analysis harder.
+func (sinfo *sessionInfo) doSendDummy() {
+	if !sinfo.init {
+		return
+	}
+	bs := util_getBytes()
+	for len(bs) < sinfo.getPaddedSize(0) {
+		bs = append(bs, 0)
+	}
+	sinfo.doSend(bs)
+}
+
 // This encrypts a packet, creates a trafficPacket struct, encodes it, and sends it to router.out to pass it to the switch layer.
 func (sinfo *sessionInfo) doSend(bs []byte) {
 	defer util_putBytes(bs)
@@ -529,13 +840,20 @@ func (sinfo *sessionInfo) doSend(bs []byte) {
 		// To prevent using empty session keys
 		return
 	}
+	sinfo.clampMSS(bs)
 	// code isn't multithreaded so appending to this is safe
 	coords := sinfo.coords
 	// Read IPv6 flowlabel field (20 bits).
-	// Assumes packet at least contains IPv6 header.
-	flowkey := uint64(bs[1]&0x0f)<<16 | uint64(bs[2])<<8 | uint64(bs[3])
+	// Dummy packets and congestion feedback don't have one, and neither does
+	// IPv4 from crypto-key routing.
+	isIPv6 := len(bs) >= 40 && bs[0]&0xf0 == 0x60
+	isIPv4 := len(bs) >= tun_IPv4_HEADER_LENGTH && bs[0]&0xf0 == 0x40
+	var flowkey uint64
+	if isIPv6 {
+		flowkey = uint64(bs[1]&0x0f)<<16 | uint64(bs[2])<<8 | uint64(bs[3])
+	}
 	// Check if the flowlabel was specified
-	if flowkey == 0 {
+	if isIPv6 && flowkey == 0 {
 		// Does the packet meet the minimum UDP packet size? (others are bigger)
 		if len(bs) >= 48 {
 			// Is the protocol TCP, UDP, SCTP?
@@ -548,17 +866,48 @@ func (sinfo *sessionInfo) doSend(bs []byte) {
 			}
 		}
 	}
+	if isIPv4 {
+		// The ports follow the header, which has a variable length, and are only in the first fragment
+		ihl := int(bs[0]&0x0f) * 4
+		isFirst := binary.BigEndian.Uint16(bs[6:8])&0x1fff == 0
+		if isFirst && ihl >= tun_IPv4_HEADER_LENGTH && len(bs) >= ihl+4 {
+			if bs[9] == 0x06 || bs[9] == 0x11 || bs[9] == 0x84 {
+				flowkey = uint64(bs[9])<<32 /* proto */ |
+					uint64(bs[ihl])<<24 | uint64(bs[ihl+1])<<16 /* sport */ |
+					uint64(bs[ihl+2])<<8 | uint64(bs[ihl+3]) /* dport */
+			}
+		}
+	}
+	// Mark the flowkey with the priority of the packet, so that switches on the
+	// path can queue it ahead of or behind other traffic
+	flowkey |= uint64(sinfo.core.priority.get(bs)) << priority_flowKeyShift
 	// If we have a flowkey, either through the IPv6 flowlabel field or through
 	// known TCP/UDP/SCTP proto-sport-dport triplet, then append it to the coords.
 	// Appending extra coords after a 0 ensures that we still target the local router
 	// but lets us send extra data (which is otherwise ignored) to help separate
 	// traffic streams into independent queues
-	if flowkey != 0 {
+	// If packets are to be delivered as they arrive, then a second 0 before the
+	// flowkey tells the switches that they don't need to keep the flow on one path
+	switch {
+	case sinfo.isUnordered():
+		coords = append(coords, 0, 0)             // Target the local switchport, and mark as unordered
+		coords = wire_put_uint64(flowkey, coords) // Then variable-length encoded flowkey
+	case flowkey != 0:
 		coords = append(coords, 0)                // First target the local switchport
 		coords = wire_put_uint64(flowkey, coords) // Then variable-length encoded flowkey
 	}
+	// Pad the packet with zeroes if needed, the remote end uses the payload
+	// length from the IPv6 header to remove this again
+	plain := bs
+	if sinfo.isPadded() {
+		plain = append(util_getBytes(), bs...)
+		for len(plain) < sinfo.getPaddedSize(len(bs)) {
+			plain = append(plain, 0)
+		}
+		defer util_putBytes(plain)
+	}
 	// Prepare the payload
-	payload, nonce := boxSeal(&sinfo.sharedSesKey, bs, &sinfo.myNonce)
+	payload, nonce := boxSeal(&sinfo.sharedSesKey, plain, &sinfo.myNonce)
 	defer util_putBytes(payload)
 	p := wire_trafficPacket{
 		Coords:  coords,
@@ -567,10 +916,30 @@ func (sinfo *sessionInfo) doSend(bs []byte) {
 		Payload: payload,
 	}
 	packet := p.encode()
-	sinfo.bytesSent += uint64(len(bs))
+	sinfo.core.flowTrace.trace(bs, "session send", "encrypted to coords %v with flow key %x, %d bytes", sinfo.coords, flowkey, len(packet))
+	sinfo.core.flowTrace.tracePending(bs, nonce)
+	if isIPv6 || isIPv4 {
+		// Only count real traffic, not dummy packets or feedback
+		sinfo.bytesSent += uint64(len(bs))
+		sinfo.realTime = time.Now()
+		if session_isCE(bs) {
+			sinfo.ceSent++
+		}
+	}
+	sinfo.logSent(nonce, len(bs), isIPv6 || isIPv4)
 	sinfo.core.router.out(packet)
 }
 
+// Checks if an IPv6 packet is marked Congestion Experienced, which is the ECN codepoint 3 in the low bits of the traffic class.
+// For IPv4 packets the codepoint is in the low bits of the TOS byte instead.
+// The whole packet, including the traffic class, is encrypted and delivered unchanged, so ECN works end to end over a session.
+func session_isCE(bs []byte) bool {
+	if len(bs) >= 2 && bs[0]&0xf0 == 0x40 {
+		return bs[1]&0x03 == 0x03
+	}
+	return len(bs) >= 2 && (bs[1]>>4)&0x03 == 0x03
+}
+
 // This takes a trafficPacket and checks the nonce.
 // If the nonce is OK, it decrypts the packet.
 // If the decrypted packet is OK, it calls router.recvPacket to pass the packet to the tun/tap.
@@ -588,6 +957,38 @@ func (sinfo *sessionInfo) doRecv(p *wire_trafficPacket) {
 	}
 	sinfo.updateNonce(&p.Nonce)
 	sinfo.time = time.Now()
+	var feedback congestion_feedback
+	if feedback.decode(bs) {
+		sinfo.handleFeedback(&feedback)
+		util_putBytes(bs)
+		return
+	}
+	if sinfo.myPadding {
+		// Drop dummy packets and remove any padding from real ones
+		switch {
+		case len(bs) >= tun_IPv6_HEADER_LENGTH && bs[0]&0xf0 == 0x60:
+			if length := tun_IPv6_HEADER_LENGTH + int(binary.BigEndian.Uint16(bs[4:6])); length < len(bs) {
+				bs = bs[:length]
+			}
+		case len(bs) >= tun_IPv4_HEADER_LENGTH && bs[0]&0xf0 == 0x40:
+			// IPv4 from crypto-key routing, where the total length includes the header
+			if length := int(binary.BigEndian.Uint16(bs[2:4])); length < len(bs) {
+				bs = bs[:length]
+			}
+		default:
+			util_putBytes(bs)
+			return
+		}
+		sinfo.realTime = sinfo.time
+	}
 	sinfo.bytesRecvd += uint64(len(bs))
+	if session_isCE(bs) {
+		sinfo.ceRecvd++
+	}
+	if sinfo.countForFeedback() {
+		sinfo.doSendFeedback()
+	}
+	sinfo.clampMSS(bs)
+	sinfo.core.flowTrace.trace(bs, "session recv", "decrypted %d bytes", len(bs))
 	sinfo.core.router.recvPacket(bs, &sinfo.theirAddr, &sinfo.theirSubnet)
 }
@@ -0,0 +1,503 @@
+package yggdrasil
+
+// This implements a small SNMPv2c agent, so that network management systems
+// can poll the node alongside other routers. It answers Get, GetNext and
+// GetBulk requests for a read-only private MIB with interface-style counters
+// for the TUN/TAP adapter and each peer link, laid out under the configured
+// base OID as follows:
+//  .1.1.0          IPv6 address of the node (OCTET STRING)
+//  .1.2.0          uptime of the node (TimeTicks)
+//  .1.3.0          number of peers (Gauge32)
+//  .2.1.0          name of the TUN/TAP adapter (OCTET STRING)
+//  .2.2.0          MTU of the TUN/TAP adapter (INTEGER)
+//  .2.3.0          bytes read from the TUN/TAP adapter (Counter64)
+//  .2.4.0          bytes written to the TUN/TAP adapter (Counter64)
+//  .2.5.0          packets read from the TUN/TAP adapter (Counter64)
+//  .2.6.0          packets written to the TUN/TAP adapter (Counter64)
+//  .2.7.0          packets read from the TUN/TAP adapter but dropped (Counter64)
+//  .2.8.0          packets for the TUN/TAP adapter but dropped (Counter64)
+//  .3.1.1.<port>   switch port of the peer (INTEGER)
+//  .3.1.2.<port>   IPv6 address of the peer (OCTET STRING)
+//  .3.1.3.<port>   encryption public key of the peer, in hex (OCTET STRING)
+//  .3.1.4.<port>   uptime of the peer link (TimeTicks)
+//  .3.1.5.<port>   bytes received from the peer (Counter64)
+//  .3.1.6.<port>   bytes sent to the peer (Counter64)
+// Sets, traps and SNMPv1/v3 aren't supported, and requests that don't use the
+// configured community are ignored.
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The default community and base OID. 99999 isn't a registered enterprise number.
+const snmp_defaultCommunity = "public"
+const snmp_defaultBaseOID = "1.3.6.1.4.1.99999"
+
+// Responses to GetBulk requests stop growing once they reach this size, to stay within a typical path MTU.
+const snmp_maxResponseSize = 1400
+
+// The most repetitions answered for a GetBulk request.
+const snmp_maxRepetitions = 64
+
+// The only version answered, which is SNMPv2c.
+const snmp_version2c = 1
+
+// BER tags used in SNMP messages.
+const (
+	snmp_tagInteger      = 0x02
+	snmp_tagOctetString  = 0x04
+	snmp_tagNull         = 0x05
+	snmp_tagOID          = 0x06
+	snmp_tagSequence     = 0x30
+	snmp_tagGauge32      = 0x42
+	snmp_tagTimeTicks    = 0x43
+	snmp_tagCounter64    = 0x46
+	snmp_tagNoSuchObject = 0x80
+	snmp_tagEndOfMibView = 0x82
+	snmp_pduGet          = 0xa0
+	snmp_pduGetNext      = 0xa1
+	snmp_pduResponse     = 0xa2
+	snmp_pduGetBulk      = 0xa5
+)
+
+// An SNMP object identifier.
+type snmpOID []uint32
+
+// A variable in the MIB, with its value already BER-encoded without a tag or length.
+type snmpVar struct {
+	oid   snmpOID
+	tag   byte
+	value []byte
+}
+
+type snmpAgent struct {
+	core      *Core
+	mutex     sync.Mutex
+	listen    string  // UDP address to listen on, or empty if the agent is disabled
+	community string  // Community that requests must use
+	base      snmpOID // OID that the MIB is found under
+	conn      net.PacketConn
+}
+
+// Initializes the snmpAgent struct.
+func (a *snmpAgent) init(core *Core) {
+	a.core = core
+	a.community = snmp_defaultCommunity
+	a.base, _ = snmp_parseOID(snmp_defaultBaseOID)
+}
+
+// Sets the address to listen on, the community to answer and the base OID of the MIB.
+// An empty address disables the agent, and an empty community or base OID uses the default.
+func (a *snmpAgent) setConfig(listen string, community string, base string) error {
+	if community == "" {
+		community = snmp_defaultCommunity
+	}
+	if base == "" {
+		base = snmp_defaultBaseOID
+	}
+	oid, err := snmp_parseOID(base)
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.listen = listen
+	a.community = community
+	a.base = oid
+	return nil
+}
+
+// Starts answering SNMP requests, if an address to listen on is configured.
+func (a *snmpAgent) start() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.listen == "" {
+		return nil
+	}
+	conn, err := net.ListenPacket("udp", a.listen)
+	if err != nil {
+		return err
+	}
+	a.conn = conn
+	a.core.log.Println("SNMP agent listening on", conn.LocalAddr())
+	go a.serve(conn)
+	return nil
+}
+
+// Stops answering SNMP requests.
+func (a *snmpAgent) close() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.conn != nil {
+		a.conn.Close()
+		a.conn = nil
+	}
+}
+
+// Answers requests on the connection until it's closed.
+func (a *snmpAgent) serve(conn net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if response := a.handle(buf[:n]); response != nil {
+			conn.WriteTo(response, from)
+		}
+	}
+}
+
+// Handles a request and returns the response, or nil if the request should be ignored.
+func (a *snmpAgent) handle(packet []byte) []byte {
+	a.mutex.Lock()
+	community := a.community
+	a.mutex.Unlock()
+	fields, err := snmp_parseFields(packet, snmp_tagSequence)
+	if err != nil || len(fields) < 3 {
+		return nil
+	}
+	if version, err := snmp_decodeInt(fields[0], snmp_tagInteger); err != nil || version != snmp_version2c {
+		return nil
+	}
+	if fields[1].tag != snmp_tagOctetString || string(fields[1].value) != community {
+		return nil
+	}
+	pdu, err := snmp_parseFields(fields[2].raw, fields[2].tag)
+	if err != nil || len(pdu) < 4 || pdu[0].tag != snmp_tagInteger {
+		return nil
+	}
+	field1, err1 := snmp_decodeInt(pdu[1], snmp_tagInteger)
+	field2, err2 := snmp_decodeInt(pdu[2], snmp_tagInteger)
+	varbinds, err := snmp_parseFields(pdu[3].raw, snmp_tagSequence)
+	if err1 != nil || err2 != nil || err != nil {
+		return nil
+	}
+	var oids []snmpOID
+	for _, varbind := range varbinds {
+		vb, err := snmp_parseFields(varbind.raw, snmp_tagSequence)
+		if err != nil || len(vb) < 1 || vb[0].tag != snmp_tagOID {
+			return nil
+		}
+		oid, err := snmp_decodeOID(vb[0].value)
+		if err != nil {
+			return nil
+		}
+		oids = append(oids, oid)
+	}
+	vars := a.getVars()
+	var out []byte
+	switch fields[2].tag {
+	case snmp_pduGet:
+		for _, oid := range oids {
+			idx := sort.Search(len(vars), func(i int) bool { return vars[i].oid.compare(oid) >= 0 })
+			if idx < len(vars) && vars[idx].oid.compare(oid) == 0 {
+				out = append(out, vars[idx].encode()...)
+			} else {
+				out = append(out, (&snmpVar{oid: oid, tag: snmp_tagNoSuchObject}).encode()...)
+			}
+		}
+	case snmp_pduGetNext:
+		for _, oid := range oids {
+			out = append(out, snmp_getNext(vars, oid).encode()...)
+		}
+	case snmp_pduGetBulk:
+		// For GetBulk, the error status and index fields are the non-repeaters and max-repetitions
+		nonRepeaters := int(field1)
+		if nonRepeaters < 0 {
+			nonRepeaters = 0
+		} else if nonRepeaters > len(oids) {
+			nonRepeaters = len(oids)
+		}
+		maxRepetitions := int(field2)
+		if maxRepetitions > snmp_maxRepetitions {
+			maxRepetitions = snmp_maxRepetitions
+		}
+		for _, oid := range oids[:nonRepeaters] {
+			out = append(out, snmp_getNext(vars, oid).encode()...)
+		}
+		repeaters := oids[nonRepeaters:]
+		for rep := 0; rep < maxRepetitions && len(repeaters) > 0 && len(out) < snmp_maxResponseSize; rep++ {
+			for idx, oid := range repeaters {
+				next := snmp_getNext(vars, oid)
+				out = append(out, next.encode()...)
+				repeaters[idx] = next.oid
+			}
+		}
+	default:
+		return nil
+	}
+	response := snmp_encodeTLV(snmp_tagInteger, snmp_encodeInt(snmp_version2c))
+	response = append(response, snmp_encodeTLV(snmp_tagOctetString, []byte(community))...)
+	body := snmp_encodeTLV(snmp_tagInteger, pdu[0].value) // Request ID
+	body = append(body, snmp_encodeTLV(snmp_tagInteger, snmp_encodeInt(0))...)
+	body = append(body, snmp_encodeTLV(snmp_tagInteger, snmp_encodeInt(0))...)
+	body = append(body, snmp_encodeTLV(snmp_tagSequence, out)...)
+	response = append(response, snmp_encodeTLV(snmp_pduResponse, body)...)
+	return snmp_encodeTLV(snmp_tagSequence, response)
+}
+
+// Gets a sorted snapshot of the MIB.
+func (a *snmpAgent) getVars() []snmpVar {
+	a.mutex.Lock()
+	base := a.base
+	a.mutex.Unlock()
+	var vars []snmpVar
+	add := func(tag byte, value []byte, suffix ...uint32) {
+		oid := append(append(snmpOID{}, base...), suffix...)
+		vars = append(vars, snmpVar{oid: oid, tag: tag, value: value})
+	}
+	ticks := func(d time.Duration) []byte {
+		return snmp_encodeUint(uint64(d/(10*time.Millisecond)) & 0xffffffff)
+	}
+	ports := a.core.peers.ports.Load().(map[switchPort]*peer)
+	add(snmp_tagOctetString, []byte(net.IP(a.core.router.addr[:]).String()), 1, 1, 0)
+	add(snmp_tagTimeTicks, ticks(time.Since(a.core.startTime)), 1, 2, 0)
+	var links uint64
+	for port := range ports {
+		if port != 0 {
+			links++
+		}
+	}
+	add(snmp_tagGauge32, snmp_encodeUint(links), 1, 3, 0)
+	tun := &a.core.tun
+	state := tun.getState()
+	name := "none"
+	if state.iface != nil {
+		name = state.name()
+	}
+	add(snmp_tagOctetString, []byte(name), 2, 1, 0)
+	add(snmp_tagInteger, snmp_encodeInt(int64(state.mtu)), 2, 2, 0)
+	add(snmp_tagCounter64, snmp_encodeUint(atomic.LoadUint64(&tun.counters.bytesRead)), 2, 3, 0)
+	add(snmp_tagCounter64, snmp_encodeUint(atomic.LoadUint64(&tun.counters.bytesWritten)), 2, 4, 0)
+	add(snmp_tagCounter64, snmp_encodeUint(atomic.LoadUint64(&tun.counters.packetsRead)), 2, 5, 0)
+	add(snmp_tagCounter64, snmp_encodeUint(atomic.LoadUint64(&tun.counters.packetsWritten)), 2, 6, 0)
+	add(snmp_tagCounter64, snmp_encodeUint(atomic.LoadUint64(&tun.counters.readDropped)), 2, 7, 0)
+	add(snmp_tagCounter64, snmp_encodeUint(atomic.LoadUint64(&tun.counters.writeDropped)), 2, 8, 0)
+	for port, p := range ports {
+		if port == 0 {
+			// This is our own router, not a link to another node
+			continue
+		}
+		addr := *address_addrForNodeID(getNodeID(&p.box))
+		idx := uint32(port)
+		add(snmp_tagInteger, snmp_encodeInt(int64(port)), 3, 1, 1, idx)
+		add(snmp_tagOctetString, []byte(net.IP(addr[:]).String()), 3, 1, 2, idx)
+		add(snmp_tagOctetString, []byte(hex.EncodeToString(p.box[:])), 3, 1, 3, idx)
+		add(snmp_tagTimeTicks, ticks(time.Since(p.firstSeen)), 3, 1, 4, idx)
+		add(snmp_tagCounter64, snmp_encodeUint(atomic.LoadUint64(&p.bytesRecvd)), 3, 1, 5, idx)
+		add(snmp_tagCounter64, snmp_encodeUint(atomic.LoadUint64(&p.bytesSent)), 3, 1, 6, idx)
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].oid.compare(vars[j].oid) < 0 })
+	return vars
+}
+
+// Gets the first variable after the OID, or an endOfMibView for the OID if there isn't one.
+func snmp_getNext(vars []snmpVar, oid snmpOID) *snmpVar {
+	idx := sort.Search(len(vars), func(i int) bool { return vars[i].oid.compare(oid) > 0 })
+	if idx < len(vars) {
+		return &vars[idx]
+	}
+	return &snmpVar{oid: oid, tag: snmp_tagEndOfMibView}
+}
+
+// Encodes the variable as a varbind.
+func (v *snmpVar) encode() []byte {
+	varbind := snmp_encodeTLV(snmp_tagOID, v.oid.encode())
+	varbind = append(varbind, snmp_encodeTLV(v.tag, v.value)...)
+	return snmp_encodeTLV(snmp_tagSequence, varbind)
+}
+
+// Compares two OIDs in lexicographic order, returning -1, 0 or 1.
+func (oid snmpOID) compare(other snmpOID) int {
+	for idx := 0; idx < len(oid) && idx < len(other); idx++ {
+		switch {
+		case oid[idx] < other[idx]:
+			return -1
+		case oid[idx] > other[idx]:
+			return 1
+		}
+	}
+	switch {
+	case len(oid) < len(other):
+		return -1
+	case len(oid) > len(other):
+		return 1
+	}
+	return 0
+}
+
+// Encodes the OID without a tag or length. The OID must have at least 2 sub-identifiers.
+func (oid snmpOID) encode() []byte {
+	out := snmp_encodeSubID(oid[0]*40 + oid[1])
+	for _, sub := range oid[2:] {
+		out = append(out, snmp_encodeSubID(sub)...)
+	}
+	return out
+}
+
+// Parses an OID in dotted notation, i.e. "1.3.6.1.4.1.99999".
+func snmp_parseOID(s string) (snmpOID, error) {
+	var oid snmpOID
+	for _, part := range strings.Split(strings.TrimPrefix(s, "."), ".") {
+		sub, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, errors.New("invalid OID: " + s)
+		}
+		oid = append(oid, uint32(sub))
+	}
+	if len(oid) < 2 || oid[0] > 2 || (oid[0] < 2 && oid[1] >= 40) {
+		return nil, errors.New("invalid OID: " + s)
+	}
+	return oid, nil
+}
+
+// Decodes an OID from BER without a tag or length.
+func snmp_decodeOID(bs []byte) (snmpOID, error) {
+	var subs []uint32
+	var sub uint64
+	for idx, b := range bs {
+		sub = sub<<7 | uint64(b&0x7f)
+		if sub > 0xffffffff {
+			return nil, errors.New("OID sub-identifier too large")
+		}
+		if b&0x80 == 0 {
+			subs = append(subs, uint32(sub))
+			sub = 0
+		} else if idx == len(bs)-1 {
+			return nil, errors.New("truncated OID")
+		}
+	}
+	if len(subs) == 0 {
+		return nil, errors.New("empty OID")
+	}
+	var oid snmpOID
+	if subs[0] < 80 {
+		oid = snmpOID{subs[0] / 40, subs[0] % 40}
+	} else {
+		oid = snmpOID{2, subs[0] - 80}
+	}
+	return append(oid, subs[1:]...), nil
+}
+
+// Encodes an OID sub-identifier in base 128.
+func snmp_encodeSubID(sub uint32) []byte {
+	out := []byte{byte(sub & 0x7f)}
+	for sub >>= 7; sub > 0; sub >>= 7 {
+		out = append([]byte{byte(sub&0x7f) | 0x80}, out...)
+	}
+	return out
+}
+
+// A BER-encoded field, with its tag, its value, and the whole field including the tag and length.
+type snmpField struct {
+	tag   byte
+	value []byte
+	raw   []byte
+}
+
+// Parses a single field from the start of bs, returning the field and whatever follows it.
+func snmp_parseTLV(bs []byte) (snmpField, []byte, error) {
+	if len(bs) < 2 {
+		return snmpField{}, nil, errors.New("truncated field")
+	}
+	length := int(bs[1])
+	header := 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 || len(bs) < header+n {
+			return snmpField{}, nil, errors.New("invalid field length")
+		}
+		length = 0
+		for _, b := range bs[header : header+n] {
+			length = length<<8 | int(b)
+		}
+		header += n
+	}
+	if len(bs) < header+length {
+		return snmpField{}, nil, errors.New("truncated field")
+	}
+	field := snmpField{
+		tag:   bs[0],
+		value: bs[header : header+length],
+		raw:   bs[:header+length],
+	}
+	return field, bs[header+length:], nil
+}
+
+// Parses a constructed field with the given tag from the start of bs, and returns the fields inside it.
+func snmp_parseFields(bs []byte, tag byte) ([]snmpField, error) {
+	outer, _, err := snmp_parseTLV(bs)
+	if err != nil {
+		return nil, err
+	}
+	if outer.tag != tag {
+		return nil, errors.New("unexpected field")
+	}
+	var fields []snmpField
+	for rest := outer.value; len(rest) > 0; {
+		var field snmpField
+		if field, rest, err = snmp_parseTLV(rest); err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// Decodes a signed integer field with the given tag.
+func snmp_decodeInt(field snmpField, tag byte) (int64, error) {
+	if field.tag != tag || len(field.value) == 0 || len(field.value) > 8 {
+		return 0, errors.New("invalid integer")
+	}
+	v := int64(int8(field.value[0]))
+	for _, b := range field.value[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+// Encodes a signed integer without a tag or length, using as few bytes as possible.
+func snmp_encodeInt(v int64) []byte {
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, uint64(v))
+	for len(bs) > 1 && ((bs[0] == 0 && bs[1]&0x80 == 0) || (bs[0] == 0xff && bs[1]&0x80 != 0)) {
+		bs = bs[1:]
+	}
+	return bs
+}
+
+// Encodes an unsigned integer without a tag or length, using as few bytes as possible.
+func snmp_encodeUint(v uint64) []byte {
+	bs := make([]byte, 9)
+	binary.BigEndian.PutUint64(bs[1:], v)
+	for len(bs) > 1 && bs[0] == 0 && bs[1]&0x80 == 0 {
+		bs = bs[1:]
+	}
+	return bs
+}
+
+// Encodes a field with the given tag and value.
+func snmp_encodeTLV(tag byte, value []byte) []byte {
+	out := []byte{tag}
+	if len(value) < 0x80 {
+		out = append(out, byte(len(value)))
+	} else {
+		var length []byte
+		for l := len(value); l > 0; l >>= 8 {
+			length = append([]byte{byte(l)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, value...)
+}
@@ -0,0 +1,128 @@
+package yggdrasil
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestSNMPEncodeInt(t *testing.T) {
+	tests := []struct {
+		value int64
+		want  []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x00, 0x80}},
+		{255, []byte{0x00, 0xff}},
+		{256, []byte{0x01, 0x00}},
+		{32767, []byte{0x7f, 0xff}},
+		{32768, []byte{0x00, 0x80, 0x00}},
+		{-1, []byte{0xff}},
+		{-128, []byte{0x80}},
+		{-129, []byte{0xff, 0x7f}},
+		{-256, []byte{0xff, 0x00}},
+		{math.MaxInt64, []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{math.MinInt64, []byte{0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		got := snmp_encodeInt(test.value)
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%d: got % x, want % x", test.value, got, test.want)
+			continue
+		}
+		decoded, err := snmp_decodeInt(snmpField{tag: 0x02, value: got}, 0x02)
+		if err != nil || decoded != test.value {
+			t.Errorf("%d: decoded as %d, %v", test.value, decoded, err)
+		}
+	}
+}
+
+func TestSNMPEncodeUint(t *testing.T) {
+	tests := []struct {
+		value uint64
+		want  []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x00, 0x80}},
+		{255, []byte{0x00, 0xff}},
+		{256, []byte{0x01, 0x00}},
+		{math.MaxUint32, []byte{0x00, 0xff, 0xff, 0xff, 0xff}},
+		{1 << 32, []byte{0x01, 0x00, 0x00, 0x00, 0x00}},
+		{math.MaxInt64, []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{math.MaxUint64, []byte{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, test := range tests {
+		if got := snmp_encodeUint(test.value); !bytes.Equal(got, test.want) {
+			t.Errorf("%d: got % x, want % x", test.value, got, test.want)
+		}
+	}
+}
+
+func TestSNMPEncodeTLV(t *testing.T) {
+	tests := []struct {
+		length int
+		header []byte
+	}{
+		{0, []byte{0x04, 0x00}},
+		{1, []byte{0x04, 0x01}},
+		{127, []byte{0x04, 0x7f}},
+		{128, []byte{0x04, 0x81, 0x80}},
+		{255, []byte{0x04, 0x81, 0xff}},
+		{256, []byte{0x04, 0x82, 0x01, 0x00}},
+		{65536, []byte{0x04, 0x83, 0x01, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		value := bytes.Repeat([]byte{0xaa}, test.length)
+		got := snmp_encodeTLV(0x04, value)
+		if !bytes.Equal(got[:len(got)-test.length], test.header) {
+			t.Errorf("length %d: got header % x, want % x", test.length, got[:len(got)-test.length], test.header)
+			continue
+		}
+		field, rest, err := snmp_parseTLV(append(got, 0x05, 0x00))
+		switch {
+		case err != nil:
+			t.Errorf("length %d: failed to parse: %v", test.length, err)
+		case field.tag != 0x04 || !bytes.Equal(field.value, value):
+			t.Errorf("length %d: parsed as tag %#x with %d bytes", test.length, field.tag, len(field.value))
+		case !bytes.Equal(rest, []byte{0x05, 0x00}):
+			t.Errorf("length %d: got % x after the field", test.length, rest)
+		}
+	}
+}
+
+func TestSNMPOID(t *testing.T) {
+	tests := []struct {
+		oid  string
+		want []byte
+	}{
+		{"1.3.6.1", []byte{0x2b, 0x06, 0x01}},
+		{"1.3.6.1.4.1.99999", []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0x86, 0x8d, 0x1f}},
+		{"1.3.127.128", []byte{0x2b, 0x7f, 0x81, 0x00}},
+		{"1.3.4294967295", []byte{0x2b, 0x8f, 0xff, 0xff, 0xff, 0x7f}},
+		{"2.100.3", []byte{0x81, 0x34, 0x03}},
+	}
+	for _, test := range tests {
+		oid, err := snmp_parseOID(test.oid)
+		if err != nil {
+			t.Errorf("%s: %v", test.oid, err)
+			continue
+		}
+		got := oid.encode()
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got % x, want % x", test.oid, got, test.want)
+			continue
+		}
+		decoded, err := snmp_decodeOID(got)
+		if err != nil || decoded.compare(oid) != 0 {
+			t.Errorf("%s: decoded as %v, %v", test.oid, decoded, err)
+		}
+	}
+	for _, bad := range [][]byte{{}, {0x2b, 0x86}, {0x2b, 0x90, 0x80, 0x80, 0x80, 0x00}} {
+		if _, err := snmp_decodeOID(bad); err == nil {
+			t.Errorf("% x: decoded without an error", bad)
+		}
+	}
+}
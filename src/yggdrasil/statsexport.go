@@ -0,0 +1,285 @@
+package yggdrasil
+
+// This periodically writes stats about the node to a unix datagram socket, so
+// that a lightweight supervisor on an embedded router can collect them without
+// polling the admin socket or running anything that scrapes HTTP.
+// Stats are written either in the statsd line format, one datagram per stat,
+// i.e.
+//  yggdrasil.peers:3|g
+//  yggdrasil.tun.bytes_read:12345|c
+// with counters sent as the change since the last interval, or as a single
+// datagram holding a JSON object with the current value of every stat.
+// Latencies, i.e. peer RTTs, session handshake times and search durations, are
+// written as histograms, with a counter for each bucket of the samples that
+// took at most that many milliseconds, and a count and sum of all samples, i.e.
+//  yggdrasil.search_ms.le_100:4|c
+// so that percentiles can be worked out from them.
+// Nothing is written while nothing is listening on the socket.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The default interval between writing stats, and the default prefix of stat names.
+const statsExport_defaultInterval = 10 * time.Second
+const statsExport_defaultPrefix = "yggdrasil"
+
+type statsExport struct {
+	core     *Core
+	mutex    sync.Mutex
+	target   string        // Path of the unix datagram socket to write stats to, or empty if disabled
+	interval time.Duration // Time between writing stats
+	format   string        // Either "statsd" or "json"
+	prefix   string        // Prefix of stat names
+	stop     chan struct{}
+	// Histograms of latencies, which are allocated in init so that their counters are aligned for atomic access
+	peerRTT   *statsExport_histogram // Round trip times of links to peers, sampled every time they're updated
+	handshake *statsExport_histogram // Times from the first ping of a session to the pong that opens it
+	search    *statsExport_histogram // Times from the start of a search to finding the node
+}
+
+// The upper bounds of the histogram buckets, in milliseconds, above which samples only count towards the total.
+var statsExport_buckets = [...]uint64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000}
+
+// A histogram of durations, which may be added to from any goroutine.
+type statsExport_histogram struct {
+	buckets [len(statsExport_buckets)]uint64 // Samples no longer than each bound, not counting those in lower buckets
+	count   uint64                           // All samples
+	sum     uint64                           // Sum of all samples, in milliseconds
+}
+
+// Adds a sample to the histogram.
+func (h *statsExport_histogram) observe(d time.Duration) {
+	ms := uint64(d / time.Millisecond)
+	if d < 0 {
+		ms = 0
+	}
+	for idx, bound := range statsExport_buckets {
+		if ms <= bound {
+			atomic.AddUint64(&h.buckets[idx], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, ms)
+}
+
+// A single stat, which is either a gauge or a counter that only ever increases.
+type statsExport_stat struct {
+	name    string
+	value   uint64
+	counter bool
+}
+
+// Initializes the statsExport struct.
+func (s *statsExport) init(core *Core) {
+	s.core = core
+	s.interval = statsExport_defaultInterval
+	s.format = "statsd"
+	s.prefix = statsExport_defaultPrefix
+	s.peerRTT = new(statsExport_histogram)
+	s.handshake = new(statsExport_histogram)
+	s.search = new(statsExport_histogram)
+}
+
+// Sets the socket that stats are written to, how often and in which format.
+// An empty target disables stats export, and a zero interval, empty format or empty prefix uses the default.
+func (s *statsExport) setConfig(target string, interval time.Duration, format string, prefix string) error {
+	switch format {
+	case "":
+		format = "statsd"
+	case "statsd", "json":
+	default:
+		return errors.New("unknown stats format: " + format)
+	}
+	if interval < 0 {
+		return errors.New("invalid stats interval")
+	} else if interval == 0 {
+		interval = statsExport_defaultInterval
+	}
+	if prefix == "" {
+		prefix = statsExport_defaultPrefix
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.target = target
+	s.interval = interval
+	s.format = format
+	s.prefix = prefix
+	return nil
+}
+
+// Starts writing stats, if a target is configured.
+func (s *statsExport) start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.target == "" {
+		return nil
+	}
+	s.core.log.Println("Exporting stats to", s.target)
+	s.stop = make(chan struct{})
+	go s.exportLoop(s.stop, s.target, s.interval)
+	return nil
+}
+
+// Stops writing stats.
+func (s *statsExport) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// Writes stats every interval until stopped.
+// Failures are only logged when they start or stop happening, so a supervisor that's down doesn't fill the log.
+func (s *statsExport) exportLoop(stop chan struct{}, target string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := make(map[string]uint64)
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	var failing bool
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		var err error
+		if conn == nil {
+			conn, err = net.Dial("unixgram", target)
+		}
+		if err == nil {
+			if err = s.write(conn, last); err != nil {
+				// The supervisor may have restarted and made a new socket, so dial it again next time
+				conn.Close()
+				conn = nil
+			}
+		}
+		switch {
+		case err != nil && !failing:
+			s.core.log.Println("Failed to export stats:", err)
+		case err == nil && failing:
+			s.core.log.Println("Exporting stats again")
+		}
+		failing = err != nil
+	}
+}
+
+// Writes the current stats to the connection.
+// The last values of counters are used and updated to send the change in statsd counters.
+func (s *statsExport) write(conn net.Conn, last map[string]uint64) error {
+	s.mutex.Lock()
+	format, prefix := s.format, s.prefix
+	s.mutex.Unlock()
+	stats := s.getStats()
+	if format == "json" {
+		values := make(map[string]uint64)
+		for _, stat := range stats {
+			values[stat.name] = stat.value
+		}
+		bs, err := json.Marshal(map[string]interface{}{
+			"time":  time.Now().Unix(),
+			"stats": values,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(bs)
+		return err
+	}
+	for _, stat := range stats {
+		var line string
+		if stat.counter {
+			prev, isIn := last[stat.name]
+			last[stat.name] = stat.value
+			if !isIn || stat.value < prev {
+				// Counters are only sent once there's a previous value to compare with
+				continue
+			}
+			line = fmt.Sprintf("%s.%s:%d|c", prefix, stat.name, stat.value-prev)
+		} else {
+			line = fmt.Sprintf("%s.%s:%d|g", prefix, stat.name, stat.value)
+		}
+		if _, err := conn.Write([]byte(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gets the current value of every stat, sorted by name.
+func (s *statsExport) getStats() []statsExport_stat {
+	var stats []statsExport_stat
+	gauge := func(name string, value uint64) {
+		stats = append(stats, statsExport_stat{name: name, value: value})
+	}
+	counter := func(name string, value uint64) {
+		stats = append(stats, statsExport_stat{name: name, value: value, counter: true})
+	}
+	histogram := func(name string, h *statsExport_histogram) {
+		// Buckets are cumulative, so each one counts every sample up to its bound
+		var total uint64
+		for idx, bound := range statsExport_buckets {
+			total += atomic.LoadUint64(&h.buckets[idx])
+			counter(fmt.Sprintf("%s.le_%d", name, bound), total)
+		}
+		counter(name+".count", atomic.LoadUint64(&h.count))
+		counter(name+".sum", atomic.LoadUint64(&h.sum))
+	}
+	gauge("uptime", uint64(time.Since(s.core.startTime).Seconds()))
+	ports := s.core.peers.ports.Load().(map[switchPort]*peer)
+	var peers uint64
+	for port, p := range ports {
+		if port == 0 {
+			// This is our own router, not a link to another node
+			continue
+		}
+		peers++
+		counter(fmt.Sprintf("peer.%d.bytes_sent", port), atomic.LoadUint64(&p.bytesSent))
+		counter(fmt.Sprintf("peer.%d.bytes_recvd", port), atomic.LoadUint64(&p.bytesRecvd))
+	}
+	gauge("peers", peers)
+	var sessions uint64
+	s.core.router.doAdmin(func() {
+		sessions = uint64(len(s.core.sessions.sinfos))
+	})
+	gauge("sessions", sessions)
+	var queues, queueSize uint64
+	var dropped uint64
+	s.core.switchTable.doAdmin(func() {
+		queues = uint64(len(s.core.switchTable.queues.bufs))
+		queueSize = uint64(s.core.switchTable.queues.size)
+		for _, stats := range s.core.switchTable.queues.stats {
+			dropped += stats.droppedPackets
+		}
+	})
+	gauge("switch.queues", queues)
+	gauge("switch.queue_bytes", queueSize)
+	counter("switch.dropped_packets", dropped)
+	tun := s.core.tun.counters
+	counter("tun.bytes_read", atomic.LoadUint64(&tun.bytesRead))
+	counter("tun.bytes_written", atomic.LoadUint64(&tun.bytesWritten))
+	counter("tun.packets_read", atomic.LoadUint64(&tun.packetsRead))
+	counter("tun.packets_written", atomic.LoadUint64(&tun.packetsWritten))
+	counter("tun.read_dropped", atomic.LoadUint64(&tun.readDropped))
+	counter("tun.write_dropped", atomic.LoadUint64(&tun.writeDropped))
+	histogram("peer_rtt_ms", s.peerRTT)
+	histogram("session_handshake_ms", s.handshake)
+	histogram("search_ms", s.search)
+	sort.Slice(stats, func(i, j int) bool { return stats[i].name < stats[j].name })
+	return stats
+}
@@ -0,0 +1,113 @@
+package yggdrasil
+
+// This implements links over the standard input and output of the process, or
+// over a pair of pipes that it inherited, so that a link can be carried by any
+// program that can run a command and pass its stdin/stdout along, like SSH or
+// a serial modem, without support for each one being added here. For example,
+// with the peer stdio:// configured on the remote node,
+//  ssh remote yggdrasil -useconffile /etc/yggdrasil.conf
+// can be set as a transport on the local node, as the far end of the link.
+// Inherited pipes are given by file descriptor, or handle on Windows, with the
+// peer pipe://?in=3&out=4.
+// The peering protocol is the same as over TCP, so either end can be the one
+// that runs the other. Each pair of files carries a single link, for as long
+// as the process runs, because there's no way to tell where the data from an
+// old link ends once it has been read. When the link closes, so do the files,
+// which tells the carrier to hang up. When stdio is used, the log must be
+// written somewhere else, i.e. to stderr.
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// The files for each link, by the address of the link, shared by all Cores in the process.
+// The files are opened the first time a peer URI is used and are kept here for
+// as long as the process runs, since an *os.File closes its descriptor when
+// it's garbage collected, which would pull it out from under a running link.
+var stdiolink_files = struct {
+	sync.Mutex
+	endpoints map[string]*stdiolink_endpoint
+}{endpoints: make(map[string]*stdiolink_endpoint)}
+
+type stdiolink_endpoint struct {
+	in   *os.File
+	out  *os.File
+	used bool // Whether a link has been made over the files
+}
+
+// Returns true if the peer URI is for a stdio:// or pipe:// link.
+// These can only be given in the configuration, since a pipe:// peer from the
+// admin socket could take over any file descriptor that the process has open.
+func stdiolink_isURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "stdio" || u.Scheme == "pipe"
+}
+
+// Gets the files and address for a stdio:// or pipe:// peer URI, opening them the first time.
+func stdiolink_parse(u *url.URL) (*stdiolink_endpoint, string, error) {
+	var in, out uint64
+	name := "stdio://"
+	if u.Scheme != "stdio" {
+		args := u.Query()
+		var err error
+		in, err = strconv.ParseUint(args.Get("in"), 10, 0)
+		if err != nil {
+			return nil, "", errors.New("invalid input file descriptor: " + args.Get("in"))
+		}
+		out, err = strconv.ParseUint(args.Get("out"), 10, 0)
+		if err != nil {
+			return nil, "", errors.New("invalid output file descriptor: " + args.Get("out"))
+		}
+		name = "pipe://?in=" + strconv.FormatUint(in, 10) + "&out=" + strconv.FormatUint(out, 10)
+	}
+	stdiolink_files.Lock()
+	defer stdiolink_files.Unlock()
+	if endpoint, isIn := stdiolink_files.endpoints[name]; isIn {
+		return endpoint, name, nil
+	}
+	endpoint := &stdiolink_endpoint{in: os.Stdin, out: os.Stdout}
+	if u.Scheme != "stdio" {
+		endpoint.in = os.NewFile(uintptr(in), "pipe-in")
+		endpoint.out = os.NewFile(uintptr(out), "pipe-out")
+	}
+	stdiolink_files.endpoints[name] = endpoint
+	return endpoint, name, nil
+}
+
+// Returns a connection that reads from one file and writes to the other, which can only be done once per address.
+// Closing the connection closes both files.
+func stdiolink_dial(endpoint *stdiolink_endpoint, name string) (net.Conn, error) {
+	stdiolink_files.Lock()
+	defer stdiolink_files.Unlock()
+	if endpoint.used {
+		return nil, errors.New("link already used: " + name)
+	}
+	endpoint.used = true
+	in, out := endpoint.in, endpoint.out
+	local, remote := net.Pipe()
+	go func() {
+		io.Copy(out, remote)
+		out.Close()
+		in.Close()
+	}()
+	go func() {
+		io.Copy(remote, in)
+		remote.Close()
+	}()
+	return &wrappedConn{
+		c: local,
+		raddr: &wrappedAddr{
+			network: "stdio",
+			addr:    name,
+		},
+	}, nil
+}
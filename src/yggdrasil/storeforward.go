@@ -0,0 +1,147 @@
+package yggdrasil
+
+// This holds packets for a few seconds while a session to their destination
+// is being set up, or set up again after coords change or a peer flaps, and
+// sends them once the session is ready. Without it, only the most recent packet
+// is kept while searching, so a brief outage drops everything else that the
+// applications send in the meantime.
+// Packets are held per destination address or /64, with a limit on how many are
+// held for each and for how long, and on the number of destinations, so that
+// traffic to unreachable nodes can't use much memory. This is opt-in, and only
+// used from the router goroutine.
+
+import (
+	"time"
+)
+
+// The default number of packets held per destination, and the default time they're held for.
+const storeForward_defaultPackets = 32
+const storeForward_defaultHoldtime = 3 * time.Second
+
+// The most destinations that packets are held for at once.
+const storeForward_maxDestinations = 64
+
+type storeForward struct {
+	core     *Core
+	enabled  bool
+	packets  int
+	holdtime time.Duration
+	buffers  map[address]*storeForward_buffer // Keyed by destination address, or by /64 with the rest zeroed
+	dropped  uint64                           // Packets dropped because a buffer was full or expired
+}
+
+// The packets held for a destination.
+type storeForward_buffer struct {
+	packets [][]byte
+	times   []time.Time // When each packet was held
+}
+
+// Initializes the storeForward struct.
+func (s *storeForward) init(core *Core) {
+	s.core = core
+	s.buffers = make(map[address]*storeForward_buffer)
+}
+
+// Sets whether packets are held, how many are held per destination, and how long they're held for.
+// Zero uses the default. This must be called before the router is started.
+func (s *storeForward) setConfig(enabled bool, packets int, holdtime time.Duration) {
+	if packets <= 0 {
+		packets = storeForward_defaultPackets
+	}
+	if holdtime <= 0 {
+		holdtime = storeForward_defaultHoldtime
+	}
+	s.enabled = enabled
+	s.packets = packets
+	s.holdtime = holdtime
+}
+
+// Gets the key for the destination of an IPv6 packet.
+func storeForward_getKey(dest *address, snet *subnet) address {
+	var key address
+	if dest.isValid() {
+		key = *dest
+	} else {
+		copy(key[:], snet[:])
+	}
+	return key
+}
+
+// Holds a packet until there's a session to its destination, returning false if holding packets is disabled.
+// The oldest packets are dropped when the destination's buffer is full, and new ones are dropped when too many destinations have buffers.
+func (s *storeForward) hold(bs []byte, dest *address, snet *subnet) bool {
+	if !s.enabled {
+		return false
+	}
+	key := storeForward_getKey(dest, snet)
+	buf, isIn := s.buffers[key]
+	if !isIn {
+		if len(s.buffers) >= storeForward_maxDestinations {
+			s.cleanup()
+		}
+		if len(s.buffers) >= storeForward_maxDestinations {
+			s.dropped++
+			util_putBytes(bs)
+			return true
+		}
+		buf = &storeForward_buffer{}
+		s.buffers[key] = buf
+	}
+	if len(buf.packets) >= s.packets {
+		s.dropped++
+		util_putBytes(buf.packets[0])
+		buf.packets = buf.packets[1:]
+		buf.times = buf.times[1:]
+	}
+	buf.packets = append(buf.packets, bs)
+	buf.times = append(buf.times, time.Now())
+	return true
+}
+
+// Sends the packets held for the session's destination, now that the session is ready.
+func (s *storeForward) flush(sinfo *sessionInfo) {
+	var snet address
+	copy(snet[:], sinfo.theirSubnet[:])
+	for _, key := range []address{sinfo.theirAddr, snet} {
+		buf, isIn := s.buffers[key]
+		if !isIn {
+			continue
+		}
+		delete(s.buffers, key)
+		now := time.Now()
+		for idx, bs := range buf.packets {
+			if now.Sub(buf.times[idx]) > s.holdtime {
+				s.dropped++
+				util_putBytes(bs)
+				continue
+			}
+			s.core.flowTrace.trace(bs, "router", "held for %s until the session was ready", now.Sub(buf.times[idx]).Round(time.Millisecond))
+			s.core.router.sendPacket(bs)
+		}
+	}
+}
+
+// Drops packets that have been held for too long, and the buffers that are left empty.
+func (s *storeForward) cleanup() {
+	now := time.Now()
+	for key, buf := range s.buffers {
+		for len(buf.packets) > 0 && now.Sub(buf.times[0]) > s.holdtime {
+			s.dropped++
+			util_putBytes(buf.packets[0])
+			buf.packets = buf.packets[1:]
+			buf.times = buf.times[1:]
+		}
+		if len(buf.packets) == 0 {
+			delete(s.buffers, key)
+		}
+	}
+}
+
+// Gets the number of destinations with packets held, the number of packets held, and the number dropped, for getSelf.
+func (s *storeForward) getStats() (int, int, uint64) {
+	var held int
+	for _, buf := range s.buffers {
+		held += len(buf.packets)
+	}
+	return len(s.buffers), held, s.dropped
+}
@@ -12,6 +12,9 @@ package yggdrasil
 //  A little annoying to do with constant changes from backpressure
 
 import (
+	"encoding/hex"
+	"errors"
+	"math"
 	"math/rand"
 	"sync"
 	"sync/atomic"
@@ -21,6 +24,7 @@ import (
 const switch_timeout = time.Minute
 const switch_updateInterval = switch_timeout / 2
 const switch_throttle = switch_updateInterval / 2
+const switch_historySize = 64 // Number of coords changes to remember
 
 // The switch locator represents the topology and network state dependent info about a node, minus the signatures that go with it.
 // Nodes will pick the best root they see, provided that the root continues to push out updates with new timestamps.
@@ -168,8 +172,62 @@ type switchTable struct {
 	idleIn   chan switchPort     // Incoming idle notifications from peer links
 	admin    chan func()         // Pass a lambda for the admin socket to query stuff
 	queues   switch_buffers      // Queues - not atomic so ONLY use through admin chan
+	history  []switchHistoryInfo // Recent changes to our own coords, protected by mutex
+	// Parent selection preferences, set before the switch is started
+	preferred   map[boxPubKey]struct{} // Peers to use as parent in preference to others
+	pinned      bool                   // Only ever use preferred peers as parent
+	holddown    time.Duration          // Time after changing parent before changing again for a shorter path
+	parentTime  time.Time              // When the parent last changed
+	reparenting bool                   // Reprocessing all messages after the parent's coords changed
+
+	busy map[switchPort]*switch_busyPeriod // Peers that have been kept busy since they were last idle, only used by the worker
+
+	flows        map[string]*switch_flow // Next hops that traffic flows are kept on, only used by the worker
+	flowsCleaned time.Time               // When expired flows were last removed
+}
+
+// The next hop that a traffic flow is kept on, so that its packets aren't reordered by taking different paths.
+// A flow is identified by its stream ID, which is its coords along with the flow label, or a hash of its protocol and ports, that the source session appended to them.
+// Once a flow has been idle for switch_flowTimeout, its next packet may take a different path without overtaking any others, so it's free to move.
+type switch_flow struct {
+	port    switchPort
+	last    time.Time // When the flow last sent a packet
+	packets uint64
+	bytes   uint64
+}
+
+const switch_flowTimeout = 5 * time.Second
+
+// The traffic sent to a peer since it was last idle, used to estimate the throughput of the link.
+// A link that is kept busy can't carry traffic any faster than it's being given it, so the rate at which it takes traffic is an estimate of its throughput.
+type switch_busyPeriod struct {
+	peer  *peer // The peer on the port, in case the port is reused by a new peer
+	start time.Time
+	bytes uint64
 }
 
+// A busy period is only used to estimate throughput if it lasted and carried at least this much, as short bursts only fill buffers and don't say much about the link.
+const (
+	switch_busyMinTime  = 200 * time.Millisecond
+	switch_busyMinBytes = 262144
+)
+
+// A change to our own coords, kept so that connectivity problems can be matched up with reparenting.
+type switchHistoryInfo struct {
+	time      time.Time
+	reason    string
+	oldCoords []byte
+	newCoords []byte
+	oldRoot   sigPubKey
+	newRoot   sigPubKey
+	oldParent *boxPubKey // Nil if we were the root
+	newParent *boxPubKey // Nil if we're now the root
+}
+
+// A peer is only chosen as parent for a shorter path if its quality score is no more than this far below the parent's, and is chosen for a path that's no longer if its score is more than this far above.
+// Links need to differ by this much to change parent, so two links of similar quality don't take turns.
+const switch_scoreMargin = 20
+
 // Initializes the switchTable struct.
 func (t *switchTable) init(core *Core, key sigPubKey) {
 	now := time.Now()
@@ -186,6 +244,52 @@ func (t *switchTable) init(core *Core, key sigPubKey) {
 	t.admin = make(chan func())
 }
 
+// Sets which peers, by encryption key, are preferred as our parent, whether only those peers may be our parent, and how long to wait after changing parent before changing again for a shorter path to the root.
+// This must be called before the switch is started.
+func (t *switchTable) setParentPreferences(keys []string, pinned bool, holddown time.Duration) error {
+	preferred := make(map[boxPubKey]struct{})
+	for _, key := range keys {
+		keyBytes, err := hex.DecodeString(key)
+		if err != nil {
+			return err
+		}
+		if len(keyBytes) != boxPubKeyLen {
+			return errors.New("invalid key length: " + key)
+		}
+		var box boxPubKey
+		copy(box[:], keyBytes)
+		preferred[box] = struct{}{}
+	}
+	if pinned && len(preferred) == 0 {
+		return errors.New("the parent can't be pinned without any preferred peers")
+	}
+	t.preferred = preferred
+	t.pinned = pinned
+	t.holddown = holddown
+	return nil
+}
+
+// Gets the quality score of the peer on the given port and whether it's suppressed for flapping, or a perfect score if there's no peer there.
+func (t *switchTable) getPortScore(port switchPort) (float64, bool) {
+	if p, isIn := t.core.peers.getPorts()[port]; isIn && port != 0 {
+		return p.getScore()
+	}
+	return 100, false
+}
+
+// Checks if the peer on the given port is preferred as our parent.
+func (t *switchTable) isPreferred(port switchPort) bool {
+	if len(t.preferred) == 0 {
+		return false
+	}
+	p, isIn := t.core.peers.ports.Load().(map[switchPort]*peer)[port]
+	if !isIn {
+		return false
+	}
+	_, isIn = t.preferred[p.box]
+	return isIn
+}
+
 // Safely gets a copy of this node's locator.
 func (t *switchTable) getLocator() switchLocator {
 	t.mutex.RLock()
@@ -224,6 +328,9 @@ func (t *switchTable) cleanRoot() {
 		doUpdate = true
 	}
 	if doUpdate {
+		if t.data.locator.root != t.key {
+			t.addHistory(now, "root", switchLocator{root: t.key}, switchPort(0))
+		}
 		t.parent = switchPort(0)
 		t.time = now
 		if t.data.locator.root != t.key {
@@ -239,6 +346,41 @@ func (t *switchTable) cleanRoot() {
 	}
 }
 
+// Records a change to our own locator or parent in the history, removing the oldest entry if the history is full.
+// The reason is "root" if we've become the root, or "parent" if we've picked a new parent.
+// Must be called with the mutex held, before t.data.locator and t.parent are updated.
+func (t *switchTable) addHistory(now time.Time, reason string, locator switchLocator, parent switchPort) {
+	ports := t.core.peers.getPorts()
+	getKey := func(port switchPort) *boxPubKey {
+		if p, isIn := ports[port]; isIn && port != 0 {
+			key := p.box
+			return &key
+		}
+		return nil
+	}
+	info := switchHistoryInfo{
+		time:      now,
+		reason:    reason,
+		oldCoords: t.data.locator.getCoords(),
+		newCoords: locator.getCoords(),
+		oldRoot:   t.data.locator.root,
+		newRoot:   locator.root,
+		oldParent: getKey(t.parent),
+		newParent: getKey(parent),
+	}
+	if len(t.history) >= switch_historySize {
+		t.history = append(t.history[:0], t.history[1:]...)
+	}
+	t.history = append(t.history, info)
+}
+
+// Gets a copy of the history of changes to our own coords, oldest first.
+func (t *switchTable) getHistory() []switchHistoryInfo {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return append([]switchHistoryInfo(nil), t.history...)
+}
+
 // Removes a peer.
 // Must be called by the router mainLoop goroutine, e.g. call router.doAdmin with a lambda that calls this.
 // If the removed peer was this node's parent, it immediately tries to find a new parent.
@@ -397,17 +539,28 @@ func (t *switchTable) unlockedHandleMsg(msg *switchMsg, fromPort switchPort) {
 	cost := len(sender.locator.coords) * int(pTime.Seconds())
 	pCost := len(t.data.locator.coords) * int(sTime.Seconds())
 	dropTstamp, isIn := t.drop[sender.locator.root]
+	sScore, sSuppressed := t.getPortScore(sender.port)
+	pScore, pSuppressed := t.getPortScore(t.parent)
+	canChange := t.reparenting || now.Sub(t.parentTime) >= t.holddown
 	// Here be dragons
 	switch {
 	case !noLoop: // do nothing
 	case isIn && dropTstamp >= sender.locator.tstamp: // do nothing
+	case t.pinned && !t.isPreferred(sender.port): // do nothing
 	case firstIsBetter(&sender.locator.root, &t.data.locator.root):
 		updateRoot = true
 	case t.data.locator.root != sender.locator.root: // do nothing
 	case t.data.locator.tstamp > sender.locator.tstamp: // do nothing
 	case noParent:
 		updateRoot = true
-	case cost < pCost:
+	case t.isPreferred(sender.port) && !t.isPreferred(t.parent):
+		updateRoot = true
+	case t.isPreferred(t.parent) && !t.isPreferred(sender.port): // do nothing
+	case sender.port != t.parent && sSuppressed && !pSuppressed: // do nothing, the sender keeps disconnecting
+	case cost < pCost && canChange && sScore >= pScore-switch_scoreMargin:
+		updateRoot = true
+	case sender.port != t.parent && cost <= pCost && canChange && sScore > pScore+switch_scoreMargin:
+		// A path that's no longer over a much better link
 		updateRoot = true
 	case sender.port != t.parent: // do nothing
 	case !equiv(&sender.locator, &t.data.locator):
@@ -417,15 +570,20 @@ func (t *switchTable) unlockedHandleMsg(msg *switchMsg, fromPort switchPort) {
 		// Then reprocess *all* messages to look for a better parent
 		// This is so we don't keep using this node as our parent if there's something better
 		t.parent = 0
+		t.reparenting = true
 		t.unlockedHandleMsg(msg, fromPort)
 		for _, info := range t.data.peers {
 			t.unlockedHandleMsg(&info.msg, info.port)
 		}
+		t.reparenting = false
 	case now.Sub(t.time) < switch_throttle: // do nothing
 	case sender.locator.tstamp > t.data.locator.tstamp:
 		updateRoot = true
 	}
 	if updateRoot {
+		if !equiv(&sender.locator, &t.data.locator) || t.parent != sender.port {
+			t.addHistory(now, "parent", sender.locator, sender.port)
+		}
 		if !equiv(&sender.locator, &t.data.locator) {
 			doUpdate = true
 			t.data.seq++
@@ -437,6 +595,9 @@ func (t *switchTable) unlockedHandleMsg(msg *switchMsg, fromPort switchPort) {
 		if t.data.locator.tstamp != sender.locator.tstamp {
 			t.time = now
 		}
+		if t.parent != sender.port {
+			t.parentTime = now
+		}
 		t.data.locator = sender.locator
 		t.parent = sender.port
 		t.core.peers.sendSwitchMsgs()
@@ -533,14 +694,81 @@ func switch_getPacketCoords(packet []byte) []byte {
 	return coords
 }
 
+// Checks if a packet's coords are marked as not needing to be kept in order, which the source session does by putting a second 0 after the 0 that ends the destination's coords.
+// Real coords never contain a 0, since that's the port of the node itself.
+func switch_isUnordered(coords []byte) bool {
+	for len(coords) > 0 {
+		port, length := wire_decode_uint64(coords)
+		if length == 0 {
+			return false
+		}
+		coords = coords[length:]
+		if port == 0 {
+			next, length := wire_decode_uint64(coords)
+			return length != 0 && next == 0
+		}
+	}
+	return false
+}
+
+// Traffic classes, which are queued separately.
+// Protocol traffic (DHT lookups, session pings and so on) is always sent before queued session traffic, and session traffic is dropped first when the queues are full, so a saturated link doesn't break routing.
+// Bench and MTU probe packets are protocol traffic that's marked to be queued as session traffic instead, so that they can't starve it.
+// Session traffic is split by the priority that the source marked it with, which is sent and dropped in the same order.
+// Because the source chooses it, interactive traffic only gets switch_interactiveWeight bytes for each byte of other waiting session traffic.
+// Link protocol traffic (switch messages) never goes through the queues at all.
+const (
+	switch_classBackground  = iota // Session traffic with background priority
+	switch_classTraffic            // Session traffic
+	switch_classInteractive        // Session traffic with interactive priority
+	switch_classProtocol           // Protocol traffic
+	switch_classCount
+)
+
+// Bytes of interactive traffic that are sent for each byte of background or normal session traffic, while both are waiting.
+const switch_interactiveWeight = 3
+
+// Bytes of interactive traffic that can be sent in a burst while other session traffic is waiting.
+const switch_interactiveBurst = 65536
+
+// Names of the traffic classes, for the admin API.
+var switch_classNames = [switch_classCount]string{"background", "traffic", "interactive", "protocol"}
+
+// Counters of packets handled in each traffic class.
+type switch_classStats struct {
+	sentPackets    uint64
+	sentBytes      uint64
+	droppedPackets uint64
+	droppedBytes   uint64
+}
+
+// Gets the traffic class of a packet.
+func switch_getPacketClass(packet []byte) int {
+	priority := priority_fromCoords(switch_getPacketCoords(packet))
+	if pType, _ := wire_decode_uint64(packet); pType == wire_ProtocolTraffic {
+		if priority == priority_measurement {
+			return switch_classTraffic
+		}
+		return switch_classProtocol
+	}
+	switch priority {
+	case priority_background:
+		return switch_classBackground
+	case priority_interactive:
+		return switch_classInteractive
+	default:
+		return switch_classTraffic
+	}
+}
+
 // Returns a unique string for each stream of traffic
-// Equal to coords
+// Equal to coords, preceded by the traffic class, so that each class is queued separately
 // The sender may append arbitrary info to the end of coords (as long as it's begins with a 0x00) to designate separate traffic streams
 // Currently, it's the IPv6 next header type and the first 2 uint16 of the next header
 // This is equivalent to the TCP/UDP protocol numbers and the source / dest ports
 // TODO figure out if something else would make more sense (other transport protocols?)
 func switch_getPacketStreamID(packet []byte) string {
-	return string(switch_getPacketCoords(packet))
+	return string(append([]byte{byte(switch_getPacketClass(packet))}, switch_getPacketCoords(packet)...))
 }
 
 // Find the best port for a given set of coords
@@ -567,28 +795,59 @@ func (t *switchTable) handleIn(packet []byte, idle map[switchPort]struct{}) bool
 	ports := t.core.peers.getPorts()
 	if t.selfIsClosest(coords) {
 		// TODO? call the router directly, and remove the whole concept of a self peer?
+		t.queues.countSent(packet)
 		ports[0].sendPacket(packet)
 		return true
 	}
 	table := t.getTable()
 	myDist := table.self.dist(coords)
 	var best *peer
+	var flow *switch_flow
+	if switch_getPacketClass(packet) != switch_classProtocol && !switch_isUnordered(coords) {
+		flow = t.getFlow(switch_getPacketStreamID(packet))
+		if t.flowIsPinned(flow, coords) {
+			// Keep the flow on the next hop that it's been using, and wait for it if it's busy
+			if _, isIdle := idle[flow.port]; !isIdle {
+				return false
+			}
+			best = ports[flow.port]
+		}
+	}
 	bestDist := myDist
-	for port := range idle {
-		if to := ports[port]; to != nil {
-			if info, isIn := table.elems[to.port]; isIn {
-				dist := info.locator.dist(coords)
-				if !(dist < bestDist) {
-					continue
+	var bestThroughput float64
+	if best == nil {
+		for port := range idle {
+			if to := ports[port]; to != nil {
+				if info, isIn := table.elems[to.port]; isIn {
+					dist := info.locator.dist(coords)
+					throughput := to.getThroughput()
+					if throughput == 0 {
+						// Not known yet, so try this link to find out
+						throughput = math.Inf(1)
+					}
+					switch {
+					case dist < bestDist:
+					case best != nil && dist == bestDist && throughput > bestThroughput:
+						// Break ties between equally close next hops in favour of the faster link
+					default:
+						continue
+					}
+					best = to
+					bestDist = dist
+					bestThroughput = throughput
 				}
-				best = to
-				bestDist = dist
 			}
 		}
 	}
 	if best != nil {
 		// Send to the best idle next hop
+		t.core.flowTrace.traceSwitch(packet, true, "sent to port %d", best.port)
+		if flow != nil {
+			flow.use(best.port, packet)
+		}
 		delete(idle, best.port)
+		t.queues.countSent(packet)
+		t.countBusy(best, packet)
 		best.sendPacket(packet)
 		return true
 	} else {
@@ -609,6 +868,7 @@ const switch_buffer_maxSize = 4 * 1048576 // Maximum 4 MB
 type switch_buffer struct {
 	packets []switch_packetInfo // Currently buffered packets, which may be dropped if it grows too large
 	size    uint64              // Total queue size in bytes
+	class   int                 // Traffic class of the packets
 }
 
 type switch_buffers struct {
@@ -616,6 +876,23 @@ type switch_buffers struct {
 	size    uint64                   // Total size of all buffers, in bytes
 	maxbufs int
 	maxsize uint64
+	stats   [switch_classCount]switch_classStats
+	credit  int64 // Bytes of interactive traffic that can still be sent ahead of other waiting session traffic
+}
+
+// Counts a packet as sent in its traffic class.
+func (b *switch_buffers) countSent(packet []byte) {
+	stats := &b.stats[switch_getPacketClass(packet)]
+	stats.sentPackets++
+	stats.sentBytes += uint64(len(packet))
+}
+
+// Counts a packet as dropped in its traffic class, and returns it to the pool.
+func (b *switch_buffers) drop(packet []byte) {
+	stats := &b.stats[switch_getPacketClass(packet)]
+	stats.droppedPackets++
+	stats.droppedBytes += uint64(len(packet))
+	util_putBytes(packet)
 }
 
 func (b *switch_buffers) cleanup(t *switchTable) {
@@ -625,7 +902,8 @@ func (b *switch_buffers) cleanup(t *switchTable) {
 		coords := switch_getPacketCoords(packet.bytes)
 		if t.selfIsClosest(coords) {
 			for _, packet := range buf.packets {
-				util_putBytes(packet.bytes)
+				t.core.flowTrace.traceSwitch(packet.bytes, true, "dropped from the queue, no peer is closer to the destination")
+				b.drop(packet.bytes)
 			}
 			b.size -= buf.size
 			delete(b.bufs, streamID)
@@ -633,10 +911,23 @@ func (b *switch_buffers) cleanup(t *switchTable) {
 	}
 
 	for b.size > switch_buffer_maxSize {
-		// Drop a random queue
-		target := rand.Uint64() % b.size
+		// Drop from a random queue, weighted by size, in the lowest class that has anything queued
+		class := switch_classCount
+		var classSize uint64
+		for _, buf := range b.bufs {
+			switch {
+			case buf.class < class:
+				class, classSize = buf.class, buf.size
+			case buf.class == class:
+				classSize += buf.size
+			}
+		}
+		target := rand.Uint64() % classSize
 		var size uint64 // running total
 		for streamID, buf := range b.bufs {
+			if buf.class != class {
+				continue
+			}
 			size += buf.size
 			if size < target {
 				continue
@@ -645,7 +936,8 @@ func (b *switch_buffers) cleanup(t *switchTable) {
 			packet, buf.packets = buf.packets[0], buf.packets[1:]
 			buf.size -= uint64(len(packet.bytes))
 			b.size -= uint64(len(packet.bytes))
-			util_putBytes(packet.bytes)
+			t.core.flowTrace.traceSwitch(packet.bytes, true, "dropped from the queue, which is full")
+			b.drop(packet.bytes)
 			if len(buf.packets) == 0 {
 				delete(b.bufs, streamID)
 			} else {
@@ -657,6 +949,48 @@ func (b *switch_buffers) cleanup(t *switchTable) {
 	}
 }
 
+// Gets the flow with the given stream ID, adding it if it's new.
+// Flows that have expired are removed every switch_flowTimeout.
+func (t *switchTable) getFlow(streamID string) *switch_flow {
+	now := time.Now()
+	if now.Sub(t.flowsCleaned) > switch_flowTimeout {
+		for id, flow := range t.flows {
+			if now.Sub(flow.last) > switch_flowTimeout {
+				delete(t.flows, id)
+			}
+		}
+		t.flowsCleaned = now
+	}
+	flow, isIn := t.flows[streamID]
+	if !isIn {
+		flow = &switch_flow{}
+		t.flows[streamID] = flow
+	}
+	return flow
+}
+
+// Checks if a flow is kept on its next hop, which it is if it's sent a packet recently and the next hop is still closer to the destination.
+func (t *switchTable) flowIsPinned(flow *switch_flow, coords []byte) bool {
+	switch {
+	case flow.port == 0:
+		return false
+	case time.Since(flow.last) > switch_flowTimeout:
+		return false
+	case t.core.peers.getPorts()[flow.port] == nil:
+		return false
+	default:
+		return t.portIsCloser(coords, flow.port)
+	}
+}
+
+// Records a packet of the flow being sent to the next hop.
+func (f *switch_flow) use(port switchPort, packet []byte) {
+	f.port = port
+	f.last = time.Now()
+	f.packets++
+	f.bytes += uint64(len(packet))
+}
+
 // Handles incoming idle notifications
 // Loops over packets and sends the newest one that's OK for this peer to send
 // Returns true if the peer is no longer idle, false if it should be added to the idle list
@@ -665,20 +999,45 @@ func (t *switchTable) handleIdle(port switchPort) bool {
 	if to == nil {
 		return true
 	}
-	var best string
-	var bestPriority float64
+	var best, lower string
+	var bestClass, lowerClass int
+	var bestPriority, lowerPriority float64
 	t.queues.cleanup(t)
 	now := time.Now()
 	for streamID, buf := range t.queues.bufs {
 		// Filter over the streams that this node is closer to
-		// Keep the one with the smallest queue
+		// Keep the one in the highest class, and then with the smallest queue
+		// Also keep the best one below interactive, in case interactive traffic has used up its share
+		isLower := buf.class < switch_classInteractive
+		if buf.class < bestClass && !(isLower && buf.class >= lowerClass) {
+			continue
+		}
 		packet := buf.packets[0]
 		coords := switch_getPacketCoords(packet.bytes)
+		if flow, isIn := t.flows[streamID]; isIn && flow.port != port && t.flowIsPinned(flow, coords) {
+			// Kept on a different next hop
+			continue
+		}
 		priority := float64(now.Sub(packet.time)) / float64(buf.size)
-		if priority > bestPriority && t.portIsCloser(coords, port) {
+		if priority <= 0 || !t.portIsCloser(coords, port) {
+			continue
+		}
+		if buf.class > bestClass || (buf.class == bestClass && priority > bestPriority) {
 			best = streamID
+			bestClass = buf.class
 			bestPriority = priority
 		}
+		if isLower && (buf.class > lowerClass || (buf.class == lowerClass && priority > lowerPriority)) {
+			lower = streamID
+			lowerClass = buf.class
+			lowerPriority = priority
+		}
+	}
+	isContended := bestClass == switch_classInteractive && lowerPriority != 0
+	if isContended && t.queues.credit <= 0 {
+		// Interactive traffic has had its share while other session traffic waits, so send that instead
+		best, bestClass = lower, lowerClass
+		isContended = false
 	}
 	if bestPriority != 0 {
 		buf := t.queues.bufs[best]
@@ -693,26 +1052,72 @@ func (t *switchTable) handleIdle(port switchPort) bool {
 			// Need to update the map, since buf was retrieved by value
 			t.queues.bufs[best] = buf
 		}
+		t.core.flowTrace.traceSwitch(packet.bytes, true, "sent to port %d after %s in the queue", port, time.Since(packet.time).Round(time.Microsecond))
+		if bestClass != switch_classProtocol && !switch_isUnordered(switch_getPacketCoords(packet.bytes)) {
+			t.getFlow(best).use(port, packet.bytes)
+		}
+		switch {
+		case isContended:
+			t.queues.credit -= int64(len(packet.bytes))
+		case bestClass < switch_classInteractive:
+			t.queues.credit += int64(len(packet.bytes)) * switch_interactiveWeight
+			if t.queues.credit > switch_interactiveBurst {
+				t.queues.credit = switch_interactiveBurst
+			}
+		}
+		t.queues.countSent(packet.bytes)
+		t.countBusy(to, packet.bytes)
 		to.sendPacket(packet.bytes)
 		return true
 	} else {
+		t.endBusy(to)
 		return false
 	}
 }
 
+// Counts a packet sent to a peer towards the peer's current busy period, starting one if the peer was idle.
+func (t *switchTable) countBusy(to *peer, packet []byte) {
+	busy, isIn := t.busy[to.port]
+	if !isIn || busy.peer != to {
+		busy = &switch_busyPeriod{peer: to, start: time.Now()}
+		t.busy[to.port] = busy
+	}
+	busy.bytes += uint64(len(packet))
+}
+
+// Ends a peer's busy period when it becomes idle, and updates the estimated throughput of the link if the period was long enough to say anything useful.
+func (t *switchTable) endBusy(to *peer) {
+	busy, isIn := t.busy[to.port]
+	if !isIn {
+		return
+	}
+	delete(t.busy, to.port)
+	if busy.peer != to {
+		return
+	}
+	if elapsed := time.Since(busy.start); elapsed >= switch_busyMinTime && busy.bytes >= switch_busyMinBytes {
+		to.updateThroughput(8 * float64(busy.bytes) / elapsed.Seconds())
+	}
+}
+
 // The switch worker does routing lookups and sends packets to where they need to be
 func (t *switchTable) doWorker() {
 	t.queues.bufs = make(map[string]switch_buffer) // Packets per PacketStreamID (string)
-	idle := make(map[switchPort]struct{})          // this is to deduplicate things
+	t.queues.credit = switch_interactiveBurst
+	idle := make(map[switchPort]struct{}) // this is to deduplicate things
+	t.busy = make(map[switchPort]*switch_busyPeriod)
+	t.flows = make(map[string]*switch_flow)
 	for {
 		select {
 		case bytes := <-t.packetIn:
 			// Try to send it somewhere (or drop it if it's corrupt or at a dead end)
 			if !t.handleIn(bytes, idle) {
 				// There's nobody free to take it right now, so queue it for later
+				t.core.flowTrace.traceSwitch(bytes, false, "queued, no idle peer is closer to the destination")
 				packet := switch_packetInfo{bytes, time.Now()}
 				streamID := switch_getPacketStreamID(packet.bytes)
 				buf, bufExists := t.queues.bufs[streamID]
+				buf.class = switch_getPacketClass(packet.bytes)
 				buf.packets = append(buf.packets, packet)
 				buf.size += uint64(len(packet.bytes))
 				t.queues.size += uint64(len(packet.bytes))
@@ -0,0 +1,10 @@
+// +build !windows
+
+package yggdrasil
+
+import "errors"
+
+// TAP adapters only need to be installed on Windows.
+func tap_uninstall(ifname string) error {
+	return errors.New("removing the TUN/TAP adapter is only supported on Windows")
+}
@@ -0,0 +1,203 @@
+package yggdrasil
+
+// This makes sure that there's a TAP adapter for us to use on Windows, so that
+// users don't have to install and rename one by hand before starting the node.
+// Adapters are listed with PowerShell. If there isn't one that we can use, or
+// the driver is too old, the adapter is installed or the driver updated with
+// tapinstall from the TAP-Windows package, and a new adapter is renamed to
+// the configured interface name, or to tap_defaultName if it's "auto".
+// Adapters that were already there, which may belong to other programs like
+// OpenVPN, are never used unless they have that name, nor renamed, and
+// uninstalling only removes the one with our name.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The component ID of the TAP-Windows driver, and the name given to an adapter that we install when the interface name is "auto".
+const tap_componentID = "tap0901"
+const tap_defaultName = "Yggdrasil"
+
+// The oldest driver version that's known to work, which is the NDIS 5 driver from tap-windows-9.9.2.
+var tap_minVersion = []int{9, 0, 0, 9}
+
+// A TAP adapter, as listed by PowerShell.
+type tapAdapter struct {
+	name     string
+	version  string
+	deviceID string // The PnP instance ID, which tapinstall removes the adapter by
+}
+
+// Lists the TAP adapters that are installed.
+func tap_getAdapters() ([]tapAdapter, error) {
+	script := fmt.Sprintf("Get-NetAdapter -IncludeHidden | Where-Object { $_.ComponentID -eq '%s' } | "+
+		"ForEach-Object { $_.Name + \"`t\" + $_.DriverVersionString + \"`t\" + $_.PnPDeviceID }", tap_componentID)
+	output, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script).Output()
+	if err != nil {
+		return nil, err
+	}
+	var adapters []tapAdapter
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		adapters = append(adapters, tapAdapter{name: fields[0], version: fields[1], deviceID: fields[2]})
+	}
+	return adapters, nil
+}
+
+// Checks if a driver version is at least tap_minVersion. Missing parts of short versions count as 0, i.e. "9.21" is 9.21.0.0, and versions that can't be parsed are assumed to be new enough.
+func tap_versionOK(version string) bool {
+	parts := strings.Split(version, ".")
+	for idx, min := range tap_minVersion {
+		var n int
+		if idx < len(parts) {
+			var err error
+			if n, err = strconv.Atoi(parts[idx]); err != nil {
+				return true
+			}
+		}
+		if n != min {
+			return n > min
+		}
+	}
+	return true
+}
+
+// Finds tapinstall and the driver's inf file, next to our executable or where the TAP-Windows package installs them.
+func tap_findInstaller() (string, string, error) {
+	var dirs []string
+	if exe, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+	if pf := os.Getenv("ProgramFiles"); pf != "" {
+		dirs = append(dirs, filepath.Join(pf, "TAP-Windows", "bin"))
+	}
+	for _, dir := range dirs {
+		tapinstall := filepath.Join(dir, "tapinstall.exe")
+		if _, err := os.Stat(tapinstall); err != nil {
+			continue
+		}
+		for _, infDir := range []string{dir, filepath.Join(dir, "..", "driver"), filepath.Join(dir, "driver")} {
+			inf := filepath.Join(infDir, "OemVista.inf")
+			if _, err := os.Stat(inf); err == nil {
+				return tapinstall, inf, nil
+			}
+		}
+	}
+	return "", "", errors.New("tapinstall.exe and OemVista.inf from TAP-Windows weren't found")
+}
+
+// Runs a command, logging it and its output if it fails.
+func (tun *tunDevice) runTAPCommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	tun.core.log.Printf("TAP command: %v", strings.Join(cmd.Args, " "))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		tun.core.log.Printf("Windows %s failed: %v.", filepath.Base(name), err)
+		tun.core.log.Println(string(output))
+	}
+	return err
+}
+
+// Makes sure there's an up to date TAP adapter for the interface name, installing or updating it if needed.
+// Returns the name of the adapter to use, or an empty string to let the driver pick one.
+func (tun *tunDevice) prepareTAP(ifname string) (string, error) {
+	adapters, err := tap_getAdapters()
+	if err != nil {
+		// Older versions of Windows don't have Get-NetAdapter, so carry on as before
+		tun.core.log.Println("Failed to list TAP adapters, not checking them:", err)
+		if ifname == "auto" {
+			return "", nil
+		}
+		return ifname, nil
+	}
+	want := ifname
+	if want == "auto" {
+		want = tap_defaultName
+	}
+	var found *tapAdapter
+	for idx := range adapters {
+		if adapters[idx].name == want {
+			found = &adapters[idx]
+			break
+		}
+	}
+	if found != nil && tap_versionOK(found.version) {
+		return found.name, nil
+	}
+	tapinstall, inf, err := tap_findInstaller()
+	if err != nil {
+		if found != nil {
+			tun.core.log.Printf("TAP-Windows driver %s is older than the supported version, and can't be updated: %v", found.version, err)
+			return found.name, nil
+		}
+		return "", fmt.Errorf("no TAP adapter named %s, and one can't be installed: %v", want, err)
+	}
+	if found != nil {
+		tun.core.log.Printf("Updating TAP-Windows driver %s", found.version)
+		if err := tun.runTAPCommand(tapinstall, "update", inf, tap_componentID); err != nil {
+			tun.core.log.Println("Failed to update the TAP-Windows driver, using the old one")
+		}
+		return found.name, nil
+	}
+	tun.core.log.Printf("Installing a TAP adapter named %s", want)
+	if err := tun.runTAPCommand(tapinstall, "install", inf, tap_componentID); err != nil {
+		return "", err
+	}
+	// The new adapter is the one that wasn't there before
+	existing := make(map[string]bool)
+	for _, adapter := range adapters {
+		existing[adapter.deviceID] = true
+	}
+	installed, err := tap_getAdapters()
+	if err != nil {
+		return "", err
+	}
+	for _, adapter := range installed {
+		if existing[adapter.deviceID] {
+			continue
+		}
+		err := tun.runTAPCommand("netsh", "interface", "set", "interface",
+			fmt.Sprintf("name=%s", adapter.name),
+			fmt.Sprintf("newname=%s", want))
+		if err != nil {
+			return "", err
+		}
+		return want, nil
+	}
+	return "", errors.New("the installed TAP adapter wasn't found")
+}
+
+// Removes the TAP adapter for the interface name, if there is one.
+func tap_uninstall(ifname string) error {
+	if ifname == "auto" {
+		ifname = tap_defaultName
+	}
+	adapters, err := tap_getAdapters()
+	if err != nil {
+		return err
+	}
+	for _, adapter := range adapters {
+		if adapter.name != ifname {
+			continue
+		}
+		tapinstall, _, err := tap_findInstaller()
+		if err != nil {
+			return err
+		}
+		output, err := exec.Command(tapinstall, "remove", "@"+adapter.deviceID).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+	return fmt.Errorf("no TAP adapter named %s", ifname)
+}
@@ -15,11 +15,16 @@ package yggdrasil
 //  See version.go for version metadata format
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,6 +36,13 @@ const tcp_msgSize = 2048 + 65535 // TODO figure out what makes sense
 const default_tcp_timeout = 6 * time.Second
 const tcp_ping_interval = (default_tcp_timeout * 2 / 3)
 
+// Peering policies that can be applied to a listener.
+const (
+	tcp_policyDefault    = "default"    // Global allowed keys, plus link-local peers
+	tcp_policyOpen       = "open"       // Any peer is allowed
+	tcp_policyRestricted = "restricted" // Only the listener's (or else global) allowed keys
+)
+
 // Wrapper function for non tcp/ip connections.
 func setNoDelay(c net.Conn, delay bool) {
 	tcp, ok := c.(*net.TCPConn)
@@ -41,12 +53,49 @@ func setNoDelay(c net.Conn, delay bool) {
 
 // The TCP listener and information about active TCP connections, to avoid duplication.
 type tcpInterface struct {
-	core        *Core
-	serv        net.Listener
-	tcp_timeout time.Duration
-	mutex       sync.Mutex // Protecting the below
-	calls       map[string]struct{}
-	conns       map[tcpInfo](chan struct{})
+	core          *Core
+	serv          net.Listener
+	tcp_timeout   time.Duration
+	tcp_keepalive time.Duration
+	tcp_handshake time.Duration
+	tcp_passive   bool
+	mutex         sync.Mutex // Protecting the below
+	listeners     []*tcpListener
+	main          *tcpListener // The listener for the Listen address, which serv belongs to
+	calls         map[string]struct{}
+	conns         map[tcpInfo](chan struct{})
+	transports    map[string]Transport
+	outgoing      map[net.Conn]*tcpOutgoing
+	linkKeys      map[boxPubKey]struct{} // Ephemeral link keys of our handshakes in progress, to tell a connection to ourself from a node with a copy of our keys
+}
+
+// How often keep-alive traffic is sent on an idle link, and how long to wait for traffic from the peer before assuming the link is dead.
+// In passive mode, we don't send keep-alives or time out reads, and instead have the operating system send TCP keep-alive probes, which it only does when the link is idle.
+// Links that carry traffic then have no keep-alive traffic at all, and dead peers are found by TCP itself, which is slower.
+// Passive mode is only used if both ends ask for it in the link handshake, as an active peer would time out without our keep-alives, and otherwise the link falls back to keep-alives.
+// The handshake timeout limits how long the peer has to finish exchanging metadata and any handshake steps, which can take much longer than a keep-alive on links over Tor or satellite.
+// The MTU of the link is set per peer along with the timeouts, and caps the MTU of our sessions whose traffic leaves through the link.
+type tcpTimeouts struct {
+	keepalive time.Duration
+	read      time.Duration // Reads never time out if this is negative
+	handshake time.Duration // The read timeout is used if this is zero, and the handshake never times out if this is negative
+	passive   bool
+	mtu       uint16 // No cap if this is zero
+}
+
+// An outgoing connection, which is closed and dialled again if its local address goes away.
+type tcpOutgoing struct {
+	call   string // The name of the call that made the connection, i.e. "host:port" or "host:port/intf"
+	redial bool   // Set if the connection was closed to be dialled again
+}
+
+// A listener for incoming connections, along with the peering policy that is applied to connections accepted by it.
+// If it's bound to a specific address, it's listened on again when the host's addresses change, and serv is nil while the address can't be bound.
+type tcpListener struct {
+	addr    string // The configured address, with the port that was bound if it was configured as 0
+	serv    net.Listener
+	policy  string
+	allowed map[boxPubKey]struct{} // Only used by the restricted policy
 }
 
 // This is used as the key to a map that tracks existing connections, to prevent multiple connections to the same keys and local/remote address pair from occuring.
@@ -60,48 +109,378 @@ type tcpInfo struct {
 
 // Returns the address of the listener.
 func (iface *tcpInterface) getAddr() *net.TCPAddr {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+	if iface.serv == nil {
+		return &net.TCPAddr{}
+	}
 	return iface.serv.Addr().(*net.TCPAddr)
 }
 
+// Gets the timeouts used for links that don't set their own.
+func (iface *tcpInterface) getTimeouts() *tcpTimeouts {
+	return &tcpTimeouts{keepalive: iface.tcp_keepalive, read: iface.tcp_timeout, handshake: iface.tcp_handshake, passive: iface.tcp_passive}
+}
+
+// Gets the timeouts for a link from the keepalive, timeout, handshake and passive parameters of its peer URI, along with its MTU from the mtu parameter, which are removed from args.
+// Missing parameters use the global timeouts, and the read timeout is raised if needed so the peer has time to send a keep-alive.
+func (iface *tcpInterface) parseTimeouts(args url.Values) (*tcpTimeouts, error) {
+	timeouts := iface.getTimeouts()
+	if s := args.Get("keepalive"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, errors.New("invalid keepalive: " + s)
+		}
+		timeouts.keepalive = d
+	}
+	if s := args.Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, errors.New("invalid timeout: " + s)
+		}
+		timeouts.read = d
+	}
+	if s := args.Get("handshake"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, errors.New("invalid handshake: " + s)
+		}
+		timeouts.handshake = d
+	}
+	if s := args.Get("passive"); s != "" {
+		passive, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, errors.New("invalid passive: " + s)
+		}
+		timeouts.passive = passive
+	}
+	if s := args.Get("mtu"); s != "" {
+		mtu, err := strconv.ParseUint(s, 10, 16)
+		if err != nil || mtu < 1280 {
+			return nil, errors.New("invalid mtu: " + s)
+		}
+		timeouts.mtu = uint16(mtu)
+	}
+	args.Del("keepalive")
+	args.Del("timeout")
+	args.Del("handshake")
+	args.Del("passive")
+	args.Del("mtu")
+	timeouts.read = tcp_minReadTimeout(timeouts.read, timeouts.keepalive)
+	return timeouts, nil
+}
+
+// Raises a read timeout to 1.5 times the keep-alive interval, unless it's negative, so that a link isn't dropped while waiting for a keep-alive.
+func tcp_minReadTimeout(read time.Duration, keepalive time.Duration) time.Duration {
+	if min := keepalive * 3 / 2; read >= 0 && read < min {
+		return min
+	}
+	return read
+}
+
 // Attempts to initiate a connection to the provided address.
-func (iface *tcpInterface) connect(addr string, intf string) {
-	iface.call(addr, nil, intf)
+// If timeouts is nil, the global timeouts are used, which is also true for the other connect functions.
+func (iface *tcpInterface) connect(addr string, intf string, timeouts *tcpTimeouts) {
+	iface.call(addr, nil, intf, nil, timeouts)
 }
 
 // Attempst to initiate a connection to the provided address, viathe provided socks proxy address.
-func (iface *tcpInterface) connectSOCKS(socksaddr, peeraddr string) {
-	iface.call(peeraddr, &socksaddr, "")
+func (iface *tcpInterface) connectSOCKS(socksaddr, peeraddr string, timeouts *tcpTimeouts) {
+	iface.call(peeraddr, &socksaddr, "", nil, timeouts)
+}
+
+// Attempts to initiate a connection to a node listening on the unix socket at the provided path.
+func (iface *tcpInterface) connectUnix(path string, timeouts *tcpTimeouts) {
+	iface.call("unix://"+path, nil, "", func() (net.Conn, error) {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		return &wrappedConn{
+			c: conn,
+			raddr: &wrappedAddr{
+				network: "unix",
+				addr:    "unix://" + path,
+			},
+		}, nil
+	}, timeouts)
+}
+
+// Attempts to initiate a connection to the provided address, via the first of the configured proxies that works.
+func (iface *tcpInterface) connectProxies(peeraddr string, timeouts *tcpTimeouts) {
+	iface.call(peeraddr, nil, "", func() (net.Conn, error) {
+		return iface.core.proxies.dial(peeraddr)
+	}, timeouts)
+}
+
+// Attempts to initiate a connection to the provided address, via the named pluggable transport, which is given the provided arguments.
+func (iface *tcpInterface) connectTransport(name string, args url.Values, peeraddr string, timeouts *tcpTimeouts) error {
+	iface.mutex.Lock()
+	transport, isIn := iface.transports[name]
+	iface.mutex.Unlock()
+	if !isIn {
+		return errors.New("unknown transport: " + name)
+	}
+	iface.call(peeraddr, nil, "", func() (net.Conn, error) {
+		return transport.Dial(peeraddr, args)
+	}, timeouts)
+	return nil
+}
+
+// Attempts to initiate an in-memory link to the Core listening with the provided name, which must be in the same process.
+func (iface *tcpInterface) connectMem(name string, args url.Values, timeouts *tcpTimeouts) error {
+	latency, bandwidth, err := memlink_parseArgs(args)
+	if err != nil {
+		return err
+	}
+	iface.call("mem://"+name, nil, "", func() (net.Conn, error) {
+		return memlink_dial(name, latency, bandwidth)
+	}, timeouts)
+	return nil
+}
+
+// Attempts to initiate a link over the standard input and output, or a pair of inherited pipes, given by a stdio:// or pipe:// peer URI.
+func (iface *tcpInterface) connectStdio(u *url.URL, timeouts *tcpTimeouts) error {
+	endpoint, name, err := stdiolink_parse(u)
+	if err != nil {
+		return err
+	}
+	iface.call(name, nil, "", func() (net.Conn, error) {
+		return stdiolink_dial(endpoint, name)
+	}, timeouts)
+	return nil
+}
+
+// Adds a pluggable transport with the given name, replacing any existing transport with the same name.
+func (iface *tcpInterface) addTransport(name string, transport Transport) {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+	iface.transports[name] = transport
 }
 
 // Initializes the struct.
-func (iface *tcpInterface) init(core *Core, addr string, readTimeout int32) (err error) {
+func (iface *tcpInterface) init(core *Core, addr string, readTimeout int32, keepaliveInterval int32, handshakeTimeout int32, passiveKeepalive bool) (err error) {
 	iface.core = core
+	iface.tcp_passive = passiveKeepalive
 
+	iface.tcp_keepalive = time.Duration(keepaliveInterval) * time.Millisecond
+	if iface.tcp_keepalive <= 0 {
+		iface.tcp_keepalive = tcp_ping_interval
+	}
 	iface.tcp_timeout = time.Duration(readTimeout) * time.Millisecond
-	if iface.tcp_timeout >= 0 && iface.tcp_timeout < default_tcp_timeout {
+	if iface.tcp_timeout == 0 {
 		iface.tcp_timeout = default_tcp_timeout
 	}
+	iface.tcp_timeout = tcp_minReadTimeout(iface.tcp_timeout, iface.tcp_keepalive)
+	iface.tcp_handshake = time.Duration(handshakeTimeout) * time.Millisecond
 
+	iface.calls = make(map[string]struct{})
+	iface.conns = make(map[tcpInfo](chan struct{}))
+	iface.transports = make(map[string]Transport)
+	iface.outgoing = make(map[net.Conn]*tcpOutgoing)
+	iface.linkKeys = make(map[boxPubKey]struct{})
+	if addr == "none" {
+		// Only outgoing and in-memory links, i.e. for simulations
+		return nil
+	}
 	iface.serv, err = net.Listen("tcp", addr)
 	if err == nil {
-		iface.calls = make(map[string]struct{})
-		iface.conns = make(map[tcpInfo](chan struct{}))
-		go iface.listener()
+		l := &tcpListener{addr: tcp_boundAddr(addr, iface.serv), serv: iface.serv, policy: tcp_policyDefault}
+		iface.main = l
+		iface.listeners = append(iface.listeners, l)
+		go iface.listener(l, l.serv)
 	}
 
 	return err
 }
 
-// Runs the listener, which spawns off goroutines for incoming connections.
-func (iface *tcpInterface) listener() {
-	defer iface.serv.Close()
-	iface.core.log.Println("Listening for TCP on:", iface.serv.Addr().String())
+// Gets a copy of each listener, as they can be rebound at any time.
+func (iface *tcpInterface) getListeners() []tcpListener {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+	var listeners []tcpListener
+	for _, l := range iface.listeners {
+		listeners = append(listeners, *l)
+	}
+	return listeners
+}
+
+// Gets the address to listen on again when rebinding a listener, which keeps the port that was bound, so that peers and multicast announcements stay valid.
+func tcp_boundAddr(addr string, serv net.Listener) string {
+	host, port, err := net.SplitHostPort(addr)
+	bound, isTCP := serv.Addr().(*net.TCPAddr)
+	if err != nil || !isTCP || (port != "" && port != "0") {
+		return addr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(bound.Port))
+}
+
+// Listens again on the address of each listener that's bound to a specific address, if that address is no longer assigned to the host or now resolves to a different address.
+// Listeners on wildcard addresses or unix sockets are left alone, as they keep working whatever the host's addresses are.
+// A listener whose address can't be bound, i.e. because it's gone, is left unbound, and this returns true so that it's tried again later.
+func (iface *tcpInterface) rebindListeners(addrs map[string]struct{}) bool {
+	iface.mutex.Lock()
+	listeners := append([]*tcpListener(nil), iface.listeners...)
+	iface.mutex.Unlock()
+	var unbound bool
+	for _, l := range listeners {
+		if strings.HasPrefix(l.addr, "unix://") {
+			continue
+		}
+		host, _, err := net.SplitHostPort(l.addr)
+		if err != nil || host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			continue
+		}
+		iface.mutex.Lock()
+		serv := l.serv
+		isMain := l == iface.main
+		iface.mutex.Unlock()
+		want, err := net.ResolveTCPAddr("tcp", l.addr)
+		if serv != nil {
+			bound := serv.Addr().(*net.TCPAddr)
+			if _, isIn := addrs[bound.IP.String()]; isIn && (err != nil || want.IP.Equal(bound.IP)) {
+				// Still bound to the right address, or the name can't be resolved right now
+				continue
+			}
+			iface.mutex.Lock()
+			l.serv = nil
+			if isMain {
+				iface.serv = nil
+			}
+			iface.mutex.Unlock()
+			serv.Close()
+		}
+		var newServ net.Listener
+		if err == nil {
+			newServ, err = net.Listen("tcp", l.addr)
+		}
+		if err != nil {
+			if serv != nil {
+				iface.core.log.Println("Failed to listen again on", l.addr+":", err)
+			}
+			unbound = true
+			continue
+		}
+		iface.mutex.Lock()
+		l.serv = newServ
+		if isMain {
+			iface.serv = newServ
+		}
+		iface.mutex.Unlock()
+		go iface.listener(l, newServ)
+	}
+	return unbound
+}
+
+// Starts an additional listener with its own peering policy and allowed keys.
+// An empty policy is treated as the default policy.
+func (iface *tcpInterface) addListener(addr string, policy string, allowed []string) error {
+	if policy == "" {
+		policy = tcp_policyDefault
+	}
+	switch policy {
+	case tcp_policyDefault, tcp_policyOpen, tcp_policyRestricted:
+	default:
+		return errors.New("unknown peering policy: " + policy)
+	}
+	l := &tcpListener{
+		policy:  policy,
+		allowed: make(map[boxPubKey]struct{}),
+	}
+	for _, bstr := range allowed {
+		boxBytes, err := hex.DecodeString(bstr)
+		if err != nil {
+			return err
+		}
+		if len(boxBytes) != boxPubKeyLen {
+			return errors.New("invalid key length: " + bstr)
+		}
+		var box boxPubKey
+		copy(box[:], boxBytes)
+		l.allowed[box] = struct{}{}
+	}
+	serv, err := tcp_listen(addr)
+	if err != nil {
+		return err
+	}
+	l.addr = tcp_boundAddr(addr, serv)
+	l.serv = serv
+	iface.mutex.Lock()
+	iface.listeners = append(iface.listeners, l)
+	iface.mutex.Unlock()
+	go iface.listener(l, serv)
+	return nil
+}
+
+// Listens on the provided address, which is either a TCP address or a unix socket given as unix:///path.
+// A socket left behind by a node that didn't shut down cleanly is removed first, as long as nothing is listening on it.
+func tcp_listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix://") {
+		return net.Listen("tcp", addr)
+	}
+	path := addr[7:]
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New("already listening on " + addr)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// Runs the listener, which spawns off goroutines for incoming connections, until it's replaced by rebinding.
+func (iface *tcpInterface) listener(l *tcpListener, serv net.Listener) {
+	defer serv.Close()
+	network := serv.Addr().Network()
+	iface.core.log.Println("Listening for", strings.ToUpper(network), "on:", serv.Addr().String(), "policy:", l.policy)
 	for {
-		sock, err := iface.serv.Accept()
+		sock, err := serv.Accept()
 		if err != nil {
+			iface.mutex.Lock()
+			replaced := l.serv != serv
+			iface.mutex.Unlock()
+			if replaced {
+				// Closed by rebindListeners
+				return
+			}
 			panic(err)
 		}
-		go iface.handler(sock, true)
+		if network == "unix" {
+			// The other end of a unix socket is usually unnamed, so name it after the socket instead
+			sock = &wrappedConn{
+				c: sock,
+				raddr: &wrappedAddr{
+					network: "unix",
+					addr:    "unix://" + serv.Addr().String(),
+				},
+			}
+		}
+		go iface.handler(sock, l, nil)
+	}
+}
+
+// Returns true if an incoming connection from the given key and remote address is allowed by the listener's peering policy.
+func (l *tcpListener) isAllowed(core *Core, box *boxPubKey, raddr net.Addr) bool {
+	switch l.policy {
+	case tcp_policyOpen:
+		return true
+	case tcp_policyRestricted:
+		if len(l.allowed) == 0 {
+			return core.peers.hasAllowedEncryptionPublicKey(box)
+		}
+		_, isIn := l.allowed[*box]
+		return isIn
+	default:
+		if core.peers.isAllowedEncryptionPublicKey(box) {
+			return true
+		}
+		// Allow unauthorized peers if they're link-local
+		raddrStr, _, _ := net.SplitHostPort(raddr.String())
+		return net.ParseIP(raddrStr).IsLinkLocalUnicast()
 	}
 }
 
@@ -110,25 +489,33 @@ func (iface *tcpInterface) listener() {
 // If the dial is successful, it launches the handler.
 // When finished, it removes the outgoing call, so reconnection attempts can be made later.
 // This all happens in a separate goroutine that it spawns.
-func (iface *tcpInterface) call(saddr string, socksaddr *string, sintf string) {
+// If dial is not nil, it is used to make the connection instead, i.e. for pluggable transports.
+// If timeouts is nil, the global timeouts are used.
+func (iface *tcpInterface) call(saddr string, socksaddr *string, sintf string, dial func() (net.Conn, error), timeouts *tcpTimeouts) {
 	go func() {
 		callname := saddr
 		if sintf != "" {
 			callname = fmt.Sprintf("%s/%s", saddr, sintf)
 		}
 		quit := false
+		redial := false
 		iface.mutex.Lock()
 		if _, isIn := iface.calls[callname]; isIn {
 			quit = true
 		} else {
 			iface.calls[callname] = struct{}{}
 			defer func() {
-				// Block new calls for a little while, to mitigate livelock scenarios
-				time.Sleep(default_tcp_timeout)
-				time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
+				if !redial {
+					// Block new calls for a little while, to mitigate livelock scenarios
+					time.Sleep(default_tcp_timeout)
+					time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
+				}
 				iface.mutex.Lock()
 				delete(iface.calls, callname)
 				iface.mutex.Unlock()
+				if redial {
+					iface.call(saddr, socksaddr, sintf, dial, timeouts)
+				}
 			}()
 		}
 		iface.mutex.Unlock()
@@ -137,7 +524,12 @@ func (iface *tcpInterface) call(saddr string, socksaddr *string, sintf string) {
 		}
 		var conn net.Conn
 		var err error
-		if socksaddr != nil {
+		if dial != nil {
+			conn, err = dial()
+			if err != nil {
+				return
+			}
+		} else if socksaddr != nil {
 			if sintf != "" {
 				return
 			}
@@ -159,8 +551,19 @@ func (iface *tcpInterface) call(saddr string, socksaddr *string, sintf string) {
 			}
 		} else {
 			dialer := net.Dialer{}
-			if sintf != "" {
-				ief, err := net.InterfaceByName(sintf)
+			daddr, dintf := saddr, sintf
+			if dintf != "" {
+				if dst, err := net.ResolveTCPAddr("tcp", daddr); err == nil && dst.IP.IsLinkLocalUnicast() {
+					// Link-local addresses are only reachable through the given interface, so it's used as the zone
+					if dst.Zone != "" && dst.Zone != dintf {
+						return
+					}
+					dst.Zone = dintf
+					daddr, dintf = dst.String(), ""
+				}
+			}
+			if dintf != "" {
+				ief, err := net.InterfaceByName(dintf)
 				if err != nil {
 					return
 				} else {
@@ -169,7 +572,7 @@ func (iface *tcpInterface) call(saddr string, socksaddr *string, sintf string) {
 					}
 					addrs, err := ief.Addrs()
 					if err == nil {
-						dst, err := net.ResolveTCPAddr("tcp", saddr)
+						dst, err := net.ResolveTCPAddr("tcp", daddr)
 						if err != nil {
 							return
 						}
@@ -192,33 +595,91 @@ func (iface *tcpInterface) call(saddr string, socksaddr *string, sintf string) {
 					}
 				}
 			}
-			conn, err = dialer.Dial("tcp", saddr)
+			conn, err = dialer.Dial("tcp", daddr)
 			if err != nil {
 				return
 			}
 		}
-		iface.handler(conn, false)
+		out := &tcpOutgoing{call: callname}
+		iface.mutex.Lock()
+		iface.outgoing[conn] = out
+		iface.mutex.Unlock()
+		iface.handler(conn, nil, timeouts)
+		iface.mutex.Lock()
+		delete(iface.outgoing, conn)
+		redial = out.redial
+		iface.mutex.Unlock()
 	}()
 }
 
+// Gets the names of the calls with an open outgoing connection, i.e. "host:port" or "host:port/intf".
+func (iface *tcpInterface) getOutgoing() []string {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+	var calls []string
+	for _, out := range iface.outgoing {
+		calls = append(calls, out.call)
+	}
+	return calls
+}
+
+// Closes outgoing connections and dials them again, if shouldClose returns true for them or is nil.
+// Returns the number of connections closed.
+func (iface *tcpInterface) reconnect(shouldClose func(conn net.Conn) bool) int {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+	var count int
+	for conn, out := range iface.outgoing {
+		if out.redial || (shouldClose != nil && !shouldClose(conn)) {
+			continue
+		}
+		out.redial = true
+		conn.Close()
+		count++
+	}
+	return count
+}
+
 // This exchanges/checks connection metadata, sets up the peer struct, sets up the writer goroutine, and then runs the reader within the current goroutine.
 // It defers a bunch of cleanup stuff to tear down all of these things when the reader exists (e.g. due to a closed connection or a timeout).
-func (iface *tcpInterface) handler(sock net.Conn, incoming bool) {
+// The listener is the one that accepted the connection, or nil for outgoing connections.
+// If timeouts is nil, the global timeouts are used.
+func (iface *tcpInterface) handler(sock net.Conn, listener *tcpListener, timeouts *tcpTimeouts) {
 	defer sock.Close()
+	if timeouts == nil {
+		timeouts = iface.getTimeouts()
+	}
+	passive := false
+	if tc, ok := sock.(*net.TCPConn); ok && timeouts.passive {
+		// Only real TCP connections can use passive mode, anything else falls back to keep-alives
+		passive = tc.SetKeepAlive(true) == nil && tc.SetKeepAlivePeriod(timeouts.keepalive) == nil
+	}
 	// Get our keys
 	myLinkPub, myLinkPriv := newBoxKeys() // ephemeral link keys
+	iface.mutex.Lock()
+	iface.linkKeys[*myLinkPub] = struct{}{}
+	iface.mutex.Unlock()
+	defer func() {
+		iface.mutex.Lock()
+		delete(iface.linkKeys, *myLinkPub)
+		iface.mutex.Unlock()
+	}()
 	meta := version_getBaseMetadata()
 	meta.box = iface.core.boxPub
 	meta.sig = iface.core.sigPub
 	meta.link = *myLinkPub
 	metaBytes := meta.encode()
+	handshakeTimeout := timeouts.handshake
+	if handshakeTimeout == 0 {
+		handshakeTimeout = timeouts.read
+	}
+	if handshakeTimeout > 0 {
+		sock.SetDeadline(time.Now().Add(handshakeTimeout))
+	}
 	_, err := sock.Write(metaBytes)
 	if err != nil {
 		return
 	}
-	if iface.tcp_timeout > 0 {
-		sock.SetReadDeadline(time.Now().Add(iface.tcp_timeout))
-	}
 	_, err = sock.Read(metaBytes)
 	if err != nil {
 		return
@@ -229,15 +690,27 @@ func (iface *tcpInterface) handler(sock net.Conn, incoming bool) {
 		// If it's a version mismatch issue, then print an error message
 		base := version_getBaseMetadata()
 		if meta.meta == base.meta {
-			if meta.ver > base.ver {
+			if meta.ver != base.ver {
 				iface.core.log.Println("Failed to connect to node:", sock.RemoteAddr().String(), "version:", meta.ver)
-			} else if meta.ver == base.ver && meta.minorVer > base.minorVer {
+			} else if meta.minorVer < version_minMinorVer {
 				iface.core.log.Println("Failed to connect to node:", sock.RemoteAddr().String(), "version:", fmt.Sprintf("%d.%d", meta.ver, meta.minorVer))
 			}
 		}
 		// TODO? Block forever to prevent future connection attempts? suppress future messages about the same node?
 		return
 	}
+	version := meta.negotiate()
+	meta.passive = passive
+	if err := version_handshake(sock, &meta, version); err != nil {
+		iface.core.log.Println("Failed to connect to node:", sock.RemoteAddr().String(), "handshake:", err)
+		return
+	}
+	// Older nodes don't know about passive mode, so they always expect keep-alives
+	passive = version >= version_linkOptionsMinorVer && meta.passive
+	if handshakeTimeout > 0 {
+		// The reader sets its own read deadlines from here on
+		sock.SetDeadline(time.Time{})
+	}
 	info := tcpInfo{ // used as a map key, so don't include ephemeral link key
 		box: meta.box,
 		sig: meta.sig,
@@ -251,20 +724,28 @@ func (iface *tcpInterface) handler(sock net.Conn, incoming bool) {
 		}
 		return true
 	}
-	if equiv(info.box[:], iface.core.boxPub[:]) {
+	sameBox := equiv(info.box[:], iface.core.boxPub[:])
+	sameSig := equiv(info.sig[:], iface.core.sigPub[:])
+	switch {
+	case sameBox && sameSig:
+		// Either connected to ourself, in which case the other end of the connection used one of our own link keys, or to a node with a copy of our keys
+		iface.mutex.Lock()
+		_, isSelf := iface.linkKeys[meta.link]
+		iface.mutex.Unlock()
+		if !isSelf && !iface.core.collisions.isSharedKeys() {
+			iface.core.collisions.report("keys", nil, sock.RemoteAddr().String())
+		}
 		return
-	}
-	if equiv(info.sig[:], iface.core.sigPub[:]) {
+	case sameBox:
+		iface.core.collisions.report("address", nil, sock.RemoteAddr().String())
+		return
+	case sameSig:
+		iface.core.collisions.report("treeid", nil, sock.RemoteAddr().String())
 		return
 	}
 	// Check if we're authorized to connect to this key / IP
-	if incoming && !iface.core.peers.isAllowedEncryptionPublicKey(&info.box) {
-		// Allow unauthorized peers if they're link-local
-		raddrStr, _, _ := net.SplitHostPort(sock.RemoteAddr().String())
-		raddr := net.ParseIP(raddrStr)
-		if !raddr.IsLinkLocalUnicast() {
-			return
-		}
+	if listener != nil && !listener.isAllowed(iface.core, &info.box, sock.RemoteAddr()) {
+		return
 	}
 	// Check if we already have a connection to this node, close and block if yes
 	info.localAddr, _, _ = net.SplitHostPort(sock.LocalAddr().String())
@@ -288,6 +769,9 @@ func (iface *tcpInterface) handler(sock net.Conn, incoming bool) {
 	// Note that multiple connections to the same node are allowed
 	//  E.g. over different interfaces
 	p := iface.core.peers.newPeer(&info.box, &info.sig, getSharedKey(myLinkPriv, &meta.link))
+	p.version = version
+	p.endpoint = sock.RemoteAddr().String()
+	p.mtu = timeouts.mtu
 	p.linkOut = make(chan []byte, 1)
 	in := func(bs []byte) {
 		p.handlePacket(bs)
@@ -303,7 +787,7 @@ func (iface *tcpInterface) handler(sock net.Conn, incoming bool) {
 			atomic.AddUint64(&p.bytesSent, uint64(len(tcp_msg)+len(msgLen)+len(msg)))
 			util_putBytes(msg)
 		}
-		timerInterval := tcp_ping_interval
+		timerInterval := timeouts.keepalive
 		timer := time.NewTimer(timerInterval)
 		defer timer.Stop()
 		for {
@@ -323,7 +807,9 @@ func (iface *tcpInterface) handler(sock net.Conn, incoming bool) {
 			timer.Reset(timerInterval)
 			select {
 			case _ = <-timer.C:
-				send(nil) // TCP keep-alive traffic
+				if !passive {
+					send(nil) // TCP keep-alive traffic
+				}
 			case msg := <-p.linkOut:
 				send(msg)
 			case msg, ok := <-out:
@@ -342,6 +828,9 @@ func (iface *tcpInterface) handler(sock net.Conn, incoming bool) {
 		out <- msg
 	}
 	p.close = func() { sock.Close() }
+	p.getRetransmits = func() (uint64, uint64, bool) { return tcp_getRetransmits(sock) }
+	p.getPathMTU = func() (uint64, bool) { return tcp_getPathMTU(sock) }
+	p.getLinkRTT = func() (time.Duration, time.Duration, bool) { return tcp_getRTT(sock) }
 	setNoDelay(sock, true)
 	go p.linkLoop()
 	defer func() {
@@ -355,7 +844,12 @@ func (iface *tcpInterface) handler(sock net.Conn, incoming bool) {
 	themAddrString := net.IP(themAddr[:]).String()
 	themString := fmt.Sprintf("%s@%s", themAddrString, them)
 	iface.core.log.Println("Connected:", themString, "source", us)
-	err = iface.reader(sock, in) // In this goroutine, because of defers
+	readTimeout := timeouts.read
+	if passive {
+		sock.SetReadDeadline(time.Time{})
+		readTimeout = -1
+	}
+	err = iface.reader(sock, in, readTimeout) // In this goroutine, because of defers
 	if err == nil {
 		iface.core.log.Println("Disconnected:", themString, "source", us)
 	} else {
@@ -367,12 +861,13 @@ func (iface *tcpInterface) handler(sock net.Conn, incoming bool) {
 // This reads from the socket into a []byte buffer for incomping messages.
 // It copies completed messages out of the cache into a new slice, and passes them to the peer struct via the provided `in func([]byte)` argument.
 // Then it shifts the incomplete fragments of data forward so future reads won't overwrite it.
-func (iface *tcpInterface) reader(sock net.Conn, in func([]byte)) error {
+// Reads time out after the given timeout, unless it's zero or less.
+func (iface *tcpInterface) reader(sock net.Conn, in func([]byte), timeout time.Duration) error {
 	bs := make([]byte, 2*tcp_msgSize)
 	frag := bs[:0]
 	for {
-		if iface.tcp_timeout > 0 {
-			sock.SetReadDeadline(time.Now().Add(iface.tcp_timeout))
+		if timeout > 0 {
+			sock.SetReadDeadline(time.Now().Add(timeout))
 		}
 		n, err := sock.Read(bs[len(frag):])
 		if n > 0 {
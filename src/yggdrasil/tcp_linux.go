@@ -0,0 +1,77 @@
+package yggdrasil
+
+// The linux platform specific tcp parts
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Gets the total number of retransmitted segments and the sending MSS of a TCP connection from the kernel.
+// These are used to estimate packet loss on a link, as TCP hides loss from us by retransmitting.
+// Returns false if the connection isn't a TCP connection, i.e. if it's through a proxy or a custom transport.
+func tcp_getRetransmits(c net.Conn) (retrans uint64, mss uint64, ok bool) {
+	tcp, isTCP := c.(*net.TCPConn)
+	if !isTCP {
+		return
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return
+	}
+	raw.Control(func(fd uintptr) {
+		info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err != nil {
+			return
+		}
+		retrans, mss, ok = uint64(info.Total_retrans), uint64(info.Snd_mss), true
+	})
+	return
+}
+
+// Gets the path MTU of a TCP connection, as discovered by the kernel.
+// The kernel sizes segments to fit it, and lowers it when the path turns out to take less, so link frames don't need sizing to fit the underlay.
+// Returns false if the connection isn't a TCP connection.
+func tcp_getPathMTU(c net.Conn) (mtu uint64, ok bool) {
+	tcp, isTCP := c.(*net.TCPConn)
+	if !isTCP {
+		return
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return
+	}
+	raw.Control(func(fd uintptr) {
+		info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err != nil || info.Pmtu == 0 {
+			return
+		}
+		mtu, ok = uint64(info.Pmtu), true
+	})
+	return
+}
+
+// Gets the smoothed round trip time of a TCP connection and its variation, as measured by the kernel.
+// Returns false if the connection isn't a TCP connection, or no round trip has been measured yet.
+func tcp_getRTT(c net.Conn) (rtt time.Duration, rttvar time.Duration, ok bool) {
+	tcp, isTCP := c.(*net.TCPConn)
+	if !isTCP {
+		return
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return
+	}
+	raw.Control(func(fd uintptr) {
+		info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err != nil || info.Rtt == 0 {
+			return
+		}
+		rtt = time.Duration(info.Rtt) * time.Microsecond
+		rttvar = time.Duration(info.Rttvar) * time.Microsecond
+		ok = true
+	})
+	return
+}
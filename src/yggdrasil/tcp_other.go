@@ -0,0 +1,23 @@
+// +build !linux
+
+package yggdrasil
+
+import (
+	"net"
+	"time"
+)
+
+// Retransmission counts aren't available on this platform, so loss isn't estimated for links.
+func tcp_getRetransmits(c net.Conn) (retrans uint64, mss uint64, ok bool) {
+	return 0, 0, false
+}
+
+// The path MTU isn't available on this platform.
+func tcp_getPathMTU(c net.Conn) (mtu uint64, ok bool) {
+	return 0, false
+}
+
+// The round trip time isn't available on this platform.
+func tcp_getRTT(c net.Conn) (rtt time.Duration, rttvar time.Duration, ok bool) {
+	return 0, 0, false
+}
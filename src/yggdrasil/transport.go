@@ -0,0 +1,85 @@
+package yggdrasil
+
+// This implements pluggable transports, in the spirit of obfs4, which wrap the
+// outer TCP connection to a peer so that peering traffic can be obfuscated in
+// censored environments.
+// A transport is selected per peer with the transport parameter of a tcp peer
+// URI, i.e. tcp://a.b.c.d:e?transport=obfs4&cert=f&iat-mode=0, and any other
+// parameters in the URI are passed to the transport.
+// Only outgoing connections are wrapped here. For incoming connections, the
+// server side of the transport should forward to the Listen address instead.
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"sort"
+)
+
+// Transport is implemented by pluggable transports, and can be added to a
+// running node with Core.AddTransport.
+type Transport interface {
+	// Connects to the given address, wrapping the connection as needed using
+	// the parameters taken from the peer URI.
+	Dial(addr string, args url.Values) (net.Conn, error)
+}
+
+// commandTransport is a transport that runs an external command for every
+// connection, much like the ProxyCommand option in OpenSSH. The command is
+// given the peer address followed by each parameter from the peer URI as a
+// key=value argument, and the connection is carried over its stdin/stdout.
+type commandTransport struct {
+	command []string
+}
+
+// Runs the command and returns a connection that reads from its stdout and
+// writes to its stdin. Closing the connection kills the command.
+func (t *commandTransport) Dial(addr string, args url.Values) (net.Conn, error) {
+	if len(t.command) == 0 {
+		return nil, errors.New("empty transport command")
+	}
+	cmdArgs := append([]string(nil), t.command[1:]...)
+	cmdArgs = append(cmdArgs, addr)
+	var keys []string
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range args[key] {
+			cmdArgs = append(cmdArgs, key+"="+value)
+		}
+	}
+	cmd := exec.Command(t.command[0], cmdArgs...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	local, remote := net.Pipe()
+	go func() {
+		io.Copy(stdin, remote)
+		stdin.Close()
+		cmd.Process.Kill()
+	}()
+	go func() {
+		io.Copy(remote, stdout)
+		remote.Close()
+		cmd.Wait()
+	}()
+	return &wrappedConn{
+		c: local,
+		raddr: &wrappedAddr{
+			network: "tcp",
+			addr:    addr,
+		},
+	}, nil
+}
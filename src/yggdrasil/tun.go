@@ -3,23 +3,114 @@ package yggdrasil
 // This manages the tun driver to send/recv packets to/from applications
 
 import (
+	"errors"
+	"math"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
 	"yggdrasil/defaults"
 
-	"github.com/songgao/packets/ethernet"
 	"github.com/yggdrasil-network/water"
 )
 
 const tun_IPv6_HEADER_LENGTH = 40
+const tun_IPv4_HEADER_LENGTH = 20
 const tun_ETHER_HEADER_LENGTH = 14
 
+// Point-to-point addressing is only supported on Linux so far.
+const tun_pointToPointSupported = runtime.GOOS == "linux"
+
+// The default number of packets read or written at a time.
+const tun_defaultBatchSize = 16
+
+// The shortest and longest time to wait between attempts to re-create the adapter after it fails.
+const tun_recoverMinDelay = time.Second
+const tun_recoverMaxDelay = time.Minute
+
+// Policies for broadcast and multicast frames received on a TAP adapter.
+const (
+	tun_tapMulticastForward = "forward" // Handled by the node and forwarded to the mesh if multicast forwarding allows it
+	tun_tapMulticastLocal   = "local"   // Handled by the node, i.e. for neighbor discovery and MLD, but never forwarded
+	tun_tapMulticastDrop    = "drop"    // Dropped, apart from neighbor discovery
+)
+
 // Represents a running TUN/TAP interface.
 type tunDevice struct {
-	core   *Core
-	icmpv6 icmpv6
-	send   chan<- []byte
-	recv   <-chan []byte
-	mtu    int
-	iface  *water.Interface
+	core         *Core
+	icmpv6       icmpv6
+	send         chan<- []byte
+	recv         <-chan []byte
+	mtu          int
+	iface        *water.Interface
+	queues       []*water.Interface
+	stop         chan struct{}
+	lifecycle    sync.Mutex   // Held while the adapter is started, closed or re-created
+	state        atomic.Value // The *tunState of the running adapter, for other goroutines to read while it's re-created
+	settings     tunSettings  // What the adapter was last started with, to re-create it with if it fails
+	recovering   bool         // Whether the adapter is being re-created after it failed
+	counters     *tunCounters // Allocated separately, so that the counters are aligned for sync/atomic
+	txQueueLen   int          // Transmit queue length to set in the kernel, or 0 to leave it alone
+	readBuffer   int          // Size of the buffer to read packets into, if bigger than the MTU
+	tapMulticast string       // Policy for broadcast and multicast frames in TAP mode
+	linkGroup    string       // Interface group to assign the adapter to, by number or name, on Linux
+	linkAlias    string       // Alias to set on the adapter, on Linux
+	linkAltNames []string     // Alternative names to add to the adapter, on Linux
+	peerAddr     net.IP       // Address of the other end in point-to-point mode, or nil to use an on-link /7
+	queueCount   int          // Number of queues to open in multiqueue mode, on Linux, or 0 or 1 for a single queue
+	batchSize    int          // Most packets read or written at a time, or 0 for the default
+	offload      bool         // Whether to open the adapter with segmentation offload, on Linux in TUN mode
+	dropWhenFull bool         // Whether packets are dropped when the queues to and from the router are full, instead of waiting
+	vnetHdr      bool         // Whether the adapter was opened with offload, so packets have a virtio-net header
+	pathMTU      pathMTUCache // The lowest MTU seen for each destination
+	helperPath   string       // Unix socket of the interface helper that creates the adapter, or empty to create it ourselves
+}
+
+// The settings that the TUN/TAP adapter is started with.
+type tunSettings struct {
+	ifname    string
+	iftapmode bool
+	addr      string
+	mtu       int
+}
+
+// A snapshot of the running adapter. The fields of the tunDevice that this
+// copies are only used by whatever starts, closes and re-creates the adapter,
+// and by the adapter's own goroutines.
+type tunState struct {
+	iface   *water.Interface // The adapter, or nil if there isn't one
+	queues  []*water.Interface
+	mtu     int
+	vnetHdr bool
+}
+
+// Counts the traffic through the TUN/TAP adapter, i.e. for the SNMP agent.
+type tunCounters struct {
+	bytesRead      uint64
+	bytesWritten   uint64
+	packetsRead    uint64
+	packetsWritten uint64
+	readDropped    uint64 // Packets read from the adapter that were dropped because the router's queue was full
+	writeDropped   uint64 // Packets for the adapter that were dropped from the front of its queue because it was full
+	echoReplies    uint64 // Echo requests answered while there's no adapter
+	errorsSent     uint64 // ICMPv6 errors sent for packets to us while there's no adapter
+	readBatches    uint64 // Batches of packets read from the adapter, which is the number of packets read if batches aren't supported
+	writeBatches   uint64 // Batches of packets written to the adapter
+	readFiltered   uint64 // Packets read from the adapter that were dropped by the packet filter
+	writeFiltered  uint64 // Packets for the adapter that were dropped by the packet filter
+	segmentsSplit  uint64 // Large TCP segments read from the adapter with offload, which were split into packets
+	recoveries     uint64 // Times that the adapter was re-created after it failed
+	readErrors     uint64 // Reads from the adapter that failed
+	writeErrors    uint64 // Writes to the adapter that failed
+	readMalformed  uint64 // Packets read from the adapter that were shorter than their headers say, or whose headers were invalid
+	readUnknown    uint64 // Frames or packets read from the adapter that weren't IPv6, or IPv4 for crypto-key routing
+	packetTooBig   uint64 // Packets read from the adapter that were too big for their destination's remembered MTU
+	mssClamped     uint64 // TCP SYNs through sessions whose MSS was lowered to fit the session MTU
+
+	malformedBy [tun_malformedCount]uint64 // Packets counted in readMalformed, by the reason that they were malformed
 }
 
 // Gets the maximum supported MTU for the platform based on the defaults in
@@ -34,88 +125,596 @@ func getSupportedMTU(mtu int) int {
 // Initialises the TUN/TAP adapter.
 func (tun *tunDevice) init(core *Core) {
 	tun.core = core
+	tun.counters = &tunCounters{}
+	tun.tapMulticast = tun_tapMulticastForward
 	tun.icmpv6.init(tun)
+	tun.pathMTU.init()
+}
+
+// Sets the transmit queue length to set in the kernel, the size of the read buffer, the number of queues and the batch size, or the defaults if 0.
+// These take effect the next time the adapter is started.
+func (tun *tunDevice) setBuffers(txQueueLen int, readBuffer int, queues int, batchSize int) {
+	tun.txQueueLen = txQueueLen
+	tun.readBuffer = readBuffer
+	tun.queueCount = queues
+	tun.batchSize = batchSize
+}
+
+// Sets whether packets are dropped when the queues between the router and the adapter are full, instead of waiting for room.
+// This must be called before the adapter is started.
+func (tun *tunDevice) setDropWhenFull(drop bool) {
+	tun.dropWhenFull = drop
+}
+
+// Sets whether the adapter is opened with segmentation offload, which is only supported on Linux in TUN mode.
+// This takes effect the next time the adapter is started.
+func (tun *tunDevice) setOffload(offload bool) {
+	tun.offload = offload
+}
+
+// Gets the most packets read or written in a batch.
+func (tun *tunDevice) getBatchSize() int {
+	if tun.batchSize <= 0 {
+		return tun_defaultBatchSize
+	}
+	return tun.batchSize
+}
+
+// Gets a snapshot of the running adapter, which is safe to use from any goroutine.
+func (tun *tunDevice) getState() *tunState {
+	if state, ok := tun.state.Load().(*tunState); ok {
+		return state
+	}
+	return &tunState{}
+}
+
+// Publishes the adapter for getState, once it has been started or closed.
+func (tun *tunDevice) publish() {
+	tun.state.Store(&tunState{tun.iface, tun.queues, tun.mtu, tun.vnetHdr})
+}
+
+// Forgets the adapter once it has been closed.
+func (tun *tunDevice) clear() {
+	tun.iface, tun.queues, tun.mtu, tun.vnetHdr = nil, nil, 0, false
+	tun.publish()
+}
+
+// Checks if the adapter is in TAP mode.
+func (s *tunState) isTAP() bool {
+	return s.iface != nil && s.iface.IsTAP()
+}
+
+// Gets the name of the adapter, or an empty string if there isn't one.
+func (s *tunState) name() string {
+	if s.iface == nil {
+		return ""
+	}
+	return tun_adapterName(s.iface)
+}
+
+// Gets the queues of the adapter, which is just the adapter itself unless it's in multiqueue mode.
+func (tun *tunDevice) getQueues() []*water.Interface {
+	if len(tun.queues) == 0 {
+		return []*water.Interface{tun.iface}
+	}
+	return tun.queues
+}
+
+// Sets the interface group, alias and alternative names of the adapter, which are only supported on Linux.
+// These take effect the next time the adapter is started.
+func (tun *tunDevice) setLinkNames(group string, alias string, altNames []string) {
+	tun.linkGroup = group
+	tun.linkAlias = alias
+	tun.linkAltNames = altNames
+}
+
+// Sets the address of the other end of the adapter, which puts it in point-to-point mode, or clears it if empty.
+// These take effect the next time the adapter is started.
+func (tun *tunDevice) setPeerAddress(peer string) error {
+	if peer == "" {
+		tun.peerAddr = nil
+		return nil
+	}
+	ip := net.ParseIP(peer)
+	if ip == nil || ip.To4() != nil {
+		return errors.New("invalid IPv6 peer address: " + peer)
+	}
+	tun.peerAddr = ip
+	return nil
+}
+
+// Sets the policy for broadcast and multicast frames received in TAP mode, or the default if empty.
+func (tun *tunDevice) setTAPMulticast(policy string) error {
+	switch policy {
+	case "":
+		policy = tun_tapMulticastForward
+	case tun_tapMulticastForward, tun_tapMulticastLocal, tun_tapMulticastDrop:
+	default:
+		return errors.New("unknown TAP multicast policy: " + policy)
+	}
+	tun.tapMulticast = policy
+	return nil
+}
+
+// Checks if multicast packets read from the adapter may be forwarded to the mesh.
+func (tun *tunDevice) forwardsMulticast() bool {
+	return !tun.getState().isTAP() || tun.tapMulticast == tun_tapMulticastForward
+}
+
+// Gets the name of the adapter while it's being set up. Other goroutines use getState instead.
+func (tun *tunDevice) name() string {
+	return tun_adapterName(tun.iface)
+}
+
+// Gets the name of an adapter. Adapters that water didn't open, like Wintun
+// adapters on Windows, know their own names.
+func tun_adapterName(iface *water.Interface) string {
+	if named, ok := iface.ReadWriteCloser.(interface{ adapterName() string }); ok {
+		return named.adapterName()
+	}
+	return iface.Name()
 }
 
 // Starts the setup process for the TUN/TAP adapter, and if successful, starts
 // the read/write goroutines to handle packets on that interface.
 func (tun *tunDevice) start(ifname string, iftapmode bool, addr string, mtu int) error {
-	if ifname == "none" {
+	if tun_isHeadless(ifname) {
+		// There's no adapter, so packets for us are answered by the responder instead
+		stop := make(chan struct{})
+		tun.stop = stop
+		tun.mtu = tun_headlessMTU
+		tun.publish()
+		go tun.respond(stop)
 		return nil
 	}
-	if err := tun.setup(ifname, iftapmode, addr, mtu); err != nil {
+	tun.settings = tunSettings{ifname, iftapmode, addr, mtu}
+	if tun.peerAddr != nil {
+		switch {
+		case !tun_pointToPointSupported:
+			return errors.New("point-to-point mode isn't supported on this platform")
+		case iftapmode:
+			return errors.New("point-to-point mode can't be used in TAP mode")
+		}
+	}
+	setup := tun.setup
+	if tun.helperPath != "" {
+		setup = tun.setupFromHelper
+	}
+	if err := setup(ifname, iftapmode, addr, mtu); err != nil {
 		return err
 	}
-	go func() { panic(tun.read()) }()
-	go func() { panic(tun.write()) }()
+	if tun.queueCount > 1 && len(tun.queues) == 0 {
+		tun.core.log.Println("Multiple TUN/TAP queues aren't supported on this platform, using one")
+	}
+	tun.publish()
+	// Each queue is read and written in parallel, so that several cores can be busy with the adapter
+	stop := make(chan struct{})
+	tun.stop = stop
+	queues := tun.getQueues()
+	recvs := []<-chan []byte{tun.recv}
+	if len(queues) > 1 {
+		recvs = tun.dispatch(len(queues), stop)
+	}
+	for idx, queue := range queues {
+		queue, recv := queue, recvs[idx]
+		go func() {
+			if err := tun.read(queue); !tun_isStopped(stop) {
+				atomic.AddUint64(&tun.counters.readErrors, 1)
+				tun.core.log.Println("Failed to read from the TUN/TAP adapter:", err)
+				tun.recover(stop)
+			}
+		}()
+		go func() {
+			if err := tun.write(queue, recv, stop); err != nil {
+				atomic.AddUint64(&tun.counters.writeErrors, 1)
+				tun.core.log.Println("Failed to write to the TUN/TAP adapter:", err)
+				tun.recover(stop)
+			}
+		}()
+	}
 	return nil
 }
 
-// Writes a packet to the TUN/TAP adapter. If the adapter is running in TAP
-// mode then additional ethernet encapsulation is added for the benefit of the
-// host operating system.
-func (tun *tunDevice) write() error {
+// Checks if the goroutines of an adapter have been told to stop, because it was closed.
+func tun_isStopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Closes the TUN/TAP adapter and starts it again with the given settings, i.e. when the configuration is reloaded.
+// Must be called with the lifecycle mutex held, unless the node hasn't started yet.
+func (tun *tunDevice) restart(ifname string, iftapmode bool, addr string, mtu int) error {
+	tun.close()
+	tun.clear()
+	return tun.start(ifname, iftapmode, addr, mtu)
+}
+
+// Re-creates the adapter after its goroutines failed, i.e. because it was
+// removed, the system was suspended or the driver was reset, retrying with
+// backoff until it works, or until the adapter is closed or reconfigured. The
+// stop channel is that of the goroutines that failed, so that only the first
+// of them to fail does anything.
+func (tun *tunDevice) recover(stop chan struct{}) {
+	tun.lifecycle.Lock()
+	if tun.stop != stop {
+		tun.lifecycle.Unlock()
+		return
+	}
+	isMain := tun == &tun.core.tun // Policy routing only routes through the main adapter
+	if isMain {
+		tun.core.policyRoute.close()
+	}
+	tun.close()
+	tun.clear()
+	tun.recovering = true
+	tun.lifecycle.Unlock()
+	delay := tun_recoverMinDelay
+	for {
+		tun.drain(delay)
+		tun.lifecycle.Lock()
+		if !tun.recovering {
+			tun.lifecycle.Unlock()
+			return
+		}
+		s := tun.settings
+		if err := tun.restart(s.ifname, s.iftapmode, s.addr, s.mtu); err != nil {
+			tun.lifecycle.Unlock()
+			if delay *= 2; delay > tun_recoverMaxDelay {
+				delay = tun_recoverMaxDelay
+			}
+			tun.core.log.Printf("Failed to re-create the TUN/TAP adapter, trying again in %s: %v", delay, err)
+			continue
+		}
+		tun.recovering = false
+		atomic.AddUint64(&tun.counters.recoveries, 1)
+		tun.lifecycle.Unlock()
+		tun.core.log.Println("Re-created the TUN/TAP adapter")
+		if !isMain {
+			return
+		}
+		if err := tun.core.policyRoute.start(); err != nil {
+			tun.core.log.Println("Failed to set up policy routing:", err)
+		}
+		return
+	}
+}
+
+// Drops the packets for the adapter for the given time, while it's being
+// re-created, so that the router isn't left waiting for room in its queue.
+func (tun *tunDevice) drain(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 	for {
-		data := <-tun.recv
-		if tun.iface == nil {
+		select {
+		case packet := <-tun.recv:
+			atomic.AddUint64(&tun.counters.writeDropped, 1)
+			util_putBytes(packet)
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// Closes the adapter for good, i.e. when the node stops, without it being re-created if it failed.
+func (tun *tunDevice) shutdown() error {
+	tun.lifecycle.Lock()
+	defer tun.lifecycle.Unlock()
+	tun.recovering = false
+	return tun.close()
+}
+
+// Splits the packets for the adapter between the given number of queues by
+// flow, so that each flow is written by the same queue and stays in order,
+// and returns the channel of packets for each queue. The packets are split
+// until the adapter is closed.
+func (tun *tunDevice) dispatch(count int, stop chan struct{}) []<-chan []byte {
+	sends := make([]chan []byte, count)
+	recvs := make([]<-chan []byte, count)
+	for idx := range sends {
+		sends[idx] = make(chan []byte, router_tunQueueSize)
+		recvs[idx] = sends[idx]
+	}
+	go func() {
+		for {
+			select {
+			case data := <-tun.recv:
+				queue := sends[tun_flowHash(data)%uint32(count)]
+				router_queue(queue, queue, tun.counters, data, tun.dropWhenFull)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return recvs
+}
+
+// Hashes the flow that a packet belongs to, which is its addresses and either
+// its IPv6 flow label or, if it doesn't have one, its protocol and TCP or UDP
+// ports. Fragments of a packet hash the same as each other, although not
+// always the same as the rest of their flow.
+func tun_flowHash(packet []byte) uint32 {
+	hash := uint32(2166136261) // FNV-1a
+	add := func(bs []byte) {
+		for _, b := range bs {
+			hash ^= uint32(b)
+			hash *= 16777619
+		}
+	}
+	switch {
+	case len(packet) >= tun_IPv6_HEADER_LENGTH && packet[0]>>4 == 6:
+		add(packet[8:40])
+		if label := []byte{packet[1] & 0x0f, packet[2], packet[3]}; label[0]|label[1]|label[2] != 0 {
+			add(label)
+			break
+		}
+		add(packet[6:7])
+		if (packet[6] == packetFilter_tcp || packet[6] == packetFilter_udp) && len(packet) >= tun_IPv6_HEADER_LENGTH+4 {
+			add(packet[tun_IPv6_HEADER_LENGTH : tun_IPv6_HEADER_LENGTH+4])
+		}
+	case len(packet) >= tun_IPv4_HEADER_LENGTH && packet[0]>>4 == 4:
+		add(packet[12:20])
+		add(packet[9:10])
+		ihl := int(packet[0]&0x0f) * 4
+		isFragment := packet[6]&0x3f != 0 || packet[7] != 0 // More fragments, or an offset
+		if (packet[9] == packetFilter_tcp || packet[9] == packetFilter_udp) && !isFragment && len(packet) >= ihl+4 {
+			add(packet[ihl : ihl+4])
+		}
+	}
+	return hash
+}
+
+// Writes packets to a queue of the TUN/TAP adapter. If the adapter is running
+// in TAP mode then additional ethernet encapsulation is added for the benefit
+// of the host operating system. Packets that are already waiting are written
+// in batches, and on Linux the ethernet header and packet are written together
+// with vectored I/O instead of being copied into a frame first. The packets
+// for the queue are taken from recv.
+func (tun *tunDevice) write(iface *water.Interface, recv <-chan []byte, stop chan struct{}) error {
+	var raw syscall.RawConn
+	if iface != nil {
+		raw = tun_rawConn(iface)
+	}
+	vnetHdr := tun.getState().vnetHdr
+	batch := make([][]byte, 0, tun.getBatchSize())
+	header := make([]byte, tun_ETHER_HEADER_LENGTH)
+	var frame []byte // Reused for each frame when they can't be written with vectored I/O
+	for {
+		select {
+		case data := <-recv:
+			batch = append(batch[:0], data)
+		case <-stop:
+			return nil
+		}
+	fill:
+		for len(batch) < cap(batch) {
+			select {
+			case data := <-recv:
+				batch = append(batch, data)
+			default:
+				break fill
+			}
+		}
+		if iface == nil {
+			for _, data := range batch {
+				util_putBytes(data)
+			}
 			continue
 		}
-		if tun.iface.IsTAP() {
-			var frame ethernet.Frame
-			frame.Prepare(
-				tun.icmpv6.peermac[:6], // Destination MAC address
-				tun.icmpv6.mymac[:6],   // Source MAC address
-				ethernet.NotTagged,     // VLAN tagging
-				ethernet.IPv6,          // Ethertype
-				len(data))              // Payload length
-			copy(frame[tun_ETHER_HEADER_LENGTH:], data[:])
-			if _, err := tun.iface.Write(frame); err != nil {
-				panic(err)
+		atomic.AddUint64(&tun.counters.writeBatches, 1)
+		for _, data := range batch {
+			tun.core.cjdns.translateIn(data)
+			if !tun.core.pktFilter.allow(data, packetFilter_in) {
+				atomic.AddUint64(&tun.counters.writeFiltered, 1)
+				tun.core.flowTrace.trace(data, "tun write", "dropped by the packet filter")
+				util_putBytes(data)
+				continue
+			}
+			var err error
+			switch {
+			case vnetHdr && raw != nil:
+				tun.core.capture.captureTUN(data)
+				err = tun_writev(raw, tun_vnetHdrNone, data)
+			case vnetHdr:
+				tun.core.capture.captureTUN(data)
+				frame = append(append(frame[:0], tun_vnetHdrNone...), data...)
+				_, err = iface.Write(frame)
+			case !iface.IsTAP():
+				tun.core.capture.captureTUN(data)
+				_, err = iface.Write(data)
+			case raw != nil:
+				tun.prepareHeader(header, data)
+				tun.core.capture.captureTUN(header, data)
+				err = tun_writev(raw, header, data)
+			default:
+				tun.prepareHeader(header, data)
+				tun.core.capture.captureTUN(header, data)
+				frame = append(append(frame[:0], header...), data...)
+				_, err = iface.Write(frame)
 			}
-		} else {
-			if _, err := tun.iface.Write(data); err != nil {
-				panic(err)
+			if err != nil {
+				util_putBytes(data)
+				if tun_isStopped(stop) {
+					// The adapter was closed while writing, which is expected
+					continue
+				}
+				return err
 			}
+			atomic.AddUint64(&tun.counters.bytesWritten, uint64(len(data)))
+			atomic.AddUint64(&tun.counters.packetsWritten, 1)
+			util_putBytes(data)
 		}
-		util_putBytes(data)
 	}
 }
 
-// Reads any packets that are waiting on the TUN/TAP adapter. If the adapter
-// is running in TAP mode then the ethernet headers will automatically be
-// processed and stripped if necessary. If an ICMPv6 packet is found, then
-// the relevant helper functions in icmpv6.go are called.
-func (tun *tunDevice) read() error {
-	mtu := tun.mtu
-	if tun.iface.IsTAP() {
+// Gets the average number of packets in each batch, rounded to two decimal places, for getTunTap.
+func tun_batchAverage(packets uint64, batches uint64) float64 {
+	if batches == 0 {
+		return 0
+	}
+	return math.Round(float64(packets)/float64(batches)*100) / 100
+}
+
+// Fills in the ethernet header of a frame for the packet in TAP mode.
+func (tun *tunDevice) prepareHeader(header []byte, data []byte) {
+	if len(data) > 0 && data[0]&0xf0 == 0x40 {
+		dstmac := tun.icmpv6.destMAC(nil)
+		copy(header[0:6], dstmac[:])
+		copy(header[6:12], tun.icmpv6.mymac[:6])
+		header[12], header[13] = 0x08, 0x00 // Ethertype, IPv4
+		return
+	}
+	var dstmac macAddress
+	switch {
+	case len(data) >= tun_IPv6_HEADER_LENGTH && data[24] == 0xff:
+		// Multicast goes to the MAC address that the group maps to, i.e. 33:33:xx:xx:xx:xx
+		copy(dstmac[:], []byte{0x33, 0x33})
+		copy(dstmac[2:], data[36:40])
+	case len(data) >= tun_IPv6_HEADER_LENGTH:
+		dstmac = tun.icmpv6.destMAC(data[24:40])
+	default:
+		dstmac = tun.icmpv6.destMAC(nil)
+	}
+	copy(header[0:6], dstmac[:])             // Destination MAC address
+	copy(header[6:12], tun.icmpv6.mymac[:6]) // Source MAC address
+	header[12], header[13] = 0x86, 0xdd      // Ethertype, IPv6
+}
+
+// Reads any packets that are waiting on a queue of the TUN/TAP adapter. If the
+// adapter is running in TAP mode then the ethernet headers will automatically
+// be processed and stripped if necessary. If an ICMPv6 packet is found, then
+// the relevant helper functions in icmpv6.go are called. On Linux, packets
+// that arrive together are read in a batch, without waiting for the adapter to
+// become readable again between them.
+func (tun *tunDevice) read(iface *water.Interface) error {
+	state := tun.getState()
+	mtu := state.mtu
+	if iface.IsTAP() {
 		mtu += tun_ETHER_HEADER_LENGTH
 	}
-	buf := make([]byte, mtu)
+	var scratch []byte
+	if state.vnetHdr {
+		// Segments can be much bigger than the MTU
+		mtu = tun_vnetHdrLength + tun_vnetMaxSegment
+		scratch = make([]byte, tun_vnetMaxSegment)
+	}
+	if tun.readBuffer > mtu {
+		mtu = tun.readBuffer
+	}
+	raw := tun_rawConn(iface)
+	bufs := make([][]byte, 1)
+	if raw != nil {
+		bufs = make([][]byte, tun.getBatchSize())
+	}
+	for idx := range bufs {
+		bufs[idx] = make([]byte, mtu)
+	}
+	sizes := make([]int, len(bufs))
 	for {
-		n, err := tun.iface.Read(buf)
+		var n int
+		var err error
+		if raw != nil {
+			n, err = tun_readBatch(raw, bufs, sizes)
+		} else if sizes[0], err = iface.Read(bufs[0]); err == nil {
+			n = 1
+		}
+		if n > 0 {
+			atomic.AddUint64(&tun.counters.readBatches, 1)
+		}
+		for idx := 0; idx < n; idx++ {
+			if state.vnetHdr {
+				tun.handleVnetRead(iface, bufs[idx][:sizes[idx]], scratch)
+			} else {
+				tun.handleRead(iface, bufs[idx][:sizes[idx]])
+			}
+		}
 		if err != nil {
 			// panic(err)
 			return err
 		}
-		o := 0
-		if tun.iface.IsTAP() {
-			o = tun_ETHER_HEADER_LENGTH
-		}
-		if buf[o]&0xf0 != 0x60 ||
-			n != 256*int(buf[o+4])+int(buf[o+5])+tun_IPv6_HEADER_LENGTH+o {
-			// Either not an IPv6 packet or not the complete packet for some reason
-			//panic("Should not happen in testing")
-			continue
+	}
+}
+
+// Handles a packet read from the TUN/TAP adapter, passing it on to the router if it's valid.
+func (tun *tunDevice) handleRead(iface *water.Interface, buf []byte) {
+	n := len(buf)
+	o := 0
+	if iface.IsTAP() {
+		o = tun_ETHER_HEADER_LENGTH
+	}
+	tun.core.capture.captureTUN(buf)
+	switch {
+	case n < o+1:
+		tun.countMalformed(tun_malformedShort)
+		return
+	case o == 0 && buf[0]&0xf0 == 0x40 && tun.core.ckr.isEnabled():
+		// An IPv4 packet, which is sent by crypto-key routing
+		length, reason := tun_parseIPv4(buf)
+		if length == 0 {
+			tun.countMalformed(reason)
+			return
 		}
-		if buf[o+6] == 58 {
-			// Found an ICMPv6 packet
-			b := make([]byte, n)
-			copy(b, buf)
-			// tun.icmpv6.recv <- b
-			go tun.icmpv6.parse_packet(b)
+		tun.sendToRouter(buf[:length])
+		return
+	case o > 0 && (buf[12] != 0x86 || buf[13] != 0xdd), buf[o]&0xf0 != 0x60:
+		// Not an IPv6 packet, i.e. ARP in TAP mode, or IPv4 without crypto-key routing
+		atomic.AddUint64(&tun.counters.readUnknown, 1)
+		return
+	}
+	length, reason := tun_parseIPv6(buf[o:])
+	if length == 0 {
+		tun.countMalformed(reason)
+		return
+	}
+	// Anything after the packet is padding, i.e. of a short ethernet frame
+	n = o + length
+	buf = buf[:n]
+	if buf[o+6] == 58 {
+		// Found an ICMPv6 packet
+		b := make([]byte, n)
+		copy(b, buf)
+		// tun.icmpv6.recv <- b
+		go tun.icmpv6.parse_packet(iface, b)
+	}
+	if o > 0 && buf[0]&0x01 != 0 {
+		// A broadcast or multicast frame, which can only be passed on if it's IPv6 multicast
+		if tun.tapMulticast == tun_tapMulticastDrop || buf[o+24] != 0xff {
+			return
 		}
-		packet := append(util_getBytes(), buf[o:n]...)
+	}
+	if !tun.core.pktFilter.allow(buf[o:n], packetFilter_out) {
+		atomic.AddUint64(&tun.counters.readFiltered, 1)
+		return
+	}
+	if mtu := tun.core.tun.pathMTU.get(buf[o+24 : o+40]); mtu != 0 && n-o > int(mtu) {
+		atomic.AddUint64(&tun.counters.packetTooBig, 1)
+		tun.sendPacketTooBig(buf[o:n], int(mtu))
+		return
+	}
+	tun.sendToRouter(buf[o:n])
+}
+
+// Passes a packet read from the adapter, without any ethernet header, on to the router.
+func (tun *tunDevice) sendToRouter(buf []byte) {
+	atomic.AddUint64(&tun.counters.bytesRead, uint64(len(buf)))
+	atomic.AddUint64(&tun.counters.packetsRead, 1)
+	packet := append(util_getBytes(), buf...)
+	tun.core.cjdns.translateOut(packet)
+	tun.core.flowTrace.trace(packet, "tun read", "%d bytes", len(packet))
+	if !tun.dropWhenFull {
 		tun.send <- packet
+		return
+	}
+	select {
+	case tun.send <- packet:
+	default:
+		// Drop the packet rather than wait for the router, like a full interface queue would
+		atomic.AddUint64(&tun.counters.readDropped, 1)
+		tun.core.flowTrace.trace(packet, "tun read", "dropped, the router's queue is full")
+		util_putBytes(packet)
 	}
 }
 
@@ -123,8 +722,18 @@ func (tun *tunDevice) read() error {
 // process stops. Typically this operation will happen quickly, but on macOS
 // it can block until a read operation is completed.
 func (tun *tunDevice) close() error {
+	if tun.stop != nil {
+		close(tun.stop)
+		tun.stop = nil
+	}
 	if tun.iface == nil {
 		return nil
 	}
+	// The first queue is iface itself
+	for idx, queue := range tun.queues {
+		if idx > 0 {
+			queue.Close()
+		}
+	}
 	return tun.iface.Close()
 }
@@ -15,6 +15,9 @@ import (
 	"github.com/yggdrasil-network/water"
 )
 
+// Extra adapters aren't supported on this platform yet.
+const tun_extraSupported = false
+
 const SIOCSIFADDR_IN6 = (0x80000000) | ((288 & 0x1fff) << 16) | uint32(byte('i'))<<8 | 12
 
 type in6_addrlifetime struct {
@@ -13,6 +13,9 @@ import (
 	water "github.com/yggdrasil-network/water"
 )
 
+// Extra adapters aren't supported on this platform yet.
+const tun_extraSupported = false
+
 // Configures the "utun" adapter with the correct IPv6 address and MTU.
 func (tun *tunDevice) setup(ifname string, iftapmode bool, addr string, mtu int) error {
 	if iftapmode {
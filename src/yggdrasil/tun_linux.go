@@ -3,9 +3,15 @@ package yggdrasil
 // The linux platform specific tun parts
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
 
 	"github.com/docker/libcontainer/netlink"
 
@@ -23,11 +29,30 @@ func (tun *tunDevice) setup(ifname string, iftapmode bool, addr string, mtu int)
 	if ifname != "" && ifname != "auto" {
 		config.Name = ifname
 	}
-	iface, err := water.New(config)
-	if err != nil {
-		panic(err)
+	config.MultiQueue = tun.queueCount > 1
+	tun.vnetHdr = false
+	if tun.offload && !iftapmode {
+		if err := tun.openVnet(config.Name, config.MultiQueue); err != nil {
+			tun.core.log.Println("Failed to turn on TUN offload, opening the adapter without it:", err)
+		}
+	}
+	if tun.iface == nil {
+		iface, err := water.New(config)
+		if err != nil {
+			return err
+		}
+		tun.iface = iface
+		// In multiqueue mode, opening the adapter again by name adds another queue to it
+		tun.queues = []*water.Interface{iface}
+		for len(tun.queues) < tun.queueCount {
+			config.Name = iface.Name()
+			queue, err := water.New(config)
+			if err != nil {
+				return fmt.Errorf("failed to open TUN/TAP queue: %v", err)
+			}
+			tun.queues = append(tun.queues, queue)
+		}
 	}
-	tun.iface = iface
 	tun.mtu = getSupportedMTU(mtu)
 	// The following check is specific to Linux, as the TAP driver only supports
 	// an MTU of 65535-14 to make room for the ethernet headers. This makes sure
@@ -38,9 +63,12 @@ func (tun *tunDevice) setup(ifname string, iftapmode bool, addr string, mtu int)
 		}
 	}
 	// Friendly output
-	tun.core.log.Printf("Interface name: %s", tun.iface.Name())
+	tun.core.log.Printf("Interface name: %s", tun.name())
 	tun.core.log.Printf("Interface IPv6: %s", addr)
 	tun.core.log.Printf("Interface MTU: %d", tun.mtu)
+	if tun.vnetHdr {
+		tun.core.log.Println("Interface offload: TCP segmentation and checksums")
+	}
 	return tun.setupAddress(addr)
 }
 
@@ -56,29 +84,220 @@ func (tun *tunDevice) setupAddress(addr string) error {
 		return err
 	}
 	for _, ifce := range ifces {
-		if ifce.Name == tun.iface.Name() {
+		if ifce.Name == tun.name() {
 			var newIF = ifce
 			netIF = &newIF // Don't point inside ifces, it's apparently unsafe?...
 		}
 	}
 	if netIF == nil {
-		return errors.New(fmt.Sprintf("Failed to find interface: %s", tun.iface.Name()))
+		return errors.New(fmt.Sprintf("Failed to find interface: %s", tun.name()))
 	}
-	ip, ipNet, err := net.ParseCIDR(addr)
-	if err != nil {
-		return err
+	var ipNet *net.IPNet
+	if addr != "" {
+		// Extra adapters may be left without an address
+		var ip net.IP
+		ip, ipNet, err = net.ParseCIDR(addr)
+		if err != nil {
+			return err
+		}
+		if tun.peerAddr != nil {
+			err = tun_addPointToPointAddress(netIF, ip, tun.peerAddr)
+		} else {
+			err = netlink.NetworkLinkAddIp(netIF, ip, ipNet)
+		}
+		if err != nil {
+			return err
+		}
 	}
-	err = netlink.NetworkLinkAddIp(netIF, ip, ipNet)
+	err = netlink.NetworkSetMTU(netIF, tun.mtu)
 	if err != nil {
 		return err
 	}
-	err = netlink.NetworkSetMTU(netIF, tun.mtu)
-	if err != nil {
+	if tun.txQueueLen > 0 {
+		if err := netlink.NetworkSetTxQueueLen(netIF, tun.txQueueLen); err != nil {
+			return err
+		}
+	}
+	if err := tun.setupLinkNames(netIF); err != nil {
 		return err
 	}
 	netlink.NetworkLinkUp(netIF)
 	if err != nil {
 		return err
 	}
+	if tun.peerAddr != nil {
+		// There's no on-link /7, so the rest of the network has to be routed through the interface
+		if err := tun_addRoute(netIF, ipNet); err != nil {
+			return fmt.Errorf("failed to add route to %s: %v", ipNet, err)
+		}
+	}
+	return nil
+}
+
+// Extra adapters are supported on Linux.
+const tun_extraSupported = true
+
+// Netlink attributes that the netlink package doesn't support.
+const (
+	tun_IFA_ADDRESS     = 1
+	tun_IFA_LOCAL       = 2
+	tun_RTA_DST         = 1
+	tun_RTA_OIF         = 4
+	tun_IFLA_IFALIAS    = 20
+	tun_IFLA_GROUP      = 27
+	tun_IFLA_PROP_LIST  = 52
+	tun_IFLA_ALT_IFNAME = 53
+	tun_RTM_NEWLINKPROP = 108
+	tun_NLA_F_NESTED    = 0x8000
+	tun_groupsFile      = "/etc/iproute2/group"
+)
+
+// Assigns the interface to the configured group, and sets its alias and alternative names, if any.
+// These let firewall and routing rules match all of our interfaces, i.e. with "oifgroup" or by name.
+func (tun *tunDevice) setupLinkNames(netIF *net.Interface) error {
+	if tun.linkGroup != "" {
+		group, err := tun_parseGroup(tun.linkGroup)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, 4)
+		*(*uint32)(unsafe.Pointer(&data[0])) = group
+		if err := tun_netlinkRequest(syscall.RTM_NEWLINK, 0, tun_ifInfomsg(netIF.Index), tun_netlinkAttr(tun_IFLA_GROUP, data)); err != nil {
+			return fmt.Errorf("failed to set interface group: %v", err)
+		}
+	}
+	if tun.linkAlias != "" {
+		if err := tun_netlinkRequest(syscall.RTM_NEWLINK, 0, tun_ifInfomsg(netIF.Index), tun_netlinkAttr(tun_IFLA_IFALIAS, []byte(tun.linkAlias))); err != nil {
+			return fmt.Errorf("failed to set interface alias: %v", err)
+		}
+	}
+	for _, name := range tun.linkAltNames {
+		names := tun_netlinkAttr(tun_IFLA_ALT_IFNAME, append([]byte(name), 0))
+		if err := tun_netlinkRequest(tun_RTM_NEWLINKPROP, 0, tun_ifInfomsg(netIF.Index), tun_netlinkAttr(tun_IFLA_PROP_LIST|tun_NLA_F_NESTED, names)); err != nil {
+			if err == syscall.EEXIST {
+				// The name is left over from the last time that we used this interface
+				continue
+			}
+			return fmt.Errorf("failed to add alternative interface name %s: %v", name, err)
+		}
+	}
 	return nil
 }
+
+// Parses an interface group, which is either a number or a name from /etc/iproute2/group.
+func tun_parseGroup(group string) (uint32, error) {
+	if n, err := strconv.ParseUint(group, 0, 32); err == nil {
+		return uint32(n), nil
+	}
+	f, err := os.Open(tun_groupsFile)
+	if err != nil {
+		return 0, fmt.Errorf("unknown interface group: %s", group)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || fields[1] != group {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[0], 0, 32); err == nil {
+			return uint32(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown interface group: %s", group)
+}
+
+// Encodes an ifinfomsg header for a request about the interface with the given index.
+func tun_ifInfomsg(index int) []byte {
+	bs := make([]byte, syscall.SizeofIfInfomsg)
+	info := (*syscall.IfInfomsg)(unsafe.Pointer(&bs[0]))
+	info.Family = syscall.AF_UNSPEC
+	info.Index = int32(index)
+	return bs
+}
+
+// Adds a /128 address to the interface with the given address of the other end, as "ip addr add ip peer peer" would.
+func tun_addPointToPointAddress(netIF *net.Interface, ip net.IP, peer net.IP) error {
+	header := make([]byte, syscall.SizeofIfAddrmsg)
+	info := (*syscall.IfAddrmsg)(unsafe.Pointer(&header[0]))
+	info.Family = syscall.AF_INET6
+	info.Prefixlen = 128
+	info.Index = uint32(netIF.Index)
+	attrs := tun_netlinkAttr(tun_IFA_LOCAL, ip.To16())
+	attrs = append(attrs, tun_netlinkAttr(tun_IFA_ADDRESS, peer.To16())...)
+	return tun_netlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, header, attrs)
+}
+
+// Adds a route to the prefix through the interface, as "ip route add prefix dev interface" would.
+func tun_addRoute(netIF *net.Interface, prefix *net.IPNet) error {
+	header := make([]byte, syscall.SizeofRtMsg)
+	rt := (*syscall.RtMsg)(unsafe.Pointer(&header[0]))
+	rt.Family = syscall.AF_INET6
+	ones, _ := prefix.Mask.Size()
+	rt.Dst_len = uint8(ones)
+	rt.Table = syscall.RT_TABLE_MAIN
+	rt.Protocol = syscall.RTPROT_BOOT
+	rt.Scope = syscall.RT_SCOPE_UNIVERSE
+	rt.Type = syscall.RTN_UNICAST
+	index := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&index[0])) = uint32(netIF.Index)
+	attrs := tun_netlinkAttr(tun_RTA_DST, prefix.IP.To16())
+	attrs = append(attrs, tun_netlinkAttr(tun_RTA_OIF, index)...)
+	return tun_netlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, header, attrs)
+}
+
+// Encodes a netlink attribute, padded to a multiple of 4 bytes.
+func tun_netlinkAttr(attrType uint16, data []byte) []byte {
+	length := syscall.SizeofRtAttr + len(data)
+	bs := make([]byte, (length+3)&^3)
+	attr := (*syscall.RtAttr)(unsafe.Pointer(&bs[0]))
+	attr.Len = uint16(length)
+	attr.Type = attrType
+	copy(bs[syscall.SizeofRtAttr:], data)
+	return bs
+}
+
+// Sends a request with the given header, i.e. an ifinfomsg, and attributes, and waits for the kernel to acknowledge it.
+func tun_netlinkRequest(msgType uint16, flags uint16, header []byte, attrs []byte) error {
+	sock, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(sock)
+	if err := syscall.Bind(sock, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	msg := make([]byte, syscall.SizeofNlMsghdr, syscall.SizeofNlMsghdr+len(header)+len(attrs))
+	msg = append(append(msg, header...), attrs...)
+	hdr := (*syscall.NlMsghdr)(unsafe.Pointer(&msg[0]))
+	hdr.Len = uint32(len(msg))
+	hdr.Type = msgType
+	hdr.Flags = syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags
+	hdr.Seq = 1
+	if err := syscall.Sendto(sock, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(sock, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != hdr.Seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return errors.New("truncated netlink acknowledgement")
+			}
+			if errno := -*(*int32)(unsafe.Pointer(&m.Data[0])); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+}
@@ -4,6 +4,9 @@ package yggdrasil
 
 import water "github.com/yggdrasil-network/water"
 
+// Extra adapters aren't supported on this platform yet.
+const tun_extraSupported = false
+
 // This is to catch unsupported platforms
 // If your platform supports tun devices, you could try configuring it manually
 
@@ -28,6 +31,6 @@ func (tun *tunDevice) setup(ifname string, iftapmode bool, addr string, mtu int)
 // We don't know how to set the IPv6 address on an unknown platform, therefore
 // write about it to stdout and don't try to do anything further.
 func (tun *tunDevice) setupAddress(addr string) error {
-	tun.core.log.Println("Platform not supported, you must set the address of", tun.iface.Name(), "to", addr)
+	tun.core.log.Println("Platform not supported, you must set the address of", tun.name(), "to", addr)
 	return nil
 }
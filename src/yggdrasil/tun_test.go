@@ -0,0 +1,26 @@
+package yggdrasil
+
+import "testing"
+
+func TestFlowHash(t *testing.T) {
+	tcp := []byte{0x60, 0, 0, 0, 0, 20, packetFilter_tcp, 64, 8: 0xfd, 23: 1, 24: 0xfd, 39: 2, 0x04, 0xd2, 0, 80, 59: 0}
+	tests := []struct {
+		name string
+		a, b []byte
+		same bool
+	}{
+		{"same packet", tcp, append([]byte(nil), tcp...), true},
+		{"different payload", tcp, append(append([]byte(nil), tcp[:44]...), 1, 2, 3), true},
+		{"different source port", tcp, append(append([]byte(nil), tcp[:40]...), 0x04, 0xd3, 0, 80), false},
+		{"different destination", tcp, append(append(append([]byte(nil), tcp[:39]...), 3), tcp[40:]...), false},
+		{"same flow label, different ports", []byte{0x60, 0x0a, 0xbc, 0xde, 0, 4, packetFilter_udp, 64, 39: 0, 1, 2, 3, 4}, []byte{0x60, 0x0a, 0xbc, 0xde, 0, 4, packetFilter_udp, 64, 39: 0, 5, 6, 7, 8}, true},
+		{"different flow labels", []byte{0x60, 0x0a, 0xbc, 0xde, 0, 4, packetFilter_udp, 64, 39: 0, 1, 2, 3, 4}, []byte{0x60, 0x0a, 0xbc, 0xdf, 0, 4, packetFilter_udp, 64, 39: 0, 1, 2, 3, 4}, false},
+		{"IPv4 ports", []byte{0x45, 9: packetFilter_udp, 12: 10, 0, 0, 1, 10, 0, 0, 2, 0, 53, 0, 1}, []byte{0x45, 9: packetFilter_udp, 12: 10, 0, 0, 1, 10, 0, 0, 2, 0, 53, 0, 2}, false},
+		{"IPv4 fragments", []byte{0x45, 6: 0x20, 9: packetFilter_udp, 12: 10, 0, 0, 1, 10, 0, 0, 2, 0, 53, 0, 1}, []byte{0x45, 6: 0, 7: 0xb9, 9: packetFilter_udp, 12: 10, 0, 0, 1, 10, 0, 0, 2, 0xaa, 0xbb, 0xcc, 0xdd}, true},
+	}
+	for _, test := range tests {
+		if same := tun_flowHash(test.a) == tun_flowHash(test.b); same != test.same {
+			t.Errorf("%s: got the same hash %v, want %v", test.name, same, test.same)
+		}
+	}
+}
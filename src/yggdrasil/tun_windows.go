@@ -8,23 +8,31 @@ import (
 	water "github.com/yggdrasil-network/water"
 )
 
+// Extra adapters aren't supported on this platform yet.
+const tun_extraSupported = false
+
 // This is to catch Windows platforms
 
-// Configures the TAP adapter with the correct IPv6 address and MTU. On Windows
-// we don't make use of a direct operating system API to do this - we instead
-// delegate the hard work to "netsh".
+// Configures the TUN/TAP adapter with the correct IPv6 address and MTU. On
+// Windows we don't make use of a direct operating system API to do this - we
+// instead delegate the hard work to "netsh". TUN mode uses the Wintun driver,
+// and TAP mode, or TUN mode without wintun.dll, uses TAP-Windows.
 func (tun *tunDevice) setup(ifname string, iftapmode bool, addr string, mtu int) error {
 	if !iftapmode {
-		tun.core.log.Printf("TUN mode is not supported on this platform, defaulting to TAP")
+		if wintun_available() {
+			return tun.setupWintun(ifname, addr, mtu)
+		}
+		tun.core.log.Printf("TUN mode needs wintun.dll, which wasn't found, defaulting to TAP")
+	}
+	// Install or update the adapter if needed, rather than failing to start
+	name, err := tun.prepareTAP(ifname)
+	if err != nil {
+		return err
 	}
 	config := water.Config{DeviceType: water.TAP}
-	config.PlatformSpecificParams.ComponentID = "tap0901"
+	config.PlatformSpecificParams.ComponentID = tap_componentID
 	config.PlatformSpecificParams.Network = "169.254.0.1/32"
-	if ifname == "auto" {
-		config.PlatformSpecificParams.InterfaceName = ""
-	} else {
-		config.PlatformSpecificParams.InterfaceName = ifname
-	}
+	config.PlatformSpecificParams.InterfaceName = name
 	iface, err := water.New(config)
 	if err != nil {
 		panic(err)
@@ -64,11 +72,34 @@ func (tun *tunDevice) setup(ifname string, iftapmode bool, addr string, mtu int)
 	return tun.setupAddress(addr)
 }
 
-// Sets the MTU of the TAP adapter.
+// Opens a Wintun adapter and configures it.
+func (tun *tunDevice) setupWintun(ifname string, addr string, mtu int) error {
+	adapter, err := wintun_open(ifname)
+	if err != nil {
+		return err
+	}
+	tun.iface = &water.Interface{ReadWriteCloser: adapter}
+	tun.mtu = getSupportedMTU(mtu)
+	if err := tun.setupMTU(tun.mtu); err != nil {
+		adapter.Close()
+		return err
+	}
+	// Friendly output
+	tun.core.log.Printf("Interface name: %s (Wintun)", tun.name())
+	tun.core.log.Printf("Interface IPv6: %s", addr)
+	tun.core.log.Printf("Interface MTU: %d", tun.mtu)
+	if err := tun.setupAddress(addr); err != nil {
+		adapter.Close()
+		return err
+	}
+	return nil
+}
+
+// Sets the MTU of the TUN/TAP adapter.
 func (tun *tunDevice) setupMTU(mtu int) error {
 	// Set MTU
 	cmd := exec.Command("netsh", "interface", "ipv6", "set", "subinterface",
-		fmt.Sprintf("interface=%s", tun.iface.Name()),
+		fmt.Sprintf("interface=%s", tun.name()),
 		fmt.Sprintf("mtu=%d", mtu),
 		"store=active")
 	tun.core.log.Printf("netsh command: %v", strings.Join(cmd.Args, " "))
@@ -81,11 +112,11 @@ func (tun *tunDevice) setupMTU(mtu int) error {
 	return nil
 }
 
-// Sets the IPv6 address of the TAP adapter.
+// Sets the IPv6 address of the TUN/TAP adapter.
 func (tun *tunDevice) setupAddress(addr string) error {
 	// Set address
 	cmd := exec.Command("netsh", "interface", "ipv6", "add", "address",
-		fmt.Sprintf("interface=%s", tun.iface.Name()),
+		fmt.Sprintf("interface=%s", tun.name()),
 		fmt.Sprintf("addr=%s", addr),
 		"store=active")
 	tun.core.log.Printf("netsh command: %v", strings.Join(cmd.Args, " "))
@@ -0,0 +1,94 @@
+package yggdrasil
+
+// The linux platform specific parts of reading and writing the tun adapter in batches
+
+import (
+	"syscall"
+	"unsafe"
+
+	water "github.com/yggdrasil-network/water"
+)
+
+// Gets the raw connection of a queue of the adapter, which packets can be read from in batches and written to with vectored I/O.
+// Returns nil if that isn't possible, i.e. because the queue isn't in non-blocking mode, so reading until there's nothing left would block.
+func tun_rawConn(iface *water.Interface) syscall.RawConn {
+	conn, ok := iface.ReadWriteCloser.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var flags uintptr
+	var errno syscall.Errno
+	if err := raw.Control(func(fd uintptr) {
+		flags, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+	}); err != nil || errno != 0 || flags&syscall.O_NONBLOCK == 0 {
+		return nil
+	}
+	return raw
+}
+
+// Reads packets into the buffers, and their sizes into sizes, until there are no more waiting or the buffers are full.
+// Waits for the first packet, and returns the number of packets read.
+func tun_readBatch(raw syscall.RawConn, bufs [][]byte, sizes []int) (int, error) {
+	var count int
+	var readErr error
+	err := raw.Read(func(fd uintptr) bool {
+		for count < len(bufs) {
+			n, err := syscall.Read(int(fd), bufs[count])
+			switch {
+			case err == syscall.EINTR:
+				continue
+			case err == syscall.EAGAIN:
+				// Nothing left, so wait for the adapter to become readable if nothing was read
+				return count > 0
+			case err != nil:
+				readErr = err
+				return true
+			}
+			sizes[count] = n
+			count++
+		}
+		return true
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, readErr
+}
+
+// Writes the buffers to the adapter as a single packet with one system call.
+func tun_writev(raw syscall.RawConn, bufs ...[]byte) error {
+	iovecs := make([]syscall.Iovec, 0, len(bufs))
+	for _, buf := range bufs {
+		if len(buf) == 0 {
+			continue
+		}
+		iovec := syscall.Iovec{Base: &buf[0]}
+		iovec.SetLen(len(buf))
+		iovecs = append(iovecs, iovec)
+	}
+	var writeErr error
+	err := raw.Write(func(fd uintptr) bool {
+		for {
+			_, _, errno := syscall.Syscall(syscall.SYS_WRITEV, fd, uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+			switch errno {
+			case syscall.EINTR:
+				continue
+			case syscall.EAGAIN:
+				// Wait for the adapter to become writable
+				return false
+			case 0:
+			default:
+				writeErr = errno
+			}
+			return true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
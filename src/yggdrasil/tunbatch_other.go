@@ -0,0 +1,23 @@
+// +build !linux
+
+package yggdrasil
+
+import (
+	"errors"
+	"syscall"
+
+	water "github.com/yggdrasil-network/water"
+)
+
+// Reading the adapter in batches and writing to it with vectored I/O are only supported on Linux.
+func tun_rawConn(iface *water.Interface) syscall.RawConn {
+	return nil
+}
+
+func tun_readBatch(raw syscall.RawConn, bufs [][]byte, sizes []int) (int, error) {
+	return 0, errors.New("not supported on this platform")
+}
+
+func tun_writev(raw syscall.RawConn, bufs ...[]byte) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,165 @@
+package yggdrasil
+
+// This runs additional TUN adapters alongside the main one, each of which is
+// given the packets from the mesh whose destinations are in its own prefixes,
+// i.e. traffic for the node's address on one device and traffic for subnets
+// reached with crypto-key routing on another, so that the host can apply
+// different routing policies to each. Packets read from any adapter are sent
+// to the mesh as usual, and packets that match no adapter's prefixes are
+// written to the main one. The extra adapters are only supported on Linux in
+// TUN mode, and are created when the node starts.
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"yggdrasil/config"
+)
+
+type tunExtras struct {
+	core     *Core
+	configs  []config.ExtraInterfaceConfig
+	adapters atomic.Value // []*tunExtra, while they're running
+}
+
+// An additional adapter and the destinations of the packets that are written to it.
+type tunExtra struct {
+	tun      tunDevice
+	recv     chan []byte
+	address  string
+	prefixes []*net.IPNet
+}
+
+// Initializes the tunExtras struct.
+func (e *tunExtras) init(core *Core) {
+	e.core = core
+	e.adapters.Store([]*tunExtra{})
+}
+
+// Sets the adapters to create when the node starts, after checking their prefixes and addresses.
+func (e *tunExtras) setConfig(configs []config.ExtraInterfaceConfig) error {
+	for _, cfg := range configs {
+		if cfg.Name == "" || tun_isHeadless(cfg.Name) || cfg.Name == "auto" {
+			return errors.New("extra interfaces must be given a name")
+		}
+		if len(cfg.Prefixes) == 0 {
+			return errors.New("extra interface " + cfg.Name + " has no prefixes")
+		}
+		for _, prefix := range cfg.Prefixes {
+			if _, _, err := net.ParseCIDR(prefix); err != nil {
+				return err
+			}
+		}
+		if cfg.Address != "" {
+			if _, _, err := net.ParseCIDR(cfg.Address); err != nil {
+				return err
+			}
+		}
+	}
+	e.configs = configs
+	return nil
+}
+
+// Creates the configured adapters.
+func (e *tunExtras) start() error {
+	if len(e.configs) == 0 {
+		return nil
+	}
+	if !tun_extraSupported {
+		return errors.New("extra interfaces are only supported on Linux")
+	}
+	if e.core.tun.getState().isTAP() {
+		return errors.New("extra interfaces can't be used in TAP mode")
+	}
+	var adapters []*tunExtra
+	for _, cfg := range e.configs {
+		extra := &tunExtra{address: cfg.Address}
+		for _, prefix := range cfg.Prefixes {
+			_, ipNet, _ := net.ParseCIDR(prefix)
+			extra.prefixes = append(extra.prefixes, ipNet)
+		}
+		mtu := cfg.MTU
+		if mtu == 0 {
+			mtu = e.core.tun.settings.mtu
+		}
+		extra.recv = make(chan []byte, router_tunQueueSize)
+		extra.tun.init(e.core)
+		extra.tun.setDropWhenFull(e.core.tun.dropWhenFull)
+		extra.tun.send = e.core.tun.send
+		extra.tun.recv = extra.recv
+		if err := extra.tun.start(cfg.Name, false, cfg.Address, mtu); err != nil {
+			for _, started := range adapters {
+				started.tun.shutdown()
+			}
+			return err
+		}
+		e.core.log.Println("Created extra TUN adapter", extra.tun.name(), "for", cfg.Prefixes)
+		adapters = append(adapters, extra)
+	}
+	e.adapters.Store(adapters)
+	return nil
+}
+
+// Closes the adapters, after which packets for their prefixes are written to the main adapter.
+func (e *tunExtras) close() {
+	adapters := e.adapters.Load().([]*tunExtra)
+	e.adapters.Store([]*tunExtra{})
+	for _, extra := range adapters {
+		extra.tun.shutdown()
+	}
+}
+
+// Gets the adapter that a packet from the mesh should be written to, or nil if it's for the main adapter.
+// This may be called from any goroutine.
+func (e *tunExtras) lookup(packet []byte) *tunExtra {
+	adapters := e.adapters.Load().([]*tunExtra)
+	if len(adapters) == 0 || len(packet) == 0 {
+		return nil
+	}
+	var dest net.IP
+	switch {
+	case packet[0]&0xf0 == 0x60 && len(packet) >= tun_IPv6_HEADER_LENGTH:
+		dest = net.IP(packet[24:40])
+	case packet[0]&0xf0 == 0x40 && len(packet) >= tun_IPv4_HEADER_LENGTH:
+		dest = net.IP(packet[16:20])
+	default:
+		return nil
+	}
+	for _, extra := range adapters {
+		for _, prefix := range extra.prefixes {
+			if prefix.Contains(dest) {
+				return extra
+			}
+		}
+	}
+	return nil
+}
+
+// Gets the state of the adapters, for the admin API.
+func (e *tunExtras) getInfo() admin_info {
+	info := admin_info{}
+	for _, extra := range e.adapters.Load().([]*tunExtra) {
+		var prefixes []string
+		for _, prefix := range extra.prefixes {
+			prefixes = append(prefixes, prefix.String())
+		}
+		counters := extra.tun.counters
+		adapter := admin_info{
+			"address":         extra.address,
+			"prefixes":        prefixes,
+			"mtu":             extra.tun.getState().mtu,
+			"bytes_read":      atomic.LoadUint64(&counters.bytesRead),
+			"bytes_written":   atomic.LoadUint64(&counters.bytesWritten),
+			"packets_read":    atomic.LoadUint64(&counters.packetsRead),
+			"packets_written": atomic.LoadUint64(&counters.packetsWritten),
+			"read_dropped":    atomic.LoadUint64(&counters.readDropped),
+			"write_dropped":   atomic.LoadUint64(&counters.writeDropped),
+			"read_errors":     atomic.LoadUint64(&counters.readErrors),
+			"write_errors":    atomic.LoadUint64(&counters.writeErrors),
+			"recoveries":      atomic.LoadUint64(&counters.recoveries),
+		}
+		info[extra.tun.settings.ifname] = adapter
+	}
+	return info
+}
@@ -0,0 +1,150 @@
+package yggdrasil
+
+// This implements segmentation and checksum offload for the TUN adapter, which
+// is only supported on Linux. With offload, the kernel doesn't split the TCP
+// streams that are sent through the adapter into packets of the MTU, and
+// passes each large segment to us in one read, along with a virtio-net header
+// that says how it should be split. The segments are split into packets here,
+// which saves a read for every packet of a bulk transfer, and the checksums
+// that the kernel left for us to fill in are completed. Packets written to the
+// adapter are written as they are, with a header that says so.
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/yggdrasil-network/water"
+)
+
+// The size of the virtio-net header, its flags and segmentation types, and the largest segment that the kernel passes to us.
+const (
+	tun_vnetHdrLength   = 10
+	tun_vnetNeedsCsum   = 1
+	tun_vnetGSONone     = 0
+	tun_vnetGSOTCPv6    = 4
+	tun_vnetGSOECN      = 0x80
+	tun_vnetMaxSegment  = 65535
+	tun_tcpFlagFIN      = 0x01
+	tun_tcpFlagPSH      = 0x08
+	tun_tcpFlagCWR      = 0x80
+	tun_tcpHeaderLength = 20
+)
+
+// The header of packets that are written to the adapter as they are.
+var tun_vnetHdrNone = make([]byte, tun_vnetHdrLength)
+
+// The byte order of the virtio-net header, which is the host's own.
+var tun_vnetByteOrder binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// Handles a segment read from the TUN adapter with a virtio-net header, splitting it into packets if needed.
+// The packets are built in the scratch buffer, which is reused.
+func (tun *tunDevice) handleVnetRead(iface *water.Interface, buf []byte, scratch []byte) {
+	if len(buf) < tun_vnetHdrLength+tun_IPv6_HEADER_LENGTH {
+		tun.countMalformed(tun_malformedShort)
+		return
+	}
+	hdr, packet := buf[:tun_vnetHdrLength], buf[tun_vnetHdrLength:]
+	switch hdr[1] &^ tun_vnetGSOECN {
+	case tun_vnetGSONone:
+		if hdr[0]&tun_vnetNeedsCsum != 0 {
+			csumStart := int(tun_vnetByteOrder.Uint16(hdr[6:8]))
+			csumOffset := int(tun_vnetByteOrder.Uint16(hdr[8:10]))
+			if !tun_completeChecksum(packet, csumStart, csumOffset) {
+				tun.countMalformed(tun_malformedChecksum)
+				return
+			}
+		}
+		tun.handleRead(iface, packet)
+	case tun_vnetGSOTCPv6:
+		// The checksum of each packet is calculated from scratch when it's split off
+		atomic.AddUint64(&tun.counters.segmentsSplit, 1)
+		tun_splitTCP(packet, int(tun_vnetByteOrder.Uint16(hdr[4:6])), scratch, func(p []byte) {
+			tun.handleRead(iface, p)
+		})
+	default:
+		atomic.AddUint64(&tun.counters.readUnknown, 1)
+	}
+}
+
+// Splits a TCP segment into packets carrying at most mss bytes each, passing each one to handle in turn.
+// Only the first packet keeps the CWR flag, and only the last keeps FIN and PSH, as if the sender had split them.
+func tun_splitTCP(packet []byte, mss int, scratch []byte, handle func([]byte)) {
+	if mss <= 0 || len(packet) < tun_IPv6_HEADER_LENGTH+tun_tcpHeaderLength || packet[6] != packetFilter_tcp {
+		return
+	}
+	tcpLen := int(packet[tun_IPv6_HEADER_LENGTH+12]>>4) * 4
+	hdrLen := tun_IPv6_HEADER_LENGTH + tcpLen
+	if tcpLen < tun_tcpHeaderLength || len(packet) < hdrLen {
+		return
+	}
+	seq := binary.BigEndian.Uint32(packet[tun_IPv6_HEADER_LENGTH+4:])
+	payload := packet[hdrLen:]
+	for offset := 0; offset == 0 || offset < len(payload); offset += mss {
+		end := offset + mss
+		if end > len(payload) {
+			end = len(payload)
+		}
+		p := append(append(scratch[:0], packet[:hdrLen]...), payload[offset:end]...)
+		binary.BigEndian.PutUint16(p[4:6], uint16(len(p)-tun_IPv6_HEADER_LENGTH))
+		binary.BigEndian.PutUint32(p[tun_IPv6_HEADER_LENGTH+4:], seq+uint32(offset))
+		if offset > 0 {
+			p[tun_IPv6_HEADER_LENGTH+13] &^= tun_tcpFlagCWR
+		}
+		if end < len(payload) {
+			p[tun_IPv6_HEADER_LENGTH+13] &^= tun_tcpFlagFIN | tun_tcpFlagPSH
+		}
+		tun_tcpChecksum(p)
+		handle(p)
+	}
+}
+
+// Adds up the 16 bit words of b to a ones' complement sum.
+func tun_checksumAdd(sum uint32, b []byte) uint32 {
+	for idx := 0; idx+1 < len(b); idx += 2 {
+		sum += uint32(b[idx])<<8 | uint32(b[idx+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// Folds a ones' complement sum into a checksum.
+func tun_checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// Fills in the TCP checksum of an IPv6 packet without extension headers.
+func tun_tcpChecksum(packet []byte) {
+	tcp := packet[tun_IPv6_HEADER_LENGTH:]
+	tcp[16], tcp[17] = 0, 0
+	sum := tun_checksumAdd(0, packet[8:40])
+	sum += uint32(len(tcp)) + packetFilter_tcp
+	binary.BigEndian.PutUint16(tcp[16:18], tun_checksumFold(tun_checksumAdd(sum, tcp)))
+}
+
+// Completes a checksum that the kernel left for us, where the field at csumStart+csumOffset holds the sum of the pseudo-header, and the rest of the packet from csumStart is to be added.
+// Returns false if the offsets are outside the packet.
+func tun_completeChecksum(packet []byte, csumStart, csumOffset int) bool {
+	field := csumStart + csumOffset
+	if csumStart >= len(packet) || field+2 > len(packet) {
+		return false
+	}
+	csum := tun_checksumFold(tun_checksumAdd(0, packet[csumStart:]))
+	if csum == 0 {
+		// UDP uses zero for no checksum, which isn't allowed over IPv6, and TCP treats both the same
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(packet[field:], csum)
+	return true
+}
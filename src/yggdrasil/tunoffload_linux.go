@@ -0,0 +1,85 @@
+package yggdrasil
+
+// The linux platform specific parts of opening the tun adapter with offload
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	water "github.com/yggdrasil-network/water"
+)
+
+// The ioctls and flags for opening a TUN adapter with a virtio-net header and turning on offload, which water doesn't support.
+const (
+	tun_TUNSETIFF       = 0x400454ca
+	tun_TUNSETOFFLOAD   = 0x400454d0
+	tun_IFF_TUN         = 0x0001
+	tun_IFF_MULTI_QUEUE = 0x0100
+	tun_IFF_NO_PI       = 0x1000
+	tun_IFF_VNET_HDR    = 0x4000
+	tun_TUN_F_CSUM      = 0x01
+	tun_TUN_F_TSO6      = 0x04
+)
+
+// A queue of a TUN adapter that we opened ourselves, which water doesn't know the name of.
+type tun_vnetFile struct {
+	*os.File
+	name string
+}
+
+func (f *tun_vnetFile) adapterName() string {
+	return f.name
+}
+
+// Opens a queue of the TUN adapter with the name, or a new adapter if it's empty, with a virtio-net header and with checksum and TCP segmentation offload turned on.
+// The queue is non-blocking, so that it can be read in batches.
+func tun_openVnet(name string, multiQueue bool) (*tun_vnetFile, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	// A struct ifreq, with the name followed by the flags
+	var req [40]byte
+	copy(req[:syscall.IFNAMSIZ-1], name)
+	flags := uint16(tun_IFF_TUN | tun_IFF_NO_PI | tun_IFF_VNET_HDR)
+	if multiQueue {
+		flags |= tun_IFF_MULTI_QUEUE
+	}
+	*(*uint16)(unsafe.Pointer(&req[syscall.IFNAMSIZ])) = flags
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tun_TUNSETIFF, uintptr(unsafe.Pointer(&req[0]))); errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tun_TUNSETOFFLOAD, tun_TUN_F_CSUM|tun_TUN_F_TSO6); errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+	length := 0
+	for length < syscall.IFNAMSIZ && req[length] != 0 {
+		length++
+	}
+	return &tun_vnetFile{File: os.NewFile(uintptr(fd), "/dev/net/tun"), name: string(req[:length])}, nil
+}
+
+// Opens the TUN adapter with offload, along with any extra queues.
+func (tun *tunDevice) openVnet(name string, multiQueue bool) error {
+	file, err := tun_openVnet(name, multiQueue)
+	if err != nil {
+		return err
+	}
+	tun.iface = &water.Interface{ReadWriteCloser: file}
+	tun.queues = []*water.Interface{tun.iface}
+	for len(tun.queues) < tun.queueCount {
+		queue, err := tun_openVnet(file.name, multiQueue)
+		if err != nil {
+			tun.close()
+			tun.iface, tun.queues = nil, nil
+			return fmt.Errorf("failed to open TUN queue: %v", err)
+		}
+		tun.queues = append(tun.queues, &water.Interface{ReadWriteCloser: queue})
+	}
+	tun.vnetHdr = true
+	return nil
+}
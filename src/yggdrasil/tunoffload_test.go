@@ -0,0 +1,213 @@
+package yggdrasil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Works out the checksum of an IPv6 packet's upper layer the long way, rather than with the code under test.
+// A packet with a correct checksum gives 0.
+func tunOffload_testChecksum(packet []byte, protocol byte) uint16 {
+	length := len(packet) - tun_IPv6_HEADER_LENGTH
+	data := append([]byte(nil), packet[8:40]...)
+	data = append(data, byte(length>>24), byte(length>>16), byte(length>>8), byte(length), 0, 0, 0, protocol)
+	data = append(data, packet[tun_IPv6_HEADER_LENGTH:]...)
+	if len(data)%2 == 1 {
+		data = append(data, 0)
+	}
+	var sum uint64
+	for idx := 0; idx < len(data); idx += 2 {
+		sum += uint64(data[idx])<<8 | uint64(data[idx+1])
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func TestSplitTCP(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []byte
+		payload  int
+		mss      int
+		segments []int // Payload length of each packet that should be split off
+	}{
+		{"shorter than the MSS", nil, 100, 1220, []int{100}},
+		{"exactly the MSS", nil, 1220, 1220, []int{1220}},
+		{"one byte over the MSS", nil, 1221, 1220, []int{1220, 1}},
+		{"exact multiple of the MSS", nil, 3660, 1220, []int{1220, 1220, 1220}},
+		{"odd MSS and length", nil, 2999, 999, []int{999, 999, 999, 2}},
+		{"no payload", nil, 0, 1220, []int{0}},
+		{"TCP options", []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2}, 2500, 1208, []int{1208, 1208, 84}},
+	}
+	for _, test := range tests {
+		hdrLen := tun_IPv6_HEADER_LENGTH + tun_tcpHeaderLength + len(test.options)
+		packet := make([]byte, hdrLen+test.payload)
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:6], uint16(len(packet)-tun_IPv6_HEADER_LENGTH))
+		packet[6] = packetFilter_tcp
+		packet[8], packet[23], packet[24], packet[39] = 0xfd, 1, 0xfd, 2
+		tcp := packet[tun_IPv6_HEADER_LENGTH:]
+		binary.BigEndian.PutUint32(tcp[4:8], 1000)
+		tcp[12] = byte((tun_tcpHeaderLength+len(test.options))/4) << 4
+		tcp[13] = tun_tcpFlagCWR | tun_tcpFlagPSH | tun_tcpFlagFIN | 0x10
+		copy(tcp[tun_tcpHeaderLength:], test.options)
+		for idx := hdrLen; idx < len(packet); idx++ {
+			// Different at every offset, so that misplaced bytes are noticed
+			packet[idx] = byte(idx*7 + idx/251)
+		}
+		var got [][]byte
+		tun_splitTCP(packet, test.mss, make([]byte, 0, 65535), func(p []byte) {
+			got = append(got, append([]byte(nil), p...))
+		})
+		if len(got) != len(test.segments) {
+			t.Errorf("%s: got %d packets, want %d", test.name, len(got), len(test.segments))
+			continue
+		}
+		var joined []byte
+		for idx, p := range got {
+			if len(p) != hdrLen+test.segments[idx] {
+				t.Errorf("%s: packet %d has %d bytes, want %d", test.name, idx, len(p), hdrLen+test.segments[idx])
+				continue
+			}
+			if length := binary.BigEndian.Uint16(p[4:6]); int(length) != len(p)-tun_IPv6_HEADER_LENGTH {
+				t.Errorf("%s: packet %d has payload length %d", test.name, idx, length)
+			}
+			if seq := binary.BigEndian.Uint32(p[tun_IPv6_HEADER_LENGTH+4:]); seq != 1000+uint32(idx*test.mss) {
+				t.Errorf("%s: packet %d has sequence number %d", test.name, idx, seq)
+			}
+			if !bytes.Equal(p[tun_IPv6_HEADER_LENGTH+tun_tcpHeaderLength:hdrLen], test.options) {
+				t.Errorf("%s: packet %d lost its TCP options", test.name, idx)
+			}
+			if tunOffload_testChecksum(p, packetFilter_tcp) != 0 {
+				t.Errorf("%s: packet %d has a bad checksum", test.name, idx)
+			}
+			// Only the first keeps CWR, only the last keeps FIN and PSH, and all keep ACK
+			flags := p[tun_IPv6_HEADER_LENGTH+13]
+			want := byte(0x10)
+			if idx == 0 {
+				want |= tun_tcpFlagCWR
+			}
+			if idx == len(got)-1 {
+				want |= tun_tcpFlagFIN | tun_tcpFlagPSH
+			}
+			if flags != want {
+				t.Errorf("%s: packet %d has flags %#02x, want %#02x", test.name, idx, flags, want)
+			}
+			joined = append(joined, p[hdrLen:]...)
+		}
+		if !bytes.Equal(joined, packet[hdrLen:]) {
+			t.Errorf("%s: the packets don't add up to the segment's payload", test.name)
+		}
+	}
+}
+
+func TestSplitTCPInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		protocol   byte
+		length     int
+		dataOffset byte
+		mss        int
+	}{
+		{"zero MSS", packetFilter_tcp, 120, 5, 0},
+		{"negative MSS", packetFilter_tcp, 120, 5, -1},
+		{"not TCP", packetFilter_udp, 120, 5, 1220},
+		{"short TCP header", packetFilter_tcp, tun_IPv6_HEADER_LENGTH + tun_tcpHeaderLength - 1, 5, 1220},
+		{"data offset below the header", packetFilter_tcp, 120, 4, 1220},
+		{"data offset past the end", packetFilter_tcp, 80, 15, 1220},
+	}
+	for _, test := range tests {
+		packet := make([]byte, test.length)
+		packet[0] = 0x60
+		packet[6] = test.protocol
+		if len(packet) > tun_IPv6_HEADER_LENGTH+12 {
+			packet[tun_IPv6_HEADER_LENGTH+12] = test.dataOffset << 4
+		}
+		tun_splitTCP(packet, test.mss, nil, func(p []byte) {
+			t.Errorf("%s: got a packet, want none", test.name)
+		})
+	}
+}
+
+func TestCompleteChecksum(t *testing.T) {
+	tests := []struct {
+		name       string
+		protocol   byte
+		header     int // Length of the upper layer header
+		csumOffset int
+		payload    int
+	}{
+		{"TCP", packetFilter_tcp, tun_tcpHeaderLength, 16, 1000},
+		{"TCP with odd length", packetFilter_tcp, tun_tcpHeaderLength, 16, 999},
+		{"TCP without payload", packetFilter_tcp, tun_tcpHeaderLength, 16, 0},
+		{"UDP", packetFilter_udp, 8, 6, 512},
+		{"UDP with odd length", packetFilter_udp, 8, 6, 1},
+	}
+	for _, test := range tests {
+		packet := make([]byte, tun_IPv6_HEADER_LENGTH+test.header+test.payload)
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:6], uint16(len(packet)-tun_IPv6_HEADER_LENGTH))
+		packet[6] = test.protocol
+		packet[8], packet[23], packet[24], packet[39] = 0xfd, 1, 0xfd, 2
+		for idx := tun_IPv6_HEADER_LENGTH + test.header; idx < len(packet); idx++ {
+			packet[idx] = byte(idx * 13)
+		}
+		// The kernel leaves the sum of the pseudo-header in the checksum field, not inverted, which is what the sum of the whole thing comes to while the rest is zero
+		field := tun_IPv6_HEADER_LENGTH + test.csumOffset
+		pseudo := append([]byte(nil), packet[:tun_IPv6_HEADER_LENGTH+test.header]...)
+		pseudo = append(pseudo, make([]byte, test.payload)...)
+		binary.BigEndian.PutUint16(packet[field:], ^tunOffload_testChecksum(pseudo, test.protocol))
+		if !tun_completeChecksum(packet, tun_IPv6_HEADER_LENGTH, test.csumOffset) {
+			t.Errorf("%s: the offsets were rejected", test.name)
+			continue
+		}
+		if tunOffload_testChecksum(packet, test.protocol) != 0 {
+			t.Errorf("%s: checksum %#04x is wrong", test.name, binary.BigEndian.Uint16(packet[field:]))
+		}
+	}
+}
+
+func TestCompleteChecksumZero(t *testing.T) {
+	packet := make([]byte, tun_IPv6_HEADER_LENGTH+8+64)
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], 8+64)
+	packet[6] = packetFilter_udp
+	packet[8], packet[23], packet[24], packet[39] = 0xfd, 1, 0xfd, 2
+	pseudo := ^tunOffload_testChecksum(packet, packetFilter_udp)
+	for idx := tun_IPv6_HEADER_LENGTH + 8; idx < len(packet)-2; idx++ {
+		packet[idx] = byte(idx * 13)
+	}
+	// Choose the last word so that the checksum comes out as zero, which must be sent as 0xffff instead
+	binary.BigEndian.PutUint16(packet[len(packet)-2:], tunOffload_testChecksum(packet, packetFilter_udp))
+	binary.BigEndian.PutUint16(packet[tun_IPv6_HEADER_LENGTH+6:], pseudo)
+	if !tun_completeChecksum(packet, tun_IPv6_HEADER_LENGTH, 6) {
+		t.Fatal("the offsets were rejected")
+	}
+	if csum := binary.BigEndian.Uint16(packet[tun_IPv6_HEADER_LENGTH+6:]); csum != 0xffff {
+		t.Errorf("got checksum %#04x, want 0xffff", csum)
+	}
+}
+
+func TestCompleteChecksumOffsets(t *testing.T) {
+	const length = tun_IPv6_HEADER_LENGTH + 8
+	tests := []struct {
+		name       string
+		csumStart  int
+		csumOffset int
+		ok         bool
+	}{
+		{"in the packet", tun_IPv6_HEADER_LENGTH, 6, true},
+		{"field ends at the end", length - 2, 0, true},
+		{"field straddles the end", length - 1, 0, false},
+		{"start at the end", length, 0, false},
+		{"field past the end", tun_IPv6_HEADER_LENGTH, 8, false},
+	}
+	for _, test := range tests {
+		if ok := tun_completeChecksum(make([]byte, length), test.csumStart, test.csumOffset); ok != test.ok {
+			t.Errorf("%s: got %v, want %v", test.name, ok, test.ok)
+		}
+	}
+}
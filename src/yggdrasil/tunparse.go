@@ -0,0 +1,144 @@
+package yggdrasil
+
+// This checks the headers of packets read from the TUN/TAP adapter, to find
+// where each packet really ends. Packets may be followed by padding, i.e. in
+// ethernet frames that are shorter than the minimum size, so anything after
+// the length in the header is dropped rather than the whole packet. The chain
+// of IPv6 extension headers is walked to make sure that it's complete, and
+// the length of a jumbogram is taken from its jumbo payload option, as in
+// RFC 2675. Packets that are shorter than their headers say are counted as
+// malformed, with the reason, and dropped.
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// Reasons that a packet read from the adapter is malformed.
+const (
+	tun_malformedShort     = iota // Shorter than an IP header
+	tun_malformedTruncated        // Shorter than the length in its header
+	tun_malformedHeader           // An extension header that runs past the end of the packet, or an invalid IPv4 header length
+	tun_malformedJumbo            // A payload length of 0 after a hop-by-hop header without a valid jumbo payload option
+	tun_malformedChecksum         // A checksum offset from the kernel that's outside the packet, with offload
+	tun_malformedCount
+)
+
+// Names of the reasons that packets are malformed, for the admin API.
+var tun_malformedNames = [tun_malformedCount]string{"short", "truncated", "extension_header", "jumbo", "checksum_offset"}
+
+// IPv6 next header values for extension headers that the packet filter doesn't skip, and the jumbo payload option.
+const (
+	tun_nextHeaderAH   = 51
+	tun_nextHeaderESP  = 50
+	tun_nextHeaderNone = 59
+	tun_optPad1        = 0
+	tun_optJumbo       = 0xc2
+)
+
+// Counts a packet read from the adapter as malformed, for the reason.
+func (tun *tunDevice) countMalformed(reason int) {
+	atomic.AddUint64(&tun.counters.readMalformed, 1)
+	atomic.AddUint64(&tun.counters.malformedBy[reason], 1)
+}
+
+// Gets the number of malformed packets read for each reason, for the admin API.
+func (tun *tunDevice) getMalformed() admin_info {
+	info := admin_info{}
+	for reason, name := range tun_malformedNames {
+		info[name] = atomic.LoadUint64(&tun.counters.malformedBy[reason])
+	}
+	return info
+}
+
+// Gets the length of an IPv6 packet from its headers, or 0 and the reason if it's malformed.
+// The length may be shorter than the buffer, which is then followed by padding.
+func tun_parseIPv6(packet []byte) (int, int) {
+	if len(packet) < tun_IPv6_HEADER_LENGTH {
+		return 0, tun_malformedShort
+	}
+	length := tun_IPv6_HEADER_LENGTH + int(binary.BigEndian.Uint16(packet[4:6]))
+	if length == tun_IPv6_HEADER_LENGTH && packet[6] == packetFilter_hopByHop {
+		jumbo, ok := tun_jumboLength(packet)
+		if !ok {
+			return 0, tun_malformedJumbo
+		}
+		length = tun_IPv6_HEADER_LENGTH + jumbo
+	}
+	if len(packet) < length {
+		return 0, tun_malformedTruncated
+	}
+	// Make sure that the extension headers are all in the packet
+	protocol, payload := int(packet[6]), packet[tun_IPv6_HEADER_LENGTH:length]
+	for {
+		var headerLen int
+		switch protocol {
+		case packetFilter_hopByHop, packetFilter_routing, packetFilter_destOptions:
+			if len(payload) < 2 {
+				return 0, tun_malformedHeader
+			}
+			headerLen = 8 + 8*int(payload[1])
+		case tun_nextHeaderAH:
+			if len(payload) < 2 {
+				return 0, tun_malformedHeader
+			}
+			headerLen = 4 * (int(payload[1]) + 2)
+		case packetFilter_fragment:
+			if len(payload) < 8 {
+				return 0, tun_malformedHeader
+			}
+			if offset := (int(payload[2])<<8 | int(payload[3])) &^ 7; offset != 0 {
+				// The rest of the headers are in the first fragment
+				return length, 0
+			}
+			headerLen = 8
+		default:
+			// The transport header, or ESP or no next header, which can't be looked into
+			return length, 0
+		}
+		if len(payload) < headerLen {
+			return 0, tun_malformedHeader
+		}
+		protocol, payload = int(payload[0]), payload[headerLen:]
+	}
+}
+
+// Finds the jumbo payload option in the hop-by-hop header that follows the IPv6 header, which gives the length of the packet after the IPv6 header.
+func tun_jumboLength(packet []byte) (int, bool) {
+	hopByHop := packet[tun_IPv6_HEADER_LENGTH:]
+	if len(hopByHop) < 8 || len(hopByHop) < 8+8*int(hopByHop[1]) {
+		return 0, false
+	}
+	options := hopByHop[2 : 8+8*int(hopByHop[1])]
+	for len(options) > 0 {
+		if options[0] == tun_optPad1 {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || len(options) < 2+int(options[1]) {
+			return 0, false
+		}
+		if options[0] == tun_optJumbo && options[1] == 4 {
+			jumbo := int(binary.BigEndian.Uint32(options[2:6]))
+			// Smaller packets must use the payload length instead
+			return jumbo, jumbo > 65535
+		}
+		options = options[2+int(options[1]):]
+	}
+	return 0, false
+}
+
+// Gets the length of an IPv4 packet from its header, or 0 and the reason if it's malformed.
+func tun_parseIPv4(packet []byte) (int, int) {
+	if len(packet) < tun_IPv4_HEADER_LENGTH {
+		return 0, tun_malformedShort
+	}
+	length := int(binary.BigEndian.Uint16(packet[2:4]))
+	if headerLen := 4 * int(packet[0]&0x0f); headerLen < tun_IPv4_HEADER_LENGTH || headerLen > length {
+		return 0, tun_malformedHeader
+	}
+	if len(packet) < length {
+		return 0, tun_malformedTruncated
+	}
+	return length, 0
+}
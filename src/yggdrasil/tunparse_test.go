@@ -0,0 +1,72 @@
+package yggdrasil
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestParseIPv6(t *testing.T) {
+	tests := []struct {
+		name          string
+		nextHeader    byte
+		payloadLength uint16 // As given in the IPv6 header
+		payload       []byte // Everything after the IPv6 header
+		length        int
+		reason        int
+	}{
+		{"TCP", packetFilter_tcp, 53, make([]byte, 53), 93, 0},
+		{"padding after the packet", packetFilter_tcp, 53, make([]byte, 60), 93, 0},
+		{"no payload", tun_nextHeaderNone, 0, nil, 40, 0},
+		{"one byte short of the payload", packetFilter_tcp, 53, make([]byte, 52), 0, tun_malformedTruncated},
+		{"hop-by-hop then TCP", packetFilter_hopByHop, 28, append([]byte{packetFilter_tcp, 0, 0, 0, 0, 0, 0, 0}, make([]byte, 20)...), 68, 0},
+		{"routing then first fragment", packetFilter_routing, 44, append([]byte{packetFilter_fragment, 1, 15: 0, packetFilter_tcp, 0, 0, 0, 0, 0, 0, 1}, make([]byte, 20)...), 84, 0},
+		{"later fragment", packetFilter_fragment, 11, []byte{packetFilter_tcp, 0, 0x05, 0x01, 0, 0, 0, 1, 1, 2, 3}, 51, 0},
+		{"AH then TCP", tun_nextHeaderAH, 32, append([]byte{packetFilter_tcp, 1, 11: 0}, make([]byte, 20)...), 72, 0},
+		{"ESP", tun_nextHeaderESP, 9, make([]byte, 9), 49, 0},
+		{"extension header past the end", packetFilter_destOptions, 8, []byte{packetFilter_tcp, 2, 0, 0, 0, 0, 0, 0}, 0, tun_malformedHeader},
+		{"short fragment header", packetFilter_fragment, 7, []byte{packetFilter_tcp, 0, 0, 0, 0, 0, 0}, 0, tun_malformedHeader},
+		{"extension header without its length", packetFilter_routing, 1, []byte{packetFilter_tcp}, 0, tun_malformedHeader},
+		{"jumbogram", packetFilter_hopByHop, 0, append([]byte{packetFilter_tcp, 0, tun_optJumbo, 4, 0, 1, 0x11, 0x71}, make([]byte, 69993)...), 70041, 0},
+		{"truncated jumbogram", packetFilter_hopByHop, 0, append([]byte{packetFilter_tcp, 0, tun_optJumbo, 4, 0, 1, 0x11, 0x71}, make([]byte, 69992)...), 0, tun_malformedTruncated},
+		{"zero length without a jumbo option", packetFilter_hopByHop, 0, []byte{packetFilter_tcp, 0, 0, 0, 0, 0, 0, 0}, 0, tun_malformedJumbo},
+	}
+	for _, test := range tests {
+		packet := append(make([]byte, tun_IPv6_HEADER_LENGTH), test.payload...)
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:6], test.payloadLength)
+		packet[6] = test.nextHeader
+		length, reason := tun_parseIPv6(packet)
+		if length != test.length || reason != test.reason {
+			t.Errorf("%s: got length %d and reason %d, want %d and %d", test.name, length, reason, test.length, test.reason)
+		}
+	}
+	if _, reason := tun_parseIPv6(make([]byte, tun_IPv6_HEADER_LENGTH-1)); reason != tun_malformedShort {
+		t.Errorf("one byte short of the header: got reason %d, want %d", reason, tun_malformedShort)
+	}
+}
+
+func TestJumboLength(t *testing.T) {
+	tests := []struct {
+		name     string
+		hopByHop []byte // The hop-by-hop header after the IPv6 header
+		length   int
+		ok       bool
+	}{
+		{"jumbo option", []byte{packetFilter_tcp, 0, tun_optJumbo, 4, 0, 1, 0x11, 0x70}, 70000, true},
+		{"largest length", []byte{packetFilter_tcp, 0, tun_optJumbo, 4, 0x7f, 0xff, 0xff, 0xff}, 0x7fffffff, true},
+		{"after Pad1", []byte{packetFilter_tcp, 1, tun_optPad1, tun_optPad1, tun_optJumbo, 4, 0, 1, 0, 0, 15: 0}, 65536, true},
+		{"after PadN", []byte{packetFilter_tcp, 1, 1, 3, 0, 0, 0, tun_optJumbo, 4, 0, 1, 0x86, 0xa0, 15: 0}, 100000, true},
+		{"length that fits the payload length", []byte{packetFilter_tcp, 0, tun_optJumbo, 4, 0, 0, 0xff, 0xff}, 0, false},
+		{"wrong option length", []byte{packetFilter_tcp, 0, tun_optJumbo, 2, 0, 1, 0, 0}, 0, false},
+		{"option past the end of the header", []byte{packetFilter_tcp, 0, 1, 10, 0, 0, 0, 0}, 0, false},
+		{"no options", []byte{packetFilter_tcp, 0, 0, 0, 0, 0, 0, 0}, 0, false},
+		{"header shorter than 8 bytes", []byte{packetFilter_tcp, 0, tun_optJumbo, 4, 0, 1, 0x11}, 0, false},
+		{"header shorter than its length", []byte{packetFilter_tcp, 1, 1, 3, 0, 0, 0, tun_optJumbo, 4, 0, 1, 0x11, 0x70, 14: 0}, 0, false},
+	}
+	for _, test := range tests {
+		length, ok := tun_jumboLength(append(make([]byte, tun_IPv6_HEADER_LENGTH), test.hopByHop...))
+		if ok != test.ok || (ok && length != test.length) {
+			t.Errorf("%s: got %d, %v, want %d, %v", test.name, length, ok, test.length, test.ok)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package yggdrasil
 // These are misc. utility functions that didn't really fit anywhere else
 
 import "runtime"
+import "sync/atomic"
+import "time"
 
 // A wrapper around runtime.Gosched() so it doesn't need to be imported elsewhere.
 func util_yield() {
@@ -47,3 +49,96 @@ func util_putBytes(bs []byte) {
 	default:
 	}
 }
+
+// A token bucket, which refills at some rate up to a maximum burst size.
+type util_tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Refills the bucket for the time since it was last used, then takes a token if there is one.
+func (b *util_tokenBucket) take(now time.Time, rate float64, burst float64) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Rate limits requests, both from each source key and across all sources, and counts how many were rejected.
+// This is not safe to use from more than one goroutine at a time, apart from reading the rejected count with getRejected.
+type util_rateLimiter struct {
+	rate       float64 // Requests per second allowed from each source
+	burst      float64 // Requests allowed in a burst from each source
+	globalRate float64 // Requests per second allowed across all sources
+	sources    map[boxPubKey]*util_tokenBucket
+	global     util_tokenBucket
+	rejected   uint64 // Accessed atomically
+}
+
+// Returns a new rate limiter with the given per-source rate and burst, and global rate.
+// The global burst is one second's worth of requests.
+func util_newRateLimiter(rate float64, burst float64, globalRate float64) *util_rateLimiter {
+	return &util_rateLimiter{
+		rate:       rate,
+		burst:      burst,
+		globalRate: globalRate,
+		sources:    make(map[boxPubKey]*util_tokenBucket),
+		global:     util_tokenBucket{tokens: globalRate, last: time.Now()},
+	}
+}
+
+// Returns true if a request from the given source is allowed, or else counts it as rejected.
+// The global limit is checked first, and sources are only tracked once they've had a request allowed, so a flood of requests from made up keys can't grow the map by more than the global rate.
+func (l *util_rateLimiter) allow(source *boxPubKey) bool {
+	now := time.Now()
+	if !l.global.take(now, l.globalRate, l.globalRate) {
+		atomic.AddUint64(&l.rejected, 1)
+		return false
+	}
+	b, isIn := l.sources[*source]
+	if !isIn {
+		l.sources[*source] = &util_tokenBucket{tokens: l.burst - 1, last: now}
+		return true
+	}
+	if !b.take(now, l.rate, l.burst) {
+		// Give back the global token, as the request wasn't allowed after all
+		l.global.tokens++
+		atomic.AddUint64(&l.rejected, 1)
+		return false
+	}
+	return true
+}
+
+// Forgets sources that have been idle for long enough that their buckets would be full again.
+func (l *util_rateLimiter) cleanup() {
+	idle := time.Duration(l.burst/l.rate*float64(time.Second)) + time.Second
+	for key, b := range l.sources {
+		if time.Since(b.last) > idle {
+			delete(l.sources, key)
+		}
+	}
+}
+
+// Returns the number of requests that have been rejected.
+func (l *util_rateLimiter) getRejected() uint64 {
+	return atomic.LoadUint64(&l.rejected)
+}
+
+// Incrementally updates an internet checksum (RFC 1624) for the replacement of the old bytes with the new bytes, which must be the same even length.
+func util_updateChecksum(csum uint16, old []byte, new []byte) uint16 {
+	sum := uint32(^csum)
+	for idx := 0; idx+1 < len(old) && idx+1 < len(new); idx += 2 {
+		sum += uint32(^(uint16(old[idx])<<8 | uint16(old[idx+1])))
+		sum += uint32(uint16(new[idx])<<8 | uint16(new[idx+1]))
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,35 @@
+package yggdrasil
+
+import "testing"
+
+func TestRateLimiter(t *testing.T) {
+	// Hardly any refill during the test, so that only the bursts count
+	l := util_newRateLimiter(0.001, 2, 4)
+	var a, b, c boxPubKey
+	a[0], b[0], c[0] = 1, 2, 3
+	tests := []struct {
+		name    string
+		source  *boxPubKey
+		allow   bool
+		sources int // Sources tracked afterwards
+	}{
+		{"first from a", &a, true, 1},
+		{"second from a", &a, true, 1},
+		{"a over its burst", &a, false, 1},
+		{"first from b", &b, true, 2},
+		{"second from b, which uses up the global burst", &b, true, 2},
+		{"first from c, over the global burst", &c, false, 2},
+		{"b over the global burst", &b, false, 2},
+	}
+	for _, test := range tests {
+		if allow := l.allow(test.source); allow != test.allow {
+			t.Errorf("%s: got %v, want %v", test.name, allow, test.allow)
+		}
+		if len(l.sources) != test.sources {
+			t.Errorf("%s: tracking %d sources, want %d", test.name, len(l.sources), test.sources)
+		}
+	}
+	if rejected := l.getRejected(); rejected != 3 {
+		t.Errorf("got %d rejected, want 3", rejected)
+	}
+}
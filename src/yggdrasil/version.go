@@ -4,6 +4,35 @@ package yggdrasil
 // Used in the inital connection setup and key exchange
 // Some of this could arguably go in wire.go instead
 
+// Nodes with the same major version can always connect to each other, as long
+// as the older one's minor version is at least version_minMinorVer. Each side
+// sends its own minor version, and both then use the lower of the two for the
+// rest of the connection, so a node that supports newer features must keep
+// handling the older behaviour for peers that don't. The base metadata below
+// never changes within a major version, so that older nodes can always read
+// it. Anything a newer minor version needs to exchange during setup is done by
+// a handler in version_handshakes, after both sides know the agreed version.
+
+import (
+	"io"
+	"net"
+)
+
+// The oldest minor version we can still connect to.
+const version_minMinorVer = 2
+
+// The minor version from which the link options are exchanged.
+const version_linkOptionsMinorVer = 3
+
+// Link options, sent as a byte of flags.
+const version_linkPassive = 0x01 // Keep-alives are left to the operating system
+
+// Extra connection setup steps for minor versions after version_minMinorVer.
+// They're run in order for each minor version up to the agreed one, after the base metadata has been exchanged.
+var version_handshakes = map[uint64]func(sock net.Conn, meta *version_metadata) error{
+	version_linkOptionsMinorVer: version_exchangeLinkOptions,
+}
+
 // This is the version-specific metadata exchanged at the start of a connection.
 // It must always beign with the 4 bytes "meta" and a wire formatted uint64 major version number.
 // The current version also includes a minor version number, and the box/sig/link keys that need to be exchanged to open an connection.
@@ -15,6 +44,8 @@ type version_metadata struct {
 	box      boxPubKey
 	sig      sigPubKey
 	link     boxPubKey
+	// Not part of the base metadata, but exchanged by the handshake of version_linkOptionsMinorVer
+	passive bool // Whether we want passive keep-alives, and after the handshake, whether both sides do
 }
 
 // Gets a base metadata with no keys set, but with the correct version numbers.
@@ -22,7 +53,7 @@ func version_getBaseMetadata() version_metadata {
 	return version_metadata{
 		meta:     [4]byte{'m', 'e', 't', 'a'},
 		ver:      0,
-		minorVer: 2,
+		minorVer: 3,
 	}
 }
 
@@ -71,8 +102,47 @@ func (m *version_metadata) decode(bs []byte) bool {
 	return true
 }
 
-// Checks that the "meta" bytes and the version numbers are the expected values.
+// Checks that the "meta" bytes and major version are the expected values, and that the minor version isn't too old to connect to.
+// Newer minor versions are accepted, as the remote node is expected to fall back to ours.
 func (m *version_metadata) check() bool {
 	base := version_getBaseMetadata()
-	return base.meta == m.meta && base.ver == m.ver && base.minorVer == m.minorVer
+	return base.meta == m.meta && base.ver == m.ver && m.minorVer >= version_minMinorVer
+}
+
+// Gets the minor version to use with the remote node, which is the lower of ours and theirs.
+func (m *version_metadata) negotiate() uint64 {
+	base := version_getBaseMetadata()
+	if m.minorVer < base.minorVer {
+		return m.minorVer
+	}
+	return base.minorVer
+}
+
+// Runs any extra setup steps needed by minor versions up to the agreed one.
+func version_handshake(sock net.Conn, meta *version_metadata, agreed uint64) error {
+	for v := uint64(version_minMinorVer + 1); v <= agreed; v++ {
+		if h, isIn := version_handshakes[v]; isIn {
+			if err := h(sock, meta); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Sends our link options and reads the remote node's, keeping only the options that both sides asked for.
+// Before this is called, meta holds our options rather than theirs.
+func version_exchangeLinkOptions(sock net.Conn, meta *version_metadata) error {
+	var flags [1]byte
+	if meta.passive {
+		flags[0] |= version_linkPassive
+	}
+	if _, err := sock.Write(flags[:]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(sock, flags[:]); err != nil {
+		return err
+	}
+	meta.passive = meta.passive && flags[0]&version_linkPassive != 0
+	return nil
 }
@@ -0,0 +1,360 @@
+package yggdrasil
+
+// This implements an optional web UI, for users who'd rather not use
+// yggdrasilctl. It's served over HTTP on its own listen address, and shows the
+// status of the node, its peers and sessions and a graph of recent traffic,
+// with controls for adding and removing peers.
+// The page is a single embedded HTML file that polls /api, which passes admin
+// requests through to the same handlers as the admin socket. Only the requests
+// that the page needs are allowed, and /api only accepts JSON POSTs from the
+// same origin, so that other web sites open in the browser can't use it.
+// Requests must also name the web UI by its listen address, an IP address or
+// localhost in the Host header, since a web site that points its own name at
+// a local address would otherwise count as the same origin, and requests that
+// change anything must carry the token from the page that was served.
+// There's no authentication, so it should only listen on a local address.
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The largest request body accepted by /api.
+const webUI_maxRequestSize = 4096
+
+// The admin requests that the page is allowed to make, and whether they change anything, so need the token.
+var webUI_allowedRequests = map[string]bool{
+	"getself":     false,
+	"gethealth":   false,
+	"getpeers":    false,
+	"getsessions": false,
+	"addpeer":     true,
+	"removepeer":  true,
+}
+
+// The header that the page sends its token in.
+const webUI_tokenHeader = "X-Yggdrasil-Token"
+
+type webUI struct {
+	core     *Core
+	mutex    sync.Mutex
+	listen   string // Address to listen on, or empty if disabled
+	listener net.Listener
+	token    string // Given to the page when it's served, and needed for requests that change anything
+}
+
+// Initializes the webUI struct.
+func (w *webUI) init(core *Core) {
+	w.core = core
+}
+
+// Sets the address that the web UI listens on. An empty address disables it.
+func (w *webUI) setConfig(listen string) error {
+	if listen != "" {
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return errors.New("invalid web UI listen address: " + listen)
+		}
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.listen = listen
+	return nil
+}
+
+// Starts serving the web UI, if a listen address is configured.
+func (w *webUI) start() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.listen == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", w.listen)
+	if err != nil {
+		return err
+	}
+	w.listener = listener
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		listener.Close()
+		return err
+	}
+	w.token = hex.EncodeToString(token[:])
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", w.serveIndex)
+	mux.HandleFunc("/api", w.serveAPI)
+	w.core.log.Println("Web UI listening on http://" + listener.Addr().String())
+	go http.Serve(listener, mux)
+	return nil
+}
+
+// Stops serving the web UI.
+func (w *webUI) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.listener != nil {
+		w.listener.Close()
+		w.listener = nil
+	}
+}
+
+// Returns true if the Host header of a request names the web UI by its listen address, an IP address or localhost.
+// Any other name could be one that a web site has pointed at this host to get around the same origin checks.
+func (w *webUI) isAllowedHost(host string) bool {
+	w.mutex.Lock()
+	listen := w.listen
+	w.mutex.Unlock()
+	if strings.EqualFold(host, listen) {
+		return true
+	}
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		name = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	return strings.EqualFold(name, "localhost") || net.ParseIP(name) != nil
+}
+
+// Serves the page.
+func (w *webUI) serveIndex(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(rw, r)
+		return
+	}
+	if !w.isAllowedHost(r.Host) {
+		http.Error(rw, "unknown host", http.StatusForbidden)
+		return
+	}
+	w.mutex.Lock()
+	token := w.token
+	w.mutex.Unlock()
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("X-Frame-Options", "DENY")
+	rw.Header().Set("Cache-Control", "no-store")
+	io.WriteString(rw, strings.Replace(webUI_index, "{{token}}", token, 1))
+}
+
+// Answers an admin request, sent as a JSON object in the same format as to the admin socket.
+func (w *webUI) serveAPI(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Requiring a JSON content type means a cross-origin request needs a preflight, which is never answered
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Error(rw, "expected application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	if !w.isAllowedHost(r.Host) {
+		http.Error(rw, "unknown host", http.StatusForbidden)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			http.Error(rw, "cross-origin requests are not allowed", http.StatusForbidden)
+			return
+		}
+	}
+	recv := make(admin_info)
+	if err := json.NewDecoder(io.LimitReader(r.Body, webUI_maxRequestSize)).Decode(&recv); err != nil {
+		http.Error(rw, "invalid request", http.StatusBadRequest)
+		return
+	}
+	w.mutex.Lock()
+	token := w.token
+	w.mutex.Unlock()
+	var send admin_info
+	name, _ := recv["request"].(string)
+	if needsToken, isIn := webUI_allowedRequests[strings.ToLower(name)]; !isIn {
+		send = admin_info{
+			"request": recv,
+			"status":  "error",
+			"error":   "request not allowed from the web UI",
+		}
+	} else if needsToken && subtle.ConstantTimeCompare([]byte(r.Header.Get(webUI_tokenHeader)), []byte(token)) != 1 {
+		send = admin_info{
+			"request": recv,
+			"status":  "error",
+			"error":   "missing or invalid token, reload the page",
+		}
+	} else {
+		send = w.handle(recv)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(send)
+}
+
+// Passes the request to the admin handlers, turning a panic into an error response as the admin socket does.
+func (w *webUI) handle(recv admin_info) (send admin_info) {
+	defer func() {
+		if r := recover(); r != nil {
+			w.core.log.Println("Web UI error:", r)
+			send = admin_info{
+				"status": "error",
+				"error":  "Unrecoverable error, possibly as a result of invalid input types or malformed syntax",
+			}
+		}
+	}()
+	return w.core.admin.handle(recv)
+}
+
+// The page, which is kept small and free of external resources so that it works without internet access.
+const webUI_index = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="token" content="{{token}}">
+<title>Yggdrasil</title>
+<style>
+body { font-family: sans-serif; margin: 0 auto; max-width: 60em; padding: 1em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; width: 100%; font-size: 0.9em; }
+th, td { text-align: left; padding: 0.3em 0.5em; border-bottom: 1px solid #ddd; }
+td.num { text-align: right; }
+#health.ok { color: #080; }
+#health.bad { color: #b00; }
+#error { color: #b00; }
+canvas { width: 100%; height: 120px; border: 1px solid #ddd; }
+input[type=text] { width: 28em; max-width: 70%; }
+</style>
+</head>
+<body>
+<h1>Yggdrasil <span id="health"></span></h1>
+<p id="error"></p>
+<table id="self"></table>
+<h2>Traffic</h2>
+<canvas id="graph" width="800" height="120"></canvas>
+<p><span style="color:#06c">&#9632;</span> Received <span id="rxrate"></span>
+&nbsp; <span style="color:#c60">&#9632;</span> Sent <span id="txrate"></span></p>
+<h2>Peers</h2>
+<form id="addpeer">
+<input type="text" id="uri" placeholder="tcp://a.b.c.d:e">
+<input type="text" id="intf" placeholder="interface (optional)" style="width:12em">
+<button type="submit">Add peer</button>
+</form>
+<table id="peers"></table>
+<h2>Sessions</h2>
+<table id="sessions"></table>
+<script>
+"use strict";
+var samples = [], last = null;
+var token = document.querySelector("meta[name=token]").content;
+function api(req) {
+  return fetch("/api", {
+    method: "POST",
+    headers: {"Content-Type": "application/json", "X-Yggdrasil-Token": token},
+    body: JSON.stringify(req)
+  }).then(function(r) { return r.json(); }).then(function(r) {
+    if (r.status !== "success") { throw new Error(r.error || "request failed"); }
+    return r.response;
+  });
+}
+function esc(s) {
+  return String(s === null || s === undefined ? "-" : s).replace(/[&<>"']/g, function(c) {
+    return "&#" + c.charCodeAt(0) + ";";
+  });
+}
+function bytes(n) {
+  var units = ["B", "kB", "MB", "GB", "TB"], i = 0;
+  while (n >= 1000 && i < units.length - 1) { n /= 1000; i++; }
+  return n.toFixed(i ? 2 : 0) + units[i];
+}
+function rate(n) { return (n * 8 / 1000).toFixed(1) + "kbit/s"; }
+function duration(s) {
+  var d = Math.floor(s / 86400), h = Math.floor(s % 86400 / 3600), m = Math.floor(s % 3600 / 60);
+  return (d ? d + "d " : "") + (d || h ? h + "h " : "") + m + "m";
+}
+function table(id, head, rows) {
+  var html = "<tr>" + head.map(function(h) { return "<th>" + esc(h) + "</th>"; }).join("") + "</tr>";
+  rows.forEach(function(row) { html += "<tr>" + row.join("") + "</tr>"; });
+  document.getElementById(id).innerHTML = html;
+}
+function td(v, num) { return "<td" + (num ? " class=num" : "") + ">" + esc(v) + "</td>"; }
+function draw() {
+  var c = document.getElementById("graph"), g = c.getContext("2d");
+  g.clearRect(0, 0, c.width, c.height);
+  var max = 1;
+  samples.forEach(function(s) { max = Math.max(max, s.rx, s.tx); });
+  [["rx", "#06c"], ["tx", "#c60"]].forEach(function(k) {
+    g.strokeStyle = k[1];
+    g.beginPath();
+    samples.forEach(function(s, i) {
+      var x = c.width - (samples.length - 1 - i) * c.width / 59, y = c.height - 2 - s[k[0]] / max * (c.height - 4);
+      if (i) { g.lineTo(x, y); } else { g.moveTo(x, y); }
+    });
+    g.stroke();
+  });
+}
+function update() {
+  Promise.all([api({request: "getSelf"}), api({request: "getHealth"}), api({request: "getPeers"}), api({request: "getSessions"})]).then(function(r) {
+    document.getElementById("error").textContent = "";
+    var ip = Object.keys(r[0].self)[0], self = r[0].self[ip];
+    table("self", ["Address", "Subnet", "Coords", "Uptime", "Version"],
+      [[td(ip), td(self.subnet), td(self.coords), td(duration(self.uptime)), td(self.build_version)]]);
+    var health = document.getElementById("health");
+    health.textContent = r[1].health.healthy ? "(connected)" : "(not connected)";
+    health.className = r[1].health.healthy ? "ok" : "bad";
+    var peers = r[2].peers, rx = 0, tx = 0;
+    var ips = Object.keys(peers).sort(function(a, b) { return peers[a].port - peers[b].port; });
+    table("peers", ["Port", "Address", "Endpoint", "Uptime", "Received", "Sent", ""], ips.filter(function(ip) {
+      return peers[ip].port !== 0;
+    }).map(function(ip) {
+      var p = peers[ip];
+      rx += p.bytes_recvd;
+      tx += p.bytes_sent;
+      return [td(p.port, true), td(p.alias || ip), td(p.endpoint), td(duration(p.uptime)),
+        td(bytes(p.bytes_recvd), true), td(bytes(p.bytes_sent), true),
+        "<td><button onclick=\"removePeer(" + Number(p.port) + ")\">Remove</button></td>"];
+    }));
+    var now = Date.now();
+    if (last && rx >= last.rx && tx >= last.tx) {
+      var secs = (now - last.time) / 1000;
+      samples.push({rx: (rx - last.rx) / secs, tx: (tx - last.tx) / secs});
+      if (samples.length > 60) { samples.shift(); }
+      document.getElementById("rxrate").textContent = rate(samples[samples.length - 1].rx);
+      document.getElementById("txrate").textContent = rate(samples[samples.length - 1].tx);
+    }
+    last = {rx: rx, tx: tx, time: now};
+    draw();
+    var sessions = r[3].sessions;
+    table("sessions", ["Address", "Coords", "MTU", "Received", "Sent"], Object.keys(sessions).sort().map(function(ip) {
+      var s = sessions[ip];
+      return [td(s.alias || ip), td(s.coords), td(s.mtu, true), td(bytes(s.bytes_recvd), true), td(bytes(s.bytes_sent), true)];
+    }));
+  }).catch(function(e) {
+    document.getElementById("error").textContent = "Error: " + e.message;
+  });
+}
+function removePeer(port) {
+  if (!confirm("Remove the peer on port " + port + "?")) { return; }
+  api({request: "removePeer", port: port}).then(update).catch(function(e) {
+    document.getElementById("error").textContent = "Error: " + e.message;
+  });
+}
+document.getElementById("addpeer").addEventListener("submit", function(ev) {
+  ev.preventDefault();
+  var req = {request: "addPeer", uri: document.getElementById("uri").value.trim()};
+  var intf = document.getElementById("intf").value.trim();
+  if (intf) { req["interface"] = intf; }
+  api(req).then(function() {
+    document.getElementById("uri").value = "";
+    update();
+  }).catch(function(e) {
+    document.getElementById("error").textContent = "Error: " + e.message;
+  });
+});
+update();
+setInterval(update, 2000);
+</script>
+</body>
+</html>
+`
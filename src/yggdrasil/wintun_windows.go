@@ -0,0 +1,173 @@
+package yggdrasil
+
+// This is a TUN adapter backend for Windows that uses the Wintun driver rather
+// than TAP-Windows. Wintun is a layer 3 driver, so it's used in TUN mode, and
+// it passes packets through shared ring buffers rather than a read or write
+// call per packet, which is much faster. The driver comes with wintun.dll,
+// which has to be next to our executable or in the system directory, and
+// which installs the driver itself when an adapter is first created, so unlike
+// TAP-Windows there's nothing for the user to set up. If it can't be loaded,
+// the TAP adapter is used as before. The adapter is created when the node
+// starts and removed when the adapter is closed.
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The name given to the adapter when the interface name is "auto", the tunnel type that the adapter is listed under, and the size of the ring buffers, which must be a power of two between 128 KiB and 64 MiB.
+const wintun_defaultName = "Yggdrasil"
+const wintun_tunnelType = "Yggdrasil"
+const wintun_ringCapacity = 0x400000
+
+// The Wintun API, and the parts of kernel32 that the syscall package doesn't have.
+var (
+	wintun_dll                  = syscall.NewLazyDLL("wintun.dll")
+	wintun_createAdapter        = wintun_dll.NewProc("WintunCreateAdapter")
+	wintun_openAdapter          = wintun_dll.NewProc("WintunOpenAdapter")
+	wintun_closeAdapter         = wintun_dll.NewProc("WintunCloseAdapter")
+	wintun_startSession         = wintun_dll.NewProc("WintunStartSession")
+	wintun_endSession           = wintun_dll.NewProc("WintunEndSession")
+	wintun_getReadWaitEvent     = wintun_dll.NewProc("WintunGetReadWaitEvent")
+	wintun_receivePacket        = wintun_dll.NewProc("WintunReceivePacket")
+	wintun_releaseReceivePacket = wintun_dll.NewProc("WintunReleaseReceivePacket")
+	wintun_allocateSendPacket   = wintun_dll.NewProc("WintunAllocateSendPacket")
+	wintun_sendPacket           = wintun_dll.NewProc("WintunSendPacket")
+	wintun_kernel32             = syscall.NewLazyDLL("kernel32.dll")
+	wintun_createEvent          = wintun_kernel32.NewProc("CreateEventW")
+	wintun_setEvent             = wintun_kernel32.NewProc("SetEvent")
+	wintun_waitForMultiple      = wintun_kernel32.NewProc("WaitForMultipleObjects")
+)
+
+// Errors that the Wintun API returns when there's no packet to receive, or no room to send one.
+const (
+	wintun_ERROR_NO_MORE_ITEMS   = syscall.Errno(259)
+	wintun_ERROR_BUFFER_OVERFLOW = syscall.Errno(111)
+)
+
+// A Wintun adapter and its session, which is used as the ReadWriteCloser of a water.Interface.
+// The mutex is held for reading while a packet is received or sent, so that the session isn't ended underneath it.
+type wintunAdapter struct {
+	name      string
+	adapter   uintptr
+	session   uintptr
+	readEvent uintptr // Signalled by the driver when there are packets to receive
+	quitEvent uintptr // Signalled when the adapter is closed, to wake up a blocked read
+	mutex     sync.RWMutex
+	closed    bool
+}
+
+// Checks if wintun.dll can be loaded, so that the Wintun backend can be used.
+func wintun_available() bool {
+	return wintun_dll.Load() == nil
+}
+
+// Gets a pointer to the bytes at an address returned by the Wintun API.
+func wintun_bytes(ptr uintptr, size int) []byte {
+	return (*[1 << 30]byte)(*(*unsafe.Pointer)(unsafe.Pointer(&ptr)))[:size:size]
+}
+
+// Opens the Wintun adapter with the name, creating it if there isn't one, and starts a session on it.
+func wintun_open(ifname string) (*wintunAdapter, error) {
+	if ifname == "auto" {
+		ifname = wintun_defaultName
+	}
+	name, err := syscall.UTF16PtrFromString(ifname)
+	if err != nil {
+		return nil, err
+	}
+	tunnelType, err := syscall.UTF16PtrFromString(wintun_tunnelType)
+	if err != nil {
+		return nil, err
+	}
+	w := wintunAdapter{name: ifname}
+	// An adapter can be left behind by a node that didn't stop cleanly
+	w.adapter, _, _ = wintun_openAdapter.Call(uintptr(unsafe.Pointer(name)))
+	if w.adapter == 0 {
+		w.adapter, _, err = wintun_createAdapter.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(tunnelType)), 0)
+		if w.adapter == 0 {
+			return nil, errors.New("failed to create the Wintun adapter: " + err.Error())
+		}
+	}
+	w.session, _, err = wintun_startSession.Call(w.adapter, wintun_ringCapacity)
+	if w.session == 0 {
+		wintun_closeAdapter.Call(w.adapter)
+		return nil, errors.New("failed to start a Wintun session: " + err.Error())
+	}
+	w.readEvent, _, _ = wintun_getReadWaitEvent.Call(w.session)
+	w.quitEvent, _, err = wintun_createEvent.Call(0, 1, 0, 0)
+	if w.quitEvent == 0 {
+		wintun_endSession.Call(w.session)
+		wintun_closeAdapter.Call(w.adapter)
+		return nil, err
+	}
+	return &w, nil
+}
+
+// Gets the name of the adapter, which water doesn't know.
+func (w *wintunAdapter) adapterName() string {
+	return w.name
+}
+
+// Reads a packet, waiting until there is one or the adapter is closed.
+func (w *wintunAdapter) Read(b []byte) (int, error) {
+	for {
+		w.mutex.RLock()
+		if w.closed {
+			w.mutex.RUnlock()
+			return 0, io.EOF
+		}
+		var size uint32
+		packet, _, err := wintun_receivePacket.Call(w.session, uintptr(unsafe.Pointer(&size)))
+		if packet != 0 {
+			n := copy(b, wintun_bytes(packet, int(size)))
+			wintun_releaseReceivePacket.Call(w.session, packet)
+			w.mutex.RUnlock()
+			return n, nil
+		}
+		w.mutex.RUnlock()
+		if err != wintun_ERROR_NO_MORE_ITEMS {
+			return 0, err
+		}
+		events := [2]uintptr{w.readEvent, w.quitEvent}
+		wintun_waitForMultiple.Call(2, uintptr(unsafe.Pointer(&events[0])), 0, syscall.INFINITE)
+	}
+}
+
+// Writes a packet. If the ring is full, the packet is dropped, as it would be by a network card.
+func (w *wintunAdapter) Write(b []byte) (int, error) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	packet, _, err := wintun_allocateSendPacket.Call(w.session, uintptr(len(b)))
+	if packet == 0 {
+		if err == wintun_ERROR_BUFFER_OVERFLOW {
+			return len(b), nil
+		}
+		return 0, err
+	}
+	copy(wintun_bytes(packet, len(b)), b)
+	wintun_sendPacket.Call(w.session, packet)
+	return len(b), nil
+}
+
+// Ends the session and closes the adapter, which removes it from the system.
+func (w *wintunAdapter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	// Wake up a blocked read, which will then see that the adapter is closed
+	wintun_setEvent.Call(w.quitEvent)
+	wintun_endSession.Call(w.session)
+	wintun_closeAdapter.Call(w.adapter)
+	syscall.CloseHandle(syscall.Handle(w.quitEvent))
+	return nil
+}
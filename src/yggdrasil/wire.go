@@ -16,6 +16,12 @@ const (
 	wire_SessionPong                // inside protocol traffic header
 	wire_DHTLookupRequest           // inside protocol traffic header
 	wire_DHTLookupResponse          // inside protocol traffic header
+	wire_NodeInfoRequest            // inside protocol traffic header
+	wire_NodeInfoResponse           // inside protocol traffic header
+	wire_BenchPacket                // inside protocol traffic header
+	wire_SessionProbe               // inside protocol traffic header
+	wire_SessionProbeAck            // inside protocol traffic header
+	wire_MulticastMembership        // inside protocol traffic header
 )
 
 // Calls wire_put_uint64 on a nil slice.
@@ -318,6 +324,21 @@ func (p *sessionPing) encode() []byte {
 	coords := wire_encode_coords(p.Coords)
 	bs = append(bs, coords...)
 	bs = append(bs, wire_encode_uint64(uint64(p.MTU))...)
+	var padding uint64
+	if p.Padding {
+		padding = 1
+	}
+	bs = append(bs, wire_encode_uint64(padding)...)
+	var unordered uint64
+	if p.Unordered {
+		unordered = 1
+	}
+	bs = append(bs, wire_encode_uint64(unordered)...)
+	var feedback uint64
+	if p.Feedback {
+		feedback = 1
+	}
+	bs = append(bs, wire_encode_uint64(feedback)...)
 	return bs
 }
 
@@ -326,6 +347,9 @@ func (p *sessionPing) decode(bs []byte) bool {
 	var pType uint64
 	var tstamp uint64
 	var mtu uint64
+	var padding uint64
+	var unordered uint64
+	var feedback uint64
 	switch {
 	case !wire_chop_uint64(&pType, &bs):
 		return false
@@ -342,12 +366,24 @@ func (p *sessionPing) decode(bs []byte) bool {
 		return false
 	case !wire_chop_uint64(&mtu, &bs):
 		mtu = 1280
+	case !wire_chop_uint64(&padding, &bs):
+		// Older nodes don't send this, so assume they don't want padding
+		padding = 0
+	case !wire_chop_uint64(&unordered, &bs):
+		// Older nodes don't send this either, so assume they want packets kept in order
+		unordered = 0
+	case !wire_chop_uint64(&feedback, &bs):
+		// Nor this, so don't send them congestion feedback that they wouldn't use
+		feedback = 0
 	}
 	p.Tstamp = wire_intFromUint(tstamp)
 	if pType == wire_SessionPong {
 		p.IsPong = true
 	}
 	p.MTU = uint16(mtu)
+	p.Padding = padding != 0
+	p.Unordered = unordered != 0
+	p.Feedback = feedback != 0
 	return true
 }
 
@@ -418,3 +454,151 @@ func (r *dhtRes) decode(bs []byte) bool {
 	}
 	return true
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Encodes a nodeinfoReqRes into its wire format.
+func (p *nodeinfoReqRes) encode() []byte {
+	var pTypeVal uint64
+	if p.IsResponse {
+		pTypeVal = wire_NodeInfoResponse
+	} else {
+		pTypeVal = wire_NodeInfoRequest
+	}
+	bs := wire_encode_uint64(pTypeVal)
+	bs = wire_put_coords(p.SendCoords, bs)
+	if pTypeVal == wire_NodeInfoResponse {
+		bs = append(bs, p.NodeInfo...)
+	}
+	return bs
+}
+
+// Decodes an encoded nodeinfoReqRes into the struct, returning true if successful.
+func (p *nodeinfoReqRes) decode(bs []byte) bool {
+	var pType uint64
+	switch {
+	case !wire_chop_uint64(&pType, &bs):
+		return false
+	case pType != wire_NodeInfoRequest && pType != wire_NodeInfoResponse:
+		return false
+	case !wire_chop_coords(&p.SendCoords, &bs):
+		return false
+	}
+	if p.IsResponse = pType == wire_NodeInfoResponse; p.IsResponse {
+		if len(bs) == 0 {
+			return false
+		}
+		p.NodeInfo = make(nodeinfoPayload, len(bs))
+		copy(p.NodeInfo, bs)
+	}
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Encodes a benchPacket into its wire format.
+func (p *benchPacket) encode() []byte {
+	bs := wire_encode_uint64(wire_BenchPacket)
+	bs = wire_put_coords(p.SendCoords, bs)
+	bs = wire_put_uint64(p.Type, bs)
+	bs = wire_put_uint64(p.ID, bs)
+	bs = wire_put_uint64(p.Seq, bs)
+	bs = wire_put_uint64(p.Packets, bs)
+	bs = wire_put_uint64(p.Bytes, bs)
+	bs = wire_put_uint64(p.Time, bs)
+	bs = append(bs, p.Payload...)
+	return bs
+}
+
+// Decodes an encoded benchPacket into the struct, returning true if successful.
+// The payload isn't copied, as it's only ever counted.
+func (p *benchPacket) decode(bs []byte) bool {
+	var pType uint64
+	switch {
+	case !wire_chop_uint64(&pType, &bs):
+		return false
+	case pType != wire_BenchPacket:
+		return false
+	case !wire_chop_coords(&p.SendCoords, &bs):
+		return false
+	case !wire_chop_uint64(&p.Type, &bs):
+		return false
+	case !wire_chop_uint64(&p.ID, &bs):
+		return false
+	case !wire_chop_uint64(&p.Seq, &bs):
+		return false
+	case !wire_chop_uint64(&p.Packets, &bs):
+		return false
+	case !wire_chop_uint64(&p.Bytes, &bs):
+		return false
+	case !wire_chop_uint64(&p.Time, &bs):
+		return false
+	}
+	p.Payload = bs
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Encodes a sessionProbe into its wire format, without any padding.
+func (p *sessionProbe) encode() []byte {
+	pTypeVal := uint64(wire_SessionProbe)
+	if p.IsAck {
+		pTypeVal = wire_SessionProbeAck
+	}
+	bs := wire_encode_uint64(pTypeVal)
+	bs = wire_put_uint64(p.Size, bs)
+	return bs
+}
+
+// Decodes an encoded sessionProbe into the struct, ignoring any padding, and returns true if successful.
+func (p *sessionProbe) decode(bs []byte) bool {
+	var pType uint64
+	switch {
+	case !wire_chop_uint64(&pType, &bs):
+		return false
+	case pType != wire_SessionProbe && pType != wire_SessionProbeAck:
+		return false
+	case !wire_chop_uint64(&p.Size, &bs):
+		return false
+	}
+	p.IsAck = pType == wire_SessionProbeAck
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Encodes an mcastMembership into its wire format.
+func (m *mcastMembership) encode() []byte {
+	bs := wire_encode_uint64(wire_MulticastMembership)
+	bs = wire_put_coords(m.SendCoords, bs)
+	bs = wire_put_uint64(uint64(len(m.Groups)), bs)
+	for _, group := range m.Groups {
+		bs = append(bs, group[:]...)
+	}
+	return bs
+}
+
+// Decodes an encoded mcastMembership into the struct, returning true if successful.
+func (m *mcastMembership) decode(bs []byte) bool {
+	var pType, count uint64
+	switch {
+	case !wire_chop_uint64(&pType, &bs):
+		return false
+	case pType != wire_MulticastMembership:
+		return false
+	case !wire_chop_coords(&m.SendCoords, &bs):
+		return false
+	case !wire_chop_uint64(&count, &bs):
+		return false
+	case count > mcastFwd_maxGroups:
+		return false
+	}
+	m.Groups = make([]address, count)
+	for idx := range m.Groups {
+		if !wire_chop_slice(m.Groups[idx][:], &bs) {
+			return false
+		}
+	}
+	return true
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"strings"
 	"syscall"
 	"time"
 
@@ -39,12 +40,17 @@ type node struct {
 // (which guarantees that there will not be a conflict with any other services)
 // or whether to generate a random port number. The only side effect of setting
 // isAutoconf is that the TCP and UDP ports will likely end up with different
-// port numbers.
-func generateConfig(isAutoconf bool) *nodeConfig {
+// port numbers. The strength is the minimum number of leading 1 bits required
+// in the NodeID derived from the generated encryption keys, and an error is
+// returned if it's out of range.
+func generateConfig(isAutoconf bool, strength int) (*nodeConfig, error) {
 	// Create a new core.
 	core := Core{}
 	// Generate encryption keys.
-	bpub, bpriv := core.NewEncryptionKeys()
+	bpub, bpriv, err := core.NewEncryptionKeysWithStrength(strength)
+	if err != nil {
+		return nil, err
+	}
 	spub, spriv := core.NewSigningKeys()
 	// Create a node configuration and populate it.
 	cfg := nodeConfig{}
@@ -59,8 +65,17 @@ func generateConfig(isAutoconf bool) *nodeConfig {
 	cfg.EncryptionPrivateKey = hex.EncodeToString(bpriv[:])
 	cfg.SigningPublicKey = hex.EncodeToString(spub[:])
 	cfg.SigningPrivateKey = hex.EncodeToString(spriv[:])
+	cfg.Listeners = []config.ListenerConfig{}
 	cfg.Peers = []string{}
 	cfg.InterfacePeers = map[string][]string{}
+	cfg.Transports = map[string]string{}
+	cfg.CjdnsBridge = map[string]string{}
+	cfg.DSCPPriority = map[string]string{}
+	cfg.IfTAPNeighbors.Static = map[string]string{}
+	cfg.TunnelRouting.IPv4Destinations = map[string]string{}
+	cfg.TunnelRouting.IPv4Sources = []string{}
+	cfg.ExtraInterfaces = []config.ExtraInterfaceConfig{}
+	cfg.Aliases = map[string]string{}
 	cfg.AllowedEncryptionPublicKeys = []string{}
 	cfg.MulticastInterfaces = []string{".*"}
 	cfg.IfName = defaults.GetDefaults().DefaultIfName
@@ -69,115 +84,160 @@ func generateConfig(isAutoconf bool) *nodeConfig {
 	cfg.SessionFirewall.Enable = false
 	cfg.SessionFirewall.AllowFromDirect = true
 	cfg.SessionFirewall.AllowFromRemote = true
+	cfg.RouteExport.NextHop = "self"
+	cfg.RouteExport.Prefixes = []string{}
 
-	return &cfg
+	return &cfg, nil
 }
 
 // Generates a new configuration and returns it in HJSON format. This is used
-// with -genconf.
-func doGenconf() string {
-	cfg := generateConfig(false)
+// with -genconf. If a strength was given then a comment describing it is added
+// to the top of the configuration.
+func doGenconf(strength int) (string, error) {
+	cfg, err := generateConfig(false, strength)
+	if err != nil {
+		return "", err
+	}
 	bs, err := hjson.Marshal(cfg)
 	if err != nil {
 		panic(err)
 	}
-	return string(bs)
+	if strength > 0 {
+		header := fmt.Sprintf("# The encryption keys below were generated with -strength %d, so the\n"+
+			"# NodeID begins with at least %d leading 1 bits. Higher strengths encode\n"+
+			"# more of the NodeID into the IPv6 address, making it harder for another\n"+
+			"# node to generate a colliding address, but each extra bit doubles the\n"+
+			"# expected time taken to generate the keys.\n", strength, strength)
+		return header + string(bs), nil
+	}
+	return string(bs), nil
+}
+
+// Reads the configuration, either from stdin if useconf is set or from the
+// file at useconffile otherwise, and overlays it onto a newly generated
+// default configuration. This is used at startup and also when reloading the
+// configuration after a SIGHUP.
+func readConfig(useconf bool, useconffile string, normaliseconf bool) (*nodeConfig, error) {
+	var config []byte
+	var err error
+	if useconffile != "" {
+		// Read the file from the filesystem
+		config, err = ioutil.ReadFile(useconffile)
+	} else {
+		// Read the file from stdin.
+		config, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// If there's a byte order mark - which Windows 10 is now incredibly fond of
+	// throwing everywhere when it's converting things into UTF-16 for the hell
+	// of it - remove it and decode back down into UTF-8. This is necessary
+	// because hjson doesn't know what to do with UTF-16 and will panic
+	if len(config) >= 2 && (bytes.Compare(config[0:2], []byte{0xFF, 0xFE}) == 0 ||
+		bytes.Compare(config[0:2], []byte{0xFE, 0xFF}) == 0) {
+		utf := unicode.UTF16(unicode.BigEndian, unicode.UseBOM)
+		decoder := utf.NewDecoder()
+		config, err = decoder.Bytes(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Generate a new configuration - this gives us a set of sane defaults -
+	// then parse the configuration we loaded above on top of it. The effect
+	// of this is that any configuration item that is missing from the provided
+	// configuration will use a sane default.
+	cfg, err := generateConfig(false, 0)
+	if err != nil {
+		return nil, err
+	}
+	var dat map[string]interface{}
+	if err := hjson.Unmarshal(config, &dat); err != nil {
+		return nil, err
+	}
+	confJson, err := json.Marshal(dat)
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(confJson, &cfg)
+	// For now we will do a little bit to help the user adjust their
+	// configuration to match the new configuration format, as some of the key
+	// names have changed recently.
+	changes := map[string]string{
+		"Multicast":      "",
+		"LinkLocal":      "MulticastInterfaces",
+		"BoxPub":         "EncryptionPublicKey",
+		"BoxPriv":        "EncryptionPrivateKey",
+		"SigPub":         "SigningPublicKey",
+		"SigPriv":        "SigningPrivateKey",
+		"AllowedBoxPubs": "AllowedEncryptionPublicKeys",
+	}
+	// Loop over the mappings aove and see if we have anything to fix.
+	for from, to := range changes {
+		if _, ok := dat[from]; ok {
+			if to == "" {
+				if !normaliseconf {
+					log.Println("Warning: Deprecated config option", from, "- please remove")
+				}
+			} else {
+				if !normaliseconf {
+					log.Println("Warning: Deprecated config option", from, "- please rename to", to)
+				}
+				// If the configuration file doesn't already contain a line with the
+				// new name then set it to the old value. This makes sure that we
+				// don't overwrite something that was put there intentionally.
+				if _, ok := dat[to]; !ok {
+					dat[to] = dat[from]
+				}
+			}
+		}
+	}
+	// Overlay our newly mapped configuration onto the autoconf node config that
+	// we generated above.
+	if err = mapstructure.Decode(dat, &cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
 
 // The main function is responsible for configuring and starting Yggdrasil.
 func main() {
 	// Configure the command line parameters.
 	genconf := flag.Bool("genconf", false, "print a new config to stdout")
+	strength := flag.Int("strength", 0, "use in combination with -genconf, minimum number of leading 1 bits in the NodeID of the generated keys, up to 24 (each extra bit makes the address harder to collide with but doubles the time taken)")
 	useconf := flag.Bool("useconf", false, "read config from stdin")
 	useconffile := flag.String("useconffile", "", "read config from specified file path")
 	normaliseconf := flag.Bool("normaliseconf", false, "use in combination with either -useconf or -useconffile, outputs your configuration normalised")
 	autoconf := flag.Bool("autoconf", false, "automatic mode (dynamic IP, peer with IPv6 neighbors)")
+	uninstall := flag.Bool("uninstall", false, "remove the TAP adapter that was installed for IfName, use in combination with -useconf or -useconffile (Windows only)")
+	ifhelper := flag.String("ifhelper", "", "run as the interface helper for unprivileged nodes, creating TUN adapters for them on request over the unix socket at the given path (Linux only)")
 	flag.Parse()
 
 	var cfg *nodeConfig
 	switch {
+	case *ifhelper != "":
+		// Run as the interface helper, which needs CAP_NET_ADMIN, instead of
+		// as a node.
+		n := node{}
+		if err := n.core.RunInterfaceHelper(*ifhelper, log.New(os.Stdout, "", log.Flags())); err != nil {
+			fmt.Println("Interface helper failed:", err)
+			os.Exit(1)
+		}
+		return
 	case *autoconf:
 		// Use an autoconf-generated config, this will give us random keys and
 		// port numbers, and will use an automatically selected TUN/TAP interface.
-		cfg = generateConfig(true)
+		var err error
+		if cfg, err = generateConfig(true, 0); err != nil {
+			fmt.Println("Failed to generate a configuration:", err)
+			os.Exit(1)
+		}
 	case *useconffile != "" || *useconf:
 		// Use a configuration file. If -useconf, the configuration will be read
 		// from stdin. If -useconffile, the configuration will be read from the
 		// filesystem.
-		var config []byte
 		var err error
-		if *useconffile != "" {
-			// Read the file from the filesystem
-			config, err = ioutil.ReadFile(*useconffile)
-		} else {
-			// Read the file from stdin.
-			config, err = ioutil.ReadAll(os.Stdin)
-		}
-		if err != nil {
-			panic(err)
-		}
-		// If there's a byte order mark - which Windows 10 is now incredibly fond of
-		// throwing everywhere when it's converting things into UTF-16 for the hell
-		// of it - remove it and decode back down into UTF-8. This is necessary
-		// because hjson doesn't know what to do with UTF-16 and will panic
-		if bytes.Compare(config[0:2], []byte{0xFF, 0xFE}) == 0 ||
-			bytes.Compare(config[0:2], []byte{0xFE, 0xFF}) == 0 {
-			utf := unicode.UTF16(unicode.BigEndian, unicode.UseBOM)
-			decoder := utf.NewDecoder()
-			config, err = decoder.Bytes(config)
-			if err != nil {
-				panic(err)
-			}
-		}
-		// Generate a new configuration - this gives us a set of sane defaults -
-		// then parse the configuration we loaded above on top of it. The effect
-		// of this is that any configuration item that is missing from the provided
-		// configuration will use a sane default.
-		cfg = generateConfig(false)
-		var dat map[string]interface{}
-		if err := hjson.Unmarshal(config, &dat); err != nil {
-			panic(err)
-		}
-		confJson, err := json.Marshal(dat)
-		if err != nil {
-			panic(err)
-		}
-		json.Unmarshal(confJson, &cfg)
-		// For now we will do a little bit to help the user adjust their
-		// configuration to match the new configuration format, as some of the key
-		// names have changed recently.
-		changes := map[string]string{
-			"Multicast":      "",
-			"LinkLocal":      "MulticastInterfaces",
-			"BoxPub":         "EncryptionPublicKey",
-			"BoxPriv":        "EncryptionPrivateKey",
-			"SigPub":         "SigningPublicKey",
-			"SigPriv":        "SigningPrivateKey",
-			"AllowedBoxPubs": "AllowedEncryptionPublicKeys",
-		}
-		// Loop over the mappings aove and see if we have anything to fix.
-		for from, to := range changes {
-			if _, ok := dat[from]; ok {
-				if to == "" {
-					if !*normaliseconf {
-						log.Println("Warning: Deprecated config option", from, "- please remove")
-					}
-				} else {
-					if !*normaliseconf {
-						log.Println("Warning: Deprecated config option", from, "- please rename to", to)
-					}
-					// If the configuration file doesn't already contain a line with the
-					// new name then set it to the old value. This makes sure that we
-					// don't overwrite something that was put there intentionally.
-					if _, ok := dat[to]; !ok {
-						dat[to] = dat[from]
-					}
-				}
-			}
-		}
-		// Overlay our newly mapped configuration onto the autoconf node config that
-		// we generated above.
-		if err = mapstructure.Decode(dat, &cfg); err != nil {
+		if cfg, err = readConfig(*useconf, *useconffile, *normaliseconf); err != nil {
 			panic(err)
 		}
 		// If the -normaliseconf option was specified then remarshal the above
@@ -192,9 +252,24 @@ func main() {
 			fmt.Println(string(bs))
 			return
 		}
+		// If the -uninstall option was specified then remove the TAP adapter
+		// that was installed when the node was started, instead of starting.
+		if *uninstall {
+			n := node{}
+			if err := n.core.RemoveTUNAdapter(cfg.IfName); err != nil {
+				fmt.Println("Failed to remove the TAP adapter:", err)
+				os.Exit(1)
+			}
+			return
+		}
 	case *genconf:
 		// Generate a new configuration and print it to stdout.
-		fmt.Println(doGenconf())
+		conf, err := doGenconf(*strength)
+		if err != nil {
+			fmt.Println("Failed to generate a configuration:", err)
+			os.Exit(1)
+		}
+		fmt.Println(conf)
 	default:
 		// No flags were provided, therefore print the list of flags to stdout.
 		flag.PrintDefaults()
@@ -205,8 +280,15 @@ func main() {
 	if cfg == nil {
 		return
 	}
-	// Create a new logger that logs output to stdout.
-	logger := log.New(os.Stdout, "", log.Flags())
+	// Create a new logger that logs output to stdout, unless stdout carries a
+	// link to a peer, in which case the output goes to stderr instead.
+	logOutput := os.Stdout
+	for _, peer := range cfg.Peers {
+		if strings.HasPrefix(strings.ToLower(peer), "stdio:") {
+			logOutput = os.Stderr
+		}
+	}
+	logger := log.New(logOutput, "", log.Flags())
 	// Setup the Yggdrasil node itself. The node{} type includes a Core, so we
 	// don't need to create this manually.
 	n := node{}
@@ -271,7 +353,63 @@ func main() {
 		c <- os.Interrupt
 	}
 	minwinsvc.SetOnExit(winTerminate)
+	// Catch SIGHUP so that the configuration file can be reloaded at runtime.
+	r := make(chan os.Signal, 1)
+	signal.Notify(r, syscall.SIGHUP)
 	// Wait for the terminate/interrupt signal. Once a signal is received, the
 	// deferred Stop function above will run which will shut down TUN/TAP.
-	<-c
+	for {
+		select {
+		case <-r:
+			// Reload the configuration file and apply any changes that can be
+			// made without restarting. The allowed encryption public keys take
+			// effect from the next handshake onwards, the packet filter rules
+			// straight away, and the TUN/TAP adapter is re-created if its name,
+			// MTU or mode has changed.
+			if *useconffile == "" {
+				logger.Println("Reloading the configuration is only supported with -useconffile")
+				continue
+			}
+			newcfg, err := readConfig(false, *useconffile, false)
+			if err != nil {
+				logger.Println("Failed to reload configuration:", err)
+				continue
+			}
+			if err := n.core.SetAllowedEncryptionPublicKeys(newcfg.AllowedEncryptionPublicKeys); err != nil {
+				logger.Println("Failed to reload allowed encryption public keys:", err)
+				continue
+			}
+			if err := n.core.SetPacketFilter(newcfg.PacketFilter); err != nil {
+				logger.Println("Failed to reload packet filter:", err)
+				continue
+			}
+			if err := n.core.SetTunnelRouting(newcfg.TunnelRouting); err != nil {
+				logger.Println("Failed to reload tunnel routing:", err)
+				continue
+			}
+			if err := n.core.SetDSCPPriority(newcfg.DSCPPriority); err != nil {
+				logger.Println("Failed to reload DSCP priorities:", err)
+				continue
+			}
+			if err := n.core.SetTAPNeighbors(newcfg.IfTAPNeighbors); err != nil {
+				logger.Println("Failed to reload TAP neighbors:", err)
+				continue
+			}
+			if newcfg.IfName != cfg.IfName || newcfg.IfMTU != cfg.IfMTU || newcfg.IfTAPMode != cfg.IfTAPMode {
+				logger.Println("Re-creating TUN/TAP adapter")
+				if err := n.core.ReconfigureTUN(newcfg.IfName, newcfg.IfTAPMode, newcfg.IfMTU); err != nil {
+					logger.Println("Failed to reconfigure TUN/TAP:", err)
+					continue
+				}
+				cfg.IfName, cfg.IfMTU, cfg.IfTAPMode = newcfg.IfName, newcfg.IfMTU, newcfg.IfTAPMode
+			}
+			logger.Println("Reloaded configuration from", *useconffile)
+		case <-n.core.CollisionExit():
+			logger.Println("Shutting down due to key collision (ExitOnCollision is enabled)")
+			n.core.Stop()
+			os.Exit(1)
+		case <-c:
+			return
+		}
+	}
 }
@@ -10,11 +10,21 @@ import "sort"
 import "encoding/json"
 import "strconv"
 import "os"
+import "time"
+import "io/ioutil"
 
+import "github.com/neilalexander/hjson-go"
+
+import "yggdrasil/config"
 import "yggdrasil/defaults"
 
 type admin_info map[string]interface{}
 
+// The shortest time between pings. Each ping is a NodeInfo request, which the
+// remote node only answers once every two seconds from any one node, so pinging
+// any faster would show replies that were dropped by it as loss.
+const pingMinInterval = 2 * time.Second
+
 func main() {
 	server := flag.String("endpoint", defaults.GetDefaults().DefaultAdminListen, "Admin socket endpoint")
 	injson := flag.Bool("json", false, "Output in JSON format")
@@ -25,7 +35,13 @@ func main() {
 		fmt.Println("usage:", os.Args[0], "[-endpoint=proto://server] [-json] command [key=value] [...]")
 		fmt.Println("example:", os.Args[0], "getPeers")
 		fmt.Println("example:", os.Args[0], "setTunTap name=auto mtu=1500 tap_mode=false")
+		fmt.Println("example:", os.Args[0], "bench 0123456789abcdef... duration=10")
 		fmt.Println("example:", os.Args[0], "-endpoint=tcp://localhost:9001 getDHT")
+		fmt.Println("example:", os.Args[0], "getHealth")
+		fmt.Println("example:", os.Args[0], "top interval=2")
+		fmt.Println("example:", os.Args[0], "diffconfig config=/etc/yggdrasil.conf")
+		fmt.Println("example:", os.Args[0], "ping myserver count=4 interval=2")
+		fmt.Println("note: ping sends one request every", pingMinInterval, "at most, as that's as often as the remote node answers them")
 		fmt.Println("example:", os.Args[0], "-endpoint=unix:///var/run/ygg.sock getDHT")
 		return
 	}
@@ -54,12 +70,80 @@ func main() {
 	send := make(admin_info)
 	recv := make(admin_info)
 
+	if strings.ToLower(args[0]) == "top" {
+		interval := time.Second
+		for _, a := range args[1:] {
+			tokens := strings.Split(a, "=")
+			if len(tokens) == 2 && tokens[0] == "interval" {
+				if i, err := strconv.Atoi(tokens[1]); err == nil && i > 0 {
+					interval = time.Duration(i) * time.Second
+				}
+			}
+		}
+		top(encoder, decoder, interval)
+		return
+	}
+
+	if strings.ToLower(args[0]) == "diffconfig" {
+		var path string
+		for _, a := range args[1:] {
+			tokens := strings.Split(a, "=")
+			if len(tokens) == 2 && tokens[0] == "config" {
+				path = tokens[1]
+			}
+		}
+		if path == "" {
+			fmt.Println("Error: diffconfig needs the path of the config file, i.e. config=/etc/yggdrasil.conf")
+			os.Exit(1)
+		}
+		if diffConfig(encoder, decoder, path) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if strings.ToLower(args[0]) == "ping" {
+		var target string
+		count := 4
+		interval := pingMinInterval
+		for _, a := range args[1:] {
+			tokens := strings.Split(a, "=")
+			switch {
+			case len(tokens) == 1:
+				target = a
+			case tokens[0] == "box_pub_key":
+				target = tokens[1]
+			case tokens[0] == "count":
+				if i, err := strconv.Atoi(tokens[1]); err == nil && i > 0 {
+					count = i
+				}
+			case tokens[0] == "interval":
+				if i, err := strconv.Atoi(tokens[1]); err == nil && time.Duration(i)*time.Second > pingMinInterval {
+					interval = time.Duration(i) * time.Second
+				}
+			}
+		}
+		if target == "" {
+			fmt.Println("Error: ping needs the key or alias of a node, i.e. ping myserver")
+			os.Exit(1)
+		}
+		if ping(encoder, decoder, target, count, interval) == 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	for c, a := range args {
 		if c == 0 {
 			send["request"] = a
 			continue
 		}
 		tokens := strings.Split(a, "=")
+		if len(tokens) == 1 && strings.ToLower(fmt.Sprint(send["request"])) == "bench" {
+			// Allow "bench <key>" as a shorthand for "bench box_pub_key=<key>"
+			send["box_pub_key"] = a
+			continue
+		}
 		if i, err := strconv.Atoi(tokens[1]); err == nil {
 			send[tokens[0]] = i
 		} else {
@@ -107,6 +191,12 @@ func main() {
 		switch strings.ToLower(req["request"].(string)) {
 		case "dot":
 			fmt.Println(res["dot"])
+		case "gettopology":
+			if dot, ok := res["dot"]; ok {
+				fmt.Println(dot)
+			} else if json, err := json.MarshalIndent(res["topology"], "", "  "); err == nil {
+				fmt.Println(string(json))
+			}
 		case "help", "getpeers", "getswitchpeers", "getdht", "getsessions":
 			maxWidths := make(map[string]int)
 			var keyOrder []string
@@ -150,6 +240,24 @@ func main() {
 						switch k {
 						case "bytes_sent", "bytes_recvd":
 							formatted = fmt.Sprintf("%d", uint(preformatted.(float64)))
+						case "loss_percent":
+							if preformatted == nil {
+								formatted = "-"
+							} else {
+								formatted = fmt.Sprintf("%.2f%%", preformatted.(float64))
+							}
+						case "path_mtu":
+							if preformatted == nil {
+								formatted = "-"
+							} else {
+								formatted = fmt.Sprintf("%d", uint(preformatted.(float64)))
+							}
+						case "throughput_bps":
+							if preformatted == nil {
+								formatted = "-"
+							} else {
+								formatted = fmt.Sprintf("%.2fMbit/s", preformatted.(float64)/1000000)
+							}
 						case "uptime", "last_seen":
 							seconds := uint(preformatted.(float64)) % 60
 							minutes := uint(preformatted.(float64)/60) % 60
@@ -172,6 +280,32 @@ func main() {
 				if tap_mode, ok := v.(map[string]interface{})["tap_mode"].(bool); ok {
 					fmt.Println("TAP mode:", tap_mode)
 				}
+				if dropped, ok := v.(map[string]interface{})["read_dropped"].(float64); ok {
+					fmt.Println("Packets dropped after reading:", uint64(dropped))
+				}
+				if dropped, ok := v.(map[string]interface{})["write_dropped"].(float64); ok {
+					fmt.Println("Packets dropped before writing:", uint64(dropped))
+				}
+			}
+		case "gethealth":
+			h := res["health"].(map[string]interface{})
+			if h["healthy"] == true {
+				fmt.Println("Healthy")
+			} else {
+				fmt.Println("Unhealthy")
+			}
+			fmt.Println("Peers:", h["peers"])
+			fmt.Println("Coords:", h["coords"])
+			fmt.Println("TUN/TAP adapter:", h["tun"])
+			if problems, ok := h["problems"].([]interface{}); ok {
+				fmt.Println("Problems:")
+				for _, problem := range problems {
+					fmt.Println("-", problem)
+				}
+			}
+			if h["healthy"] != true {
+				// Watchdog scripts can use the exit status to tell if the node is connected
+				os.Exit(2)
 			}
 		case "getself":
 			for k, v := range res["self"].(map[string]interface{}) {
@@ -182,6 +316,41 @@ func main() {
 				if coords, ok := v.(map[string]interface{})["coords"].(string); ok {
 					fmt.Println("Coords:", coords)
 				}
+				if rejected, ok := v.(map[string]interface{})["rejected_dht_requests"].(float64); ok {
+					fmt.Println("Rejected DHT requests:", uint64(rejected))
+				}
+				if rejected, ok := v.(map[string]interface{})["rejected_nodeinfo_requests"].(float64); ok {
+					fmt.Println("Rejected NodeInfo requests:", uint64(rejected))
+				}
+				if name, ok := v.(map[string]interface{})["build_name"].(string); ok {
+					fmt.Println("Build:", name, v.(map[string]interface{})["build_version"])
+				}
+				if uptime, ok := v.(map[string]interface{})["uptime"].(float64); ok {
+					fmt.Println("Uptime:", time.Duration(uptime)*time.Second)
+				}
+				if changed, ok := v.(map[string]interface{})["coords_changed"].(float64); ok {
+					fmt.Println("Coords last changed:", time.Duration(changed)*time.Second, "ago")
+				}
+				if listeners, ok := v.(map[string]interface{})["listeners"].([]interface{}); ok {
+					for _, l := range listeners {
+						l := l.(map[string]interface{})
+						if bound, ok := l["bound"].(bool); ok && !bound {
+							fmt.Println("Not listening on:", l["address"], "(address unavailable)")
+							continue
+						}
+						fmt.Println("Listening on:", l["address"], "("+fmt.Sprint(l["policy"])+" policy)")
+					}
+				}
+				if multicast, ok := v.(map[string]interface{})["multicast"].(map[string]interface{}); ok {
+					if multicast["enabled"] == true {
+						fmt.Println("Multicast discovery on:", multicast["interfaces"])
+					} else {
+						fmt.Println("Multicast discovery is disabled")
+					}
+				}
+				if anycast, ok := v.(map[string]interface{})["anycast"].([]interface{}); ok {
+					fmt.Println("Anycast addresses:", anycast)
+				}
 			}
 		case "getswitchqueues":
 			maximumqueuesize := float64(4194304)
@@ -213,12 +382,13 @@ func main() {
 						queuesize := v.(map[string]interface{})["queue_size"].(float64)
 						queuepackets := v.(map[string]interface{})["queue_packets"].(float64)
 						queueid := v.(map[string]interface{})["queue_id"].(string)
+						queueclass := v.(map[string]interface{})["queue_class"]
 						portqueues[queueport] += 1
 						portqueuesize[queueport] += queuesize
 						portqueuepackets[queueport] += queuepackets
 						queuesizepercent := (100 / maximumqueuesize) * queuesize
-						fmt.Printf("- Switch port %d, Stream ID: %v, size: %d bytes (%d%% full), %d packets\n",
-							uint(queueport), []byte(queueid), uint(queuesize),
+						fmt.Printf("- Switch port %d, Stream ID: %v, class: %v, size: %d bytes (%d%% full), %d packets\n",
+							uint(queueport), []byte(queueid), queueclass, uint(queuesize),
 							uint(queuesizepercent), uint(queuepackets))
 					}
 				}
@@ -231,7 +401,18 @@ func main() {
 						uint(k), uint(v), uint(queuesizepercent), uint(portqueuepackets[k]))
 				}
 			}
-		case "addpeer", "removepeer", "addallowedencryptionpublickey", "removeallowedencryptionpublickey":
+			if classes, ok := v["classes"].(map[string]interface{}); ok {
+				fmt.Println("Statistics by traffic class:")
+				for _, name := range []string{"protocol", "traffic"} {
+					if c, ok := classes[name].(map[string]interface{}); ok {
+						fmt.Printf("- %s: sent %d packets (%d bytes), dropped %d packets (%d bytes)\n", name,
+							uint64(c["sent_packets"].(float64)), uint64(c["sent_bytes"].(float64)),
+							uint64(c["dropped_packets"].(float64)), uint64(c["dropped_bytes"].(float64)))
+					}
+				}
+			}
+		case "addpeer", "removepeer", "addallowedencryptionpublickey", "removeallowedencryptionpublickey",
+			"addtunnelroute", "removetunnelroute":
 			if _, ok := res["added"]; ok {
 				for _, v := range res["added"].([]interface{}) {
 					fmt.Println("Added:", fmt.Sprint(v))
@@ -263,6 +444,64 @@ func main() {
 					fmt.Println("-", v)
 				}
 			}
+		case "getclosestnodes":
+			if res["closest"] == nil {
+				fmt.Println("No nodes are known")
+			} else {
+				for _, v := range res["closest"].([]interface{}) {
+					n := v.(map[string]interface{})
+					fmt.Println(n["ip"], n["coords"], "last seen", n["last_seen"], "seconds ago")
+					fmt.Println("  box_pub_key:", n["box_pub_key"])
+				}
+			}
+		case "getcollisions":
+			if res["collisions"] == nil {
+				fmt.Println("No key collisions have been detected")
+			} else {
+				fmt.Println("Other nodes are using the same keys as this node:")
+				for _, v := range res["collisions"].([]interface{}) {
+					c := v.(map[string]interface{})
+					fmt.Print("- ", c["time"], ": ", c["type"], " collision")
+					if remote, ok := c["remote"]; ok {
+						fmt.Print(" with peer ", remote)
+					}
+					if coords, ok := c["coords"]; ok {
+						fmt.Print(" with coords ", coords)
+					}
+					fmt.Println()
+				}
+			}
+		case "getnodeservices":
+			if res["services"] == nil {
+				fmt.Println("The node doesn't list any services")
+			} else {
+				for _, v := range res["services"].([]interface{}) {
+					s := v.(map[string]interface{})
+					fmt.Printf("- %v: %v/%v\n", s["name"], s["port"], s["proto"])
+				}
+			}
+		case "bench":
+			b := res["bench"].(map[string]interface{})
+			fmt.Printf("Sent %v packets in %.1f seconds, %v arrived (%.2f%% loss)\n", b["sent_packets"], b["duration"], b["recvd_packets"], b["loss_percent"])
+			fmt.Printf("Throughput: %.2f Mbit/s\n", b["throughput_bps"].(float64)/1000000)
+		case "getcoordshistory":
+			if res["history"] == nil {
+				fmt.Println("This node's coords haven't changed")
+			} else {
+				for _, v := range res["history"].([]interface{}) {
+					h := v.(map[string]interface{})
+					fmt.Print(h["time"], ": ", h["old_coords"], " -> ", h["new_coords"])
+					switch {
+					case h["reason"] == "root":
+						fmt.Print(" (became root)")
+					case h["root_changed"] == true:
+						fmt.Print(" (new root, parent ", h["new_parent"], ")")
+					default:
+						fmt.Print(" (parent ", h["new_parent"], ")")
+					}
+					fmt.Println()
+				}
+			}
 		case "getmulticastinterfaces":
 			if _, ok := res["multicast_interfaces"]; !ok {
 				fmt.Println("No multicast interfaces found")
@@ -286,3 +525,362 @@ func main() {
 	}
 	os.Exit(0)
 }
+
+// Sends a single request over the admin connection and returns the response body.
+func request(encoder *json.Encoder, decoder *json.Decoder, name string) (map[string]interface{}, error) {
+	recv := make(admin_info)
+	if err := encoder.Encode(admin_info{"request": name}); err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(&recv); err != nil {
+		return nil, err
+	}
+	if recv["status"] == "error" {
+		return nil, fmt.Errorf("%v", recv["error"])
+	}
+	res, ok := recv["response"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("missing response body (malformed response?)")
+	}
+	return res, nil
+}
+
+// Pings the node with the given key or alias by repeatedly requesting its
+// NodeInfo without using the cache, which takes a round trip through the
+// network, and prints how long each request took. Returns the number of replies.
+// The interval mustn't be shorter than pingMinInterval, or the remote node will
+// drop requests.
+func ping(encoder *json.Encoder, decoder *json.Decoder, target string, count int, interval time.Duration) int {
+	var replies int
+	var total time.Duration
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		send := admin_info{"request": "getNodeInfo", "box_pub_key": target, "nocache": true}
+		recv := make(admin_info)
+		start := time.Now()
+		if err := encoder.Encode(send); err != nil {
+			fmt.Println("Error:", err)
+			break
+		}
+		if err := decoder.Decode(&recv); err != nil {
+			fmt.Println("Error:", err)
+			break
+		}
+		rtt := time.Since(start)
+		if recv["status"] == "error" {
+			fmt.Printf("No reply from %s: %v\n", target, recv["error"])
+			continue
+		}
+		replies++
+		total += rtt
+		fmt.Printf("Reply from %s: time=%.2fms\n", target, float64(rtt)/float64(time.Millisecond))
+	}
+	fmt.Printf("%d requests, %d replies", count, replies)
+	if replies > 0 {
+		fmt.Printf(", average time=%.2fms", float64(total)/float64(replies)/float64(time.Millisecond))
+	}
+	fmt.Println()
+	return replies
+}
+
+// Formats a rate in bytes per second as a human-readable bit rate.
+func formatRate(bytesPerSecond float64) string {
+	bits := bytesPerSecond * 8
+	switch {
+	case bits >= 1000000:
+		return fmt.Sprintf("%.2fMbit/s", bits/1000000)
+	case bits >= 1000:
+		return fmt.Sprintf("%.2fkbit/s", bits/1000)
+	default:
+		return fmt.Sprintf("%.0fbit/s", bits)
+	}
+}
+
+// Repeatedly polls the peers, sessions and switch queues, and redraws a summary of them until interrupted.
+func top(encoder *json.Encoder, decoder *json.Decoder, interval time.Duration) {
+	type counters struct {
+		sent  float64
+		recvd float64
+	}
+	last := make(map[string]counters)
+	var lastTime time.Time
+	for {
+		peers, err := request(encoder, decoder, "getPeers")
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		sessions, err := request(encoder, decoder, "getSessions")
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		queues, err := request(encoder, decoder, "getSwitchQueues")
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		now := time.Now()
+		elapsed := now.Sub(lastTime).Seconds()
+		current := make(map[string]counters)
+
+		// Clear the screen and move the cursor to the top left
+		fmt.Print("\033[H\033[2J")
+		fmt.Println("yggdrasilctl top -", now.Format("15:04:05"), "- refreshing every", interval)
+		fmt.Println()
+
+		peerList, _ := peers["peers"].(map[string]interface{})
+		var ips []string
+		for ip := range peerList {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		fmt.Printf("Peers: %d\n", len(ips))
+		fmt.Printf("%-39s  %-5s  %-10s  %-15s  %-15s  %-7s  %-15s\n", "ip", "port", "uptime", "tx", "rx", "loss", "throughput")
+		for _, ip := range ips {
+			p := peerList[ip].(map[string]interface{})
+			c := counters{}
+			c.sent, _ = p["bytes_sent"].(float64)
+			c.recvd, _ = p["bytes_recvd"].(float64)
+			current[ip] = c
+			tx, rx := "-", "-"
+			if prev, isIn := last[ip]; isIn && elapsed > 0 && c.sent >= prev.sent && c.recvd >= prev.recvd {
+				tx = formatRate((c.sent - prev.sent) / elapsed)
+				rx = formatRate((c.recvd - prev.recvd) / elapsed)
+			}
+			uptime, _ := p["uptime"].(float64)
+			loss := "-"
+			if l, ok := p["loss_percent"].(float64); ok {
+				loss = fmt.Sprintf("%.2f%%", l)
+			}
+			throughput := "-"
+			if t, ok := p["throughput_bps"].(float64); ok {
+				throughput = fmt.Sprintf("%.2fMbit/s", t/1000000)
+			}
+			fmt.Printf("%-39s  %-5v  %-10s  %-15s  %-15s  %-7s  %-15s\n", ip, p["port"],
+				(time.Duration(uptime) * time.Second).String(), tx, rx, loss, throughput)
+		}
+		fmt.Println()
+
+		sessionList, _ := sessions["sessions"].(map[string]interface{})
+		fmt.Printf("Sessions: %d\n", len(sessionList))
+		fmt.Println()
+
+		if q, ok := queues["switchqueues"].(map[string]interface{}); ok {
+			num := func(v interface{}) uint64 {
+				f, _ := v.(float64)
+				return uint64(f)
+			}
+			fmt.Printf("Switch queues: %d active, %d bytes queued (highest %d queues, %d bytes, maximum %d bytes)\n",
+				num(q["queues_count"]), num(q["queues_size"]), num(q["highest_queues_count"]),
+				num(q["highest_queues_size"]), num(q["maximum_queues_size"]))
+			if classes, ok := q["classes"].(map[string]interface{}); ok {
+				var names []string
+				for name := range classes {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					stats := classes[name].(map[string]interface{})
+					fmt.Printf("- Class %s: sent %d packets (%d bytes), dropped %d packets (%d bytes)\n", name,
+						num(stats["sent_packets"]), num(stats["sent_bytes"]), num(stats["dropped_packets"]), num(stats["dropped_bytes"]))
+				}
+			}
+		}
+
+		last = current
+		lastTime = now
+		time.Sleep(interval)
+	}
+}
+
+// Gets a list of strings from a decoded config or admin response value.
+func stringList(v interface{}) []string {
+	var out []string
+	if l, ok := v.([]interface{}); ok {
+		for _, s := range l {
+			out = append(out, fmt.Sprint(s))
+		}
+	}
+	return out
+}
+
+// Compares two lists as sets, and returns the entries that are only in the first and only in the second.
+func diffLists(a []string, b []string) (onlyA []string, onlyB []string) {
+	inA := make(map[string]bool)
+	inB := make(map[string]bool)
+	for _, s := range a {
+		inA[s] = true
+	}
+	for _, s := range b {
+		inB[s] = true
+	}
+	for _, s := range a {
+		if !inB[s] {
+			onlyA = append(onlyA, s)
+		}
+	}
+	for _, s := range b {
+		if !inA[s] {
+			onlyB = append(onlyB, s)
+		}
+	}
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+	return
+}
+
+// Gets the name that the daemon gives to outgoing connections to a peer URI, which is how getOutgoingPeers reports them.
+func peerCallName(peer string, intf string) string {
+	u, err := url.Parse(config.EscapeZone(peer))
+	if err != nil {
+		// No URL scheme, which is treated as a plain TCP address
+		peer = strings.ToLower(peer)
+		if strings.HasPrefix(peer, "tcp:") {
+			peer = peer[4:]
+		}
+		return peer
+	}
+	var name string
+	switch strings.ToLower(u.Scheme) {
+	case "socks":
+		name = strings.TrimPrefix(u.Path, "/")
+	case "mem":
+		name = "mem://" + u.Host
+	case "unix":
+		name = "unix://" + u.Path
+	default:
+		name = u.Host
+	}
+	if intf != "" {
+		name = fmt.Sprintf("%s/%s", name, intf)
+	}
+	return name
+}
+
+// Compares the config file at path with the running daemon, prints any differences, and returns true if there were any.
+func diffConfig(encoder *json.Encoder, decoder *json.Decoder, path string) bool {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	var cfg map[string]interface{}
+	if err := hjson.Unmarshal(bs, &cfg); err != nil {
+		fmt.Println("Error: failed to parse", path+":", err)
+		os.Exit(1)
+	}
+	get := func(name string) map[string]interface{} {
+		res, err := request(encoder, decoder, name)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return res
+	}
+	var differences int
+	report := func(format string, a ...interface{}) {
+		fmt.Printf(format+"\n", a...)
+		differences++
+	}
+
+	// Static peers, which are connected to by their call name
+	configured := make(map[string]string)
+	for _, peer := range stringList(cfg["Peers"]) {
+		configured[peerCallName(peer, "")] = peer
+	}
+	if intfpeers, ok := cfg["InterfacePeers"].(map[string]interface{}); ok {
+		for intf, peers := range intfpeers {
+			for _, peer := range stringList(peers) {
+				configured[peerCallName(peer, intf)] = fmt.Sprintf("%s (via %s)", peer, intf)
+			}
+		}
+	}
+	var calls []string
+	for call := range configured {
+		calls = append(calls, call)
+	}
+	peers := get("getOutgoingPeers")
+	discovered := make(map[string]bool)
+	for _, call := range stringList(peers["multicast"]) {
+		discovered[call] = true
+	}
+	notConnected, notConfigured := diffLists(calls, stringList(peers["outgoing"]))
+	for _, call := range notConnected {
+		report("Peer %s is configured but not connected", configured[call])
+	}
+	for _, call := range notConfigured {
+		if discovered[call] {
+			// Found by multicast discovery, which isn't something that can be configured
+			continue
+		}
+		report("Peer %s is connected but not configured", call)
+	}
+
+	// Allowed encryption public keys, which can be changed with the admin API or reloaded with SIGHUP
+	allowed := stringList(get("getAllowedEncryptionPublicKeys")["allowed_box_pubs"])
+	notApplied, notInConfig := diffLists(stringList(cfg["AllowedEncryptionPublicKeys"]), allowed)
+	for _, key := range notApplied {
+		report("Allowed encryption public key %s is configured but not applied", key)
+	}
+	for _, key := range notInConfig {
+		report("Allowed encryption public key %s is applied but not configured", key)
+	}
+
+	// Session firewall rules, which are missing from the config file if it's never been normalised
+	if fw, ok := cfg["SessionFirewall"].(map[string]interface{}); ok {
+		running, _ := get("getSessionFirewall")["firewall"].(map[string]interface{})
+		for _, opt := range []struct{ config, running string }{
+			{"Enable", "enable"},
+			{"AllowFromDirect", "allow_from_direct"},
+			{"AllowFromRemote", "allow_from_remote"},
+			{"AlwaysAllowOutbound", "always_allow_outbound"},
+			{"DenyInbound", "deny_inbound"},
+		} {
+			want, _ := fw[opt.config].(bool)
+			have, _ := running[opt.running].(bool)
+			if want != have {
+				report("Session firewall %s is %v in the config but %v when running", opt.config, want, have)
+			}
+		}
+		for _, opt := range []struct{ config, running string }{
+			{"WhitelistEncryptionPublicKeys", "whitelist_box_pubs"},
+			{"BlacklistEncryptionPublicKeys", "blacklist_box_pubs"},
+			{"WhitelistPrefixes", "whitelist_prefixes"},
+			{"BlacklistPrefixes", "blacklist_prefixes"},
+		} {
+			notApplied, notInConfig := diffLists(stringList(fw[opt.config]), stringList(running[opt.running]))
+			for _, rule := range notApplied {
+				report("Session firewall %s entry %s is configured but not applied", opt.config, rule)
+			}
+			for _, rule := range notInConfig {
+				report("Session firewall %s entry %s is applied but not configured", opt.config, rule)
+			}
+		}
+	}
+
+	// TUN/TAP interface parameters, which can be changed with setTunTap
+	for name, v := range get("getTunTap") {
+		tun, _ := v.(map[string]interface{})
+		if ifname, ok := cfg["IfName"].(string); ok && ifname != "auto" && ifname != name && !(ifname == "dummy" && name == "none") {
+			report("Interface name is %s in the config but %s when running", ifname, name)
+		}
+		if name == "none" {
+			continue
+		}
+		if mtu, ok := cfg["IfMTU"].(float64); ok && mtu != tun["mtu"] {
+			report("Interface MTU is %v in the config but %v when running", mtu, tun["mtu"])
+		}
+		if tap, ok := cfg["IfTAPMode"].(bool); ok && tap != tun["tap_mode"] {
+			report("Interface TAP mode is %v in the config but %v when running", tap, tun["tap_mode"])
+		}
+	}
+
+	if differences == 0 {
+		fmt.Println("No differences found between", path, "and the running node")
+		return false
+	}
+	return true
+}